@@ -1,51 +1,97 @@
 package main
 
 import (
+	"bytes"
 	"encoding/json"
-	"fmt"
+	"errors"
+	"io"
+	"io/fs"
 	"log"
+	"mime"
 	"net/http"
-	"os"
+	"path"
 	"strconv"
 	"strings"
 	"time"
 
-	"github.com/golang-jwt/jwt/v4"
 	"github.com/gorilla/mux"
 )
 
-func NewAPIServer(portAddress string, storage Storage) *APIServer {
+func NewAPIServer(portAddress string, storage Storage, blobs BlobStore, mailer Mailer) *APIServer {
 	return &APIServer{
 		portAddress: portAddress,
 		storage:     storage,
+		blobs:       blobs,
+		mailer:      mailer,
 	}
 }
 
 func (self *APIServer) Run() {
+	log.Println("Running on port", self.portAddress)
+
+	http.ListenAndServe(self.portAddress, self.Handler())
+}
+
+// Handler routes every endpoint of the API. Run serves it; tests can put it
+// behind an httptest server.
+func (self *APIServer) Handler() http.Handler {
 	router := mux.NewRouter()
 
 	router.HandleFunc("/admin/login", makeHTTPHandlerFunc(self.handleAdminLogin))
-	router.HandleFunc("/admin/{id}", withJWTAdminAuth(makeHTTPHandlerFunc(self.handleAdminAccessAdmin), self.storage))
-	router.HandleFunc("/admin/{id}/dash", withJWTAdminAuth(makeHTTPHandlerFunc(self.handleAdminAccessDashboard), self.storage))
-	router.HandleFunc("/admin/{id}/admins", withJWTAdminAuth(makeHTTPHandlerFunc(self.handleAdminAccessAdmins), self.storage))
-	router.HandleFunc("/admin/{id}/users", withJWTAdminAuth(makeHTTPHandlerFunc(self.handleAdminAccessUsers), self.storage))
-	router.HandleFunc("/admin/{id}/items", withJWTAdminAuth(makeHTTPHandlerFunc(self.handleAdminAccessItems), self.storage))
-	router.HandleFunc("/admin/{id}/items/{item_id}", withJWTAdminAuth(makeHTTPHandlerFunc(self.handleAdminAccessItem), self.storage))
-	router.HandleFunc("/admin/{id}/orders", withJWTAdminAuth(makeHTTPHandlerFunc(self.handleAdminAccessOrders), self.storage))
-	router.HandleFunc("/admin/{id}/orders/{order_id}", withJWTAdminAuth(makeHTTPHandlerFunc(self.handleAdminAccessOrder), self.storage))
+	router.HandleFunc("/admin/login/mfa", makeHTTPHandlerFunc(self.handleAdminLoginMFA))
+	router.HandleFunc("/admin/refresh", makeHTTPHandlerFunc(self.handleAdminRefresh))
+	router.HandleFunc("/admin/logout", makeHTTPHandlerFunc(self.handleAdminLogout))
+	router.HandleFunc("/admin/password/forgot", makeHTTPHandlerFunc(self.handleAdminForgotPassword))
+	router.HandleFunc("/admin/password/reset", makeHTTPHandlerFunc(self.handleAdminResetPassword))
+	router.HandleFunc("/admin/{id}", withJWTAdminAuth(makeHTTPHandlerFunc(self.handleAdminAccessAdmin), self.storage, requires("", "").allowingNoMFA()))
+	router.HandleFunc("/admin/{id}/password", withJWTAdminAuth(makeHTTPHandlerFunc(self.handleAdminAccessPassword), self.storage, requires("", "").allowingNoMFA().requiringSession()))
+	router.HandleFunc("/admin/{id}/mfa", withJWTAdminAuth(makeHTTPHandlerFunc(self.handleAdminAccessMFA), self.storage, requires("", "").allowingNoMFA().requiringSession()))
+	router.HandleFunc("/admin/{id}/keys", withJWTAdminAuth(makeHTTPHandlerFunc(self.handleAdminAccessAPIKeys), self.storage, requires("", "").requiringSession()))
+	router.HandleFunc("/admin/{id}/keys/{key_id}", withJWTAdminAuth(makeHTTPHandlerFunc(self.handleAdminAccessAPIKey), self.storage, requires("", "").requiringSession()))
+	router.HandleFunc("/admin/{id}/dash", withJWTAdminAuth(makeHTTPHandlerFunc(self.handleAdminAccessDashboard), self.storage, requires(PermDashboardRead, PermDashboardRead)))
+	router.HandleFunc("/admin/{id}/admins", withJWTAdminAuth(makeHTTPHandlerFunc(self.handleAdminAccessAdmins), self.storage, requires(PermAdminsManage, PermAdminsManage)))
+	router.HandleFunc("/admin/{id}/admins/unlock", withJWTAdminAuth(makeHTTPHandlerFunc(self.handleAdminAccessAdminUnlock), self.storage, requires(PermAdminsManage, PermAdminsManage)))
+	router.HandleFunc("/admin/{id}/users", withJWTAdminAuth(makeHTTPHandlerFunc(self.handleAdminAccessUsers), self.storage, requires(PermUsersRead, PermUsersWrite)))
+	router.HandleFunc("/admin/{id}/users/unlock", withJWTAdminAuth(makeHTTPHandlerFunc(self.handleAdminAccessUserUnlock), self.storage, requires(PermUsersWrite, PermUsersWrite)))
+	router.HandleFunc("/admin/{id}/items", withJWTAdminAuth(makeHTTPHandlerFunc(self.handleAdminAccessItems), self.storage, requires(PermCatalogRead, PermCatalogWrite)))
+	router.HandleFunc("/admin/{id}/items/{item_id}", withJWTAdminAuth(makeHTTPHandlerFunc(self.handleAdminAccessItem), self.storage, requires(PermCatalogRead, PermCatalogWrite)))
+	router.HandleFunc("/admin/{id}/items/{item_id}/stock", withJWTAdminAuth(makeHTTPHandlerFunc(self.handleAdminAccessItemStock), self.storage, requires(PermCatalogRead, PermCatalogWrite)))
+	router.HandleFunc("/admin/{id}/items/{item_id}/options", withJWTAdminAuth(makeHTTPHandlerFunc(self.handleAdminAccessItemOptions), self.storage, requires(PermCatalogRead, PermCatalogWrite)))
+	router.HandleFunc("/admin/{id}/items/{item_id}/skus", withJWTAdminAuth(makeHTTPHandlerFunc(self.handleAdminAccessSKUs), self.storage, requires(PermCatalogRead, PermCatalogWrite)))
+	router.HandleFunc("/admin/{id}/items/{item_id}/skus/{sku_id}", withJWTAdminAuth(makeHTTPHandlerFunc(self.handleAdminAccessSKU), self.storage, requires(PermCatalogRead, PermCatalogWrite)))
+	router.HandleFunc("/admin/{id}/items/{item_id}/skus/{sku_id}/stock", withJWTAdminAuth(makeHTTPHandlerFunc(self.handleAdminAccessItemStock), self.storage, requires(PermCatalogRead, PermCatalogWrite)))
+	router.HandleFunc("/admin/{id}/items/{item_id}/images", withJWTAdminAuth(makeHTTPHandlerFunc(self.handleAdminAccessItemImages), self.storage, requires(PermCatalogRead, PermCatalogWrite)))
+	router.HandleFunc("/admin/{id}/items/{item_id}/images/{image_id}", withJWTAdminAuth(makeHTTPHandlerFunc(self.handleAdminAccessItemImage), self.storage, requires(PermCatalogRead, PermCatalogWrite)))
+	router.HandleFunc("/admin/{id}/items/{item_id}/categories", withJWTAdminAuth(makeHTTPHandlerFunc(self.handleAdminAccessItemCategories), self.storage, requires(PermCatalogRead, PermCatalogWrite)))
+	router.HandleFunc("/admin/{id}/categories", withJWTAdminAuth(makeHTTPHandlerFunc(self.handleAdminAccessCategories), self.storage, requires(PermCatalogRead, PermCatalogWrite)))
+	router.HandleFunc("/admin/{id}/categories/{category_id}", withJWTAdminAuth(makeHTTPHandlerFunc(self.handleAdminAccessCategory), self.storage, requires(PermCatalogRead, PermCatalogWrite)))
+	router.HandleFunc("/admin/{id}/orders", withJWTAdminAuth(makeHTTPHandlerFunc(self.handleAdminAccessOrders), self.storage, requires(PermOrdersRead, PermOrdersWrite)))
+	router.HandleFunc("/admin/{id}/orders/{order_id}", withJWTAdminAuth(makeHTTPHandlerFunc(self.handleAdminAccessOrder), self.storage, requires(PermOrdersRead, PermOrdersWrite)))
 
 	router.HandleFunc("/user/login", makeHTTPHandlerFunc(self.handleUserLogin))
+	router.HandleFunc("/user/refresh", makeHTTPHandlerFunc(self.handleUserRefresh))
+	router.HandleFunc("/user/logout", makeHTTPHandlerFunc(self.handleUserLogout))
+	router.HandleFunc("/user/password/forgot", makeHTTPHandlerFunc(self.handleUserForgotPassword))
+	router.HandleFunc("/user/password/reset", makeHTTPHandlerFunc(self.handleUserResetPassword))
 	router.HandleFunc("/user/signup", makeHTTPHandlerFunc(self.handleNewUser))
+	router.HandleFunc("/user/verify", makeHTTPHandlerFunc(self.handleVerifyEmail))
 	router.HandleFunc("/user/{id}", withJWTUserAuth(makeHTTPHandlerFunc(self.handleAccessUser), self.storage))
-	router.HandleFunc("/user/{id}/items", withJWTUserAuth(makeHTTPHandlerFunc(self.handleAccessUserItems), self.storage))
+	router.HandleFunc("/user/{id}/verify", withJWTUserAuth(makeHTTPHandlerFunc(self.handleAccessUserVerification), self.storage))
+	router.HandleFunc("/user/{id}/password", withJWTUserAuth(makeHTTPHandlerFunc(self.handleUserAccessPassword), self.storage))
+	router.HandleFunc("/user/{id}/cart", withJWTUserAuth(makeHTTPHandlerFunc(self.handleAccessUserCart), self.storage))
 	router.HandleFunc("/user/{id}/checkout", withJWTUserAuth(makeHTTPHandlerFunc(self.handleAccessUserCheckout), self.storage))
 	router.HandleFunc("/user/{id}/orders", withJWTUserAuth(makeHTTPHandlerFunc(self.handleAccessUserOrders), self.storage))
+	router.HandleFunc("/.well-known/jwks.json", makeHTTPHandlerFunc(self.handleJWKS))
 	router.HandleFunc("/items", makeHTTPHandlerFunc(self.handleAccessItems))
-	router.HandleFunc("/items/{id}", makeHTTPHandlerFunc(self.handleAccessItem))
+	router.HandleFunc("/items/search", makeHTTPHandlerFunc(self.handleAccessItemSearch))
+	router.HandleFunc("/items/{item_id}", makeHTTPHandlerFunc(self.handleAccessItem))
+	router.HandleFunc("/categories", makeHTTPHandlerFunc(self.handleAccessCategories))
+	router.HandleFunc("/categories/{slug}/items", makeHTTPHandlerFunc(self.handleAccessCategoryItems))
+	router.PathPrefix(mediaPrefix).HandlerFunc(makeHTTPHandlerFunc(self.handleAccessMedia))
 
-	log.Println("Running on port", self.portAddress)
+	router.NotFoundHandler = http.HandlerFunc(handleRouteNotFound)
 
-	http.ListenAndServe(self.portAddress, router)
+	return withRequestID(router)
 }
 
 func (self *APIServer) handleAdminLogin(w http.ResponseWriter, r *http.Request) error {
@@ -54,7 +100,96 @@ func (self *APIServer) handleAdminLogin(w http.ResponseWriter, r *http.Request)
 		return self.handlePostAdminLogin(w, r)
 	}
 
-	return fmt.Errorf("Invalid method: \"%s\"", r.Method)
+	return methodNotAllowedError(r.Method)
+}
+
+func (self *APIServer) handleAdminLoginMFA(w http.ResponseWriter, r *http.Request) error {
+	switch r.Method {
+	case "POST":
+		return self.handlePostAdminLoginMFA(w, r)
+	}
+
+	return methodNotAllowedError(r.Method)
+}
+
+func (self *APIServer) handleAdminRefresh(w http.ResponseWriter, r *http.Request) error {
+	switch r.Method {
+	case "POST":
+		return self.handleRefreshSession(w, r, AdminSession)
+	}
+
+	return methodNotAllowedError(r.Method)
+}
+
+func (self *APIServer) handleAdminLogout(w http.ResponseWriter, r *http.Request) error {
+	switch r.Method {
+	case "POST":
+		return self.handleRevokeSession(w, r, AdminSession)
+	}
+
+	return methodNotAllowedError(r.Method)
+}
+
+func (self *APIServer) handleAdminForgotPassword(w http.ResponseWriter, r *http.Request) error {
+	switch r.Method {
+	case "POST":
+		return self.handleForgotPassword(w, r, AdminSession)
+	}
+
+	return methodNotAllowedError(r.Method)
+}
+
+func (self *APIServer) handleAdminResetPassword(w http.ResponseWriter, r *http.Request) error {
+	switch r.Method {
+	case "POST":
+		return self.handleResetPassword(w, r, AdminSession)
+	}
+
+	return methodNotAllowedError(r.Method)
+}
+
+func (self *APIServer) handleAdminAccessPassword(w http.ResponseWriter, r *http.Request) error {
+	switch r.Method {
+	case "PUT":
+		return self.handleChangePassword(w, r, AdminSession)
+	}
+
+	return methodNotAllowedError(r.Method)
+}
+
+func (self *APIServer) handleAdminAccessMFA(w http.ResponseWriter, r *http.Request) error {
+	switch r.Method {
+	case "GET":
+		return self.handleGetMFAStatus(w, r)
+	case "POST":
+		return self.handleBeginMFAEnrollment(w, r)
+	case "PUT":
+		return self.handleConfirmMFAEnrollment(w, r)
+	case "DELETE":
+		return self.handleDisableMFA(w, r)
+	}
+
+	return methodNotAllowedError(r.Method)
+}
+
+func (self *APIServer) handleAdminAccessAPIKeys(w http.ResponseWriter, r *http.Request) error {
+	switch r.Method {
+	case "GET":
+		return self.handleGetAPIKeys(w, r)
+	case "POST":
+		return self.handleCreateAPIKey(w, r)
+	}
+
+	return methodNotAllowedError(r.Method)
+}
+
+func (self *APIServer) handleAdminAccessAPIKey(w http.ResponseWriter, r *http.Request) error {
+	switch r.Method {
+	case "DELETE":
+		return self.handleRevokeAPIKey(w, r)
+	}
+
+	return methodNotAllowedError(r.Method)
 }
 
 func (self *APIServer) handleAdminAccessAdmin(w http.ResponseWriter, r *http.Request) error {
@@ -65,7 +200,7 @@ func (self *APIServer) handleAdminAccessAdmin(w http.ResponseWriter, r *http.Req
 		return self.handleUpdateAdminAccount(w, r)
 	}
 
-	return fmt.Errorf("Invalid method: \"%s\"", r.Method)
+	return methodNotAllowedError(r.Method)
 }
 
 func (self *APIServer) handleAdminAccessDashboard(w http.ResponseWriter, r *http.Request) error {
@@ -74,7 +209,7 @@ func (self *APIServer) handleAdminAccessDashboard(w http.ResponseWriter, r *http
 		return self.handleGetDashboard(w, r)
 	}
 
-	return fmt.Errorf("Invalid method: \"%s\"", r.Method)
+	return methodNotAllowedError(r.Method)
 }
 
 func (self *APIServer) handleAdminAccessAdmins(w http.ResponseWriter, r *http.Request) error {
@@ -83,11 +218,31 @@ func (self *APIServer) handleAdminAccessAdmins(w http.ResponseWriter, r *http.Re
 		return self.handleGetAdminAccounts(w, r)
 	case "POST":
 		return self.handleCreateAdminAccount(w, r)
+	case "PUT":
+		return self.handleSetAdminRole(w, r)
 	case "DELETE":
 		return self.handleDeleteAdminAccount(w, r)
 	}
 
-	return fmt.Errorf("Invalid method: \"%s\"", r.Method)
+	return methodNotAllowedError(r.Method)
+}
+
+func (self *APIServer) handleAdminAccessAdminUnlock(w http.ResponseWriter, r *http.Request) error {
+	switch r.Method {
+	case "POST":
+		return self.handleUnlockAccount(w, r, AdminSession)
+	}
+
+	return methodNotAllowedError(r.Method)
+}
+
+func (self *APIServer) handleAdminAccessUserUnlock(w http.ResponseWriter, r *http.Request) error {
+	switch r.Method {
+	case "POST":
+		return self.handleUnlockAccount(w, r, UserSession)
+	}
+
+	return methodNotAllowedError(r.Method)
 }
 
 func (self *APIServer) handleAdminAccessUsers(w http.ResponseWriter, r *http.Request) error {
@@ -100,7 +255,7 @@ func (self *APIServer) handleAdminAccessUsers(w http.ResponseWriter, r *http.Req
 		return self.handleDeleteUserAccount(w, r)
 	}
 
-	return fmt.Errorf("Invalid method: \"%s\"", r.Method)
+	return methodNotAllowedError(r.Method)
 }
 
 func (self *APIServer) handleAdminAccessItems(w http.ResponseWriter, r *http.Request) error {
@@ -113,7 +268,7 @@ func (self *APIServer) handleAdminAccessItems(w http.ResponseWriter, r *http.Req
 		return self.handleDeleteItem(w, r)
 	}
 
-	return fmt.Errorf("Invalid method: \"%s\"", r.Method)
+	return methodNotAllowedError(r.Method)
 }
 
 func (self *APIServer) handleAdminAccessItem(w http.ResponseWriter, r *http.Request) error {
@@ -124,7 +279,77 @@ func (self *APIServer) handleAdminAccessItem(w http.ResponseWriter, r *http.Requ
 		return self.handleUpdateItem(w, r)
 	}
 
-	return fmt.Errorf("Invalid method: \"%s\"", r.Method)
+	return methodNotAllowedError(r.Method)
+}
+
+func (self *APIServer) handleAdminAccessItemStock(w http.ResponseWriter, r *http.Request) error {
+	switch r.Method {
+	case "GET":
+		return self.handleGetItemStock(w, r)
+	case "PUT":
+		return self.handleSetItemStock(w, r)
+	case "POST":
+		return self.handleAdjustItemStock(w, r)
+	}
+
+	return methodNotAllowedError(r.Method)
+}
+
+func (self *APIServer) handleAdminAccessItemImages(w http.ResponseWriter, r *http.Request) error {
+	switch r.Method {
+	case "GET":
+		return self.handleGetItemImages(w, r)
+	case "POST":
+		return self.handleUploadItemImage(w, r)
+	case "PUT":
+		return self.handleReorderItemImages(w, r)
+	case "DELETE":
+		return self.handleDeleteItemImage(w, r)
+	}
+
+	return methodNotAllowedError(r.Method)
+}
+
+func (self *APIServer) handleAdminAccessItemImage(w http.ResponseWriter, r *http.Request) error {
+	switch r.Method {
+	case "GET":
+		return self.handleGetItemImage(w, r)
+	case "PUT":
+		return self.handleUpdateItemImage(w, r)
+	}
+
+	return methodNotAllowedError(r.Method)
+}
+
+func (self *APIServer) handleAdminAccessItemOptions(w http.ResponseWriter, r *http.Request) error {
+	switch r.Method {
+	case "GET":
+		return self.handleGetItemOptions(w, r)
+	case "PUT":
+		return self.handleSetItemOptions(w, r)
+	}
+
+	return methodNotAllowedError(r.Method)
+}
+
+func (self *APIServer) handleAdminAccessSKUs(w http.ResponseWriter, r *http.Request) error {
+	switch r.Method {
+	case "GET":
+		return self.handleGetSKUs(w, r)
+	}
+
+	return methodNotAllowedError(r.Method)
+}
+
+func (self *APIServer) handleAdminAccessSKU(w http.ResponseWriter, r *http.Request) error {
+	switch r.Method {
+	case "GET":
+		return self.handleGetSKU(w, r)
+	case "PUT":
+		return self.handleUpdateSKU(w, r)
+	}
+
+	return methodNotAllowedError(r.Method)
 }
 
 func (self *APIServer) handleAdminAccessOrders(w http.ResponseWriter, r *http.Request) error {
@@ -137,7 +362,7 @@ func (self *APIServer) handleAdminAccessOrders(w http.ResponseWriter, r *http.Re
 		return self.handleDeleteOrder(w, r)
 	}
 
-	return fmt.Errorf("Invalid method: \"%s\"", r.Method)
+	return methodNotAllowedError(r.Method)
 }
 
 func (self *APIServer) handleAdminAccessOrder(w http.ResponseWriter, r *http.Request) error {
@@ -148,7 +373,7 @@ func (self *APIServer) handleAdminAccessOrder(w http.ResponseWriter, r *http.Req
 		return self.handleUpdateOrder(w, r)
 	}
 
-	return fmt.Errorf("Invalid method: \"%s\"", r.Method)
+	return methodNotAllowedError(r.Method)
 }
 
 func (self *APIServer) handleUserLogin(w http.ResponseWriter, r *http.Request) error {
@@ -157,7 +382,52 @@ func (self *APIServer) handleUserLogin(w http.ResponseWriter, r *http.Request) e
 		return self.handlePostUserLogin(w, r)
 	}
 
-	return fmt.Errorf("Invalid method: \"%s\"", r.Method)
+	return methodNotAllowedError(r.Method)
+}
+
+func (self *APIServer) handleUserRefresh(w http.ResponseWriter, r *http.Request) error {
+	switch r.Method {
+	case "POST":
+		return self.handleRefreshSession(w, r, UserSession)
+	}
+
+	return methodNotAllowedError(r.Method)
+}
+
+func (self *APIServer) handleUserLogout(w http.ResponseWriter, r *http.Request) error {
+	switch r.Method {
+	case "POST":
+		return self.handleRevokeSession(w, r, UserSession)
+	}
+
+	return methodNotAllowedError(r.Method)
+}
+
+func (self *APIServer) handleUserForgotPassword(w http.ResponseWriter, r *http.Request) error {
+	switch r.Method {
+	case "POST":
+		return self.handleForgotPassword(w, r, UserSession)
+	}
+
+	return methodNotAllowedError(r.Method)
+}
+
+func (self *APIServer) handleUserResetPassword(w http.ResponseWriter, r *http.Request) error {
+	switch r.Method {
+	case "POST":
+		return self.handleResetPassword(w, r, UserSession)
+	}
+
+	return methodNotAllowedError(r.Method)
+}
+
+func (self *APIServer) handleUserAccessPassword(w http.ResponseWriter, r *http.Request) error {
+	switch r.Method {
+	case "PUT":
+		return self.handleChangePassword(w, r, UserSession)
+	}
+
+	return methodNotAllowedError(r.Method)
 }
 
 func (self *APIServer) handleNewUser(w http.ResponseWriter, r *http.Request) error {
@@ -166,7 +436,7 @@ func (self *APIServer) handleNewUser(w http.ResponseWriter, r *http.Request) err
 		return self.handleCreateUserAccount(w, r)
 	}
 
-	return fmt.Errorf("Invalid method: \"%s\"", r.Method)
+	return methodNotAllowedError(r.Method)
 }
 
 func (self *APIServer) handleAccessUser(w http.ResponseWriter, r *http.Request) error {
@@ -177,20 +447,40 @@ func (self *APIServer) handleAccessUser(w http.ResponseWriter, r *http.Request)
 		return self.handleUpdateUserAccount(w, r)
 	}
 
-	return fmt.Errorf("Invalid method: \"%s\"", r.Method)
+	return methodNotAllowedError(r.Method)
 }
 
-func (self *APIServer) handleAccessUserItems(w http.ResponseWriter, r *http.Request) error {
+func (self *APIServer) handleAccessUserCart(w http.ResponseWriter, r *http.Request) error {
 	switch r.Method {
 	case "GET":
 		return self.handleGetUserItems(w, r)
 	case "POST":
 		return self.handleAddItemToUserAccount(w, r)
+	case "PUT":
+		return self.handleSetUserItemQuantity(w, r)
 	case "DELETE":
 		return self.handleRemoveItemFromUserAccount(w, r)
 	}
 
-	return fmt.Errorf("Invalid method: \"%s\"", r.Method)
+	return methodNotAllowedError(r.Method)
+}
+
+func (self *APIServer) handleVerifyEmail(w http.ResponseWriter, r *http.Request) error {
+	switch r.Method {
+	case "GET":
+		return self.handleGetVerifyEmail(w, r)
+	}
+
+	return methodNotAllowedError(r.Method)
+}
+
+func (self *APIServer) handleAccessUserVerification(w http.ResponseWriter, r *http.Request) error {
+	switch r.Method {
+	case "POST":
+		return self.handleResendVerification(w, r)
+	}
+
+	return methodNotAllowedError(r.Method)
 }
 
 func (self *APIServer) handleAccessUserCheckout(w http.ResponseWriter, r *http.Request) error {
@@ -199,7 +489,7 @@ func (self *APIServer) handleAccessUserCheckout(w http.ResponseWriter, r *http.R
 		return self.handleCheckoutUserAccount(w, r)
 	}
 
-	return fmt.Errorf("Invalid method: \"%s\"", r.Method)
+	return methodNotAllowedError(r.Method)
 }
 
 func (self *APIServer) handleAccessUserOrders(w http.ResponseWriter, r *http.Request) error {
@@ -208,7 +498,42 @@ func (self *APIServer) handleAccessUserOrders(w http.ResponseWriter, r *http.Req
 		return self.handleGetUserOrders(w, r)
 	}
 
-	return fmt.Errorf("Invalid method: \"%s\"", r.Method)
+	return methodNotAllowedError(r.Method)
+}
+
+func (self *APIServer) handleAdminAccessItemCategories(w http.ResponseWriter, r *http.Request) error {
+	switch r.Method {
+	case "GET":
+		return self.handleGetItemCategories(w, r)
+	case "PUT":
+		return self.handleSetItemCategories(w, r)
+	}
+
+	return methodNotAllowedError(r.Method)
+}
+
+func (self *APIServer) handleAdminAccessCategories(w http.ResponseWriter, r *http.Request) error {
+	switch r.Method {
+	case "GET":
+		return self.handleGetCategories(w, r)
+	case "POST":
+		return self.handleCreateCategory(w, r)
+	case "DELETE":
+		return self.handleDeleteCategory(w, r)
+	}
+
+	return methodNotAllowedError(r.Method)
+}
+
+func (self *APIServer) handleAdminAccessCategory(w http.ResponseWriter, r *http.Request) error {
+	switch r.Method {
+	case "GET":
+		return self.handleGetCategory(w, r)
+	case "PUT":
+		return self.handleUpdateCategory(w, r)
+	}
+
+	return methodNotAllowedError(r.Method)
 }
 
 func (self *APIServer) handleAccessItems(w http.ResponseWriter, r *http.Request) error {
@@ -217,7 +542,16 @@ func (self *APIServer) handleAccessItems(w http.ResponseWriter, r *http.Request)
 		return self.handleGetItems(w, r)
 	}
 
-	return fmt.Errorf("Invalid method: \"%s\"", r.Method)
+	return methodNotAllowedError(r.Method)
+}
+
+func (self *APIServer) handleAccessItemSearch(w http.ResponseWriter, r *http.Request) error {
+	switch r.Method {
+	case "GET":
+		return self.handleSearchItems(w, r)
+	}
+
+	return methodNotAllowedError(r.Method)
 }
 
 func (self *APIServer) handleAccessItem(w http.ResponseWriter, r *http.Request) error {
@@ -226,101 +560,380 @@ func (self *APIServer) handleAccessItem(w http.ResponseWriter, r *http.Request)
 		return self.handleGetItem(w, r)
 	}
 
-	return fmt.Errorf("Invalid method: \"%s\"", r.Method)
+	return methodNotAllowedError(r.Method)
 }
 
-// method specific handlers
-
-func (self *APIServer) handlePostAdminLogin(w http.ResponseWriter, r *http.Request) error {
-	loginRequest := new(LoginRequest)
-	jsonDecoderHandle := json.NewDecoder(r.Body)
-	jsonDecoderHandle.DisallowUnknownFields()
-	if err := jsonDecoderHandle.Decode(&loginRequest); err != nil {
-		return err
+func (self *APIServer) handleAccessMedia(w http.ResponseWriter, r *http.Request) error {
+	switch r.Method {
+	case "GET":
+		return self.handleGetMedia(w, r)
 	}
 
-	auth_token, err := self.storage.LoginAdminAccount(loginRequest.Username, loginRequest.Password)
-	if err != nil {
-		return err
+	return methodNotAllowedError(r.Method)
+}
+
+func (self *APIServer) handleJWKS(w http.ResponseWriter, r *http.Request) error {
+	switch r.Method {
+	case "GET":
+		return self.handleGetJWKS(w, r)
 	}
 
-	return WriteJSON(w, http.StatusOK, struct {
-		AuthToken string `json:"auth_token"`
-	}{auth_token})
+	return methodNotAllowedError(r.Method)
 }
 
-func (self *APIServer) handleGetAdminAccount(w http.ResponseWriter, r *http.Request) error {
-	id, err := getID(r)
+// handleGetJWKS publishes the token verification keys. Verifiers may cache
+// them for a few minutes and should fetch them again on an unknown kid.
+func (self *APIServer) handleGetJWKS(w http.ResponseWriter, r *http.Request) error {
+	keys, err := tokenKeys()
 	if err != nil {
 		return err
 	}
 
-	account, err := self.storage.GetAdminAccount(int32(id))
-	if err != nil {
-		return err
-	}
+	w.Header().Set("Cache-Control", "public, max-age=300")
 
-	account.HashedPassword = ""
+	return WriteJSON(w, http.StatusOK, keys.JWKS())
+}
 
-	return WriteJSON(w, http.StatusOK, account)
+func (self *APIServer) handleAccessCategories(w http.ResponseWriter, r *http.Request) error {
+	switch r.Method {
+	case "GET":
+		return self.handleGetCategoryTree(w, r)
+	}
+
+	return methodNotAllowedError(r.Method)
 }
 
-func (self *APIServer) handleUpdateAdminAccount(w http.ResponseWriter, r *http.Request) error {
-	id, err := getID(r)
-	if err != nil {
-		return err
+func (self *APIServer) handleAccessCategoryItems(w http.ResponseWriter, r *http.Request) error {
+	switch r.Method {
+	case "GET":
+		return self.handleGetCategoryItems(w, r)
 	}
 
-	updateAdminAccountRequest := new(UpdateAccountRequest)
-	jsonDecoderHandle := json.NewDecoder(r.Body)
-	jsonDecoderHandle.DisallowUnknownFields()
-	if err := jsonDecoderHandle.Decode(&updateAdminAccountRequest); err != nil {
+	return methodNotAllowedError(r.Method)
+}
+
+// method specific handlers
+
+func (self *APIServer) handlePostAdminLogin(w http.ResponseWriter, r *http.Request) error {
+	loginRequest := new(LoginRequest)
+	if err := decodeJSON(w, r, loginRequest); err != nil {
 		return err
 	}
 
-	account := AdminAccount{
-		ID:       uint32(id),
-		Username: updateAdminAccountRequest.Username,
+	keys := loginThrottleKeys(r, AdminSession, loginRequest.Username)
+	if err := self.checkLoginThrottles(keys); err != nil {
+		return err
 	}
 
-	if err := self.storage.UpdateAdminAccount(&account); err != nil {
+	account, err := self.storage.LoginAdminAccount(loginRequest.Username, loginRequest.Password)
+	if err != nil {
+		self.recordLoginResult(keys, err)
 		return err
 	}
 
-	return WriteJSON(w, http.StatusOK, struct {
-		UpdatedAccount int32 `json:"updated_account"`
-	}{int32(id)})
-}
+	// the account's failures are only cleared once the code is right as well,
+	// or a known password could be used to reset them between code guesses
+	if account.MFAEnabled {
+		mfaToken, err := generateMFAChallenge(account)
+		if err != nil {
+			return err
+		}
 
-func (self *APIServer) handleGetDashboard(w http.ResponseWriter, r *http.Request) error {
-	admins, err := self.storage.GetAdminAccounts()
+		return WriteJSON(w, http.StatusOK, MFAChallenge{
+			MFARequired: true,
+			MFAToken:    mfaToken,
+			ExpiresIn:   int64(mfaChallengeTTL / time.Second),
+		})
+	}
+
+	tokens, err := self.storage.OpenSession(AdminSession, int32(account.ID))
 	if err != nil {
 		return err
 	}
 
-	for _, admin := range admins {
-		admin.HashedPassword = ""
+	self.recordLoginResult(keys, nil)
+
+	return WriteJSON(w, http.StatusOK, tokens)
+}
+
+// handlePostAdminLoginMFA is the second step of logging in with two-factor
+// authentication. Wrong codes count against the same keys as wrong
+// passwords.
+func (self *APIServer) handlePostAdminLoginMFA(w http.ResponseWriter, r *http.Request) error {
+	mfaLoginRequest := new(MFALoginRequest)
+	if err := decodeJSON(w, r, mfaLoginRequest); err != nil {
+		return err
 	}
 
-	users, err := self.storage.GetUserAccounts()
+	id, username, err := parseMFAChallenge(mfaLoginRequest.MFAToken)
 	if err != nil {
 		return err
 	}
 
-	for _, user := range users {
-		user.HashedPassword = ""
+	keys := loginThrottleKeys(r, AdminSession, username)
+	if err := self.checkLoginThrottles(keys); err != nil {
+		return err
 	}
 
-	items, err := self.storage.GetItems()
-	if err != nil {
+	if err := self.storage.VerifyMFA(id, mfaLoginRequest.Code); err != nil {
+		self.recordLoginResult(keys, err)
 		return err
 	}
 
-	orders, err := self.storage.GetOrders()
+	tokens, err := self.storage.OpenSession(AdminSession, id)
 	if err != nil {
 		return err
 	}
 
+	self.recordLoginResult(keys, nil)
+
+	return WriteJSON(w, http.StatusOK, tokens)
+}
+
+func (self *APIServer) handleGetAPIKeys(w http.ResponseWriter, r *http.Request) error {
+	id, err := getID(r)
+	if err != nil {
+		return err
+	}
+
+	keys, err := self.storage.GetAPIKeys(id)
+	if err != nil {
+		return err
+	}
+
+	return WriteJSON(w, http.StatusOK, keys)
+}
+
+// handleCreateAPIKey mints a key with some of the admin's permissions. The
+// key is in the response and is not shown again.
+func (self *APIServer) handleCreateAPIKey(w http.ResponseWriter, r *http.Request) error {
+	principal, _ := principalFrom(r)
+
+	createAPIKeyRequest := new(CreateAPIKeyRequest)
+	if err := decodeJSON(w, r, createAPIKeyRequest); err != nil {
+		return err
+	}
+
+	key, secret, keyHash, err := NewAPIKey(
+		principal.AccountID,
+		principal.Role,
+		createAPIKeyRequest.Name,
+		createAPIKeyRequest.Scopes,
+		createAPIKeyRequest.ExpiresAt,
+	)
+	if err != nil {
+		return err
+	}
+
+	if err := self.storage.CreateAPIKey(key, keyHash); err != nil {
+		return err
+	}
+
+	return WriteJSON(w, http.StatusOK, struct {
+		*APIKey
+		Key string `json:"key"`
+	}{
+		APIKey: key,
+		Key:    secret,
+	})
+}
+
+func (self *APIServer) handleRevokeAPIKey(w http.ResponseWriter, r *http.Request) error {
+	id, err := getID(r)
+	if err != nil {
+		return err
+	}
+
+	keyID, err := getKeyID(r)
+	if err != nil {
+		return err
+	}
+
+	if err := self.storage.RevokeAPIKey(id, keyID); err != nil {
+		return err
+	}
+
+	return WriteJSON(w, http.StatusOK, struct {
+		RevokedKey int32 `json:"revoked_key"`
+	}{
+		RevokedKey: keyID,
+	})
+}
+
+func (self *APIServer) handleGetMFAStatus(w http.ResponseWriter, r *http.Request) error {
+	id, err := getID(r)
+	if err != nil {
+		return err
+	}
+
+	account, err := self.storage.GetAdminAccount(id)
+	if err != nil {
+		return err
+	}
+
+	return WriteJSON(w, http.StatusOK, struct {
+		MFAEnabled  bool `json:"mfa_enabled"`
+		MFARequired bool `json:"mfa_required"`
+	}{
+		MFAEnabled:  account.MFAEnabled,
+		MFARequired: mfaRequired(),
+	})
+}
+
+// handleBeginMFAEnrollment hands out a new secret. It is not in force until
+// the admin confirms it with a code from their authenticator.
+func (self *APIServer) handleBeginMFAEnrollment(w http.ResponseWriter, r *http.Request) error {
+	id, err := getID(r)
+	if err != nil {
+		return err
+	}
+
+	account, err := self.storage.GetAdminAccount(id)
+	if err != nil {
+		return err
+	}
+
+	enrollment, err := NewMFAEnrollment(account.Username)
+	if err != nil {
+		return err
+	}
+
+	if err := self.storage.BeginMFAEnrollment(id, enrollment.Secret); err != nil {
+		return err
+	}
+
+	return WriteJSON(w, http.StatusOK, enrollment)
+}
+
+// handleConfirmMFAEnrollment turns two-factor authentication on and returns
+// the recovery codes, which are not shown again.
+func (self *APIServer) handleConfirmMFAEnrollment(w http.ResponseWriter, r *http.Request) error {
+	id, err := getID(r)
+	if err != nil {
+		return err
+	}
+
+	mfaCodeRequest := new(MFACodeRequest)
+	if err := decodeJSON(w, r, mfaCodeRequest); err != nil {
+		return err
+	}
+
+	codes, hashes, err := generateRecoveryCodes()
+	if err != nil {
+		return err
+	}
+
+	if err := self.storage.ConfirmMFAEnrollment(id, mfaCodeRequest.Code, hashes); err != nil {
+		return err
+	}
+
+	return WriteJSON(w, http.StatusOK, struct {
+		RecoveryCodes []string `json:"recovery_codes"`
+	}{
+		RecoveryCodes: codes,
+	})
+}
+
+func (self *APIServer) handleDisableMFA(w http.ResponseWriter, r *http.Request) error {
+	id, err := getID(r)
+	if err != nil {
+		return err
+	}
+
+	mfaCodeRequest := new(MFACodeRequest)
+	if err := decodeJSON(w, r, mfaCodeRequest); err != nil {
+		return err
+	}
+
+	if mfaRequired() {
+		return conflictError("Two-factor authentication is required and cannot be disabled")
+	}
+
+	if err := self.storage.VerifyMFA(id, mfaCodeRequest.Code); err != nil {
+		return err
+	}
+
+	if err := self.storage.DisableMFA(id); err != nil {
+		return err
+	}
+
+	return WriteJSON(w, http.StatusOK, "Two-factor authentication disabled")
+}
+
+func (self *APIServer) handleGetAdminAccount(w http.ResponseWriter, r *http.Request) error {
+	id, err := getID(r)
+	if err != nil {
+		return err
+	}
+
+	account, err := self.storage.GetAdminAccount(int32(id))
+	if err != nil {
+		return err
+	}
+
+	account.HashedPassword = ""
+
+	return WriteJSON(w, http.StatusOK, account)
+}
+
+func (self *APIServer) handleUpdateAdminAccount(w http.ResponseWriter, r *http.Request) error {
+	id, err := getID(r)
+	if err != nil {
+		return err
+	}
+
+	updateAdminAccountRequest := new(UpdateAccountRequest)
+	if err := decodeJSON(w, r, updateAdminAccountRequest); err != nil {
+		return err
+	}
+
+	account := AdminAccount{
+		ID:       uint32(id),
+		Username: updateAdminAccountRequest.Username,
+	}
+
+	if err := self.storage.UpdateAdminAccount(&account); err != nil {
+		return err
+	}
+
+	return WriteJSON(w, http.StatusOK, struct {
+		UpdatedAccount int32 `json:"updated_account"`
+	}{int32(id)})
+}
+
+func (self *APIServer) handleGetDashboard(w http.ResponseWriter, r *http.Request) error {
+	adminPage, err := self.storage.GetAdminAccounts(ListOptions{})
+	if err != nil {
+		return err
+	}
+
+	admins := adminPage.Data
+	for _, admin := range admins {
+		admin.HashedPassword = ""
+	}
+
+	userPage, err := self.storage.GetUserAccounts(ListOptions{})
+	if err != nil {
+		return err
+	}
+
+	users := userPage.Data
+	for _, user := range users {
+		user.HashedPassword = ""
+	}
+
+	itemPage, err := self.storage.GetItems(ItemFilter{})
+	if err != nil {
+		return err
+	}
+
+	orderPage, err := self.storage.GetOrders(OrderFilter{})
+	if err != nil {
+		return err
+	}
+
+	items, orders := itemPage.Data, orderPage.Data
+
 	return WriteJSON(w, http.StatusOK, struct {
 		Admins      []*AdminAccount `json:"admins"`
 		TotalAdmins int             `json:"total_admins"`
@@ -334,27 +947,30 @@ func (self *APIServer) handleGetDashboard(w http.ResponseWriter, r *http.Request
 }
 
 func (self *APIServer) handleGetAdminAccounts(w http.ResponseWriter, r *http.Request) error {
-	accounts, err := self.storage.GetAdminAccounts()
+	opts, err := parseListOptions(r)
+	if err != nil {
+		return err
+	}
+
+	page, err := self.storage.GetAdminAccounts(opts)
 	if err != nil {
 		return err
 	}
 
-	for _, account := range accounts {
+	for _, account := range page.Data {
 		account.HashedPassword = ""
 	}
 
-	return WriteJSON(w, http.StatusOK, accounts)
+	return WriteJSON(w, http.StatusOK, page)
 }
 
 func (self *APIServer) handleCreateAdminAccount(w http.ResponseWriter, r *http.Request) error {
-	createAdminAccountRequest := new(CreateAccountRequest)
-	jsonDecoderHandle := json.NewDecoder(r.Body)
-	jsonDecoderHandle.DisallowUnknownFields()
-	if err := jsonDecoderHandle.Decode(&createAdminAccountRequest); err != nil {
+	createAdminAccountRequest := new(CreateAdminAccountRequest)
+	if err := decodeJSON(w, r, createAdminAccountRequest); err != nil {
 		return err
 	}
 
-	account, err := NewAdminAccount(createAdminAccountRequest.Username, createAdminAccountRequest.Password)
+	account, err := NewAdminAccount(createAdminAccountRequest.Username, createAdminAccountRequest.Password, createAdminAccountRequest.Role)
 	if err != nil {
 		return err
 	}
@@ -368,14 +984,37 @@ func (self *APIServer) handleCreateAdminAccount(w http.ResponseWriter, r *http.R
 	return WriteJSON(w, http.StatusOK, account)
 }
 
+func (self *APIServer) handleSetAdminRole(w http.ResponseWriter, r *http.Request) error {
+	setAdminRoleRequest := new(SetAdminRoleRequest)
+	if err := decodeJSON(w, r, setAdminRoleRequest); err != nil {
+		return err
+	}
+
+	if err := self.storage.SetAdminRole(setAdminRoleRequest.ID, setAdminRoleRequest.Role); err != nil {
+		return err
+	}
+
+	return WriteJSON(w, http.StatusOK, struct {
+		UpdatedAccount int32 `json:"updated_account"`
+		Role           Role  `json:"role"`
+	}{setAdminRoleRequest.ID, setAdminRoleRequest.Role})
+}
+
 func (self *APIServer) handleDeleteAdminAccount(w http.ResponseWriter, r *http.Request) error {
+	adminID, err := getID(r)
+	if err != nil {
+		return err
+	}
+
 	deleteAdminAccountRequest := new(DeleteAccountRequest)
-	jsonDecoderHandle := json.NewDecoder(r.Body)
-	jsonDecoderHandle.DisallowUnknownFields()
-	if err := jsonDecoderHandle.Decode(&deleteAdminAccountRequest); err != nil {
+	if err := decodeJSON(w, r, deleteAdminAccountRequest); err != nil {
 		return err
 	}
 
+	if deleteAdminAccountRequest.ID == adminID {
+		return conflictError("You cannot delete your own account")
+	}
+
 	if err := self.storage.DeleteAdminAccount(deleteAdminAccountRequest.ID); err != nil {
 		return err
 	}
@@ -386,339 +1025,1417 @@ func (self *APIServer) handleDeleteAdminAccount(w http.ResponseWriter, r *http.R
 }
 
 func (self *APIServer) handleGetUserAccounts(w http.ResponseWriter, r *http.Request) error {
-	accounts, err := self.storage.GetUserAccounts()
+	opts, err := parseListOptions(r)
+	if err != nil {
+		return err
+	}
+
+	page, err := self.storage.GetUserAccounts(opts)
 	if err != nil {
 		return err
 	}
 
-	for _, account := range accounts {
+	for _, account := range page.Data {
 		account.HashedPassword = ""
 	}
 
-	return WriteJSON(w, http.StatusOK, accounts)
+	return WriteJSON(w, http.StatusOK, page)
 }
 
 func (self *APIServer) handlePostUserLogin(w http.ResponseWriter, r *http.Request) error {
 	loginRequest := new(LoginRequest)
-	jsonDecoderHandle := json.NewDecoder(r.Body)
-	jsonDecoderHandle.DisallowUnknownFields()
-	if err := jsonDecoderHandle.Decode(&loginRequest); err != nil {
+	if err := decodeJSON(w, r, loginRequest); err != nil {
+		return err
+	}
+
+	keys := loginThrottleKeys(r, UserSession, loginRequest.Username)
+	if err := self.checkLoginThrottles(keys); err != nil {
+		return err
+	}
+
+	tokens, err := self.storage.LoginUserAccount(loginRequest.Username, loginRequest.Password)
+	self.recordLoginResult(keys, err)
+	if err != nil {
+		return err
+	}
+
+	return WriteJSON(w, http.StatusOK, tokens)
+}
+
+// loginThrottleKeys are what a login attempt counts against: the account,
+// which is always first, and the client's IP.
+func loginThrottleKeys(r *http.Request, kind SessionKind, username string) []string {
+	return []string{accountThrottleKey(kind, username), ipThrottleKey(clientIP(r))}
+}
+
+// checkLoginThrottles refuses a login while any of its keys is locked out,
+// before the password is even looked at.
+func (self *APIServer) checkLoginThrottles(keys []string) error {
+	now := time.Now().UTC()
+
+	var wait time.Duration
+	for _, key := range keys {
+		throttle, err := self.storage.GetLoginThrottle(key)
+		if err != nil {
+			return err
+		}
+
+		wait = max(wait, throttle.lockedFor(now))
+	}
+
+	if wait > 0 {
+		return loginLockedError(wait)
+	}
+
+	return nil
+}
+
+// recordLoginResult counts a wrong username, password or two-factor code
+// against every key, and clears the account's failures after a successful
+// login. The IP's failures are left to expire, so one working login cannot
+// reset them.
+func (self *APIServer) recordLoginResult(keys []string, err error) {
+	if err == nil {
+		if err := self.storage.ClearLoginThrottle(keys[0]); err != nil {
+			log.Printf("Failed to clear login failures of %s: %s\n", keys[0], err)
+		}
+		return
+	}
+
+	if err != errInvalidCredentials && err != errInvalidMFACode {
+		return
+	}
+
+	for _, key := range keys {
+		if _, err := self.storage.RecordLoginFailure(key); err != nil {
+			log.Printf("Failed to record login failure of %s: %s\n", key, err)
+		}
+	}
+}
+
+// handleUnlockAccount lifts an account's lockout. Lockouts of client IPs
+// are left to expire.
+func (self *APIServer) handleUnlockAccount(w http.ResponseWriter, r *http.Request, kind SessionKind) error {
+	unlockAccountRequest := new(UnlockAccountRequest)
+	if err := decodeJSON(w, r, unlockAccountRequest); err != nil {
+		return err
+	}
+
+	var username string
+	if kind == AdminSession {
+		account, err := self.storage.GetAdminAccount(unlockAccountRequest.ID)
+		if err != nil {
+			return err
+		}
+		username = account.Username
+	} else {
+		account, err := self.storage.GetUserAccount(unlockAccountRequest.ID)
+		if err != nil {
+			return err
+		}
+		username = account.Username
+	}
+
+	if err := self.storage.ClearLoginThrottle(accountThrottleKey(kind, username)); err != nil {
+		return err
+	}
+
+	return WriteJSON(w, http.StatusOK, struct {
+		UnlockedAccount int32 `json:"unlocked_account"`
+	}{unlockAccountRequest.ID})
+}
+
+func (self *APIServer) handleRefreshSession(w http.ResponseWriter, r *http.Request, kind SessionKind) error {
+	refreshRequest := new(RefreshRequest)
+	if err := decodeJSON(w, r, refreshRequest); err != nil {
+		return err
+	}
+
+	tokens, err := self.storage.RefreshSession(kind, refreshRequest.RefreshToken)
+	if err != nil {
 		return err
 	}
 
-	auth_token, err := self.storage.LoginUserAccount(loginRequest.Username, loginRequest.Password)
+	return WriteJSON(w, http.StatusOK, tokens)
+}
+
+func (self *APIServer) handleRevokeSession(w http.ResponseWriter, r *http.Request, kind SessionKind) error {
+	refreshRequest := new(RefreshRequest)
+	if err := decodeJSON(w, r, refreshRequest); err != nil {
+		return err
+	}
+
+	if err := self.storage.RevokeSession(kind, refreshRequest.RefreshToken); err != nil {
+		return err
+	}
+
+	return WriteJSON(w, http.StatusOK, "Logged out")
+}
+
+func (self *APIServer) handleChangePassword(w http.ResponseWriter, r *http.Request, kind SessionKind) error {
+	id, err := getID(r)
+	if err != nil {
+		return err
+	}
+
+	changePasswordRequest := new(ChangePasswordRequest)
+	if err := decodeJSON(w, r, changePasswordRequest); err != nil {
+		return err
+	}
+
+	if err := self.storage.ChangePassword(kind, id, changePasswordRequest.CurrentPassword, changePasswordRequest.NewPassword); err != nil {
+		return err
+	}
+
+	return WriteJSON(w, http.StatusOK, "Password changed")
+}
+
+// handleForgotPassword answers the same whether or not the account exists,
+// so it cannot be used to find out which usernames are taken.
+func (self *APIServer) handleForgotPassword(w http.ResponseWriter, r *http.Request, kind SessionKind) error {
+	forgotPasswordRequest := new(ForgotPasswordRequest)
+	if err := decodeJSON(w, r, forgotPasswordRequest); err != nil {
+		return err
+	}
+
+	reset, err := self.storage.CreatePasswordReset(kind, forgotPasswordRequest.Username)
+	if err != nil {
+		return err
+	}
+
+	if reset != nil {
+		if err := self.mailer.Send(reset.Message()); err != nil {
+			log.Printf("Failed to send password reset for %s %d: %s\n", kind, reset.AccountID, err)
+		}
+	}
+
+	return WriteJSON(w, http.StatusOK, "If the account exists, a password reset email has been sent")
+}
+
+func (self *APIServer) handleResetPassword(w http.ResponseWriter, r *http.Request, kind SessionKind) error {
+	resetPasswordRequest := new(ResetPasswordRequest)
+	if err := decodeJSON(w, r, resetPasswordRequest); err != nil {
+		return err
+	}
+
+	if err := self.storage.ResetPassword(kind, resetPasswordRequest.Token, resetPasswordRequest.Password); err != nil {
+		return err
+	}
+
+	return WriteJSON(w, http.StatusOK, "Password reset; log in with the new password")
+}
+
+func (self *APIServer) handleCreateUserAccount(w http.ResponseWriter, r *http.Request) error {
+	createUserAccountRequest := new(CreateAccountRequest)
+	if err := decodeJSON(w, r, createUserAccountRequest); err != nil {
+		return err
+	}
+
+	account, err := NewUserAccount(createUserAccountRequest.Username, createUserAccountRequest.Password, createUserAccountRequest.Email)
+	if err != nil {
+		return err
+	}
+
+	if err := self.storage.CreateUserAccount(account); err != nil {
+		return err
+	}
+
+	// the account exists either way; the user can ask for another email
+	if err := self.sendVerificationEmail(r, int32(account.ID)); err != nil {
+		log.Printf("Failed to send verification email to user %d: %s\n", account.ID, err)
+	}
+
+	account.HashedPassword = ""
+
+	return WriteJSON(w, http.StatusOK, account)
+}
+
+// sendVerificationEmail mails the user a link to verify their email, unless
+// one was sent too recently.
+func (self *APIServer) sendVerificationEmail(r *http.Request, id int32) error {
+	account, err := self.storage.ClaimVerificationEmail(id)
+	if err != nil {
+		return err
+	}
+
+	token, err := generateVerificationToken(account)
+	if err != nil {
+		return err
+	}
+
+	return self.mailer.Send(verificationMessage(account, verificationLink(r, token)))
+}
+
+func (self *APIServer) handleResendVerification(w http.ResponseWriter, r *http.Request) error {
+	id, err := getID(r)
+	if err != nil {
+		return err
+	}
+
+	if err := self.sendVerificationEmail(r, id); err != nil {
+		return err
+	}
+
+	return WriteJSON(w, http.StatusOK, "Verification email sent")
+}
+
+func (self *APIServer) handleGetVerifyEmail(w http.ResponseWriter, r *http.Request) error {
+	id, email, err := parseVerificationToken(r.URL.Query().Get("token"))
+	if err != nil {
+		return err
+	}
+
+	if err := self.storage.VerifyUserEmail(id, email); err != nil {
+		return err
+	}
+
+	return WriteJSON(w, http.StatusOK, "Email verified")
+}
+
+func (self *APIServer) handleDeleteUserAccount(w http.ResponseWriter, r *http.Request) error {
+	deleteUserAccountRequest := new(DeleteAccountRequest)
+	if err := decodeJSON(w, r, deleteUserAccountRequest); err != nil {
+		return err
+	}
+
+	if err := self.storage.DeleteUserAccount(deleteUserAccountRequest.ID); err != nil {
+		return err
+	}
+
+	return WriteJSON(w, http.StatusOK, struct {
+		DeletedAccount int32 `json:"deleted_account"`
+	}{deleteUserAccountRequest.ID})
+}
+
+func (self *APIServer) handleGetUserAccount(w http.ResponseWriter, r *http.Request) error {
+	id, err := getID(r)
+	if err != nil {
+		return err
+	}
+
+	account, err := self.storage.GetUserAccount(int32(id))
+	if err != nil {
+		return err
+	}
+
+	account.HashedPassword = ""
+
+	return WriteJSON(w, http.StatusOK, account)
+}
+
+func (self *APIServer) handleUpdateUserAccount(w http.ResponseWriter, r *http.Request) error {
+	id, err := getID(r)
+	if err != nil {
+		return err
+	}
+
+	updateUserAccountRequest := new(UpdateUserAccountRequest)
+	if err := decodeJSON(w, r, updateUserAccountRequest); err != nil {
+		return err
+	}
+
+	account := UserAccount{
+		ID:       uint32(id),
+		Username: updateUserAccountRequest.Username,
+	}
+
+	if updateUserAccountRequest.Email != "" {
+		if account.Email, err = normalizeEmail(updateUserAccountRequest.Email); err != nil {
+			return err
+		}
+	}
+
+	current, err := self.storage.GetUserAccount(id)
+	if err != nil {
+		return err
+	}
+
+	if err := self.storage.UpdateUserAccount(&account); err != nil {
+		return err
+	}
+
+	if account.Email != "" && account.Email != current.Email {
+		if err := self.sendVerificationEmail(r, id); err != nil {
+			log.Printf("Failed to send verification email to user %d: %s\n", id, err)
+		}
+	}
+
+	return WriteJSON(w, http.StatusOK, struct {
+		UpdatedAccount int32 `json:"updated_account"`
+	}{int32(id)})
+}
+
+func (self *APIServer) handleGetUserItems(w http.ResponseWriter, r *http.Request) error {
+	id, err := getID(r)
+	if err != nil {
+		return err
+	}
+
+	if _, err := self.storage.GetUserAccount(int32(id)); err != nil {
+		return err
+	}
+
+	cartItems, err := self.storage.GetUserItems(id)
+	if err != nil {
+		return err
+	}
+
+	lines, total, err := self.storage.GetItemsById(cartItems)
+	if err != nil {
+		return err
+	}
+
+	items := make([]*Item, 0, len(lines))
+	for _, line := range lines {
+		items = append(items, line.Item)
+	}
+
+	if err := self.attachImages(items...); err != nil {
+		return err
+	}
+
+	return WriteJSON(w, http.StatusOK, Cart{Lines: lines, Total: total})
+}
+
+func (self *APIServer) handleAddItemToUserAccount(w http.ResponseWriter, r *http.Request) error {
+	id, err := getID(r)
+	if err != nil {
+		return err
+	}
+
+	addItemRequest := new(AddItemRequest)
+	if err := decodeJSON(w, r, addItemRequest); err != nil {
+		return err
+	}
+
+	// omitting the quantity adds a single unit
+	if addItemRequest.Quantity == 0 {
+		addItemRequest.Quantity = 1
+	}
+
+	if err := self.storage.AddItemToUserAccount(id, addItemRequest.ItemID, addItemRequest.SKUID, addItemRequest.Quantity); err != nil {
+		return err
+	}
+
+	return WriteJSON(w, http.StatusOK, struct {
+		AddedItem int32 `json:"added_item"`
+		SKU       int32 `json:"sku,omitempty"`
+		Quantity  int32 `json:"quantity"`
+		Account   int32 `json:"account"`
+	}{addItemRequest.ItemID, addItemRequest.SKUID, addItemRequest.Quantity, id})
+}
+
+func (self *APIServer) handleSetUserItemQuantity(w http.ResponseWriter, r *http.Request) error {
+	id, err := getID(r)
+	if err != nil {
+		return err
+	}
+
+	setItemQuantityRequest := new(SetItemQuantityRequest)
+	if err := decodeJSON(w, r, setItemQuantityRequest); err != nil {
+		return err
+	}
+
+	if err := self.storage.SetUserItemQuantity(id, setItemQuantityRequest.ItemID, setItemQuantityRequest.SKUID, setItemQuantityRequest.Quantity); err != nil {
+		return err
+	}
+
+	return WriteJSON(w, http.StatusOK, struct {
+		UpdatedItem int32 `json:"updated_item"`
+		SKU         int32 `json:"sku,omitempty"`
+		Quantity    int32 `json:"quantity"`
+		Account     int32 `json:"account"`
+	}{setItemQuantityRequest.ItemID, setItemQuantityRequest.SKUID, setItemQuantityRequest.Quantity, id})
+}
+
+func (self *APIServer) handleRemoveItemFromUserAccount(w http.ResponseWriter, r *http.Request) error {
+	id, err := getID(r)
+	if err != nil {
+		return err
+	}
+
+	removeItemRequest := new(RemoveItemRequest)
+	if err := decodeJSON(w, r, removeItemRequest); err != nil {
+		return err
+	}
+
+	if err := self.storage.RemoveItemFromUserAccount(id, removeItemRequest.ItemID, removeItemRequest.SKUID); err != nil {
+		return err
+	}
+
+	return WriteJSON(w, http.StatusOK, struct {
+		AddedItem int32 `json:"removed_item"`
+		SKU       int32 `json:"sku,omitempty"`
+		Account   int32 `json:"account"`
+	}{removeItemRequest.ItemID, removeItemRequest.SKUID, id})
+}
+
+func (self *APIServer) handleCheckoutUserAccount(w http.ResponseWriter, r *http.Request) error {
+	id, err := getID(r)
+	if err != nil {
+		return err
+	}
+
+	// the account row stays locked until the transaction ends, so a second
+	// concurrent checkout waits here and then finds the cart already empty
+	var order *Order
+	err = self.storage.WithTx(func(tx Storage) error {
+		account, err := tx.LockUserAccount(id)
+		if err != nil {
+			return err
+		}
+
+		if account.EmailVerifiedAt == nil {
+			return forbiddenError("Verify your email address before checking out")
+		}
+
+		cartItems, err := tx.GetUserItems(id)
+		if err != nil {
+			return err
+		}
+
+		if len(cartItems) == 0 {
+			return conflictError("Cart for account %d is empty", id)
+		}
+
+		lines, err := buildOrderLines(tx, cartItems)
+		if err != nil {
+			return err
+		}
+
+		if order, err = NewOrder(uint32(id), lines); err != nil {
+			return err
+		}
+
+		if err := tx.CreateOrder(order); err != nil {
+			return err
+		}
+
+		return tx.ClearUserItems(id)
+	})
+	if err != nil {
+		return err
+	}
+
+	return WriteJSON(w, http.StatusOK, struct {
+		Order  *Order      `json:"order"`
+		Status OrderStatus `json:"status"`
+	}{order, order.Status})
+}
+
+func (self *APIServer) handleGetUserOrders(w http.ResponseWriter, r *http.Request) error {
+	id, err := getID(r)
+	if err != nil {
+		return err
+	}
+
+	account, err := self.storage.GetUserAccount(int32(id))
+	if err != nil {
+		return err
+	}
+
+	orders, err := self.storage.GetOrdersById(account.Orders)
+	if err != nil {
+		return err
+	}
+
+	return WriteJSON(w, http.StatusOK, orders)
+}
+
+func (self *APIServer) handleGetItems(w http.ResponseWriter, r *http.Request) error {
+	filter, err := parseItemFilter(r)
+	if err != nil {
+		return err
+	}
+
+	page, err := self.storage.GetItems(filter)
+	if err != nil {
+		return err
+	}
+
+	if err := self.attachImages(page.Data...); err != nil {
+		return err
+	}
+
+	return WriteJSON(w, http.StatusOK, page)
+}
+
+func (self *APIServer) handleCreateItem(w http.ResponseWriter, r *http.Request) error {
+	createItemRequest := new(CreateItemRequest)
+	if err := decodeJSON(w, r, createItemRequest); err != nil {
+		return err
+	}
+
+	price, err := createItemRequest.Price.Normalize()
+	if err != nil {
+		return err
+	}
+
+	item := NewItem(createItemRequest.Name, createItemRequest.Description, price)
+	if err := self.storage.CreateItem(item); err != nil {
+		return err
+	}
+
+	return WriteJSON(w, http.StatusOK, item)
+}
+
+func (self *APIServer) handleDeleteItem(w http.ResponseWriter, r *http.Request) error {
+	deleteItemRequest := new(DeleteItemRequest)
+	if err := decodeJSON(w, r, deleteItemRequest); err != nil {
+		return err
+	}
+
+	images, err := self.storage.GetItemImages(deleteItemRequest.ID)
+	if err != nil {
+		return err
+	}
+
+	if err := self.storage.DeleteItem(deleteItemRequest.ID); err != nil {
+		return err
+	}
+
+	self.deleteImageBlobs(images...)
+
+	return WriteJSON(w, http.StatusOK, struct {
+		DeletedItem int32 `json:"deleted_item"`
+	}{deleteItemRequest.ID})
+}
+
+func (self *APIServer) handleSearchItems(w http.ResponseWriter, r *http.Request) error {
+	limit, err := parseLimit(r)
+	if err != nil {
+		return err
+	}
+
+	results, err := self.storage.SearchItems(r.URL.Query().Get("q"), limit)
+	if err != nil {
+		return err
+	}
+
+	items := make([]*Item, 0, len(results))
+	for _, result := range results {
+		items = append(items, result.Item)
+	}
+
+	if err := self.attachImages(items...); err != nil {
+		return err
+	}
+
+	return WriteJSON(w, http.StatusOK, results)
+}
+
+func (self *APIServer) handleGetItem(w http.ResponseWriter, r *http.Request) error {
+	id, err := getItemID(r)
+	if err != nil {
+		return err
+	}
+
+	item, err := self.storage.GetItem(int32(id))
+	if err != nil {
+		return err
+	}
+
+	if item.Options, err = self.storage.GetItemOptions(id); err != nil {
+		return err
+	}
+
+	if item.SKUs, err = self.storage.GetSKUs(id); err != nil {
+		return err
+	}
+
+	if err := self.attachImages(item); err != nil {
+		return err
+	}
+
+	return WriteJSON(w, http.StatusOK, item)
+}
+
+func (self *APIServer) handleUpdateItem(w http.ResponseWriter, r *http.Request) error {
+	id, err := getItemID(r)
+	if err != nil {
+		return err
+	}
+
+	updateItemRequest := new(UpdateItemRequest)
+	if err := decodeJSON(w, r, updateItemRequest); err != nil {
+		return err
+	}
+
+	price, err := updateItemRequest.Price.Normalize()
+	if err != nil {
+		return err
+	}
+
+	item := Item{
+		ID:          uint32(id),
+		Name:        updateItemRequest.Name,
+		Description: updateItemRequest.Description,
+		Price:       price,
+	}
+
+	if err := self.storage.UpdateItem(&item); err != nil {
+		return err
+	}
+
+	return WriteJSON(w, http.StatusOK, struct {
+		UpdatedItem int32 `json:"updated_item"`
+	}{int32(id)})
+}
+
+func (self *APIServer) handleGetCategories(w http.ResponseWriter, r *http.Request) error {
+	categories, err := self.storage.GetCategories()
+	if err != nil {
+		return err
+	}
+
+	return WriteJSON(w, http.StatusOK, categories)
+}
+
+func (self *APIServer) handleGetCategoryTree(w http.ResponseWriter, r *http.Request) error {
+	categories, err := self.storage.GetCategories()
+	if err != nil {
+		return err
+	}
+
+	return WriteJSON(w, http.StatusOK, buildCategoryTree(categories))
+}
+
+func (self *APIServer) handleCreateCategory(w http.ResponseWriter, r *http.Request) error {
+	createCategoryRequest := new(CreateCategoryRequest)
+	if err := decodeJSON(w, r, createCategoryRequest); err != nil {
+		return err
+	}
+
+	category, err := NewCategory(createCategoryRequest.Name, createCategoryRequest.Slug, createCategoryRequest.ParentID)
+	if err != nil {
+		return err
+	}
+
+	if err := self.storage.CreateCategory(category); err != nil {
+		return err
+	}
+
+	return WriteJSON(w, http.StatusOK, category)
+}
+
+func (self *APIServer) handleDeleteCategory(w http.ResponseWriter, r *http.Request) error {
+	deleteCategoryRequest := new(DeleteCategoryRequest)
+	if err := decodeJSON(w, r, deleteCategoryRequest); err != nil {
+		return err
+	}
+
+	if err := self.storage.DeleteCategory(deleteCategoryRequest.ID); err != nil {
+		return err
+	}
+
+	return WriteJSON(w, http.StatusOK, struct {
+		DeletedCategory int32 `json:"deleted_category"`
+	}{deleteCategoryRequest.ID})
+}
+
+func (self *APIServer) handleGetCategory(w http.ResponseWriter, r *http.Request) error {
+	id, err := getCategoryID(r)
+	if err != nil {
+		return err
+	}
+
+	category, err := self.storage.GetCategory(id)
+	if err != nil {
+		return err
+	}
+
+	return WriteJSON(w, http.StatusOK, category)
+}
+
+func (self *APIServer) handleUpdateCategory(w http.ResponseWriter, r *http.Request) error {
+	id, err := getCategoryID(r)
+	if err != nil {
+		return err
+	}
+
+	updateCategoryRequest := new(UpdateCategoryRequest)
+	if err := decodeJSON(w, r, updateCategoryRequest); err != nil {
+		return err
+	}
+
+	category := &Category{ID: uint32(id)}
+	if err := category.Set(updateCategoryRequest.Name, updateCategoryRequest.Slug, updateCategoryRequest.ParentID); err != nil {
+		return err
+	}
+
+	if err := self.storage.UpdateCategory(category); err != nil {
+		return err
+	}
+
+	return WriteJSON(w, http.StatusOK, struct {
+		UpdatedCategory int32 `json:"updated_category"`
+	}{id})
+}
+
+func (self *APIServer) handleGetCategoryItems(w http.ResponseWriter, r *http.Request) error {
+	category, err := self.storage.GetCategoryBySlug(mux.Vars(r)["slug"])
+	if err != nil {
+		return err
+	}
+
+	filter, err := parseItemFilter(r)
+	if err != nil {
+		return err
+	}
+
+	filter.CategoryID = int32(category.ID)
+
+	page, err := self.storage.GetItems(filter)
+	if err != nil {
+		return err
+	}
+
+	if err := self.attachImages(page.Data...); err != nil {
+		return err
+	}
+
+	return WriteJSON(w, http.StatusOK, page)
+}
+
+func (self *APIServer) handleGetItemCategories(w http.ResponseWriter, r *http.Request) error {
+	id, err := getItemID(r)
+	if err != nil {
+		return err
+	}
+
+	if _, err := self.storage.GetItem(id); err != nil {
+		return err
+	}
+
+	categories, err := self.storage.GetItemCategories(id)
+	if err != nil {
+		return err
+	}
+
+	return WriteJSON(w, http.StatusOK, categories)
+}
+
+func (self *APIServer) handleSetItemCategories(w http.ResponseWriter, r *http.Request) error {
+	id, err := getItemID(r)
+	if err != nil {
+		return err
+	}
+
+	setItemCategoriesRequest := new(SetItemCategoriesRequest)
+	if err := decodeJSON(w, r, setItemCategoriesRequest); err != nil {
+		return err
+	}
+
+	if err := self.storage.SetItemCategories(id, setItemCategoriesRequest.CategoryIDs); err != nil {
+		return err
+	}
+
+	categories, err := self.storage.GetItemCategories(id)
+	if err != nil {
+		return err
+	}
+
+	return WriteJSON(w, http.StatusOK, categories)
+}
+
+func (self *APIServer) handleGetItemImages(w http.ResponseWriter, r *http.Request) error {
+	id, err := getItemID(r)
+	if err != nil {
+		return err
+	}
+
+	if _, err := self.storage.GetItem(id); err != nil {
+		return err
+	}
+
+	images, err := self.storage.GetItemImages(id)
+	if err != nil {
+		return err
+	}
+
+	return WriteJSON(w, http.StatusOK, images)
+}
+
+// handleUploadItemImage takes a multipart form with the file in the "image"
+// field. Setting "primary" to true makes it the item's primary image.
+func (self *APIServer) handleUploadItemImage(w http.ResponseWriter, r *http.Request) error {
+	id, err := getItemID(r)
+	if err != nil {
+		return err
+	}
+
+	// leave room for the multipart framing around the file itself
+	r.Body = http.MaxBytesReader(w, r.Body, maxImageBytes+1<<20)
+	if err := r.ParseMultipartForm(maxImageBytes); err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			return payloadTooLargeError("Image must be at most %d MB", maxImageBytes>>20)
+		}
+
+		return badRequestError("Invalid upload: %s", err)
+	}
+	defer r.MultipartForm.RemoveAll()
+
+	file, _, err := r.FormFile("image")
+	if err != nil {
+		return validationError("image", "Missing image file: %s", err)
+	}
+	defer file.Close()
+
+	data, err := io.ReadAll(io.LimitReader(file, maxImageBytes+1))
+	if err != nil {
+		return err
+	}
+
+	upload, err := processImage(data)
+	if err != nil {
+		return err
+	}
+
+	if _, err := self.storage.GetItem(id); err != nil {
+		return err
+	}
+
+	image, err := NewItemImage(id, upload)
+	if err != nil {
+		return err
+	}
+	image.Primary = r.FormValue("primary") == "true"
+
+	if err := self.blobs.Put(image.Key, bytes.NewReader(upload.data)); err != nil {
+		return err
+	}
+
+	if err := self.blobs.Put(image.ThumbnailKey, bytes.NewReader(upload.thumbnail)); err != nil {
+		self.deleteImageBlobs(image)
+		return err
+	}
+
+	if err := self.storage.CreateItemImage(image); err != nil {
+		self.deleteImageBlobs(image)
+		return err
+	}
+
+	return WriteJSON(w, http.StatusOK, image)
+}
+
+func (self *APIServer) handleReorderItemImages(w http.ResponseWriter, r *http.Request) error {
+	id, err := getItemID(r)
+	if err != nil {
+		return err
+	}
+
+	reorderImagesRequest := new(ReorderImagesRequest)
+	if err := decodeJSON(w, r, reorderImagesRequest); err != nil {
+		return err
+	}
+
+	if err := self.storage.ReorderItemImages(id, reorderImagesRequest.ImageIDs); err != nil {
+		return err
+	}
+
+	images, err := self.storage.GetItemImages(id)
+	if err != nil {
+		return err
+	}
+
+	return WriteJSON(w, http.StatusOK, images)
+}
+
+func (self *APIServer) handleDeleteItemImage(w http.ResponseWriter, r *http.Request) error {
+	id, err := getItemID(r)
+	if err != nil {
+		return err
+	}
+
+	deleteImageRequest := new(DeleteImageRequest)
+	if err := decodeJSON(w, r, deleteImageRequest); err != nil {
+		return err
+	}
+
+	image, err := self.getItemImage(id, deleteImageRequest.ID)
+	if err != nil {
+		return err
+	}
+
+	if err := self.storage.DeleteItemImage(deleteImageRequest.ID); err != nil {
+		return err
+	}
+
+	self.deleteImageBlobs(image)
+
+	return WriteJSON(w, http.StatusOK, struct {
+		DeletedImage int32 `json:"deleted_image"`
+	}{deleteImageRequest.ID})
+}
+
+func (self *APIServer) handleGetItemImage(w http.ResponseWriter, r *http.Request) error {
+	id, err := getItemID(r)
+	if err != nil {
+		return err
+	}
+
+	imageID, err := getImageID(r)
+	if err != nil {
+		return err
+	}
+
+	image, err := self.getItemImage(id, imageID)
+	if err != nil {
+		return err
+	}
+
+	return WriteJSON(w, http.StatusOK, image)
+}
+
+func (self *APIServer) handleUpdateItemImage(w http.ResponseWriter, r *http.Request) error {
+	id, err := getItemID(r)
+	if err != nil {
+		return err
+	}
+
+	imageID, err := getImageID(r)
+	if err != nil {
+		return err
+	}
+
+	updateImageRequest := new(UpdateImageRequest)
+	if err := decodeJSON(w, r, updateImageRequest); err != nil {
+		return err
+	}
+
+	// an item always has a primary image, so it can only be handed over
+	if !updateImageRequest.Primary {
+		return validationError("primary", "Make another image primary instead")
+	}
+
+	if err := self.storage.SetPrimaryItemImage(id, imageID); err != nil {
+		return err
+	}
+
+	image, err := self.getItemImage(id, imageID)
+	if err != nil {
+		return err
+	}
+
+	return WriteJSON(w, http.StatusOK, image)
+}
+
+// handleGetMedia serves a stored blob. Keys are random and never reused, so
+// clients may cache them indefinitely.
+func (self *APIServer) handleGetMedia(w http.ResponseWriter, r *http.Request) error {
+	key := strings.TrimPrefix(r.URL.Path, mediaPrefix)
+
+	blob, err := self.blobs.Open(key)
+	if errors.Is(err, fs.ErrNotExist) {
+		return notFoundError("Not found")
+	}
+	if err != nil {
+		return err
+	}
+	defer blob.Close()
+
+	w.Header().Set("Content-Type", mime.TypeByExtension(path.Ext(key)))
+	w.Header().Set("Cache-Control", "public, max-age=31536000, immutable")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(http.StatusOK)
+
+	_, err = io.Copy(w, blob)
+	if err != nil {
+		log.Printf("Serving %s: %s\n", key, err)
+	}
+
+	return nil
+}
+
+// getItemImage loads an image and checks it belongs to the item in the route.
+func (self *APIServer) getItemImage(itemID, imageID int32) (*ItemImage, error) {
+	image, err := self.storage.GetItemImage(imageID)
+	if err != nil {
+		return nil, err
+	}
+
+	if image.ItemID != itemID {
+		return nil, notFoundError("Image %d of item %d not found", imageID, itemID)
+	}
+
+	return image, nil
+}
+
+// attachImages fills in the images of each item.
+func (self *APIServer) attachImages(items ...*Item) error {
+	if len(items) == 0 {
+		return nil
+	}
+
+	ids := make([]int32, 0, len(items))
+	for _, item := range items {
+		ids = append(ids, int32(item.ID))
+	}
+
+	images, err := self.storage.GetImagesForItems(ids)
+	if err != nil {
+		return err
+	}
+
+	for _, item := range items {
+		item.Images = images[int32(item.ID)]
+	}
+
+	return nil
+}
+
+// deleteImageBlobs removes the files behind images whose records are gone. A
+// failure only leaves an orphaned file behind, so it is logged, not returned.
+func (self *APIServer) deleteImageBlobs(images ...*ItemImage) {
+	for _, image := range images {
+		for _, key := range []string{image.Key, image.ThumbnailKey} {
+			if err := self.blobs.Delete(key); err != nil {
+				log.Printf("Deleting media %s: %s\n", key, err)
+			}
+		}
+	}
+}
+
+func (self *APIServer) handleGetItemOptions(w http.ResponseWriter, r *http.Request) error {
+	id, err := getItemID(r)
 	if err != nil {
 		return err
 	}
 
-	return WriteJSON(w, http.StatusOK, struct {
-		AuthToken string `json:"auth_token"`
-	}{auth_token})
-}
-
-func (self *APIServer) handleCreateUserAccount(w http.ResponseWriter, r *http.Request) error {
-	createUserAccountRequest := new(CreateAccountRequest)
-	jsonDecoderHandle := json.NewDecoder(r.Body)
-	jsonDecoderHandle.DisallowUnknownFields()
-	if err := jsonDecoderHandle.Decode(&createUserAccountRequest); err != nil {
+	if _, err := self.storage.GetItem(id); err != nil {
 		return err
 	}
 
-	account, err := NewUserAccount(createUserAccountRequest.Username, createUserAccountRequest.Password)
+	options, err := self.storage.GetItemOptions(id)
 	if err != nil {
 		return err
 	}
 
-	if err := self.storage.CreateUserAccount(account); err != nil {
+	skus, err := self.storage.GetSKUs(id)
+	if err != nil {
 		return err
 	}
 
-	account.HashedPassword = ""
-
-	return WriteJSON(w, http.StatusOK, account)
+	return WriteJSON(w, http.StatusOK, struct {
+		Options []*ItemOption `json:"options"`
+		SKUs    []*SKU        `json:"skus"`
+	}{options, skus})
 }
 
-func (self *APIServer) handleDeleteUserAccount(w http.ResponseWriter, r *http.Request) error {
-	deleteUserAccountRequest := new(DeleteAccountRequest)
-	jsonDecoderHandle := json.NewDecoder(r.Body)
-	jsonDecoderHandle.DisallowUnknownFields()
-	if err := jsonDecoderHandle.Decode(&deleteUserAccountRequest); err != nil {
+func (self *APIServer) handleSetItemOptions(w http.ResponseWriter, r *http.Request) error {
+	id, err := getItemID(r)
+	if err != nil {
 		return err
 	}
 
-	if err := self.storage.DeleteUserAccount(deleteUserAccountRequest.ID); err != nil {
+	setItemOptionsRequest := new(SetItemOptionsRequest)
+	if err := decodeJSON(w, r, setItemOptionsRequest); err != nil {
 		return err
 	}
 
-	return WriteJSON(w, http.StatusOK, struct {
-		DeletedAccount int32 `json:"deleted_account"`
-	}{deleteUserAccountRequest.ID})
-}
-
-func (self *APIServer) handleGetUserAccount(w http.ResponseWriter, r *http.Request) error {
-	id, err := getID(r)
-	if err != nil {
+	if err := checkItemOptions(setItemOptionsRequest.Options); err != nil {
 		return err
 	}
 
-	account, err := self.storage.GetUserAccount(int32(id))
+	skus, err := self.storage.SetItemOptions(id, setItemOptionsRequest.Options)
 	if err != nil {
 		return err
 	}
 
-	account.HashedPassword = ""
-
-	return WriteJSON(w, http.StatusOK, account)
+	return WriteJSON(w, http.StatusOK, struct {
+		Options []*ItemOption `json:"options"`
+		SKUs    []*SKU        `json:"skus"`
+	}{setItemOptionsRequest.Options, skus})
 }
 
-func (self *APIServer) handleUpdateUserAccount(w http.ResponseWriter, r *http.Request) error {
-	id, err := getID(r)
+func (self *APIServer) handleGetSKUs(w http.ResponseWriter, r *http.Request) error {
+	id, err := getItemID(r)
 	if err != nil {
 		return err
 	}
 
-	updateUserAccountRequest := new(UpdateAccountRequest)
-	jsonDecoderHandle := json.NewDecoder(r.Body)
-	jsonDecoderHandle.DisallowUnknownFields()
-	if err := jsonDecoderHandle.Decode(&updateUserAccountRequest); err != nil {
+	if _, err := self.storage.GetItem(id); err != nil {
 		return err
 	}
 
-	account := UserAccount{
-		ID:       uint32(id),
-		Username: updateUserAccountRequest.Username,
-	}
-
-	if err := self.storage.UpdateUserAccount(&account); err != nil {
+	skus, err := self.storage.GetSKUs(id)
+	if err != nil {
 		return err
 	}
 
-	return WriteJSON(w, http.StatusOK, struct {
-		UpdatedAccount int32 `json:"updated_account"`
-	}{int32(id)})
+	return WriteJSON(w, http.StatusOK, skus)
 }
 
-func (self *APIServer) handleGetUserItems(w http.ResponseWriter, r *http.Request) error {
-	id, err := getID(r)
+func (self *APIServer) handleGetSKU(w http.ResponseWriter, r *http.Request) error {
+	id, err := getItemID(r)
 	if err != nil {
 		return err
 	}
 
-	account, err := self.storage.GetUserAccount(int32(id))
+	skuID, err := getSKUID(r)
 	if err != nil {
 		return err
 	}
 
-	items, total, err := self.storage.GetItemsById(account.Items)
+	sku, err := self.getItemSKU(id, skuID)
 	if err != nil {
 		return err
 	}
 
-	return WriteJSON(w, http.StatusOK, struct {
-		Items []*Item `json:"items"`
-		Total float64 `json:"total"`
-	}{items, total})
+	return WriteJSON(w, http.StatusOK, sku)
 }
 
-func (self *APIServer) handleAddItemToUserAccount(w http.ResponseWriter, r *http.Request) error {
-	id, err := getID(r)
+func (self *APIServer) handleUpdateSKU(w http.ResponseWriter, r *http.Request) error {
+	id, err := getItemID(r)
 	if err != nil {
 		return err
 	}
 
-	addItemRequest := new(AddItemRequest)
-	jsonDecoderHandle := json.NewDecoder(r.Body)
-	jsonDecoderHandle.DisallowUnknownFields()
-	if err := jsonDecoderHandle.Decode(&addItemRequest); err != nil {
+	skuID, err := getSKUID(r)
+	if err != nil {
 		return err
 	}
 
-	if err := self.storage.AddItemToUserAccount(id, addItemRequest.ItemID); err != nil {
+	updateSKURequest := new(UpdateSKURequest)
+	if err := decodeJSON(w, r, updateSKURequest); err != nil {
 		return err
 	}
 
-	return WriteJSON(w, http.StatusOK, struct {
-		AddedItem int32 `json:"added_item"`
-		Account   int32 `json:"account"`
-	}{addItemRequest.ItemID, id})
-}
-
-func (self *APIServer) handleRemoveItemFromUserAccount(w http.ResponseWriter, r *http.Request) error {
-	id, err := getID(r)
+	item, err := self.storage.GetItem(id)
 	if err != nil {
 		return err
 	}
 
-	removeItemRequest := new(RemoveItemRequest)
-	jsonDecoderHandle := json.NewDecoder(r.Body)
-	jsonDecoderHandle.DisallowUnknownFields()
-	if err := jsonDecoderHandle.Decode(&removeItemRequest); err != nil {
+	sku, err := self.getItemSKU(id, skuID)
+	if err != nil {
 		return err
 	}
 
-	if err := self.storage.RemoveItemFromUserAccount(id, removeItemRequest.ItemID); err != nil {
+	sku.Code = strings.TrimSpace(updateSKURequest.Code)
+	sku.Barcode = strings.TrimSpace(updateSKURequest.Barcode)
+
+	sku.PriceOverride = nil
+	if updateSKURequest.PriceOverride != nil {
+		price, err := updateSKURequest.PriceOverride.Normalize()
+		if err != nil {
+			return err
+		}
+
+		if price.Currency != item.Price.Currency {
+			return validationError("price_override", "SKU price must be in the item's currency %s, got %s", item.Price.Currency, price.Currency)
+		}
+
+		sku.PriceOverride = &price
+	}
+
+	if err := self.storage.UpdateSKU(sku); err != nil {
 		return err
 	}
 
-	return WriteJSON(w, http.StatusOK, struct {
-		AddedItem int32 `json:"removed_item"`
-		Account   int32 `json:"account"`
-	}{removeItemRequest.ItemID, id})
+	return WriteJSON(w, http.StatusOK, sku)
 }
 
-func (self *APIServer) handleCheckoutUserAccount(w http.ResponseWriter, r *http.Request) error {
-	id, err := getID(r)
+// getItemSKU loads a SKU and checks it belongs to the item in the route.
+func (self *APIServer) getItemSKU(itemID, skuID int32) (*SKU, error) {
+	sku, err := self.storage.GetSKU(skuID)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	account, err := self.storage.GetUserAccount(int32(id))
+	if sku.ItemID != itemID {
+		return nil, notFoundError("SKU %d of item %d not found", skuID, itemID)
+	}
+
+	return sku, nil
+}
+
+func (self *APIServer) handleGetItemStock(w http.ResponseWriter, r *http.Request) error {
+	id, err := getItemID(r)
 	if err != nil {
 		return err
 	}
 
-	_, total, err := self.storage.GetItemsById(account.Items)
+	skuID, err := getSKUID(r)
 	if err != nil {
 		return err
 	}
 
-	order := NewOrder(uint32(id), account.Items, total)
-	if err := self.storage.CreateOrder(order); err != nil {
+	item, err := self.storage.GetItem(id)
+	if err != nil {
 		return err
 	}
 
-	if err := self.storage.ClearUserItems(id); err != nil {
+	stock := item.Stock
+	if skuID != 0 {
+		sku, err := self.getItemSKU(id, skuID)
+		if err != nil {
+			return err
+		}
+
+		stock = sku.Stock
+	}
+
+	adjustments, err := self.storage.GetStockAdjustments(id)
+	if err != nil {
 		return err
 	}
 
+	// the item's history includes its SKUs; a SKU's only its own
+	if skuID != 0 {
+		kept := make([]*StockAdjustment, 0, len(adjustments))
+		for _, adjustment := range adjustments {
+			if adjustment.SKUID == skuID {
+				kept = append(kept, adjustment)
+			}
+		}
+		adjustments = kept
+	}
+
 	return WriteJSON(w, http.StatusOK, struct {
-		Order  *Order `json:"order"`
-		Status string `json:"status"`
-	}{order, "pending"})
+		ItemID      int32              `json:"item_id"`
+		SKUID       int32              `json:"sku_id,omitempty"`
+		Stock       int32              `json:"stock"`
+		Adjustments []*StockAdjustment `json:"adjustments"`
+	}{id, skuID, stock, adjustments})
 }
 
-func (self *APIServer) handleGetUserOrders(w http.ResponseWriter, r *http.Request) error {
-	id, err := getID(r)
+func (self *APIServer) handleSetItemStock(w http.ResponseWriter, r *http.Request) error {
+	adminID, err := getID(r)
 	if err != nil {
 		return err
 	}
 
-	account, err := self.storage.GetUserAccount(int32(id))
+	id, err := getItemID(r)
 	if err != nil {
 		return err
 	}
 
-	orders, err := self.storage.GetOrdersById(account.Orders)
+	skuID, err := getSKUID(r)
 	if err != nil {
 		return err
 	}
 
-	return WriteJSON(w, http.StatusOK, orders)
-}
+	setStockRequest := new(SetStockRequest)
+	if err := decodeJSON(w, r, setStockRequest); err != nil {
+		return err
+	}
 
-func (self *APIServer) handleGetItems(w http.ResponseWriter, r *http.Request) error {
-	items, err := self.storage.GetItems()
+	adjustment, err := self.storage.SetItemStock(id, skuID, setStockRequest.Stock, setStockRequest.Reason, adminID)
 	if err != nil {
 		return err
 	}
 
-	return WriteJSON(w, http.StatusOK, items)
+	return WriteJSON(w, http.StatusOK, adjustment)
 }
 
-func (self *APIServer) handleCreateItem(w http.ResponseWriter, r *http.Request) error {
-	createItemRequest := new(CreateItemRequest)
-	jsonDecoderHandle := json.NewDecoder(r.Body)
-	jsonDecoderHandle.DisallowUnknownFields()
-	if err := jsonDecoderHandle.Decode(&createItemRequest); err != nil {
+func (self *APIServer) handleAdjustItemStock(w http.ResponseWriter, r *http.Request) error {
+	adminID, err := getID(r)
+	if err != nil {
 		return err
 	}
 
-	item := NewItem(createItemRequest.Name, createItemRequest.Description, createItemRequest.Price)
-	if err := self.storage.CreateItem(item); err != nil {
+	id, err := getItemID(r)
+	if err != nil {
 		return err
 	}
 
-	return WriteJSON(w, http.StatusOK, item)
-}
+	skuID, err := getSKUID(r)
+	if err != nil {
+		return err
+	}
 
-func (self *APIServer) handleDeleteItem(w http.ResponseWriter, r *http.Request) error {
-	deleteItemRequest := new(DeleteItemRequest)
-	jsonDecoderHandle := json.NewDecoder(r.Body)
-	jsonDecoderHandle.DisallowUnknownFields()
-	if err := jsonDecoderHandle.Decode(&deleteItemRequest); err != nil {
+	adjustStockRequest := new(AdjustStockRequest)
+	if err := decodeJSON(w, r, adjustStockRequest); err != nil {
 		return err
 	}
 
-	if err := self.storage.DeleteItem(deleteItemRequest.ID); err != nil {
+	adjustment, err := self.storage.AdjustItemStock(id, skuID, adjustStockRequest.Delta, adjustStockRequest.Reason, adminID)
+	if err != nil {
 		return err
 	}
 
-	return WriteJSON(w, http.StatusOK, struct {
-		DeletedItem int32 `json:"deleted_item"`
-	}{deleteItemRequest.ID})
+	return WriteJSON(w, http.StatusOK, adjustment)
 }
 
-func (self *APIServer) handleGetItem(w http.ResponseWriter, r *http.Request) error {
-	id, err := getItemID(r)
+func (self *APIServer) handleGetOrders(w http.ResponseWriter, r *http.Request) error {
+	filter, err := parseOrderFilter(r)
 	if err != nil {
 		return err
 	}
 
-	item, err := self.storage.GetItem(int32(id))
+	page, err := self.storage.GetOrders(filter)
 	if err != nil {
 		return err
 	}
 
-	return WriteJSON(w, http.StatusOK, item)
+	return WriteJSON(w, http.StatusOK, page)
 }
 
-func (self *APIServer) handleUpdateItem(w http.ResponseWriter, r *http.Request) error {
-	id, err := getItemID(r)
+func (self *APIServer) handleCreateOrder(w http.ResponseWriter, r *http.Request) error {
+	adminID, err := getID(r)
 	if err != nil {
 		return err
 	}
 
-	updateItemRequest := new(UpdateItemRequest)
-	jsonDecoderHandle := json.NewDecoder(r.Body)
-	jsonDecoderHandle.DisallowUnknownFields()
-	if err := jsonDecoderHandle.Decode(&updateItemRequest); err != nil {
+	createOrderRequest := new(CreateOrderRequest)
+	if err := decodeJSON(w, r, createOrderRequest); err != nil {
 		return err
 	}
 
-	item := Item{
-		ID:          uint32(id),
-		Name:        updateItemRequest.Name,
-		Description: updateItemRequest.Description,
-		Price:       updateItemRequest.Price,
+	keys := make([]cartKey, 0, len(createOrderRequest.Items)+len(createOrderRequest.SKUs))
+	for _, itemID := range createOrderRequest.Items {
+		keys = append(keys, cartKey{itemID: itemID})
 	}
 
-	if err := self.storage.UpdateItem(&item); err != nil {
-		return err
-	}
+	for _, skuID := range createOrderRequest.SKUs {
+		sku, err := self.storage.GetSKU(skuID)
+		if errors.Is(err, errNotFound) {
+			return validationError("skus", "SKU %d not found", skuID)
+		}
+		if err != nil {
+			return err
+		}
 
-	return WriteJSON(w, http.StatusOK, struct {
-		UpdatedItem int32 `json:"updated_item"`
-	}{int32(id)})
-}
+		keys = append(keys, cartKey{itemID: sku.ItemID, skuID: skuID})
+	}
 
-func (self *APIServer) handleGetOrders(w http.ResponseWriter, r *http.Request) error {
-	orders, err := self.storage.GetOrders()
+	lines, err := buildOrderLines(self.storage, countItems(keys))
 	if err != nil {
 		return err
 	}
 
-	return WriteJSON(w, http.StatusOK, orders)
-}
+	byKey := make(map[cartKey]*OrderLine, len(lines))
+	for _, line := range lines {
+		byKey[cartKey{line.ItemID, line.SKUID}] = line
+	}
 
-func (self *APIServer) handleCreateOrder(w http.ResponseWriter, r *http.Request) error {
-	createOrderRequest := new(CreateOrderRequest)
-	jsonDecoderHandle := json.NewDecoder(r.Body)
-	jsonDecoderHandle.DisallowUnknownFields()
-	if err := jsonDecoderHandle.Decode(&createOrderRequest); err != nil {
+	for _, key := range keys {
+		if _, ok := byKey[key]; !ok {
+			return validationError("items", "Item %d not found", key.itemID)
+		}
+	}
+
+	for _, override := range createOrderRequest.PriceOverrides {
+		line, ok := byKey[cartKey{override.ItemID, override.SKUID}]
+		if !ok {
+			return validationError("price_overrides", "Price override for %s does not match an ordered item", stockLabel(override.ItemID, override.SKUID))
+		}
+
+		if line.ListPrice != nil {
+			return validationError("price_overrides", "Price for %s is overridden more than once", stockLabel(override.ItemID, override.SKUID))
+		}
+
+		if err := line.Override(override.UnitPrice, override.Reason, adminID); err != nil {
+			return err
+		}
+	}
+
+	order, err := NewOrder(uint32(createOrderRequest.AccountID), lines)
+	if err != nil {
 		return err
 	}
 
-	order := NewOrder(uint32(createOrderRequest.AccountID), createOrderRequest.Items, createOrderRequest.Total)
 	if err := self.storage.CreateOrder(order); err != nil {
 		return err
 	}
@@ -728,9 +2445,7 @@ func (self *APIServer) handleCreateOrder(w http.ResponseWriter, r *http.Request)
 
 func (self *APIServer) handleDeleteOrder(w http.ResponseWriter, r *http.Request) error {
 	deleteOrderRequest := new(DeleteOrderRequest)
-	jsonDecoderHandle := json.NewDecoder(r.Body)
-	jsonDecoderHandle.DisallowUnknownFields()
-	if err := jsonDecoderHandle.Decode(&deleteOrderRequest); err != nil {
+	if err := decodeJSON(w, r, deleteOrderRequest); err != nil {
 		return err
 	}
 
@@ -754,45 +2469,88 @@ func (self *APIServer) handleGetOrder(w http.ResponseWriter, r *http.Request) er
 		return err
 	}
 
+	if order.History, err = self.storage.GetOrderStatusHistory(id); err != nil {
+		return err
+	}
+
 	return WriteJSON(w, http.StatusOK, order)
 }
 
+// buildOrderLines snapshots the cart items, as currently priced, into order
+// lines.
+func buildOrderLines(storage Storage, cartItems []*CartItem) ([]*OrderLine, error) {
+	cartLines, _, err := storage.GetItemsById(cartItems)
+	if err != nil {
+		return nil, err
+	}
+
+	lines := make([]*OrderLine, 0, len(cartLines))
+	for _, cartLine := range cartLines {
+		line, err := NewOrderLine(cartLine.Item, cartLine.SKU, cartLine.Quantity)
+		if err != nil {
+			return nil, err
+		}
+
+		lines = append(lines, line)
+	}
+
+	return lines, nil
+}
+
+// countItems turns a list of items and SKUs into cart items, counting a
+// repeat as another unit of the same line.
+func countItems(keys []cartKey) []*CartItem {
+	cartItems := make([]*CartItem, 0)
+	byKey := make(map[cartKey]*CartItem)
+	for _, key := range keys {
+		if cartItem, ok := byKey[key]; ok {
+			cartItem.Quantity++
+			continue
+		}
+
+		cartItem := &CartItem{ItemID: key.itemID, SKUID: key.skuID, Quantity: 1}
+		byKey[key] = cartItem
+		cartItems = append(cartItems, cartItem)
+	}
+
+	return cartItems
+}
+
 func getID(r *http.Request) (int32, error) {
 	idStr := mux.Vars(r)["id"]
 
 	id, err := strconv.Atoi(idStr)
 	if err != nil {
-		return 0, fmt.Errorf("Invalid id: \"%s\"", idStr)
+		return 0, badRequestError("Invalid id: \"%s\"", idStr)
 	}
 
 	return int32(id), nil
 }
 
 func (self *APIServer) handleUpdateOrder(w http.ResponseWriter, r *http.Request) error {
-	id, err := getOrderID(r)
+	adminID, err := getID(r)
 	if err != nil {
 		return err
 	}
 
-	updateOrderRequest := new(UpdateOrderRequest)
-	jsonDecoderHandle := json.NewDecoder(r.Body)
-	jsonDecoderHandle.DisallowUnknownFields()
-	if err := jsonDecoderHandle.Decode(&updateOrderRequest); err != nil {
+	id, err := getOrderID(r)
+	if err != nil {
 		return err
 	}
 
-	order := Order{
-		ID:     uint32(id),
-		Status: updateOrderRequest.Status,
+	updateOrderRequest := new(UpdateOrderRequest)
+	if err := decodeJSON(w, r, updateOrderRequest); err != nil {
+		return err
 	}
 
-	if err := self.storage.UpdateOrder(&order); err != nil {
+	if err := self.storage.UpdateOrderStatus(id, updateOrderRequest.Status, adminID); err != nil {
 		return err
 	}
 
 	return WriteJSON(w, http.StatusOK, struct {
-		UpdatedOrder int32 `json:"updated_order"`
-	}{int32(id)})
+		UpdatedOrder int32       `json:"updated_order"`
+		Status       OrderStatus `json:"status"`
+	}{id, updateOrderRequest.Status})
 }
 
 func getItemID(r *http.Request) (int32, error) {
@@ -800,7 +2558,7 @@ func getItemID(r *http.Request) (int32, error) {
 
 	id, err := strconv.Atoi(idStr)
 	if err != nil {
-		return 0, fmt.Errorf("Invalid id: \"%s\"", idStr)
+		return 0, badRequestError("Invalid id: \"%s\"", idStr)
 	}
 
 	return int32(id), nil
@@ -811,7 +2569,56 @@ func getOrderID(r *http.Request) (int32, error) {
 
 	id, err := strconv.Atoi(idStr)
 	if err != nil {
-		return 0, fmt.Errorf("Invalid id: \"%s\"", idStr)
+		return 0, badRequestError("Invalid id: \"%s\"", idStr)
+	}
+
+	return int32(id), nil
+}
+
+// getSKUID returns zero on routes without a SKU, which address the item's own
+// stock.
+func getSKUID(r *http.Request) (int32, error) {
+	idStr, ok := mux.Vars(r)["sku_id"]
+	if !ok {
+		return 0, nil
+	}
+
+	id, err := strconv.Atoi(idStr)
+	if err != nil {
+		return 0, badRequestError("Invalid id: \"%s\"", idStr)
+	}
+
+	return int32(id), nil
+}
+
+func getImageID(r *http.Request) (int32, error) {
+	idStr := mux.Vars(r)["image_id"]
+
+	id, err := strconv.Atoi(idStr)
+	if err != nil {
+		return 0, badRequestError("Invalid id: \"%s\"", idStr)
+	}
+
+	return int32(id), nil
+}
+
+func getKeyID(r *http.Request) (int32, error) {
+	idStr := mux.Vars(r)["key_id"]
+
+	id, err := strconv.Atoi(idStr)
+	if err != nil {
+		return 0, badRequestError("Invalid id: \"%s\"", idStr)
+	}
+
+	return int32(id), nil
+}
+
+func getCategoryID(r *http.Request) (int32, error) {
+	idStr := mux.Vars(r)["category_id"]
+
+	id, err := strconv.Atoi(idStr)
+	if err != nil {
+		return 0, badRequestError("Invalid id: \"%s\"", idStr)
 	}
 
 	return int32(id), nil
@@ -827,117 +2634,70 @@ func WriteJSON(w http.ResponseWriter, status int, v any) error {
 func makeHTTPHandlerFunc(f apiFunc) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		defer func(start time.Time) {
-			log.Printf("REQUEST: %s %s STATUS: %s DURATION: %s\n", r.Method, r.URL.Path, w.Header().Get("Status"), time.Since(start))
+			log.Printf("REQUEST: %s %s STATUS: %s REQUEST_ID: %s DURATION: %s\n", r.Method, r.URL.Path, w.Header().Get("Status"), requestIDFrom(r), time.Since(start))
 		}(time.Now())
 
 		if err := f(w, r); err != nil {
-			WriteJSON(w, http.StatusBadRequest, ApiError{Error: err.Error()})
+			writeError(w, r, err)
 		}
 	}
 }
 
-func validateJWT(token string) (*jwt.Token, error) {
-	envSecret := os.Getenv("JWT_SECRET")
-
-	return jwt.Parse(token, func(token *jwt.Token) (any, error) {
-		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
-			return nil, fmt.Errorf("Unexpected signing method: %v", token.Header["alg"])
-		}
+// sessionAllows checks that the token's session is still active and belongs
+// to the account the token was issued for, so logging out or a revoked token
+// family cuts off access tokens that have not expired yet.
+func sessionAllows(storage Storage, sessionID string, kind SessionKind, id int32) bool {
+	session, err := storage.GetSession(sessionID)
+	if err != nil {
+		return false
+	}
 
-		return []byte(envSecret), nil
-	})
+	return session.Active() && session.Kind == kind && session.AccountID == id
 }
 
-func withJWTAdminAuth(handler http.HandlerFunc, storage Storage) http.HandlerFunc {
+// withJWTAdminAuth also enforces the route's permissions. The role in the
+// token has to match the admin's current one, so a changed role takes effect
+// at the next refresh rather than when the old token expires.
+func withJWTAdminAuth(handler http.HandlerFunc, storage Storage, access adminAccess) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		authHeader := r.Header.Get("Authorization")
-		splitToken := strings.Split(authHeader, "Bearer ")
-		if len(splitToken) != 2 {
-			WriteJSON(w, http.StatusUnauthorized, ApiError{Error: "Unauthorized"})
+		principal, ok := authenticate(w, r, storage, AdminSession)
+		if !ok {
 			return
 		}
-		tokenString := splitToken[1]
-
-		token, err := validateJWT(tokenString)
-		if err != nil || !token.Valid {
-			WriteJSON(w, http.StatusUnauthorized, ApiError{Error: "Unauthorized"})
-			return
-		}
-
-		claims := token.Claims.(jwt.MapClaims)
 
-		id, err := getID(r)
-		if err != nil {
-			WriteJSON(w, http.StatusBadRequest, ApiError{Error: err.Error()})
+		if access.sessionOnly && principal.APIKeyID != 0 {
+			writeError(w, r, forbiddenError("API keys cannot be used here; log in instead"))
 			return
 		}
 
-		if claimId := int32(claims["id"].(float64)); claimId != id {
-			WriteJSON(w, http.StatusUnauthorized, ApiError{Error: "Unauthorized"})
+		if !principal.can(access.permission(r.Method)) {
+			writeError(w, r, forbiddenError("Forbidden"))
 			return
 		}
 
-		account, err := storage.GetAdminAccount(id)
-		if err != nil {
-			WriteJSON(w, http.StatusUnauthorized, ApiError{Error: "Unauthorized"})
+		if mfaRequired() && !principal.MFAEnabled && !access.withoutMFA {
+			writeError(w, r, forbiddenError("Two-factor authentication must be enabled for this account"))
 			return
 		}
 
-		if account.Username != claims["username"] {
-			WriteJSON(w, http.StatusUnauthorized, ApiError{Error: "Unauthorized"})
-			return
+		if principal.APIKeyID != 0 {
+			if err := storage.RecordAPIKeyUse(principal.APIKeyID); err != nil {
+				writeError(w, r, err)
+				return
+			}
 		}
 
-		handler(w, r)
+		handler(w, withPrincipal(r, principal))
 	}
 }
 
 func withJWTUserAuth(handler http.HandlerFunc, storage Storage) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		authHeader := r.Header.Get("Authorization")
-		splitToken := strings.Split(authHeader, "Bearer ")
-		if len(splitToken) != 2 {
-			WriteJSON(w, http.StatusUnauthorized, ApiError{Error: "Unauthorized"})
-			return
-		}
-		tokenString := splitToken[1]
-
-		token, err := validateJWT(tokenString)
-		if err != nil || !token.Valid {
-			WriteJSON(w, http.StatusUnauthorized, ApiError{Error: "Unauthorized"})
-			return
-		}
-
-		claims := token.Claims.(jwt.MapClaims)
-
-		// verify that the user id in the url path matches the user id in the Token
-		id, err := getID(r)
-		if err != nil {
-			WriteJSON(w, http.StatusBadRequest, ApiError{Error: err.Error()})
-			return
-		}
-
-		if claimId := int32(claims["id"].(float64)); claimId != id {
-			WriteJSON(w, http.StatusUnauthorized, ApiError{Error: "Unauthorized"})
-			return
-		}
-
-		account, err := storage.GetUserAccount(id)
-		if err != nil {
-			WriteJSON(w, http.StatusUnauthorized, ApiError{Error: "Unauthorized"})
-			return
-		}
-
-		if account.Username != claims["username"] {
-			WriteJSON(w, http.StatusUnauthorized, ApiError{Error: "Unauthorized"})
-			return
-		}
-
-		if int64(claims["exp"].(float64)) < time.Now().Unix() {
-			WriteJSON(w, http.StatusUnauthorized, ApiError{Error: "Unauthorized"})
+		principal, ok := authenticate(w, r, storage, UserSession)
+		if !ok {
 			return
 		}
 
-		handler(w, r)
+		handler(w, withPrincipal(r, principal))
 	}
 }
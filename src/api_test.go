@@ -0,0 +1,459 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// testServer is the API over a fresh MemoryStorage, served by httptest.
+type testServer struct {
+	*httptest.Server
+	t       *testing.T
+	storage *MemoryStorage
+	mailer  *captureMailer
+}
+
+func newTestServer(t *testing.T) *testServer {
+	t.Helper()
+
+	t.Setenv("ROOT_USER", "root")
+	t.Setenv("ROOT_PASS", "rootpassword")
+	t.Setenv("JWT_SECRET", "test-secret")
+	t.Setenv("TRUST_PROXY", "")
+
+	storage := NewMemoryStorage()
+	if err := storage.Init(); err != nil {
+		t.Fatal(err)
+	}
+
+	blobs, err := NewLocalBlobStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mailer := new(captureMailer)
+
+	server := httptest.NewServer(NewAPIServer("", storage, blobs, mailer).Handler())
+	t.Cleanup(server.Close)
+
+	return &testServer{Server: server, t: t, storage: storage, mailer: mailer}
+}
+
+// captureMailer keeps every message it is asked to send.
+type captureMailer struct {
+	mu       sync.Mutex
+	messages []*Message
+}
+
+func (self *captureMailer) Send(message *Message) error {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+
+	self.messages = append(self.messages, message)
+	return nil
+}
+
+// last returns the latest message sent to the address, or nil.
+func (self *captureMailer) last(to string) *Message {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+
+	for i := len(self.messages) - 1; i >= 0; i-- {
+		if self.messages[i].To == to {
+			return self.messages[i]
+		}
+	}
+
+	return nil
+}
+
+// request sends body as JSON and decodes the response into out, when out is
+// not nil. The returned response's body has already been read and closed.
+func (self *testServer) request(method, path, token string, body, out any) *http.Response {
+	self.t.Helper()
+
+	res, raw, err := self.send(method, path, token, body)
+	if err != nil {
+		self.t.Fatalf("%s %s: %s", method, path, err)
+	}
+
+	if out != nil {
+		if err := json.Unmarshal(raw, out); err != nil {
+			self.t.Fatalf("%s %s: decoding %q: %s", method, path, raw, err)
+		}
+	}
+
+	return res
+}
+
+// send is request without the test helpers, for use from other goroutines.
+// The token is an access token or an API key.
+func (self *testServer) send(method, path, token string, body any) (*http.Response, []byte, error) {
+	var reader io.Reader
+	switch body := body.(type) {
+	case nil:
+	case string:
+		reader = strings.NewReader(body)
+	default:
+		encoded, err := json.Marshal(body)
+		if err != nil {
+			return nil, nil, err
+		}
+		reader = bytes.NewReader(encoded)
+	}
+
+	req, err := http.NewRequest(method, self.URL+path, reader)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	switch {
+	case strings.HasPrefix(token, apiKeyPrefix):
+		req.Header.Set("X-API-Key", token)
+	case token != "":
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	res, err := self.Client().Do(req)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer res.Body.Close()
+
+	raw, err := io.ReadAll(res.Body)
+	return res, raw, err
+}
+
+func (self *testServer) expect(res *http.Response, status int) {
+	self.t.Helper()
+
+	if res.StatusCode != status {
+		self.t.Fatalf("%s %s: got status %d, want %d", res.Request.Method, res.Request.URL.Path, res.StatusCode, status)
+	}
+}
+
+func (self *testServer) login(path string, request LoginRequest) *TokenPair {
+	self.t.Helper()
+
+	tokens := new(TokenPair)
+	self.expect(self.request("POST", path, "", request, tokens), http.StatusOK)
+
+	return tokens
+}
+
+func (self *testServer) adminLogin() string {
+	self.t.Helper()
+
+	return self.login("/admin/login", LoginRequest{Username: "root", Password: "rootpassword"}).AuthToken
+}
+
+// signup creates a user, verifies their email with the link they were sent
+// and logs them in.
+func (self *testServer) signup(username string) (int32, *TokenPair) {
+	self.t.Helper()
+
+	account := new(UserAccount)
+	res := self.request("POST", "/user/signup", "", CreateAccountRequest{
+		Username: username,
+		Password: username + "-password",
+		Email:    username + "@example.com",
+	}, account)
+	self.expect(res, http.StatusOK)
+
+	self.verifyEmail(account.Email)
+
+	return int32(account.ID), self.login("/user/login", LoginRequest{Username: username, Password: username + "-password"})
+}
+
+// verifyEmail follows the link in the latest verification email to address.
+func (self *testServer) verifyEmail(address string) {
+	self.t.Helper()
+
+	message := self.mailer.last(address)
+	if message == nil {
+		self.t.Fatalf("no verification email sent to %s", address)
+	}
+
+	start := strings.Index(message.Body, "/user/verify?")
+	if start < 0 {
+		self.t.Fatalf("no verification link in %q", message.Body)
+	}
+	link := strings.Fields(message.Body[start:])[0]
+
+	self.expect(self.request("GET", link, "", nil, nil), http.StatusOK)
+}
+
+// createItem adds an item with stock to the catalog.
+func (self *testServer) createItem(adminToken, name string, price int64, stock int32) int32 {
+	self.t.Helper()
+
+	item := new(Item)
+	res := self.request("POST", "/admin/1/items", adminToken, CreateItemRequest{Name: name, Price: Money{Amount: price}}, item)
+	self.expect(res, http.StatusOK)
+
+	path := fmt.Sprintf("/admin/1/items/%d/stock", item.ID)
+	res = self.request("PUT", path, adminToken, SetStockRequest{Stock: stock, Reason: "Initial count"}, nil)
+	self.expect(res, http.StatusOK)
+
+	return int32(item.ID)
+}
+
+func TestMemoryStorageServesAPI(t *testing.T) {
+	server := newTestServer(t)
+	adminToken := server.adminLogin()
+	shirtID := server.createItem(adminToken, "Shirt", 1000, 5)
+	hatID := server.createItem(adminToken, "Hat", 2000, 5)
+
+	userID, tokens := server.signup("bob")
+	cartPath := fmt.Sprintf("/user/%d/cart", userID)
+	server.expect(server.request("POST", cartPath, tokens.AuthToken, AddItemRequest{ItemID: shirtID, Quantity: 2}, nil), http.StatusOK)
+	server.expect(server.request("POST", cartPath, tokens.AuthToken, AddItemRequest{ItemID: hatID}, nil), http.StatusOK)
+
+	cart := new(Cart)
+	server.expect(server.request("GET", cartPath, tokens.AuthToken, nil, cart), http.StatusOK)
+	if len(cart.Lines) != 2 || cart.Total.Amount != 4000 {
+		t.Fatalf("got %d lines totalling %s, want 2 totalling 4000", len(cart.Lines), cart.Total)
+	}
+
+	// every server starts from nothing but the root admin
+	other := newTestServer(t)
+	items := new(Page[*Item])
+	other.expect(other.request("GET", "/items", "", nil, items), http.StatusOK)
+	if len(items.Data) != 0 {
+		t.Fatalf("got %d items on a fresh server, want none", len(items.Data))
+	}
+}
+
+func TestMemoryStorageRejectsBadLogins(t *testing.T) {
+	server := newTestServer(t)
+	userID, tokens := server.signup("bob")
+
+	res := server.request("POST", "/user/login", "", LoginRequest{Username: "bob", Password: "wrong-password"}, nil)
+	if res.StatusCode == http.StatusOK {
+		t.Fatal("logged in with the wrong password")
+	}
+
+	res = server.request("POST", "/user/login", "", LoginRequest{Username: "ghost", Password: "ghost-password"}, nil)
+	if res.StatusCode == http.StatusOK {
+		t.Fatal("logged in as an unknown user")
+	}
+
+	// a token only opens its own account
+	otherID, _ := server.signup("amy")
+	server.expect(server.request("GET", fmt.Sprintf("/user/%d", otherID), tokens.AuthToken, nil, nil), http.StatusUnauthorized)
+	server.expect(server.request("GET", fmt.Sprintf("/user/%d", userID), tokens.AuthToken, nil, nil), http.StatusOK)
+}
+
+func TestCheckoutConcurrentRequests(t *testing.T) {
+	server := newTestServer(t)
+	adminToken := server.adminLogin()
+	shirtID := server.createItem(adminToken, "Shirt", 1000, 5)
+	hatID := server.createItem(adminToken, "Hat", 2000, 5)
+
+	userID, tokens := server.signup("bob")
+	cartPath := fmt.Sprintf("/user/%d/cart", userID)
+	server.expect(server.request("POST", cartPath, tokens.AuthToken, AddItemRequest{ItemID: shirtID}, nil), http.StatusOK)
+	server.expect(server.request("POST", cartPath, tokens.AuthToken, AddItemRequest{ItemID: hatID}, nil), http.StatusOK)
+
+	const attempts = 10
+
+	statuses := make(chan int, attempts)
+	var wg sync.WaitGroup
+	for i := 0; i < attempts; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			res, _, err := server.send("POST", fmt.Sprintf("/user/%d/checkout", userID), tokens.AuthToken, nil)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			statuses <- res.StatusCode
+		}()
+	}
+	wg.Wait()
+	close(statuses)
+
+	counts := make(map[int]int)
+	for status := range statuses {
+		counts[status]++
+	}
+
+	// the losers find the cart already emptied by the winner
+	if counts[http.StatusOK] != 1 || counts[http.StatusConflict] != attempts-1 {
+		t.Fatalf("got statuses %v, want one %d and %d %d", counts, http.StatusOK, attempts-1, http.StatusConflict)
+	}
+
+	var orders []*Order
+	server.expect(server.request("GET", fmt.Sprintf("/user/%d/orders", userID), tokens.AuthToken, nil, &orders), http.StatusOK)
+	if len(orders) != 1 || orders[0].Total.Amount != 3000 {
+		t.Fatalf("got orders %+v, want one totalling 3000", orders)
+	}
+
+	cart := new(Cart)
+	server.expect(server.request("GET", cartPath, tokens.AuthToken, nil, cart), http.StatusOK)
+	if len(cart.Lines) != 0 {
+		t.Fatalf("got %d lines in the cart after checkout, want none", len(cart.Lines))
+	}
+
+	var stock struct {
+		Stock int32 `json:"stock"`
+	}
+	server.expect(server.request("GET", fmt.Sprintf("/admin/1/items/%d/stock", shirtID), adminToken, nil, &stock), http.StatusOK)
+	if stock.Stock != 4 {
+		t.Fatalf("got stock %d after checkout, want 4", stock.Stock)
+	}
+}
+
+func TestUpdateOrderStatus(t *testing.T) {
+	server := newTestServer(t)
+	adminToken := server.adminLogin()
+	itemID := server.createItem(adminToken, "Shirt", 1000, 5)
+
+	userID, tokens := server.signup("bob")
+	server.expect(server.request("POST", fmt.Sprintf("/user/%d/cart", userID), tokens.AuthToken, AddItemRequest{ItemID: itemID}, nil), http.StatusOK)
+
+	var checkout struct {
+		Order *Order `json:"order"`
+	}
+	server.expect(server.request("POST", fmt.Sprintf("/user/%d/checkout", userID), tokens.AuthToken, nil, &checkout), http.StatusOK)
+
+	orderPath := fmt.Sprintf("/admin/1/orders/%d", checkout.Order.ID)
+
+	steps := []struct {
+		status OrderStatus
+		want   int
+		code   ErrorCode
+	}{
+		{OrderStatusShipped, http.StatusConflict, CodeConflict},
+		{"lost", http.StatusUnprocessableEntity, CodeValidationFailed},
+		{OrderStatusPaid, http.StatusOK, ""},
+		{OrderStatusPaid, http.StatusConflict, CodeConflict},
+		{OrderStatusFulfilled, http.StatusOK, ""},
+		{OrderStatusShipped, http.StatusOK, ""},
+		{OrderStatusCancelled, http.StatusConflict, CodeConflict},
+		{OrderStatusDelivered, http.StatusOK, ""},
+		{OrderStatusRefunded, http.StatusOK, ""},
+		{OrderStatusPending, http.StatusConflict, CodeConflict},
+	}
+
+	for _, step := range steps {
+		apiErr := new(ApiError)
+		res := server.request("PUT", orderPath, adminToken, UpdateOrderRequest{Status: step.status}, apiErr)
+		if res.StatusCode != step.want || apiErr.Code != step.code {
+			t.Fatalf("moving to %s: got %d %q, want %d %q", step.status, res.StatusCode, apiErr.Code, step.want, step.code)
+		}
+	}
+
+	order := new(Order)
+	server.expect(server.request("GET", orderPath, adminToken, nil, order), http.StatusOK)
+
+	want := []OrderStatus{OrderStatusPending, OrderStatusPaid, OrderStatusFulfilled, OrderStatusShipped, OrderStatusDelivered, OrderStatusRefunded}
+	if order.Status != OrderStatusRefunded || len(order.History) != len(want) {
+		t.Fatalf("got status %s with %d history entries, want %s with %d", order.Status, len(order.History), OrderStatusRefunded, len(want))
+	}
+
+	for i, change := range order.History {
+		if change.ToStatus != want[i] {
+			t.Errorf("history entry %d: got %s, want %s", i, change.ToStatus, want[i])
+		}
+	}
+}
+
+func TestCreateOrderUnknownSKU(t *testing.T) {
+	server := newTestServer(t)
+	adminToken := server.adminLogin()
+	userID, _ := server.signup("bob")
+
+	apiErr := new(ApiError)
+	res := server.request("POST", "/admin/1/orders", adminToken, CreateOrderRequest{AccountID: userID, SKUs: []int32{99}}, apiErr)
+	server.expect(res, http.StatusUnprocessableEntity)
+	if apiErr.Code != CodeValidationFailed || apiErr.Fields["skus"] == "" {
+		t.Fatalf("got %+v, want a validation error on skus", apiErr)
+	}
+}
+
+func TestCheckoutStaleCart(t *testing.T) {
+	server := newTestServer(t)
+	adminToken := server.adminLogin()
+	shirtID := server.createItem(adminToken, "Shirt", 1000, 5)
+	hatID := server.createItem(adminToken, "Hat", 2000, 5)
+
+	userID, tokens := server.signup("bob")
+	cartPath := fmt.Sprintf("/user/%d/cart", userID)
+	checkoutPath := fmt.Sprintf("/user/%d/checkout", userID)
+	server.expect(server.request("POST", cartPath, tokens.AuthToken, AddItemRequest{ItemID: shirtID}, nil), http.StatusOK)
+	server.expect(server.request("POST", cartPath, tokens.AuthToken, AddItemRequest{ItemID: hatID}, nil), http.StatusOK)
+
+	// an item deleted while the cart still holds it, as a delete racing a
+	// checkout would leave things
+	delete(server.storage.data.items, uint32(hatID))
+
+	apiErr := new(ApiError)
+	server.expect(server.request("POST", checkoutPath, tokens.AuthToken, nil, apiErr), http.StatusConflict)
+	if want := fmt.Sprintf("item %d", hatID); apiErr.Code != CodeConflict || !strings.Contains(apiErr.Error, want) {
+		t.Fatalf("got %+v, want a conflict naming %s", apiErr, want)
+	}
+
+	delete(server.storage.data.items, uint32(shirtID))
+	server.expect(server.request("POST", checkoutPath, tokens.AuthToken, nil, nil), http.StatusConflict)
+
+	var orders []*Order
+	server.expect(server.request("GET", fmt.Sprintf("/user/%d/orders", userID), tokens.AuthToken, nil, &orders), http.StatusOK)
+	if len(orders) != 0 {
+		t.Fatalf("got orders %+v, want none", orders)
+	}
+
+	if cartItems := server.storage.data.carts[uint32(userID)]; len(cartItems) != 2 {
+		t.Fatalf("got %d cart items after failed checkouts, want both kept", len(cartItems))
+	}
+}
+
+func TestSetItemCategoriesUnknownCategory(t *testing.T) {
+	server := newTestServer(t)
+	adminToken := server.adminLogin()
+	itemID := server.createItem(adminToken, "Shirt", 1000, 5)
+
+	category := new(Category)
+	server.expect(server.request("POST", "/admin/1/categories", adminToken, CreateCategoryRequest{Name: "Tops"}, category), http.StatusOK)
+
+	path := fmt.Sprintf("/admin/1/items/%d/categories", itemID)
+	apiErr := new(ApiError)
+	res := server.request("PUT", path, adminToken, SetItemCategoriesRequest{CategoryIDs: []int32{int32(category.ID), 99}}, apiErr)
+	server.expect(res, http.StatusUnprocessableEntity)
+	if apiErr.Code != CodeValidationFailed || apiErr.Fields["category_ids"] == "" {
+		t.Fatalf("got %+v, want a validation error on category_ids", apiErr)
+	}
+
+	server.expect(server.request("PUT", path, adminToken, SetItemCategoriesRequest{CategoryIDs: []int32{int32(category.ID)}}, nil), http.StatusOK)
+}
+
+func TestCreateOrderOverrideOverflow(t *testing.T) {
+	server := newTestServer(t)
+	adminToken := server.adminLogin()
+	itemID := server.createItem(adminToken, "Shirt", 1000, 5)
+	userID, _ := server.signup("bob")
+
+	request := CreateOrderRequest{
+		AccountID: userID,
+		Items:     []int32{itemID, itemID},
+		PriceOverrides: []*PriceOverride{
+			{ItemID: itemID, UnitPrice: Money{Amount: math.MaxInt64/2 + 1}, Reason: "Typo"},
+		},
+	}
+
+	apiErr := new(ApiError)
+	server.expect(server.request("POST", "/admin/1/orders", adminToken, request, apiErr), http.StatusUnprocessableEntity)
+	if apiErr.Fields["price_overrides"] == "" {
+		t.Fatalf("got %+v, want a validation error on price_overrides", apiErr)
+	}
+}
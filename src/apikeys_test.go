@@ -0,0 +1,131 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+)
+
+type createdAPIKey struct {
+	APIKey
+	Key string `json:"key"`
+}
+
+func (self *testServer) createAPIKey(adminID int32, token string, scopes ...Permission) *createdAPIKey {
+	self.t.Helper()
+
+	key := new(createdAPIKey)
+	path := fmt.Sprintf("/admin/%d/keys", adminID)
+	self.expect(self.request("POST", path, token, CreateAPIKeyRequest{Name: "script", Scopes: scopes}, key), http.StatusOK)
+
+	return key
+}
+
+func TestAPIKeyScopes(t *testing.T) {
+	server := newTestServer(t)
+	ownerToken := server.adminLogin()
+	key := server.createAPIKey(1, ownerToken, PermCatalogRead)
+
+	server.expect(server.request("GET", "/admin/1/items", key.Key, nil, nil), http.StatusOK)
+	server.expect(server.request("POST", "/admin/1/items", key.Key, CreateItemRequest{Name: "Hat", Price: Money{Amount: 2000}}, nil), http.StatusForbidden)
+	server.expect(server.request("GET", "/admin/1/users", key.Key, nil, nil), http.StatusForbidden)
+
+	// keys cannot manage keys, passwords or two-factor authentication
+	server.expect(server.request("GET", "/admin/1/keys", key.Key, nil, nil), http.StatusForbidden)
+	server.expect(server.request("POST", "/admin/1/mfa", key.Key, nil, nil), http.StatusForbidden)
+
+	// a key only acts as the admin that made it
+	otherID, _ := server.createAdmin(ownerToken, "max", RoleManager)
+	server.expect(server.request("GET", fmt.Sprintf("/admin/%d/items", otherID), key.Key, nil, nil), http.StatusUnauthorized)
+
+	server.expect(server.request("GET", "/admin/1/items", apiKeyPrefix+"not-a-key", nil, nil), http.StatusUnauthorized)
+
+	var keys []*APIKey
+	server.expect(server.request("GET", "/admin/1/keys", ownerToken, nil, &keys), http.StatusOK)
+	if len(keys) != 1 || keys[0].LastUsedAt == nil || keys[0].Prefix != key.Key[:len(key.Prefix)] {
+		t.Fatalf("got keys %+v, want the one key, marked used", keys)
+	}
+}
+
+func TestAPIKeyFollowsRole(t *testing.T) {
+	server := newTestServer(t)
+	ownerToken := server.adminLogin()
+	catalogID, catalogToken := server.createAdmin(ownerToken, "carol", RoleCatalog)
+
+	// a key cannot have more than the admin's role grants
+	path := fmt.Sprintf("/admin/%d/keys", catalogID)
+	request := CreateAPIKeyRequest{Name: "script", Scopes: []Permission{PermCatalogWrite, PermUsersRead}}
+	server.expect(server.request("POST", path, catalogToken, request, nil), http.StatusUnprocessableEntity)
+
+	key := server.createAPIKey(catalogID, catalogToken, PermCatalogRead, PermCatalogWrite)
+	itemsPath := fmt.Sprintf("/admin/%d/items", catalogID)
+	server.expect(server.request("POST", itemsPath, key.Key, CreateItemRequest{Name: "Hat", Price: Money{Amount: 2000}}, nil), http.StatusOK)
+
+	// and loses what the role loses
+	res := server.request("PUT", "/admin/1/admins", ownerToken, SetAdminRoleRequest{ID: catalogID, Role: RoleSupport}, nil)
+	server.expect(res, http.StatusOK)
+
+	server.expect(server.request("POST", itemsPath, key.Key, CreateItemRequest{Name: "Cap", Price: Money{Amount: 2000}}, nil), http.StatusForbidden)
+	server.expect(server.request("GET", itemsPath, key.Key, nil, nil), http.StatusOK)
+}
+
+func TestAPIKeyRevokedOrExpired(t *testing.T) {
+	server := newTestServer(t)
+	ownerToken := server.adminLogin()
+
+	past := time.Now().UTC().Add(-time.Minute)
+	request := CreateAPIKeyRequest{Name: "script", Scopes: []Permission{PermCatalogRead}, ExpiresAt: &past}
+	server.expect(server.request("POST", "/admin/1/keys", ownerToken, request, nil), http.StatusUnprocessableEntity)
+
+	revoked := server.createAPIKey(1, ownerToken, PermCatalogRead)
+	server.expect(server.request("DELETE", fmt.Sprintf("/admin/1/keys/%d", revoked.ID), ownerToken, nil, nil), http.StatusOK)
+	server.expect(server.request("GET", "/admin/1/items", revoked.Key, nil, nil), http.StatusUnauthorized)
+
+	expired := server.createAPIKey(1, ownerToken, PermCatalogRead)
+	server.storage.data.apiKeys[uint32(expired.ID)].ExpiresAt = &past
+	server.expect(server.request("GET", "/admin/1/items", expired.Key, nil, nil), http.StatusUnauthorized)
+}
+
+func TestAPIKeyUseRecordedOnlyWhenAllowed(t *testing.T) {
+	server := newTestServer(t)
+	key := server.createAPIKey(1, server.adminLogin(), PermCatalogRead)
+
+	lastUsed := func() *time.Time {
+		return server.storage.data.apiKeys[uint32(key.ID)].LastUsedAt
+	}
+
+	server.expect(server.request("GET", "/admin/1/users", key.Key, nil, nil), http.StatusForbidden)
+	server.expect(server.request("GET", "/admin/2/items", key.Key, nil, nil), http.StatusUnauthorized)
+	if used := lastUsed(); used != nil {
+		t.Fatalf("denied requests marked the key used at %s", used)
+	}
+
+	server.expect(server.request("GET", "/admin/1/items", key.Key, nil, nil), http.StatusOK)
+	if lastUsed() == nil {
+		t.Fatal("an allowed request did not mark the key used")
+	}
+}
+
+func TestAPIKeyActive(t *testing.T) {
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	earlier, later := now.Add(-time.Minute), now.Add(time.Minute)
+
+	tests := []struct {
+		name string
+		key  APIKey
+		want bool
+	}{
+		{"no expiry", APIKey{}, true},
+		{"expires later", APIKey{ExpiresAt: &later}, true},
+		{"expires now", APIKey{ExpiresAt: &now}, false},
+		{"expired", APIKey{ExpiresAt: &earlier}, false},
+		{"revoked", APIKey{ExpiresAt: &later, RevokedAt: &earlier}, false},
+	}
+
+	for _, test := range tests {
+		if got := test.key.Active(now); got != test.want {
+			t.Errorf("%s: got %t, want %t", test.name, got, test.want)
+		}
+	}
+}
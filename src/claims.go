@@ -0,0 +1,234 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+)
+
+// TokenType is what a token is for. Each type has its own audience too, and
+// a token is only accepted where its type is, so a user token can never pass
+// for an admin token or a verification link for a login.
+type TokenType string
+
+const (
+	AdminAccessToken  TokenType = "admin_access"
+	UserAccessToken   TokenType = "user_access"
+	MFAChallengeToken TokenType = "mfa_challenge"
+	VerifyEmailToken  TokenType = "verify_email"
+)
+
+func accessTokenType(kind SessionKind) TokenType {
+	if kind == AdminSession {
+		return AdminAccessToken
+	}
+
+	return UserAccessToken
+}
+
+// Claims is everything a token can carry. Which fields are set depends on
+// the type: access tokens name a session, admin ones a role and its
+// permissions, verification tokens an email.
+type Claims struct {
+	jwt.RegisteredClaims
+
+	Type        TokenType    `json:"token_type"`
+	AccountID   int32        `json:"id"`
+	Username    string       `json:"username,omitempty"`
+	SessionID   string       `json:"sid,omitempty"`
+	Role        Role         `json:"role,omitempty"`
+	Permissions []Permission `json:"permissions,omitempty"`
+	Email       string       `json:"email,omitempty"`
+}
+
+// signToken signs claims with the configured key set. The token expires ttl
+// from now.
+func signToken(claims *Claims, ttl time.Duration) (string, error) {
+	keys, err := tokenKeys()
+	if err != nil {
+		return "", err
+	}
+
+	return keys.Sign(claims, ttl)
+}
+
+// parseToken verifies a token of the given type with the configured key set.
+func parseToken(tokenString string, tokenType TokenType) (*Claims, error) {
+	keys, err := tokenKeys()
+	if err != nil {
+		return nil, err
+	}
+
+	return keys.Parse(tokenString, tokenType)
+}
+
+// Principal is who an authenticated request is from, as checked by
+// authenticate. Handlers get it with principalFrom.
+type Principal struct {
+	Kind        SessionKind
+	AccountID   int32
+	Username    string
+	SessionID   string
+	Role        Role
+	Permissions []Permission
+
+	// MFAEnabled is whether the admin has two-factor authentication on. It
+	// is always false for users.
+	MFAEnabled bool
+
+	// APIKeyID is the key an admin request was made with, or zero for
+	// requests with an access token.
+	APIKeyID int32
+}
+
+// can reports whether the token's permissions include permission. The empty
+// permission is granted to everyone.
+func (self *Principal) can(permission Permission) bool {
+	if permission == "" {
+		return true
+	}
+
+	for _, granted := range self.Permissions {
+		if granted == permission {
+			return true
+		}
+	}
+
+	return false
+}
+
+type principalKey struct{}
+
+func withPrincipal(r *http.Request, principal *Principal) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), principalKey{}, principal))
+}
+
+func principalFrom(r *http.Request) (*Principal, bool) {
+	principal, ok := r.Context().Value(principalKey{}).(*Principal)
+	return principal, ok
+}
+
+// authenticate is the validation every authenticated route shares. The
+// request needs a valid access token for kind, for the account in the path,
+// from an active session, with the account's current role. A rename does not
+// end sessions: the principal carries the current username, not the token's.
+// Admin routes also take an X-API-Key instead. Anything else is answered
+// here with 401, 400 for a bad id in the path or 500 if storage fails, and
+// authenticate returns false.
+func authenticate(w http.ResponseWriter, r *http.Request, storage Storage, kind SessionKind) (*Principal, bool) {
+	fail := func(err error) (*Principal, bool) {
+		writeError(w, r, err)
+		return nil, false
+	}
+
+	unauthorized := func() (*Principal, bool) {
+		return fail(unauthorizedError("Unauthorized"))
+	}
+
+	var principal *Principal
+	var err error
+	if apiKey := r.Header.Get("X-API-Key"); apiKey != "" && kind == AdminSession {
+		principal, err = apiKeyPrincipal(storage, apiKey)
+		if err != nil && err != errInvalidAPIKey {
+			return fail(err)
+		}
+	} else {
+		principal, err = tokenPrincipal(r, kind)
+	}
+	if err != nil {
+		return unauthorized()
+	}
+
+	id, err := getID(r)
+	if err != nil {
+		return fail(err)
+	}
+
+	if principal.AccountID != id {
+		return unauthorized()
+	}
+
+	var username string
+	var role Role
+	if kind == AdminSession {
+		account, err := storage.GetAdminAccount(id)
+		if errors.Is(err, errNotFound) {
+			return unauthorized()
+		}
+		if err != nil {
+			return fail(err)
+		}
+		username, role, principal.MFAEnabled = account.Username, account.Role, account.MFAEnabled
+	} else {
+		account, err := storage.GetUserAccount(id)
+		if errors.Is(err, errNotFound) {
+			return unauthorized()
+		}
+		if err != nil {
+			return fail(err)
+		}
+		username = account.Username
+	}
+
+	principal.Username = username
+
+	// keys act with the admin's current role, narrowed to their scopes
+	if principal.APIKeyID != 0 {
+		principal.Role = role
+		principal.Permissions = scopedPermissions(principal.Permissions, role)
+		return principal, true
+	}
+
+	if role != principal.Role {
+		return unauthorized()
+	}
+
+	if !sessionAllows(storage, principal.SessionID, kind, id) {
+		return unauthorized()
+	}
+
+	return principal, true
+}
+
+func tokenPrincipal(r *http.Request, kind SessionKind) (*Principal, error) {
+	tokenString, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok {
+		return nil, fmt.Errorf("Missing bearer token")
+	}
+
+	claims, err := parseToken(tokenString, accessTokenType(kind))
+	if err != nil {
+		return nil, err
+	}
+
+	return &Principal{
+		Kind:        kind,
+		AccountID:   claims.AccountID,
+		Username:    claims.Username,
+		SessionID:   claims.SessionID,
+		Role:        claims.Role,
+		Permissions: claims.Permissions,
+	}, nil
+}
+
+// apiKeyPrincipal looks the key up. The principal's permissions are the key's
+// scopes until authenticate narrows them to the admin's role. Its use is only
+// recorded once the request has passed every check, by withJWTAdminAuth.
+func apiKeyPrincipal(storage Storage, apiKey string) (*Principal, error) {
+	key, err := storage.FindAPIKey(hashToken(apiKey))
+	if err != nil {
+		return nil, err
+	}
+
+	return &Principal{
+		Kind:        AdminSession,
+		AccountID:   key.AdminID,
+		APIKeyID:    key.ID,
+		Permissions: key.Scopes,
+	}, nil
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+)
+
+// resign signs claims as they are with the current key, without the
+// standard claims Sign would set.
+func resign(t *testing.T, claims *Claims) string {
+	t.Helper()
+
+	keys, err := tokenKeys()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	token := jwt.NewWithClaims(keys.current.Method, claims)
+	token.Header["kid"] = keys.current.ID
+
+	signed, err := token.SignedString(keys.current.signKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return signed
+}
+
+func TestAuthenticateRejectsBadClaims(t *testing.T) {
+	server := newTestServer(t)
+	adminToken := server.adminLogin()
+	_, userTokens := server.signup("bob")
+
+	keys, err := tokenKeys()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		change func(*Claims)
+		want   int
+	}{
+		{"unchanged", func(*Claims) {}, http.StatusOK},
+		{"another issuer", func(claims *Claims) {
+			claims.Issuer = "someone-else"
+		}, http.StatusUnauthorized},
+		{"user audience", func(claims *Claims) {
+			claims.Audience = jwt.ClaimStrings{keys.audienceFor(UserAccessToken)}
+		}, http.StatusUnauthorized},
+		{"no audience", func(claims *Claims) {
+			claims.Audience = nil
+		}, http.StatusUnauthorized},
+		{"expired", func(claims *Claims) {
+			claims.ExpiresAt = jwt.NewNumericDate(time.Now().Add(-time.Minute))
+		}, http.StatusUnauthorized},
+		{"no expiry", func(claims *Claims) {
+			claims.ExpiresAt = nil
+		}, http.StatusUnauthorized},
+		{"not valid yet", func(claims *Claims) {
+			claims.NotBefore = jwt.NewNumericDate(time.Now().Add(time.Hour))
+		}, http.StatusUnauthorized},
+		{"MFA challenge type", func(claims *Claims) {
+			claims.Type = MFAChallengeToken
+		}, http.StatusUnauthorized},
+		{"another role", func(claims *Claims) {
+			claims.Role = RoleSupport
+		}, http.StatusUnauthorized},
+		{"another session", func(claims *Claims) {
+			claims.SessionID = "not-a-session"
+		}, http.StatusUnauthorized},
+	}
+
+	for _, test := range tests {
+		claims, err := parseToken(adminToken, AdminAccessToken)
+		if err != nil {
+			t.Fatal(err)
+		}
+		test.change(claims)
+
+		if res := server.request("GET", "/admin/1", resign(t, claims), nil, nil); res.StatusCode != test.want {
+			t.Errorf("%s: got %d, want %d", test.name, res.StatusCode, test.want)
+		}
+	}
+
+	// a user's token does not open an admin route, even for the same id
+	server.expect(server.request("GET", "/admin/1", userTokens.AuthToken, nil, nil), http.StatusUnauthorized)
+	server.expect(server.request("GET", "/admin/1", "", nil, nil), http.StatusUnauthorized)
+	server.expect(server.request("GET", "/admin/1", "not-a-token", nil, nil), http.StatusUnauthorized)
+}
+
+func TestRenameKeepsSessions(t *testing.T) {
+	server := newTestServer(t)
+	adminToken := server.adminLogin()
+	userID, userTokens := server.signup("bob")
+
+	userPath := fmt.Sprintf("/user/%d", userID)
+	server.expect(server.request("PUT", userPath, userTokens.AuthToken, UpdateUserAccountRequest{Username: "robert"}, nil), http.StatusOK)
+
+	account := new(UserAccount)
+	server.expect(server.request("GET", userPath, userTokens.AuthToken, nil, account), http.StatusOK)
+	if account.Username != "robert" {
+		t.Fatalf("got username %q, want robert", account.Username)
+	}
+
+	server.expect(server.request("PUT", "/admin/1", adminToken, UpdateAccountRequest{Username: "boss"}, nil), http.StatusOK)
+	server.expect(server.request("GET", "/admin/1", adminToken, nil, nil), http.StatusOK)
+}
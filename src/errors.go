@@ -0,0 +1,171 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"regexp"
+	"strconv"
+	"time"
+)
+
+// ErrorCode is the machine-readable kind of a failed request. It goes out as
+// "code" next to the message, which is meant for people and may change, so
+// clients should branch on the code.
+type ErrorCode string
+
+const (
+	CodeBadRequest       ErrorCode = "bad_request"
+	CodeValidationFailed ErrorCode = "validation_failed"
+	CodeUnauthorized     ErrorCode = "unauthorized"
+	CodeForbidden        ErrorCode = "forbidden"
+	CodeNotFound         ErrorCode = "not_found"
+	CodeMethodNotAllowed ErrorCode = "method_not_allowed"
+	CodeConflict         ErrorCode = "conflict"
+	CodePayloadTooLarge  ErrorCode = "payload_too_large"
+	CodeTooManyRequests  ErrorCode = "too_many_requests"
+	CodeInternal         ErrorCode = "internal"
+)
+
+// StatusError is an error that says how the request failed: its status,
+// code and a message that is safe to show the client. Storage and handlers
+// return them for anything the client got wrong; every other error is
+// treated as ours and answered with a bare 500.
+type StatusError struct {
+	Status  int
+	Code    ErrorCode
+	Message string
+
+	// Fields maps the request fields that failed validation to what is
+	// wrong with them.
+	Fields map[string]string
+
+	// RetryAfter is sent as the Retry-After header when set.
+	RetryAfter time.Duration
+}
+
+func (self *StatusError) Error() string {
+	return self.Message
+}
+
+// Is matches errors with no message of their own by code, so
+// errors.Is(err, errNotFound) holds for every not found error.
+func (self *StatusError) Is(target error) bool {
+	kind, ok := target.(*StatusError)
+	return ok && kind.Message == "" && kind.Code == self.Code
+}
+
+var errNotFound = &StatusError{Status: http.StatusNotFound, Code: CodeNotFound}
+
+func newStatusError(status int, code ErrorCode, format string, args ...any) *StatusError {
+	return &StatusError{Status: status, Code: code, Message: fmt.Sprintf(format, args...)}
+}
+
+// badRequestError is for requests that cannot be made sense of: malformed
+// JSON, ids and query parameters.
+func badRequestError(format string, args ...any) error {
+	return newStatusError(http.StatusBadRequest, CodeBadRequest, format, args...)
+}
+
+// validationError is for a well-formed request with a field whose value is
+// not acceptable.
+func validationError(field, format string, args ...any) error {
+	err := newStatusError(http.StatusUnprocessableEntity, CodeValidationFailed, format, args...)
+	err.Fields = map[string]string{field: err.Message}
+	return err
+}
+
+func unauthorizedError(format string, args ...any) error {
+	return newStatusError(http.StatusUnauthorized, CodeUnauthorized, format, args...)
+}
+
+func forbiddenError(format string, args ...any) error {
+	return newStatusError(http.StatusForbidden, CodeForbidden, format, args...)
+}
+
+func notFoundError(format string, args ...any) error {
+	return newStatusError(http.StatusNotFound, CodeNotFound, format, args...)
+}
+
+func methodNotAllowedError(method string) error {
+	return newStatusError(http.StatusMethodNotAllowed, CodeMethodNotAllowed, "Invalid method: \"%s\"", method)
+}
+
+// conflictError is for requests that clash with the current state: taken
+// names, stock that has run out, the last owner.
+func conflictError(format string, args ...any) error {
+	return newStatusError(http.StatusConflict, CodeConflict, format, args...)
+}
+
+func payloadTooLargeError(format string, args ...any) error {
+	return newStatusError(http.StatusRequestEntityTooLarge, CodePayloadTooLarge, format, args...)
+}
+
+func tooManyRequestsError(retryAfter time.Duration, format string, args ...any) error {
+	err := newStatusError(http.StatusTooManyRequests, CodeTooManyRequests, format, args...)
+	err.RetryAfter = retryAfter
+	return err
+}
+
+// writeError answers the request with err. StatusErrors go out as they are;
+// anything else is a failure on our side, so it is logged and the client
+// only gets the request ID to quote.
+func writeError(w http.ResponseWriter, r *http.Request, err error) {
+	requestID := requestIDFrom(r)
+
+	var statusErr *StatusError
+	if !errors.As(err, &statusErr) {
+		log.Printf("ERROR: %s %s REQUEST_ID: %s: %s\n", r.Method, r.URL.Path, requestID, err)
+		statusErr = newStatusError(http.StatusInternalServerError, CodeInternal, "Internal server error")
+	}
+
+	if statusErr.RetryAfter > 0 {
+		seconds := int((statusErr.RetryAfter + time.Second - 1) / time.Second)
+		w.Header().Set("Retry-After", strconv.Itoa(seconds))
+	}
+
+	WriteJSON(w, statusErr.Status, ApiError{
+		Error:     statusErr.Message,
+		Code:      statusErr.Code,
+		Fields:    statusErr.Fields,
+		RequestID: requestID,
+	})
+}
+
+const requestIDHeader = "X-Request-ID"
+
+// requestIDPattern is what we accept as a caller's own request ID; anything
+// else is replaced so it cannot smuggle junk into the logs.
+var requestIDPattern = regexp.MustCompile(`^[A-Za-z0-9._-]{1,128}$`)
+
+type requestIDKey struct{}
+
+// withRequestID gives every request an ID, the caller's X-Request-ID if it
+// sent a sensible one, and echoes it in the response. Errors carry it in the
+// body and the log, to tie a client's report to the server's side.
+func withRequestID(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requestID := r.Header.Get(requestIDHeader)
+		if !requestIDPattern.MatchString(requestID) {
+			var err error
+			requestID, err = randomToken()
+			if err != nil {
+				requestID = strconv.FormatInt(time.Now().UnixNano(), 36)
+			}
+		}
+
+		w.Header().Set(requestIDHeader, requestID)
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), requestIDKey{}, requestID)))
+	})
+}
+
+func requestIDFrom(r *http.Request) string {
+	requestID, _ := r.Context().Value(requestIDKey{}).(string)
+	return requestID
+}
+
+func handleRouteNotFound(w http.ResponseWriter, r *http.Request) {
+	writeError(w, r, notFoundError("No route for %s", r.URL.Path))
+}
@@ -0,0 +1,548 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+)
+
+const (
+	defaultTokenIssuer = "go_ecom"
+
+	// keyRetirement is how long a keystore key is still accepted after a
+	// newer one replaced it. It outlives every token the old key signed; the
+	// longest lived are verification links, at 24 hours.
+	keyRetirement = 48 * time.Hour
+
+	keystoreTimeFormat = "20060102T150405.000000"
+)
+
+// SigningKey is one key of a KeySet, named in token headers by its ID.
+// Previous keys are only kept to verify, and have no signKey.
+type SigningKey struct {
+	ID        string
+	Method    jwt.SigningMethod
+	CreatedAt time.Time
+
+	signKey   any
+	verifyKey any
+}
+
+// KeySet signs tokens with its current key and verifies them with any of its
+// keys, so tokens signed before a rotation stay valid until they expire.
+type KeySet struct {
+	issuer   string
+	audience string
+	current  *SigningKey
+	keys     map[string]*SigningKey
+}
+
+var (
+	keySetOnce   sync.Once
+	loadedKeySet *KeySet
+	keySetErr    error
+)
+
+// tokenKeys is the key set configured by the environment, loaded on first
+// use.
+func tokenKeys() (*KeySet, error) {
+	keySetOnce.Do(func() {
+		loadedKeySet, keySetErr = LoadKeySet()
+	})
+
+	return loadedKeySet, keySetErr
+}
+
+// LoadKeySet reads the keys for JWT_ALG: HS256 (the default) uses JWT_SECRET,
+// RS256 and EdDSA use JWT_PRIVATE_KEY_FILE or else the local keystore.
+func LoadKeySet() (*KeySet, error) {
+	set := &KeySet{
+		issuer:   os.Getenv("JWT_ISSUER"),
+		audience: os.Getenv("JWT_AUDIENCE"),
+		keys:     make(map[string]*SigningKey),
+	}
+
+	if set.issuer == "" {
+		set.issuer = defaultTokenIssuer
+	}
+
+	if set.audience == "" {
+		set.audience = set.issuer
+	}
+
+	var err error
+	switch alg := os.Getenv("JWT_ALG"); alg {
+	case "", "HS256":
+		err = set.loadSecrets()
+	case "RS256", "EdDSA":
+		if path := os.Getenv("JWT_PRIVATE_KEY_FILE"); path != "" {
+			err = set.loadKeyFiles(alg, path)
+		} else {
+			err = set.loadKeystore(alg, keystoreDir())
+		}
+	default:
+		err = fmt.Errorf("Unknown JWT algorithm: \"%s\"", alg)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	return set, nil
+}
+
+func (self *KeySet) add(key *SigningKey) {
+	self.keys[key.ID] = key
+}
+
+// audienceFor is the audience of tokens of a type, e.g.
+// "go_ecom/admin_access".
+func (self *KeySet) audienceFor(tokenType TokenType) string {
+	return fmt.Sprintf("%s/%s", self.audience, tokenType)
+}
+
+// Sign fills in the standard claims, valid from now for ttl, and signs the
+// claims with the current key, naming it in the kid header.
+func (self *KeySet) Sign(claims *Claims, ttl time.Duration) (string, error) {
+	now := time.Now()
+	claims.Issuer = self.issuer
+	claims.Audience = jwt.ClaimStrings{self.audienceFor(claims.Type)}
+	claims.IssuedAt = jwt.NewNumericDate(now)
+	claims.NotBefore = jwt.NewNumericDate(now)
+	claims.ExpiresAt = jwt.NewNumericDate(now.Add(ttl))
+
+	token := jwt.NewWithClaims(self.current.Method, claims)
+	token.Header["kid"] = self.current.ID
+
+	return token.SignedString(self.current.signKey)
+}
+
+// Parse verifies a token of the given type with the key its kid names. The
+// key's algorithm is the only one accepted, so a token cannot pick a weaker
+// one. Claims of the wrong type make the token invalid rather than panic.
+func (self *KeySet) Parse(tokenString string, tokenType TokenType) (*Claims, error) {
+	claims := new(Claims)
+	_, err := jwt.ParseWithClaims(tokenString, claims, func(token *jwt.Token) (any, error) {
+		kid, _ := token.Header["kid"].(string)
+		key, ok := self.keys[kid]
+		if !ok {
+			return nil, fmt.Errorf("Unknown signing key: \"%s\"", kid)
+		}
+
+		if token.Method.Alg() != key.Method.Alg() {
+			return nil, fmt.Errorf("Unexpected signing method: %v", token.Header["alg"])
+		}
+
+		return key.verifyKey, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	if !claims.VerifyIssuer(self.issuer, true) ||
+		!claims.VerifyAudience(self.audienceFor(tokenType), true) ||
+		!claims.VerifyExpiresAt(now, true) ||
+		!claims.VerifyNotBefore(now, true) {
+		return nil, fmt.Errorf("Invalid token issuer, audience or lifetime")
+	}
+
+	if claims.Type != tokenType {
+		return nil, fmt.Errorf("Expected a %s token, got \"%s\"", tokenType, claims.Type)
+	}
+
+	return claims, nil
+}
+
+// loadSecrets uses JWT_SECRET to sign, and still accepts tokens signed with
+// the comma-separated JWT_PREVIOUS_SECRETS while they run out.
+func (self *KeySet) loadSecrets() error {
+	secret := os.Getenv("JWT_SECRET")
+	if secret == "" {
+		return fmt.Errorf("JWT_SECRET is not set")
+	}
+
+	self.current = secretKey(secret)
+	self.add(self.current)
+
+	for _, previous := range splitList(os.Getenv("JWT_PREVIOUS_SECRETS")) {
+		key := secretKey(previous)
+		key.signKey = nil
+		self.add(key)
+	}
+
+	return nil
+}
+
+func secretKey(secret string) *SigningKey {
+	return &SigningKey{
+		ID:        "hs-" + hashToken("kid:" + secret)[:16],
+		Method:    jwt.SigningMethodHS256,
+		signKey:   []byte(secret),
+		verifyKey: []byte(secret),
+	}
+}
+
+// loadKeyFiles signs with the private key at path, and still accepts tokens
+// signed with the keys in the comma-separated JWT_PUBLIC_KEY_FILES.
+func (self *KeySet) loadKeyFiles(alg, path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	if self.current, err = parsePrivateKeyPEM(alg, data); err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+	self.add(self.current)
+
+	for _, path := range splitList(os.Getenv("JWT_PUBLIC_KEY_FILES")) {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+
+		key, err := parsePublicKeyPEM(alg, data)
+		if err != nil {
+			return fmt.Errorf("%s: %w", path, err)
+		}
+		self.add(key)
+	}
+
+	return nil
+}
+
+func keystoreDir() string {
+	if dir := os.Getenv("JWT_KEYSTORE_DIR"); dir != "" {
+		return dir
+	}
+
+	return "keys"
+}
+
+// loadKeystore signs with the newest key for alg in dir, generating one when
+// there is none or, with JWT_KEY_ROTATION set, when the newest is older than
+// that. Keys replaced more than keyRetirement ago are deleted.
+func (self *KeySet) loadKeystore(alg, dir string) error {
+	keys, err := readKeystore(alg, dir)
+	if err != nil {
+		return err
+	}
+
+	rotation, err := keyRotationInterval()
+	if err != nil {
+		return err
+	}
+
+	if len(keys) == 0 || (rotation > 0 && time.Since(keys[len(keys)-1].CreatedAt) > rotation) {
+		key, err := generateKeystoreKey(alg, dir)
+		if err != nil {
+			return err
+		}
+		keys = append(keys, key)
+	}
+
+	for i, key := range keys {
+		if i+1 < len(keys) && time.Since(keys[i+1].CreatedAt) > keyRetirement {
+			if err := os.Remove(keystorePath(dir, key)); err != nil {
+				return err
+			}
+			continue
+		}
+
+		self.add(key)
+	}
+
+	self.current = keys[len(keys)-1]
+
+	return nil
+}
+
+func keyRotationInterval() (time.Duration, error) {
+	value := os.Getenv("JWT_KEY_ROTATION")
+	if value == "" {
+		return 0, nil
+	}
+
+	rotation, err := time.ParseDuration(value)
+	if err != nil || rotation <= 0 {
+		return 0, fmt.Errorf("Invalid JWT_KEY_ROTATION: \"%s\"", value)
+	}
+
+	return rotation, nil
+}
+
+// readKeystore loads the keys for alg in dir, oldest first. Files are named
+// by when the key was made, e.g. 20240131T120000.000000-RS256.pem.
+func readKeystore(alg, dir string) ([]*SigningKey, error) {
+	paths, err := filepath.Glob(filepath.Join(dir, "*-"+alg+".pem"))
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Strings(paths)
+
+	keys := make([]*SigningKey, 0, len(paths))
+	for _, path := range paths {
+		name := strings.TrimSuffix(filepath.Base(path), "-"+alg+".pem")
+		createdAt, err := time.Parse(keystoreTimeFormat, name)
+		if err != nil {
+			return nil, fmt.Errorf("%s: not a keystore key name", path)
+		}
+
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+
+		key, err := parsePrivateKeyPEM(alg, data)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+		key.CreatedAt = createdAt
+
+		keys = append(keys, key)
+	}
+
+	return keys, nil
+}
+
+func keystorePath(dir string, key *SigningKey) string {
+	return filepath.Join(dir, key.CreatedAt.Format(keystoreTimeFormat)+"-"+key.Method.Alg()+".pem")
+}
+
+func generateKeystoreKey(alg, dir string) (*SigningKey, error) {
+	var private crypto.Signer
+	var err error
+	switch alg {
+	case "RS256":
+		private, err = rsa.GenerateKey(rand.Reader, 2048)
+	case "EdDSA":
+		_, private, err = ed25519.GenerateKey(rand.Reader)
+	default:
+		err = fmt.Errorf("Keys cannot be generated for %s", alg)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	der, err := x509.MarshalPKCS8PrivateKey(private)
+	if err != nil {
+		return nil, err
+	}
+
+	data := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})
+
+	key, err := parsePrivateKeyPEM(alg, data)
+	if err != nil {
+		return nil, err
+	}
+	key.CreatedAt = time.Now().UTC().Truncate(time.Microsecond)
+
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, err
+	}
+
+	file, err := os.OpenFile(keystorePath(dir, key), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o600)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	if _, err := file.Write(data); err != nil {
+		return nil, err
+	}
+
+	return key, nil
+}
+
+func parsePrivateKeyPEM(alg string, data []byte) (*SigningKey, error) {
+	switch alg {
+	case "RS256":
+		private, err := jwt.ParseRSAPrivateKeyFromPEM(data)
+		if err != nil {
+			return nil, err
+		}
+
+		return newPublicSigningKey(jwt.SigningMethodRS256, private, &private.PublicKey)
+	case "EdDSA":
+		private, err := jwt.ParseEdPrivateKeyFromPEM(data)
+		if err != nil {
+			return nil, err
+		}
+
+		signer := private.(ed25519.PrivateKey)
+
+		return newPublicSigningKey(jwt.SigningMethodEdDSA, signer, signer.Public())
+	}
+
+	return nil, fmt.Errorf("Unknown JWT algorithm: \"%s\"", alg)
+}
+
+// parsePublicKeyPEM reads a key that is only used to verify. A private key
+// works too; only its public half is kept.
+func parsePublicKeyPEM(alg string, data []byte) (*SigningKey, error) {
+	if key, err := parsePrivateKeyPEM(alg, data); err == nil {
+		key.signKey = nil
+		return key, nil
+	}
+
+	switch alg {
+	case "RS256":
+		public, err := jwt.ParseRSAPublicKeyFromPEM(data)
+		if err != nil {
+			return nil, err
+		}
+
+		return newPublicSigningKey(jwt.SigningMethodRS256, nil, public)
+	case "EdDSA":
+		public, err := jwt.ParseEdPublicKeyFromPEM(data)
+		if err != nil {
+			return nil, err
+		}
+
+		return newPublicSigningKey(jwt.SigningMethodEdDSA, nil, public)
+	}
+
+	return nil, fmt.Errorf("Unknown JWT algorithm: \"%s\"", alg)
+}
+
+// newPublicSigningKey names the key by a hash of its public half, so every
+// instance holding the same key agrees on its kid.
+func newPublicSigningKey(method jwt.SigningMethod, private, public any) (*SigningKey, error) {
+	der, err := x509.MarshalPKIXPublicKey(public)
+	if err != nil {
+		return nil, err
+	}
+
+	sum := sha256.Sum256(der)
+
+	return &SigningKey{
+		ID:        hex.EncodeToString(sum[:8]),
+		Method:    method,
+		signKey:   private,
+		verifyKey: public,
+	}, nil
+}
+
+// JWK is a public key in the JSON Web Key format (RFC 7517).
+type JWK struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	Alg string `json:"alg"`
+
+	// RSA
+	N string `json:"n,omitempty"`
+	E string `json:"e,omitempty"`
+
+	// Ed25519
+	Crv string `json:"crv,omitempty"`
+	X   string `json:"x,omitempty"`
+}
+
+type JWKS struct {
+	Keys []JWK `json:"keys"`
+}
+
+// JWKS publishes the public keys, so other services can verify tokens
+// without holding a secret. HS256 secrets are never published, so the set is
+// empty with HS256.
+func (self *KeySet) JWKS() *JWKS {
+	jwks := &JWKS{Keys: make([]JWK, 0, len(self.keys))}
+
+	ids := make([]string, 0, len(self.keys))
+	for id := range self.keys {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	for _, id := range ids {
+		key := self.keys[id]
+		jwk := JWK{Kid: key.ID, Use: "sig", Alg: key.Method.Alg()}
+
+		switch public := key.verifyKey.(type) {
+		case *rsa.PublicKey:
+			jwk.Kty = "RSA"
+			jwk.N = base64.RawURLEncoding.EncodeToString(public.N.Bytes())
+			jwk.E = base64.RawURLEncoding.EncodeToString(big.NewInt(int64(public.E)).Bytes())
+		case ed25519.PublicKey:
+			jwk.Kty = "OKP"
+			jwk.Crv = "Ed25519"
+			jwk.X = base64.RawURLEncoding.EncodeToString(public)
+		default:
+			continue
+		}
+
+		jwks.Keys = append(jwks.Keys, jwk)
+	}
+
+	return jwks
+}
+
+// runKeysCommand manages the local keystore: "keys rotate" makes a new
+// signing key, "keys list" shows the keys that are accepted.
+func runKeysCommand(args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("Usage: keys rotate|list")
+	}
+
+	alg := os.Getenv("JWT_ALG")
+	if alg != "RS256" && alg != "EdDSA" {
+		return fmt.Errorf("The keystore is only used with JWT_ALG=RS256 or JWT_ALG=EdDSA")
+	}
+
+	switch args[0] {
+	case "rotate":
+		key, err := generateKeystoreKey(alg, keystoreDir())
+		if err != nil {
+			return err
+		}
+
+		fmt.Printf("created   %s %s\n", key.ID, keystorePath(keystoreDir(), key))
+		return nil
+	case "list":
+		keys, err := readKeystore(alg, keystoreDir())
+		if err != nil {
+			return err
+		}
+
+		for i, key := range keys {
+			state := "retired "
+			if i == len(keys)-1 {
+				state = "current "
+			}
+			fmt.Printf("%s  %s %s (%s)\n", state, key.ID, key.Method.Alg(), key.CreatedAt.Format(time.RFC3339))
+		}
+		return nil
+	}
+
+	return fmt.Errorf("Unknown keys command: \"%s\"", args[0])
+}
+
+func splitList(value string) []string {
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+
+	return items
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+)
+
+// useKeySet makes the server sign and verify with set for the rest of the
+// test, in place of the one loaded from the environment. The environment's
+// set has to be loaded already, so that the swap is not undone by loading it.
+func useKeySet(t *testing.T, set *KeySet) {
+	t.Helper()
+
+	if _, err := tokenKeys(); err != nil {
+		t.Fatal(err)
+	}
+
+	previous := loadedKeySet
+	loadedKeySet = set
+	t.Cleanup(func() { loadedKeySet = previous })
+}
+
+func loadKeySet(t *testing.T) *KeySet {
+	t.Helper()
+
+	set, err := LoadKeySet()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return set
+}
+
+func TestKeystoreRotation(t *testing.T) {
+	server := newTestServer(t)
+	if _, err := tokenKeys(); err != nil {
+		t.Fatal(err)
+	}
+
+	dir := t.TempDir()
+	t.Setenv("JWT_ALG", "EdDSA")
+	t.Setenv("JWT_KEYSTORE_DIR", dir)
+
+	before := loadKeySet(t)
+	useKeySet(t, before)
+	oldTokens := server.login("/admin/login", LoginRequest{Username: "root", Password: "rootpassword"})
+
+	if _, err := generateKeystoreKey("EdDSA", dir); err != nil {
+		t.Fatal(err)
+	}
+
+	after := loadKeySet(t)
+	if after.current.ID == before.current.ID {
+		t.Fatal("rotating did not change the signing key")
+	}
+	useKeySet(t, after)
+
+	// tokens signed before the rotation are still good
+	server.expect(server.request("GET", "/admin/1", oldTokens.AuthToken, nil, nil), http.StatusOK)
+	newTokens := server.login("/admin/login", LoginRequest{Username: "root", Password: "rootpassword"})
+
+	jwks := new(JWKS)
+	server.expect(server.request("GET", "/.well-known/jwks.json", "", nil, jwks), http.StatusOK)
+	kids := make(map[string]bool)
+	for _, key := range jwks.Keys {
+		kids[key.Kid] = true
+	}
+	if len(jwks.Keys) != 2 || !kids[before.current.ID] || !kids[after.current.ID] {
+		t.Fatalf("got JWKS %+v, want keys %s and %s", jwks.Keys, before.current.ID, after.current.ID)
+	}
+
+	// a key set that has never seen the new key rejects what it signed
+	useKeySet(t, before)
+	server.expect(server.request("GET", "/admin/1", newTokens.AuthToken, nil, nil), http.StatusUnauthorized)
+}
+
+func TestKeySetRejectsUnknownKeys(t *testing.T) {
+	t.Setenv("JWT_ALG", "EdDSA")
+	t.Setenv("JWT_KEYSTORE_DIR", t.TempDir())
+	set := loadKeySet(t)
+
+	t.Setenv("JWT_KEYSTORE_DIR", t.TempDir())
+	stranger := loadKeySet(t)
+
+	token, err := stranger.Sign(&Claims{Type: AdminAccessToken, AccountID: 1}, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := set.Parse(token, AdminAccessToken); err == nil {
+		t.Fatal("accepted a token signed by an unknown key")
+	}
+
+	// an HMAC token naming a public key's kid must not be checked against
+	// the public key's bytes
+	forged := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
+		"token_type": AdminAccessToken,
+		"id":         1,
+		"iss":        set.issuer,
+		"aud":        set.audienceFor(AdminAccessToken),
+		"exp":        time.Now().Add(time.Minute).Unix(),
+	})
+	forged.Header["kid"] = set.current.ID
+	forgedString, err := forged.SignedString([]byte(set.current.verifyKey.(ed25519.PublicKey)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := set.Parse(forgedString, AdminAccessToken); err == nil {
+		t.Fatal("accepted an HS256 token for an EdDSA key")
+	}
+}
+
+func TestKeySetPreviousSecrets(t *testing.T) {
+	t.Setenv("JWT_ALG", "")
+	t.Setenv("JWT_SECRET", "old-secret")
+	t.Setenv("JWT_PREVIOUS_SECRETS", "")
+	old := loadKeySet(t)
+
+	token, err := old.Sign(&Claims{Type: AdminAccessToken, AccountID: 1}, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Setenv("JWT_SECRET", "new-secret")
+	if _, err := loadKeySet(t).Parse(token, AdminAccessToken); err == nil {
+		t.Fatal("accepted a token signed with a secret that was dropped")
+	}
+
+	t.Setenv("JWT_PREVIOUS_SECRETS", "older-secret, old-secret")
+	rotated := loadKeySet(t)
+	if _, err := rotated.Parse(token, AdminAccessToken); err != nil {
+		t.Fatalf("rejected a token signed with a previous secret: %s", err)
+	}
+
+	// secrets are never published
+	if keys := rotated.JWKS().Keys; len(keys) != 0 {
+		t.Fatalf("got %d keys in the JWKS, want none", len(keys))
+	}
+}
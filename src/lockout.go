@@ -0,0 +1,128 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// failures after the free ones lock the key for a second, then two,
+	// four and so on up to maxLoginLockout
+	freeAccountLoginFailures = 3
+	freeIPLoginFailures      = 10
+	maxLoginLockout          = 15 * time.Minute
+
+	// loginFailureWindow is how long failures are remembered; a key that has
+	// not failed for this long starts over.
+	loginFailureWindow = time.Hour
+)
+
+var errInvalidCredentials = unauthorizedError("Invalid username or password")
+
+// LoginThrottle counts the failed logins for a key, which is either an
+// account ("user:bob", "admin:root") or a client IP ("ip:203.0.113.7").
+// Accounts are keyed by username so that unknown usernames are throttled the
+// same way as real ones.
+type LoginThrottle struct {
+	Key           string
+	Failures      int32
+	LastFailureAt time.Time
+	LockedUntil   *time.Time
+}
+
+func accountThrottleKey(kind SessionKind, username string) string {
+	return fmt.Sprintf("%s:%s", kind, username)
+}
+
+func ipThrottleKey(ip string) string {
+	return "ip:" + ip
+}
+
+// recordFailure counts a failed login at now and locks the key once it is out
+// of free failures, doubling the lockout with every further failure.
+func (self *LoginThrottle) recordFailure(now time.Time) {
+	if now.Sub(self.LastFailureAt) > loginFailureWindow {
+		self.Failures = 0
+	}
+
+	self.Failures++
+	self.LastFailureAt = now
+
+	free := int32(freeAccountLoginFailures)
+	if strings.HasPrefix(self.Key, "ip:") {
+		free = freeIPLoginFailures
+	}
+
+	if self.Failures <= free {
+		self.LockedUntil = nil
+		return
+	}
+
+	lockout := maxLoginLockout
+	if exponent := self.Failures - free - 1; exponent < 20 {
+		lockout = min(time.Second<<exponent, maxLoginLockout)
+	}
+
+	lockedUntil := now.Add(lockout)
+	self.LockedUntil = &lockedUntil
+}
+
+// lockedFor is how much longer the key is locked at now.
+func (self *LoginThrottle) lockedFor(now time.Time) time.Duration {
+	if self.LockedUntil == nil || !now.Before(*self.LockedUntil) {
+		return 0
+	}
+
+	return self.LockedUntil.Sub(now)
+}
+
+func loginLockedError(wait time.Duration) error {
+	seconds := int((wait + time.Second - 1) / time.Second)
+	return tooManyRequestsError(wait, "Too many failed login attempts; try again in %d seconds", seconds)
+}
+
+// clientIP is the address the request came from. Behind reverse proxies set
+// TRUST_PROXY to take it from X-Forwarded-For instead: "true" for one proxy,
+// or the number of proxies in front of the server. Each proxy appends the
+// address it saw, so the client is that many entries from the right; entries
+// further left are whatever the client sent and cannot be trusted.
+func clientIP(r *http.Request) string {
+	if hops := trustedProxies(); hops > 0 {
+		var entries []string
+		for _, header := range r.Header.Values("X-Forwarded-For") {
+			for _, entry := range strings.Split(header, ",") {
+				entries = append(entries, strings.TrimSpace(entry))
+			}
+		}
+
+		if len(entries) >= hops {
+			return entries[len(entries)-hops]
+		}
+	}
+
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+
+	return host
+}
+
+func trustedProxies() int {
+	trust := os.Getenv("TRUST_PROXY")
+	if trust == "true" {
+		return 1
+	}
+
+	hops, err := strconv.Atoi(trust)
+	if err != nil || hops < 0 {
+		return 0
+	}
+
+	return hops
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestLoginThrottleBackoff(t *testing.T) {
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	throttle := &LoginThrottle{Key: accountThrottleKey(UserSession, "bob")}
+
+	for i := 0; i < freeAccountLoginFailures; i++ {
+		throttle.recordFailure(now)
+		if wait := throttle.lockedFor(now); wait != 0 {
+			t.Fatalf("locked for %s after %d failures", wait, i+1)
+		}
+	}
+
+	// each failure after the free ones doubles the lockout, up to the cap
+	for _, want := range []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 8 * time.Second} {
+		throttle.recordFailure(now)
+		if wait := throttle.lockedFor(now); wait != want {
+			t.Fatalf("got lockout %s after %d failures, want %s", wait, throttle.Failures, want)
+		}
+	}
+
+	for i := 0; i < 30; i++ {
+		throttle.recordFailure(now)
+	}
+	if wait := throttle.lockedFor(now); wait != maxLoginLockout {
+		t.Fatalf("got lockout %s after %d failures, want %s", wait, throttle.Failures, maxLoginLockout)
+	}
+
+	if wait := throttle.lockedFor(now.Add(maxLoginLockout)); wait != 0 {
+		t.Fatalf("still locked for %s once the lockout has passed", wait)
+	}
+
+	// failures older than the window are forgotten
+	later := now.Add(loginFailureWindow + time.Minute)
+	throttle.recordFailure(later)
+	if throttle.Failures != 1 || throttle.lockedFor(later) != 0 {
+		t.Fatalf("got %d failures locked for %s, want a fresh count", throttle.Failures, throttle.lockedFor(later))
+	}
+}
+
+func TestIPThrottleAllowsMoreFailures(t *testing.T) {
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	throttle := &LoginThrottle{Key: ipThrottleKey("203.0.113.7")}
+
+	for i := 0; i < freeIPLoginFailures; i++ {
+		throttle.recordFailure(now)
+	}
+	if wait := throttle.lockedFor(now); wait != 0 {
+		t.Fatalf("locked for %s within the free failures", wait)
+	}
+
+	throttle.recordFailure(now)
+	if wait := throttle.lockedFor(now); wait != time.Second {
+		t.Fatalf("got lockout %s, want %s", wait, time.Second)
+	}
+}
+
+func TestClientIP(t *testing.T) {
+	tests := []struct {
+		trust     string
+		forwarded []string
+		want      string
+	}{
+		{"", []string{"198.51.100.1"}, "192.0.2.1"},
+		{"true", nil, "192.0.2.1"},
+		{"true", []string{"198.51.100.1"}, "198.51.100.1"},
+		{"true", []string{"10.0.0.1, 198.51.100.1"}, "198.51.100.1"},
+		{"2", []string{"10.0.0.1, 198.51.100.1, 203.0.113.9"}, "198.51.100.1"},
+		{"2", []string{"10.0.0.1", "198.51.100.1, 203.0.113.9"}, "198.51.100.1"},
+		{"3", []string{"198.51.100.1, 203.0.113.9"}, "192.0.2.1"},
+		{"no", []string{"198.51.100.1"}, "192.0.2.1"},
+	}
+
+	for _, test := range tests {
+		t.Run(fmt.Sprintf("%s %v", test.trust, test.forwarded), func(t *testing.T) {
+			t.Setenv("TRUST_PROXY", test.trust)
+
+			r := httptest.NewRequest("POST", "/user/login", nil)
+			r.RemoteAddr = "192.0.2.1:4321"
+			for _, forwarded := range test.forwarded {
+				r.Header.Add("X-Forwarded-For", forwarded)
+			}
+
+			if got := clientIP(r); got != test.want {
+				t.Fatalf("got %s, want %s", got, test.want)
+			}
+		})
+	}
+}
+
+func TestLoginLockout(t *testing.T) {
+	server := newTestServer(t)
+	userID, _ := server.signup("bob")
+
+	wrong := LoginRequest{Username: "bob", Password: "wrong-password"}
+	right := LoginRequest{Username: "bob", Password: "bob-password"}
+
+	for i := 0; i <= freeAccountLoginFailures; i++ {
+		server.expect(server.request("POST", "/user/login", "", wrong, nil), http.StatusUnauthorized)
+	}
+
+	// locked now, so even the right password is turned away
+	apiErr := new(ApiError)
+	res := server.request("POST", "/user/login", "", right, apiErr)
+	server.expect(res, http.StatusTooManyRequests)
+	if apiErr.Code != CodeTooManyRequests || res.Header.Get("Retry-After") != "1" {
+		t.Fatalf("got %+v with Retry-After %q", apiErr, res.Header.Get("Retry-After"))
+	}
+
+	// an admin can lift the lockout early
+	adminToken := server.adminLogin()
+	server.expect(server.request("POST", "/admin/1/users/unlock", adminToken, UnlockAccountRequest{ID: userID}, nil), http.StatusOK)
+	server.expect(server.request("POST", "/user/login", "", right, nil), http.StatusOK)
+}
+
+func TestLoginLockoutUnknownUser(t *testing.T) {
+	server := newTestServer(t)
+
+	ghost := LoginRequest{Username: "ghost", Password: "wrong-password"}
+
+	for i := 0; i <= freeAccountLoginFailures; i++ {
+		apiErr := new(ApiError)
+		server.expect(server.request("POST", "/user/login", "", ghost, apiErr), http.StatusUnauthorized)
+		if apiErr.Error != errInvalidCredentials.Error() {
+			t.Fatalf("got %q, want %q", apiErr.Error, errInvalidCredentials)
+		}
+	}
+
+	server.expect(server.request("POST", "/user/login", "", ghost, nil), http.StatusTooManyRequests)
+}
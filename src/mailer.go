@@ -0,0 +1,80 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Message is a plain-text email.
+type Message struct {
+	To      string
+	Subject string
+	Body    string
+}
+
+// Mailer delivers email. The implementations here only log or store the
+// messages, so the service works without a mail server.
+type Mailer interface {
+	Send(*Message) error
+}
+
+func NewMailer() (Mailer, error) {
+	switch backend := os.Getenv("MAILER"); backend {
+	case "", "log":
+		return new(LogMailer), nil
+	case "file":
+		root := os.Getenv("MAIL_DIR")
+		if root == "" {
+			root = "mail"
+		}
+
+		return NewFileMailer(root)
+	default:
+		return nil, fmt.Errorf("Unknown mailer: \"%s\"", backend)
+	}
+}
+
+// LogMailer writes messages to the server log.
+type LogMailer struct{}
+
+func (self *LogMailer) Send(message *Message) error {
+	log.Printf("MAIL to %s: %s\n%s\n", message.To, message.Subject, message.Body)
+	return nil
+}
+
+// FileMailer writes each message to its own .eml file under a directory.
+type FileMailer struct {
+	root string
+}
+
+func NewFileMailer(root string) (*FileMailer, error) {
+	if err := os.MkdirAll(root, 0o755); err != nil {
+		return nil, err
+	}
+
+	return &FileMailer{root: root}, nil
+}
+
+func (self *FileMailer) Send(message *Message) error {
+	name, err := randomToken()
+	if err != nil {
+		return err
+	}
+
+	now := time.Now().UTC()
+
+	var eml strings.Builder
+	fmt.Fprintf(&eml, "To: %s\r\n", message.To)
+	fmt.Fprintf(&eml, "Subject: %s\r\n", message.Subject)
+	fmt.Fprintf(&eml, "Date: %s\r\n", now.Format(time.RFC1123Z))
+	eml.WriteString("Content-Type: text/plain; charset=utf-8\r\n\r\n")
+	eml.WriteString(strings.ReplaceAll(message.Body, "\n", "\r\n"))
+
+	target := filepath.Join(self.root, fmt.Sprintf("%s-%s.eml", now.Format("20060102T150405"), name))
+
+	return os.WriteFile(target, []byte(eml.String()), 0o644)
+}
@@ -9,18 +9,46 @@ import (
 )
 
 func main() {
-	storage, err := NewPostgresStorage()
-	defer storage.Close()
+	if len(os.Args) > 1 && os.Args[1] == "migrate" {
+		if err := runMigrateCommand(os.Args[2:]); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	if len(os.Args) > 1 && os.Args[1] == "keys" {
+		if err := runKeysCommand(os.Args[2:]); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	if _, err := tokenKeys(); err != nil {
+		log.Fatal(err)
+	}
+
+	storage, err := NewStorage()
 	if err != nil {
 		log.Fatal(err)
 	}
+	defer storage.Close()
 
 	if err := storage.Init(); err != nil {
 		log.Fatal(err)
 	}
 
+	blobs, err := NewBlobStore()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	mailer, err := NewMailer()
+	if err != nil {
+		log.Fatal(err)
+	}
+
 	portAddress := os.Getenv("PORT")
 
-	server := NewAPIServer(fmt.Sprintf(":%s", portAddress), storage)
+	server := NewAPIServer(fmt.Sprintf(":%s", portAddress), storage, blobs, mailer)
 	server.Run()
 }
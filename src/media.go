@@ -0,0 +1,339 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	_ "image/gif"
+)
+
+const (
+	// mediaPrefix is where blobs are served from; an image's URL is the prefix
+	// followed by its blob key.
+	mediaPrefix = "/media/"
+
+	maxImageBytes    = 10 << 20
+	maxImageSide     = 5000
+	maxImagesPerItem = 20
+	thumbnailSide    = 256
+)
+
+// imageFormats maps the content types accepted for upload to the extension
+// their blobs are stored under.
+var imageFormats = map[string]string{
+	"image/jpeg": ".jpg",
+	"image/png":  ".png",
+	"image/gif":  ".gif",
+}
+
+// BlobStore keeps uploaded files under slash-separated keys. Open must return
+// an error matching fs.ErrNotExist for a key that was never stored, and
+// Delete of a missing key is not an error.
+type BlobStore interface {
+	Put(key string, body io.Reader) error
+	Open(key string) (io.ReadCloser, error)
+	Delete(key string) error
+}
+
+func NewBlobStore() (BlobStore, error) {
+	switch backend := os.Getenv("BLOB_BACKEND"); backend {
+	case "", "local":
+		root := os.Getenv("MEDIA_DIR")
+		if root == "" {
+			root = "media"
+		}
+
+		return NewLocalBlobStore(root)
+	default:
+		return nil, fmt.Errorf("Unknown blob backend: \"%s\"", backend)
+	}
+}
+
+// LocalBlobStore keeps blobs as files under a directory on local disk.
+type LocalBlobStore struct {
+	root string
+}
+
+func NewLocalBlobStore(root string) (*LocalBlobStore, error) {
+	if err := os.MkdirAll(root, 0o755); err != nil {
+		return nil, err
+	}
+
+	return &LocalBlobStore{root: root}, nil
+}
+
+// Put writes the blob to a temporary file first so a reader never sees a
+// partial file.
+func (self *LocalBlobStore) Put(key string, body io.Reader) error {
+	target, err := self.path(key)
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(target), 0o755); err != nil {
+		return err
+	}
+
+	file, err := os.CreateTemp(filepath.Dir(target), ".upload-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(file.Name())
+
+	if _, err := io.Copy(file, body); err != nil {
+		file.Close()
+		return err
+	}
+
+	if err := file.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(file.Name(), target)
+}
+
+// Open only opens regular files; a key naming a directory under the root does
+// not exist as far as callers are concerned.
+func (self *LocalBlobStore) Open(key string) (io.ReadCloser, error) {
+	target, err := self.path(key)
+	if err != nil {
+		return nil, err
+	}
+
+	file, err := os.Open(target)
+	if err != nil {
+		return nil, err
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	if !info.Mode().IsRegular() {
+		file.Close()
+		return nil, &fs.PathError{Op: "open", Path: key, Err: fs.ErrNotExist}
+	}
+
+	return file, nil
+}
+
+func (self *LocalBlobStore) Delete(key string) error {
+	target, err := self.path(key)
+	if err != nil {
+		return err
+	}
+
+	if err := os.Remove(target); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	return nil
+}
+
+// path maps a key into the root, refusing anything that could escape it.
+func (self *LocalBlobStore) path(key string) (string, error) {
+	if key == "" || path.Clean(key) != key || path.IsAbs(key) || strings.HasPrefix(key, "../") || key == ".." || strings.ContainsAny(key, "\\\x00") {
+		return "", badRequestError("Invalid media key: \"%s\"", key)
+	}
+
+	return filepath.Join(self.root, filepath.FromSlash(key)), nil
+}
+
+// ItemImage is one image of an item. Images are shown in Position order and
+// exactly one of an item's images is its primary image.
+type ItemImage struct {
+	ID           uint32    `json:"id"`
+	ItemID       int32     `json:"item_id"`
+	Position     int32     `json:"position"`
+	Primary      bool      `json:"primary"`
+	URL          string    `json:"url"`
+	ThumbnailURL string    `json:"thumbnail_url"`
+	ContentType  string    `json:"content_type"`
+	Width        int32     `json:"width"`
+	Height       int32     `json:"height"`
+	Size         int64     `json:"size"`
+	CreatedAt    time.Time `json:"created_at"`
+
+	Key          string `json:"-"`
+	ThumbnailKey string `json:"-"`
+}
+
+func NewItemImage(itemID int32, upload *imageUpload) (*ItemImage, error) {
+	name, err := randomToken()
+	if err != nil {
+		return nil, err
+	}
+
+	itemImage := &ItemImage{
+		ItemID:       itemID,
+		ContentType:  upload.contentType,
+		Width:        upload.width,
+		Height:       upload.height,
+		Size:         int64(len(upload.data)),
+		CreatedAt:    time.Now().UTC(),
+		Key:          fmt.Sprintf("items/%d/%s%s", itemID, name, upload.extension),
+		ThumbnailKey: fmt.Sprintf("items/%d/%s_thumb%s", itemID, name, upload.thumbnailExtension),
+	}
+	itemImage.resolveURLs()
+
+	return itemImage, nil
+}
+
+func (self *ItemImage) resolveURLs() {
+	self.URL = mediaPrefix + self.Key
+	self.ThumbnailURL = mediaPrefix + self.ThumbnailKey
+}
+
+// imageUpload is a validated upload and the thumbnail made from it.
+type imageUpload struct {
+	data        []byte
+	contentType string
+	extension   string
+	width       int32
+	height      int32
+
+	thumbnail          []byte
+	thumbnailExtension string
+}
+
+// processImage checks that data is a JPEG, PNG or GIF of sensible dimensions,
+// judging by its contents rather than what the client claimed, and renders its
+// thumbnail.
+func processImage(data []byte) (*imageUpload, error) {
+	if len(data) > maxImageBytes {
+		return nil, validationError("image", "Image must be at most %d MB", maxImageBytes>>20)
+	}
+
+	contentType := http.DetectContentType(data)
+	extension, ok := imageFormats[contentType]
+	if !ok {
+		return nil, validationError("image", "Unsupported image type: \"%s\" (must be JPEG, PNG or GIF)", contentType)
+	}
+
+	// check the dimensions before decoding, so a small file claiming a huge
+	// canvas is turned away without allocating it
+	config, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, validationError("image", "Invalid image: %s", err)
+	}
+
+	if config.Width > maxImageSide || config.Height > maxImageSide {
+		return nil, validationError("image", "Image must be at most %d×%d pixels, got %d×%d", maxImageSide, maxImageSide, config.Width, config.Height)
+	}
+
+	decoded, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, validationError("image", "Invalid image: %s", err)
+	}
+
+	upload := &imageUpload{
+		data:        data,
+		contentType: contentType,
+		extension:   extension,
+		width:       int32(config.Width),
+		height:      int32(config.Height),
+	}
+
+	// JPEG thumbnails stay JPEG; anything that may carry transparency becomes
+	// a PNG
+	var thumbnail bytes.Buffer
+	if contentType == "image/jpeg" {
+		err = jpeg.Encode(&thumbnail, scaleToFit(decoded, thumbnailSide), &jpeg.Options{Quality: 85})
+		upload.thumbnailExtension = ".jpg"
+	} else {
+		err = png.Encode(&thumbnail, scaleToFit(decoded, thumbnailSide))
+		upload.thumbnailExtension = ".png"
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	upload.thumbnail = thumbnail.Bytes()
+
+	return upload, nil
+}
+
+// scaleToFit shrinks src, keeping its aspect ratio, so neither side exceeds
+// side. Each output pixel is the average of the source pixels it covers,
+// which avoids the aliasing of nearest-neighbour sampling. Images that
+// already fit are copied as they are.
+func scaleToFit(src image.Image, side int) *image.RGBA {
+	bounds := src.Bounds()
+	width, height := bounds.Dx(), bounds.Dy()
+
+	targetWidth, targetHeight := width, height
+	if width > side || height > side {
+		if width >= height {
+			targetWidth, targetHeight = side, max(1, height*side/width)
+		} else {
+			targetWidth, targetHeight = max(1, width*side/height), side
+		}
+	}
+
+	dst := image.NewRGBA(image.Rect(0, 0, targetWidth, targetHeight))
+	for y := 0; y < targetHeight; y++ {
+		y0 := bounds.Min.Y + y*height/targetHeight
+		y1 := max(y0+1, bounds.Min.Y+(y+1)*height/targetHeight)
+
+		for x := 0; x < targetWidth; x++ {
+			x0 := bounds.Min.X + x*width/targetWidth
+			x1 := max(x0+1, bounds.Min.X+(x+1)*width/targetWidth)
+
+			var r, g, b, a, count uint64
+			for sy := y0; sy < y1; sy++ {
+				for sx := x0; sx < x1; sx++ {
+					pr, pg, pb, pa := src.At(sx, sy).RGBA()
+					r, g, b, a = r+uint64(pr), g+uint64(pg), b+uint64(pb), a+uint64(pa)
+					count++
+				}
+			}
+
+			dst.Set(x, y, color.RGBA64{
+				R: uint16(r / count),
+				G: uint16(g / count),
+				B: uint16(b / count),
+				A: uint16(a / count),
+			})
+		}
+	}
+
+	return dst
+}
+
+// checkImageOrder makes sure an ordering names each of the item's images
+// exactly once.
+func checkImageOrder(itemID int32, images []*ItemImage, imageIDs []int32) error {
+	seen := make(map[int32]bool, len(imageIDs))
+	for _, id := range imageIDs {
+		if seen[id] {
+			return validationError("image_ids", "Image %d is listed more than once", id)
+		}
+		seen[id] = true
+	}
+
+	for _, image := range images {
+		if !seen[int32(image.ID)] {
+			return validationError("image_ids", "Image order must list every image of item %d; %d is missing", itemID, image.ID)
+		}
+	}
+
+	if len(imageIDs) != len(images) {
+		return validationError("image_ids", "Image order lists images that do not belong to item %d", itemID)
+	}
+
+	return nil
+}
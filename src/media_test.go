@@ -0,0 +1,40 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"strings"
+	"testing"
+)
+
+func TestLocalBlobStoreOpensOnlyFiles(t *testing.T) {
+	blobs, err := NewLocalBlobStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := blobs.Put("items/1/photo.jpg", strings.NewReader("jpeg")); err != nil {
+		t.Fatal(err)
+	}
+
+	file, err := blobs.Open("items/1/photo.jpg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := io.ReadAll(file)
+	file.Close()
+	if err != nil || string(body) != "jpeg" {
+		t.Fatalf("got %q, %v", body, err)
+	}
+
+	for _, key := range []string{"items", "items/1", "items/2/photo.jpg"} {
+		if _, err := blobs.Open(key); !errors.Is(err, fs.ErrNotExist) {
+			t.Errorf("opening %q: got %v, want not found", key, err)
+		}
+	}
+
+	if _, err := blobs.Open("../secret"); err == nil {
+		t.Error("opened a key outside the root")
+	}
+}
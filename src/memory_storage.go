@@ -0,0 +1,2262 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/alexedwards/argon2id"
+)
+
+// MemoryStorage is an in-process implementation of Storage. It keeps every
+// record in maps guarded by a single mutex, so it is only suitable for tests
+// and local development where no Postgres instance is available.
+//
+// A MemoryStorage handed to a WithTx callback shares the same data but does
+// not lock it again, since WithTx holds the mutex for the whole transaction.
+type MemoryStorage struct {
+	mu   *sync.Mutex
+	data *memoryData
+	inTx bool
+}
+
+type memoryData struct {
+	admins map[uint32]*AdminAccount
+	users  map[uint32]*UserAccount
+	items  map[uint32]*Item
+	orders map[uint32]*Order
+	carts  map[uint32][]*CartItem
+
+	categories     map[uint32]*Category
+	itemCategories map[uint32][]int32
+
+	skus        map[uint32]*SKU
+	itemOptions map[uint32][]*ItemOption
+	itemImages  map[uint32]*ItemImage
+
+	sessions       map[string]*Session
+	refreshTokens  map[string]*refreshToken
+	passwordResets map[string]*passwordReset
+	loginThrottles map[string]*LoginThrottle
+	adminMFA       map[uint32]*adminMFA
+	apiKeys        map[uint32]*APIKey
+	apiKeyHashes   map[string]uint32
+
+	reservations       map[reservationKey]*stockReservation
+	stockAdjustments   []*StockAdjustment
+	orderStatusHistory []*OrderStatusChange
+
+	nextAdminID             uint32
+	nextUserID              uint32
+	nextItemID              uint32
+	nextOrderID             uint32
+	nextStockAdjustmentID   uint32
+	nextOrderStatusChangeID uint32
+	nextCategoryID          uint32
+	nextSKUID               uint32
+	nextItemImageID         uint32
+	nextAPIKeyID            uint32
+}
+
+type reservationKey struct {
+	userID uint32
+	itemID int32
+	skuID  int32
+}
+
+// refreshToken is a stored refresh token, keyed by its hash.
+type refreshToken struct {
+	sessionID string
+	used      bool
+}
+
+// passwordReset is a stored reset token, keyed by its hash.
+type passwordReset struct {
+	kind      SessionKind
+	accountID int32
+	expiresAt time.Time
+	used      bool
+}
+
+// adminMFA is an admin's TOTP setup and recovery codes, the codes keyed by
+// hash with whether they have been used.
+type adminMFA struct {
+	mfaState
+	recoveryCodes map[string]bool
+}
+
+type stockReservation struct {
+	quantity  int32
+	expiresAt time.Time
+}
+
+func NewMemoryStorage() *MemoryStorage {
+	return &MemoryStorage{
+		mu: new(sync.Mutex),
+		data: &memoryData{
+			admins:                  make(map[uint32]*AdminAccount),
+			users:                   make(map[uint32]*UserAccount),
+			items:                   make(map[uint32]*Item),
+			orders:                  make(map[uint32]*Order),
+			carts:                   make(map[uint32][]*CartItem),
+			categories:              make(map[uint32]*Category),
+			itemCategories:          make(map[uint32][]int32),
+			skus:                    make(map[uint32]*SKU),
+			itemOptions:             make(map[uint32][]*ItemOption),
+			itemImages:              make(map[uint32]*ItemImage),
+			sessions:                make(map[string]*Session),
+			refreshTokens:           make(map[string]*refreshToken),
+			passwordResets:          make(map[string]*passwordReset),
+			loginThrottles:          make(map[string]*LoginThrottle),
+			adminMFA:                make(map[uint32]*adminMFA),
+			apiKeys:                 make(map[uint32]*APIKey),
+			apiKeyHashes:            make(map[string]uint32),
+			reservations:            make(map[reservationKey]*stockReservation),
+			stockAdjustments:        make([]*StockAdjustment, 0),
+			orderStatusHistory:      make([]*OrderStatusChange, 0),
+			nextAdminID:             1,
+			nextUserID:              1,
+			nextItemID:              1,
+			nextOrderID:             1,
+			nextStockAdjustmentID:   1,
+			nextOrderStatusChangeID: 1,
+			nextCategoryID:          1,
+			nextSKUID:               1,
+			nextItemImageID:         1,
+			nextAPIKeyID:            1,
+		},
+	}
+}
+
+// WithTx runs fn with exclusive access to the store and restores the state
+// from before the call if fn returns an error.
+func (self *MemoryStorage) WithTx(fn func(Storage) error) error {
+	if self.inTx {
+		return fn(self)
+	}
+
+	defer self.lock()()
+
+	snapshot := self.data.clone()
+	if err := fn(&MemoryStorage{mu: self.mu, data: self.data, inTx: true}); err != nil {
+		*self.data = *snapshot
+		return err
+	}
+
+	return nil
+}
+
+func (self *MemoryStorage) lock() func() {
+	if self.inTx {
+		return func() {}
+	}
+
+	self.mu.Lock()
+	return self.mu.Unlock
+}
+
+func (self *MemoryStorage) Init() error {
+	rootUser := os.Getenv("ROOT_USER")
+	rootPass := os.Getenv("ROOT_PASS")
+	if rootUser == "" || rootPass == "" {
+		return fmt.Errorf("ROOT_USER and ROOT_PASS must be set")
+	}
+
+	rootAccount, err := NewAdminAccount(rootUser, rootPass, RoleOwner)
+	if err != nil {
+		return err
+	}
+
+	defer self.lock()()
+
+	if _, ok := self.data.admins[1]; ok {
+		return nil
+	}
+
+	rootAccount.ID = 1
+	self.data.admins[1] = rootAccount
+	if self.data.nextAdminID <= 1 {
+		self.data.nextAdminID = 2
+	}
+
+	return nil
+}
+
+func (self *MemoryStorage) CreateAdminAccount(account *AdminAccount) error {
+	defer self.lock()()
+
+	account.ID = self.data.nextAdminID
+	self.data.nextAdminID++
+	self.data.admins[account.ID] = copyAdminAccount(account)
+
+	return nil
+}
+
+func (self *MemoryStorage) CreateUserAccount(account *UserAccount) error {
+	defer self.lock()()
+
+	if err := self.checkEmailFree(0, account.Email); err != nil {
+		return err
+	}
+
+	account.ID = self.data.nextUserID
+	self.data.nextUserID++
+	self.data.users[account.ID] = copyUserAccount(account)
+
+	return nil
+}
+
+func (self *MemoryStorage) UpdateAdminAccount(account *AdminAccount) error {
+	defer self.lock()()
+
+	stored, ok := self.data.admins[account.ID]
+	if !ok {
+		return notFoundError("Account %d not found", account.ID)
+	}
+
+	stored.Username = account.Username
+
+	return nil
+}
+
+func (self *MemoryStorage) LoginAdminAccount(username, password string) (*AdminAccount, error) {
+	unlock := self.lock()
+	var account *AdminAccount
+	for _, id := range sortedKeys(self.data.admins) {
+		if self.data.admins[id].Username == username {
+			account = copyAdminAccount(self.data.admins[id])
+			break
+		}
+	}
+	unlock()
+
+	if account == nil {
+		return nil, rejectUnknownLogin(password)
+	}
+
+	if match, err := argon2id.ComparePasswordAndHash(password, account.HashedPassword); err != nil {
+		return nil, err
+	} else if !match {
+		return nil, errInvalidCredentials
+	}
+
+	return account, nil
+}
+
+func (self *MemoryStorage) LoginUserAccount(username, password string) (*TokenPair, error) {
+	unlock := self.lock()
+	var account *UserAccount
+	for _, id := range sortedKeys(self.data.users) {
+		if self.data.users[id].Username == username {
+			account = copyUserAccount(self.data.users[id])
+			break
+		}
+	}
+	unlock()
+
+	if account == nil {
+		return nil, rejectUnknownLogin(password)
+	}
+
+	if match, err := argon2id.ComparePasswordAndHash(password, account.HashedPassword); err != nil {
+		return nil, err
+	} else if !match {
+		return nil, errInvalidCredentials
+	}
+
+	return self.openSession(UserSession, int32(account.ID), account.Username, "")
+}
+
+func (self *MemoryStorage) OpenSession(kind SessionKind, accountID int32) (*TokenPair, error) {
+	unlock := self.lock()
+	username, role, err := self.accountIdentity(kind, accountID)
+	unlock()
+
+	if err != nil {
+		return nil, err
+	}
+
+	return self.openSession(kind, accountID, username, role)
+}
+
+// accountIdentity is the username and role that go into the account's
+// access tokens.
+func (self *MemoryStorage) accountIdentity(kind SessionKind, accountID int32) (string, Role, error) {
+	if kind == AdminSession {
+		if account, ok := self.data.admins[uint32(accountID)]; ok {
+			return account.Username, account.Role, nil
+		}
+	} else if account, ok := self.data.users[uint32(accountID)]; ok {
+		return account.Username, "", nil
+	}
+
+	return "", "", notFoundError("Account %d not found", accountID)
+}
+
+// openSession starts a session for an account that has just authenticated
+// and clears out the account's expired ones.
+func (self *MemoryStorage) openSession(kind SessionKind, accountID int32, username string, role Role) (*TokenPair, error) {
+	session, err := NewSession(kind, accountID)
+	if err != nil {
+		return nil, err
+	}
+
+	tokens, refreshHash, err := issueTokens(session, username, role)
+	if err != nil {
+		return nil, err
+	}
+
+	defer self.lock()()
+
+	for id, existing := range self.data.sessions {
+		if existing.Kind == kind && existing.AccountID == accountID && !existing.ExpiresAt.After(session.CreatedAt) {
+			self.dropSession(id)
+		}
+	}
+
+	self.data.sessions[session.ID] = session
+	self.data.refreshTokens[refreshHash] = &refreshToken{sessionID: session.ID}
+
+	return tokens, nil
+}
+
+// RefreshSession swaps a refresh token for a new pair. Presenting a token
+// that was already swapped means it leaked, so the whole session is revoked.
+func (self *MemoryStorage) RefreshSession(kind SessionKind, token string) (*TokenPair, error) {
+	defer self.lock()()
+
+	stored, ok := self.data.refreshTokens[hashToken(token)]
+	if !ok {
+		return nil, errInvalidRefreshToken
+	}
+
+	session := self.data.sessions[stored.sessionID]
+	if session.Kind != kind {
+		return nil, errInvalidRefreshToken
+	}
+
+	if stored.used {
+		self.revokeSession(session)
+		return nil, errRefreshTokenReused
+	}
+
+	if !session.Active() {
+		return nil, errInvalidRefreshToken
+	}
+
+	username, role, err := self.accountIdentity(session.Kind, session.AccountID)
+	if err != nil {
+		return nil, err
+	}
+
+	tokens, refreshHash, err := issueTokens(session, username, role)
+	if err != nil {
+		return nil, err
+	}
+
+	stored.used = true
+	self.data.refreshTokens[refreshHash] = &refreshToken{sessionID: session.ID}
+	session.ExpiresAt = time.Now().UTC().Add(refreshTokenTTL)
+
+	return tokens, nil
+}
+
+// RevokeSession ends the session the refresh token belongs to, which is how
+// a client logs out.
+func (self *MemoryStorage) RevokeSession(kind SessionKind, token string) error {
+	defer self.lock()()
+
+	stored, ok := self.data.refreshTokens[hashToken(token)]
+	if !ok || self.data.sessions[stored.sessionID].Kind != kind {
+		return errInvalidRefreshToken
+	}
+
+	self.revokeSession(self.data.sessions[stored.sessionID])
+
+	return nil
+}
+
+func (self *MemoryStorage) revokeSession(session *Session) {
+	if session.RevokedAt == nil {
+		now := time.Now().UTC()
+		session.RevokedAt = &now
+	}
+}
+
+func (self *MemoryStorage) GetSession(id string) (*Session, error) {
+	defer self.lock()()
+
+	session, ok := self.data.sessions[id]
+	if !ok {
+		return nil, notFoundError("Session not found")
+	}
+
+	return copySession(session), nil
+}
+
+// dropSession deletes a session and its refresh tokens.
+func (self *MemoryStorage) dropSession(id string) {
+	delete(self.data.sessions, id)
+	for hash, token := range self.data.refreshTokens {
+		if token.sessionID == id {
+			delete(self.data.refreshTokens, hash)
+		}
+	}
+}
+
+// dropSessions deletes every session and reset token of an account that is
+// being deleted.
+func (self *MemoryStorage) dropSessions(kind SessionKind, accountID int32) {
+	for id, session := range self.data.sessions {
+		if session.Kind == kind && session.AccountID == accountID {
+			self.dropSession(id)
+		}
+	}
+
+	for hash, reset := range self.data.passwordResets {
+		if reset.kind == kind && reset.accountID == accountID {
+			delete(self.data.passwordResets, hash)
+		}
+	}
+}
+
+// hashedPassword points at the stored password hash of the account, or is
+// nil when there is no such account.
+func (self *MemoryStorage) hashedPassword(kind SessionKind, id int32) *string {
+	if kind == AdminSession {
+		if account, ok := self.data.admins[uint32(id)]; ok {
+			return &account.HashedPassword
+		}
+	} else if account, ok := self.data.users[uint32(id)]; ok {
+		return &account.HashedPassword
+	}
+
+	return nil
+}
+
+func (self *MemoryStorage) ChangePassword(kind SessionKind, id int32, current, next string) error {
+	if err := checkPassword(next); err != nil {
+		return err
+	}
+
+	unlock := self.lock()
+	stored := self.hashedPassword(kind, id)
+	var hashedPassword string
+	if stored != nil {
+		hashedPassword = *stored
+	}
+	unlock()
+
+	if stored == nil {
+		return notFoundError("Account %d not found", id)
+	}
+
+	if match, err := argon2id.ComparePasswordAndHash(current, hashedPassword); err != nil {
+		return err
+	} else if !match {
+		return validationError("current_password", "Current password is incorrect")
+	}
+
+	hashedPassword, err := argon2id.CreateHash(next, argon2id.DefaultParams)
+	if err != nil {
+		return err
+	}
+
+	defer self.lock()()
+
+	if stored := self.hashedPassword(kind, id); stored != nil {
+		*stored = hashedPassword
+	}
+
+	return nil
+}
+
+// CreatePasswordReset issues a reset token for the account with the
+// username. It returns nil, and no error, when there is no such account so
+// that callers cannot tell which usernames exist.
+func (self *MemoryStorage) CreatePasswordReset(kind SessionKind, username string) (*PasswordReset, error) {
+	defer self.lock()()
+
+	id := int32(-1)
+	var email string
+	if kind == AdminSession {
+		for _, account := range self.data.admins {
+			if account.Username == username {
+				id = int32(account.ID)
+				break
+			}
+		}
+	} else {
+		for _, account := range self.data.users {
+			if account.Username == username {
+				id, email = int32(account.ID), account.Email
+				break
+			}
+		}
+	}
+
+	if id < 0 {
+		return nil, nil
+	}
+
+	reset, err := NewPasswordReset(kind, id, username, email)
+	if err != nil {
+		return nil, err
+	}
+
+	self.data.passwordResets[hashToken(reset.Token)] = &passwordReset{
+		kind:      kind,
+		accountID: id,
+		expiresAt: reset.ExpiresAt,
+	}
+
+	return reset, nil
+}
+
+// ResetPassword sets a new password with a reset token. The token, and every
+// other outstanding token of the account, is used up, and all of the
+// account's sessions are revoked.
+func (self *MemoryStorage) ResetPassword(kind SessionKind, token, password string) error {
+	if err := checkPassword(password); err != nil {
+		return err
+	}
+
+	hashedPassword, err := argon2id.CreateHash(password, argon2id.DefaultParams)
+	if err != nil {
+		return err
+	}
+
+	defer self.lock()()
+
+	reset, ok := self.data.passwordResets[hashToken(token)]
+	if !ok || reset.kind != kind || reset.used || !time.Now().UTC().Before(reset.expiresAt) {
+		return errInvalidResetToken
+	}
+
+	stored := self.hashedPassword(kind, reset.accountID)
+	if stored == nil {
+		return errInvalidResetToken
+	}
+
+	for _, other := range self.data.passwordResets {
+		if other.kind == kind && other.accountID == reset.accountID {
+			other.used = true
+		}
+	}
+
+	*stored = hashedPassword
+	for _, session := range self.data.sessions {
+		if session.Kind == kind && session.AccountID == reset.accountID {
+			self.revokeSession(session)
+		}
+	}
+
+	return nil
+}
+
+func (self *MemoryStorage) GetLoginThrottle(key string) (*LoginThrottle, error) {
+	defer self.lock()()
+
+	if throttle, ok := self.data.loginThrottles[key]; ok {
+		return copyLoginThrottle(throttle), nil
+	}
+
+	return &LoginThrottle{Key: key}, nil
+}
+
+func (self *MemoryStorage) RecordLoginFailure(key string) (*LoginThrottle, error) {
+	defer self.lock()()
+
+	throttle, ok := self.data.loginThrottles[key]
+	if !ok {
+		throttle = &LoginThrottle{Key: key}
+		self.data.loginThrottles[key] = throttle
+	}
+
+	throttle.recordFailure(time.Now().UTC())
+
+	return copyLoginThrottle(throttle), nil
+}
+
+func (self *MemoryStorage) ClearLoginThrottle(key string) error {
+	defer self.lock()()
+
+	delete(self.data.loginThrottles, key)
+
+	return nil
+}
+
+func (self *MemoryStorage) BeginMFAEnrollment(adminID int32, secret string) error {
+	defer self.lock()()
+
+	if _, ok := self.data.admins[uint32(adminID)]; !ok {
+		return notFoundError("Account %d not found", adminID)
+	}
+
+	if mfa, ok := self.data.adminMFA[uint32(adminID)]; ok && mfa.confirmed {
+		return errMFAAlreadyEnabled
+	}
+
+	self.data.adminMFA[uint32(adminID)] = &adminMFA{
+		mfaState:      mfaState{secret: secret},
+		recoveryCodes: make(map[string]bool),
+	}
+
+	return nil
+}
+
+// ConfirmMFAEnrollment puts the pending secret in force once the admin proves
+// their authenticator has it, and replaces their recovery codes.
+func (self *MemoryStorage) ConfirmMFAEnrollment(adminID int32, code string, recoveryHashes []string) error {
+	defer self.lock()()
+
+	account, ok := self.data.admins[uint32(adminID)]
+	if !ok {
+		return notFoundError("Account %d not found", adminID)
+	}
+
+	mfa, ok := self.data.adminMFA[uint32(adminID)]
+	if !ok {
+		return errMFANotEnrolling
+	}
+
+	if mfa.confirmed {
+		return errMFAAlreadyEnabled
+	}
+
+	step, ok := matchTOTP(mfa.secret, code, mfa.lastStep, time.Now().UTC())
+	if !ok {
+		return errInvalidMFACode
+	}
+
+	mfa.confirmed, mfa.lastStep = true, step
+	mfa.recoveryCodes = make(map[string]bool, len(recoveryHashes))
+	for _, hash := range recoveryHashes {
+		mfa.recoveryCodes[hash] = false
+	}
+	account.MFAEnabled = true
+
+	return nil
+}
+
+// VerifyMFA accepts a current TOTP code that has not been used yet, or one
+// of the admin's unused recovery codes, which it uses up.
+func (self *MemoryStorage) VerifyMFA(adminID int32, code string) error {
+	defer self.lock()()
+
+	if _, ok := self.data.admins[uint32(adminID)]; !ok {
+		return notFoundError("Account %d not found", adminID)
+	}
+
+	mfa, ok := self.data.adminMFA[uint32(adminID)]
+	if !ok || !mfa.confirmed {
+		return errMFANotEnabled
+	}
+
+	if isTOTPCode(code) {
+		step, ok := matchTOTP(mfa.secret, code, mfa.lastStep, time.Now().UTC())
+		if !ok {
+			return errInvalidMFACode
+		}
+
+		mfa.lastStep = step
+
+		return nil
+	}
+
+	hash := hashRecoveryCode(code)
+	if used, ok := mfa.recoveryCodes[hash]; !ok || used {
+		return errInvalidMFACode
+	}
+
+	mfa.recoveryCodes[hash] = true
+
+	return nil
+}
+
+func (self *MemoryStorage) DisableMFA(adminID int32) error {
+	defer self.lock()()
+
+	account, ok := self.data.admins[uint32(adminID)]
+	if !ok {
+		return notFoundError("Account %d not found", adminID)
+	}
+
+	delete(self.data.adminMFA, uint32(adminID))
+	account.MFAEnabled = false
+
+	return nil
+}
+
+func (self *MemoryStorage) CreateAPIKey(key *APIKey, keyHash string) error {
+	defer self.lock()()
+
+	if _, ok := self.data.admins[uint32(key.AdminID)]; !ok {
+		return notFoundError("Account %d not found", key.AdminID)
+	}
+
+	key.ID = int32(self.data.nextAPIKeyID)
+	self.data.nextAPIKeyID++
+
+	self.data.apiKeys[uint32(key.ID)] = copyAPIKey(key)
+	self.data.apiKeyHashes[keyHash] = uint32(key.ID)
+
+	return nil
+}
+
+func (self *MemoryStorage) GetAPIKeys(adminID int32) ([]*APIKey, error) {
+	defer self.lock()()
+
+	keys := []*APIKey{}
+	for _, id := range sortedKeys(self.data.apiKeys) {
+		if key := self.data.apiKeys[id]; key.AdminID == adminID {
+			keys = append(keys, copyAPIKey(key))
+		}
+	}
+
+	return keys, nil
+}
+
+func (self *MemoryStorage) RevokeAPIKey(adminID, keyID int32) error {
+	defer self.lock()()
+
+	key, ok := self.data.apiKeys[uint32(keyID)]
+	if !ok || key.AdminID != adminID {
+		return notFoundError("API key %d not found", keyID)
+	}
+
+	if key.RevokedAt == nil {
+		now := time.Now().UTC()
+		key.RevokedAt = &now
+	}
+
+	return nil
+}
+
+// FindAPIKey finds the active key with the hash.
+func (self *MemoryStorage) FindAPIKey(keyHash string) (*APIKey, error) {
+	defer self.lock()()
+
+	id, ok := self.data.apiKeyHashes[keyHash]
+	if !ok {
+		return nil, errInvalidAPIKey
+	}
+
+	key := self.data.apiKeys[id]
+	if !key.Active(time.Now().UTC()) {
+		return nil, errInvalidAPIKey
+	}
+
+	return copyAPIKey(key), nil
+}
+
+// RecordAPIKeyUse notes that the key was just used. Call it once a request
+// made with the key has passed every check.
+func (self *MemoryStorage) RecordAPIKeyUse(keyID int32) error {
+	defer self.lock()()
+
+	key, ok := self.data.apiKeys[uint32(keyID)]
+	if !ok {
+		return notFoundError("API key %d not found", keyID)
+	}
+
+	now := time.Now().UTC()
+	key.LastUsedAt = &now
+
+	return nil
+}
+
+func (self *MemoryStorage) UpdateUserAccount(account *UserAccount) error {
+	defer self.lock()()
+
+	stored, ok := self.data.users[account.ID]
+	if !ok {
+		return notFoundError("Account %d not found", account.ID)
+	}
+
+	if account.Email != "" && account.Email != stored.Email {
+		if err := self.checkEmailFree(account.ID, account.Email); err != nil {
+			return err
+		}
+
+		stored.Email = account.Email
+		stored.EmailVerifiedAt = nil
+		stored.VerificationSentAt = nil
+	}
+
+	if account.Username != "" {
+		stored.Username = account.Username
+	}
+
+	return nil
+}
+
+// checkEmailFree refuses an email that another account already has.
+func (self *MemoryStorage) checkEmailFree(id uint32, email string) error {
+	for _, other := range self.data.users {
+		if other.ID != id && other.Email != "" && strings.EqualFold(other.Email, email) {
+			return emailTakenError(email)
+		}
+	}
+
+	return nil
+}
+
+// ClaimVerificationEmail records that a verification email is about to be
+// sent to the account, refusing if one went out too recently or the email is
+// already verified.
+func (self *MemoryStorage) ClaimVerificationEmail(id int32) (*UserAccount, error) {
+	defer self.lock()()
+
+	account, ok := self.data.users[uint32(id)]
+	if !ok {
+		return nil, notFoundError("Account %d not found", id)
+	}
+
+	now := time.Now().UTC()
+	if err := checkVerificationClaim(account, now); err != nil {
+		return nil, err
+	}
+
+	account.VerificationSentAt = &now
+
+	return copyUserAccount(account), nil
+}
+
+// VerifyUserEmail marks the email verified if it is still the account's
+// email. Verifying twice is not an error.
+func (self *MemoryStorage) VerifyUserEmail(id int32, email string) error {
+	defer self.lock()()
+
+	account, ok := self.data.users[uint32(id)]
+	if !ok || account.Email != email {
+		return unauthorizedError("Verification link is no longer valid")
+	}
+
+	if account.EmailVerifiedAt == nil {
+		now := time.Now().UTC()
+		account.EmailVerifiedAt = &now
+	}
+
+	return nil
+}
+
+func (self *MemoryStorage) LockUserAccount(id int32) (*UserAccount, error) {
+	return self.GetUserAccount(id)
+}
+
+func (self *MemoryStorage) GetAdminAccount(id int32) (*AdminAccount, error) {
+	defer self.lock()()
+
+	account, ok := self.data.admins[uint32(id)]
+	if !ok {
+		return nil, notFoundError("Account %d not found", id)
+	}
+
+	return copyAdminAccount(account), nil
+}
+
+func (self *MemoryStorage) GetUserAccount(id int32) (*UserAccount, error) {
+	defer self.lock()()
+
+	account, ok := self.data.users[uint32(id)]
+	if !ok {
+		return nil, notFoundError("Account %d not found", id)
+	}
+
+	return copyUserAccount(account), nil
+}
+
+func (self *MemoryStorage) DeleteAdminAccount(id int32) error {
+	defer self.lock()()
+
+	if _, ok := self.data.admins[uint32(id)]; !ok {
+		return notFoundError("Account %d not found", id)
+	}
+
+	if err := self.guardLastOwner(id); err != nil {
+		return err
+	}
+
+	delete(self.data.admins, uint32(id))
+	delete(self.data.adminMFA, uint32(id))
+	for hash, keyID := range self.data.apiKeyHashes {
+		if self.data.apiKeys[keyID].AdminID == id {
+			delete(self.data.apiKeys, keyID)
+			delete(self.data.apiKeyHashes, hash)
+		}
+	}
+	self.dropSessions(AdminSession, id)
+
+	return nil
+}
+
+func (self *MemoryStorage) SetAdminRole(id int32, role Role) error {
+	if err := checkRole(role); err != nil {
+		return err
+	}
+
+	defer self.lock()()
+
+	account, ok := self.data.admins[uint32(id)]
+	if !ok {
+		return notFoundError("Account %d not found", id)
+	}
+
+	if role != RoleOwner {
+		if err := self.guardLastOwner(id); err != nil {
+			return err
+		}
+	}
+
+	account.Role = role
+
+	return nil
+}
+
+// guardLastOwner refuses to let the admin stop being an owner when no other
+// owner is left.
+func (self *MemoryStorage) guardLastOwner(id int32) error {
+	for ownerID, account := range self.data.admins {
+		if account.Role == RoleOwner && ownerID != uint32(id) {
+			return nil
+		}
+	}
+
+	if self.data.admins[uint32(id)].Role == RoleOwner {
+		return lastOwnerError(id)
+	}
+
+	return nil
+}
+
+func (self *MemoryStorage) DeleteUserAccount(id int32) error {
+	defer self.lock()()
+
+	if _, ok := self.data.users[uint32(id)]; !ok {
+		return notFoundError("Account %d not found", id)
+	}
+
+	delete(self.data.users, uint32(id))
+	delete(self.data.carts, uint32(id))
+	self.dropSessions(UserSession, id)
+	for key := range self.data.reservations {
+		if key.userID == uint32(id) {
+			delete(self.data.reservations, key)
+		}
+	}
+
+	return nil
+}
+
+func (self *MemoryStorage) AddItemToUserAccount(accountID, itemID, skuID, quantity int32) error {
+	defer self.lock()()
+
+	if err := self.checkCartTarget(accountID, itemID); err != nil {
+		return err
+	}
+
+	var current int32
+	if cartItem := self.findCartItem(accountID, itemID, skuID); cartItem != nil {
+		current = cartItem.Quantity
+	}
+
+	return self.setCartQuantity(accountID, itemID, skuID, current+quantity)
+}
+
+func (self *MemoryStorage) SetUserItemQuantity(accountID, itemID, skuID, quantity int32) error {
+	if quantity == 0 {
+		return self.RemoveItemFromUserAccount(accountID, itemID, skuID)
+	}
+
+	defer self.lock()()
+
+	if err := self.checkCartTarget(accountID, itemID); err != nil {
+		return err
+	}
+
+	return self.setCartQuantity(accountID, itemID, skuID, quantity)
+}
+
+func (self *MemoryStorage) setCartQuantity(accountID, itemID, skuID, quantity int32) error {
+	if err := self.reserveStock(accountID, itemID, skuID, quantity); err != nil {
+		return err
+	}
+
+	if cartItem := self.findCartItem(accountID, itemID, skuID); cartItem != nil {
+		cartItem.Quantity = quantity
+		return nil
+	}
+
+	self.data.carts[uint32(accountID)] = append(self.data.carts[uint32(accountID)], &CartItem{ItemID: itemID, SKUID: skuID, Quantity: quantity})
+
+	return nil
+}
+
+func (self *MemoryStorage) checkCartTarget(accountID, itemID int32) error {
+	if _, ok := self.data.items[uint32(itemID)]; !ok {
+		return validationError("item_id", "Item %d not found", itemID)
+	}
+
+	if _, ok := self.data.users[uint32(accountID)]; !ok {
+		return notFoundError("Account %d not found", accountID)
+	}
+
+	return nil
+}
+
+func (self *MemoryStorage) findCartItem(accountID, itemID, skuID int32) *CartItem {
+	for _, cartItem := range self.data.carts[uint32(accountID)] {
+		if cartItem.ItemID == itemID && cartItem.SKUID == skuID {
+			return cartItem
+		}
+	}
+
+	return nil
+}
+
+func (self *MemoryStorage) RemoveItemFromUserAccount(accountID, itemID, skuID int32) error {
+	defer self.lock()()
+
+	if self.findCartItem(accountID, itemID, skuID) == nil {
+		return notFoundError("Cart line for %s in account %d not found", stockLabel(itemID, skuID), accountID)
+	}
+
+	self.removeCartItems(uint32(accountID), func(cartItem *CartItem) bool {
+		return cartItem.ItemID == itemID && cartItem.SKUID == skuID
+	})
+	delete(self.data.reservations, reservationKey{uint32(accountID), itemID, skuID})
+
+	return nil
+}
+
+func (self *MemoryStorage) removeCartItems(accountID uint32, matches func(*CartItem) bool) {
+	kept := make([]*CartItem, 0)
+	for _, cartItem := range self.data.carts[accountID] {
+		if !matches(cartItem) {
+			kept = append(kept, cartItem)
+		}
+	}
+
+	self.data.carts[accountID] = kept
+}
+
+// clearCartLines removes every cart line and stock reservation the predicate
+// matches, across all accounts.
+func (self *MemoryStorage) clearCartLines(matches func(itemID, skuID int32) bool) {
+	for accountID := range self.data.carts {
+		self.removeCartItems(accountID, func(cartItem *CartItem) bool {
+			return matches(cartItem.ItemID, cartItem.SKUID)
+		})
+	}
+
+	for key := range self.data.reservations {
+		if matches(key.itemID, key.skuID) {
+			delete(self.data.reservations, key)
+		}
+	}
+}
+
+func (self *MemoryStorage) GetUserItems(accountID int32) ([]*CartItem, error) {
+	defer self.lock()()
+
+	return copyCartItems(self.data.carts[uint32(accountID)]), nil
+}
+
+func (self *MemoryStorage) ClearUserItems(accountID int32) error {
+	defer self.lock()()
+
+	delete(self.data.carts, uint32(accountID))
+	for key := range self.data.reservations {
+		if key.userID == uint32(accountID) {
+			delete(self.data.reservations, key)
+		}
+	}
+
+	return nil
+}
+
+func (self *MemoryStorage) GetAdminAccounts(opts ListOptions) (*Page[*AdminAccount], error) {
+	defer self.lock()()
+
+	accounts := make([]*AdminAccount, 0, len(self.data.admins))
+	for _, id := range sortedKeys(self.data.admins) {
+		accounts = append(accounts, copyAdminAccount(self.data.admins[id]))
+	}
+
+	return adminListing.paginate(accounts, opts)
+}
+
+func (self *MemoryStorage) GetUserAccounts(opts ListOptions) (*Page[*UserAccount], error) {
+	defer self.lock()()
+
+	accounts := make([]*UserAccount, 0, len(self.data.users))
+	for _, id := range sortedKeys(self.data.users) {
+		accounts = append(accounts, copyUserAccount(self.data.users[id]))
+	}
+
+	return userListing.paginate(accounts, opts)
+}
+
+func (self *MemoryStorage) CreateItem(item *Item) error {
+	defer self.lock()()
+
+	item.ID = self.data.nextItemID
+	self.data.nextItemID++
+	self.data.items[item.ID] = copyItem(item)
+
+	return nil
+}
+
+func (self *MemoryStorage) GetItem(id int32) (*Item, error) {
+	defer self.lock()()
+
+	item, ok := self.data.items[uint32(id)]
+	if !ok {
+		return nil, notFoundError("Item %d not found", id)
+	}
+
+	return copyItem(item), nil
+}
+
+func (self *MemoryStorage) DeleteItem(id int32) error {
+	defer self.lock()()
+
+	if _, ok := self.data.items[uint32(id)]; !ok {
+		return notFoundError("Item %d not found", id)
+	}
+
+	delete(self.data.items, uint32(id))
+	delete(self.data.itemCategories, uint32(id))
+	delete(self.data.itemOptions, uint32(id))
+
+	for skuID, sku := range self.data.skus {
+		if sku.ItemID == id {
+			delete(self.data.skus, skuID)
+		}
+	}
+
+	for imageID, image := range self.data.itemImages {
+		if image.ItemID == id {
+			delete(self.data.itemImages, imageID)
+		}
+	}
+
+	self.clearCartLines(func(itemID, _ int32) bool { return itemID == id })
+
+	self.dropStockAdjustments(func(adjustment *StockAdjustment) bool { return adjustment.ItemID == id })
+
+	return nil
+}
+
+func (self *MemoryStorage) UpdateItem(item *Item) error {
+	defer self.lock()()
+
+	stored, ok := self.data.items[item.ID]
+	if !ok {
+		return notFoundError("Item %d not found", item.ID)
+	}
+
+	stored.Name = item.Name
+	stored.Description = item.Description
+	stored.Price = item.Price
+
+	return nil
+}
+
+func (self *MemoryStorage) GetItems(filter ItemFilter) (*Page[*Item], error) {
+	defer self.lock()()
+
+	name := strings.ToLower(filter.Name)
+
+	var subtree []int32
+	if filter.CategoryID != 0 {
+		subtree = self.categorySubtree(filter.CategoryID)
+	}
+
+	items := make([]*Item, 0, len(self.data.items))
+	for _, id := range sortedKeys(self.data.items) {
+		item := self.data.items[id]
+		if name != "" && !strings.Contains(strings.ToLower(item.Name), name) {
+			continue
+		}
+		if filter.MinPrice != nil && item.Price.Amount < *filter.MinPrice {
+			continue
+		}
+		if filter.MaxPrice != nil && item.Price.Amount > *filter.MaxPrice {
+			continue
+		}
+		if filter.Currency != "" && item.Price.Currency != filter.Currency {
+			continue
+		}
+		if subtree != nil && !self.inCategories(id, subtree) {
+			continue
+		}
+
+		items = append(items, copyItem(item))
+	}
+
+	return itemListing.paginate(items, filter.ListOptions)
+}
+
+// SearchItems matches with matchItem rather than a real text index; see
+// there for how it differs from the Postgres search.
+func (self *MemoryStorage) SearchItems(query string, limit int) ([]*ItemSearchResult, error) {
+	defer self.lock()()
+
+	terms, err := searchTerms(query)
+	if err != nil {
+		return nil, err
+	}
+
+	results := make([]*ItemSearchResult, 0)
+	for _, id := range sortedKeys(self.data.items) {
+		if result, ok := matchItem(copyItem(self.data.items[id]), terms); ok {
+			results = append(results, result)
+		}
+	}
+
+	sortSearchResults(results)
+	if len(results) > limit {
+		results = results[:limit]
+	}
+
+	return results, nil
+}
+
+func (self *MemoryStorage) GetItemsById(cartItems []*CartItem) ([]*CartLine, Money, error) {
+	defer self.lock()()
+
+	items := make(map[int32]*Item)
+	skus := make(map[int32]*SKU)
+	for _, cartItem := range cartItems {
+		if item, ok := self.data.items[uint32(cartItem.ItemID)]; ok {
+			items[cartItem.ItemID] = copyItem(item)
+		}
+
+		if sku, ok := self.data.skus[uint32(cartItem.SKUID)]; ok {
+			skus[cartItem.SKUID] = copySKU(sku)
+		}
+	}
+
+	return buildCartLines(cartItems, items, skus)
+}
+
+func (self *MemoryStorage) CreateOrder(order *Order) error {
+	defer self.lock()()
+
+	account, ok := self.data.users[order.UserID]
+	if !ok {
+		return validationError("account_id", "User %d not found", order.UserID)
+	}
+
+	// check every line before touching stock so a shortfall leaves no trace
+	for _, line := range linesByItemID(order.Lines) {
+		available, err := self.availableStock(int32(order.UserID), line.ItemID, line.SKUID)
+		if err != nil {
+			return err
+		}
+
+		if available < line.Quantity {
+			return insufficientStockError(line.ItemID, line.SKUID, line.Quantity, available)
+		}
+	}
+
+	order.ID = self.data.nextOrderID
+	self.data.nextOrderID++
+	self.data.orders[order.ID] = copyOrder(order)
+
+	orderID := int32(order.ID)
+	for _, line := range linesByItemID(order.Lines) {
+		self.recordStockChange(line.ItemID, line.SKUID, -line.Quantity, fmt.Sprintf("Order %d", order.ID), nil, &orderID)
+		delete(self.data.reservations, reservationKey{order.UserID, line.ItemID, line.SKUID})
+	}
+
+	self.recordOrderStatusChange(orderID, "", order.Status, nil)
+	account.Orders = append(account.Orders, int32(order.ID))
+
+	return nil
+}
+
+func (self *MemoryStorage) SetItemStock(itemID, skuID, stock int32, reason string, adminID int32) (*StockAdjustment, error) {
+	defer self.lock()()
+
+	current, err := self.stockOf(itemID, skuID)
+	if err != nil {
+		return nil, err
+	}
+
+	if stock < 0 {
+		return nil, validationError("stock", "Stock for %s cannot go below zero", stockLabel(itemID, skuID))
+	}
+
+	return self.recordStockChange(itemID, skuID, stock-*current, reason, &adminID, nil), nil
+}
+
+func (self *MemoryStorage) AdjustItemStock(itemID, skuID, delta int32, reason string, adminID int32) (*StockAdjustment, error) {
+	defer self.lock()()
+
+	current, err := self.stockOf(itemID, skuID)
+	if err != nil {
+		return nil, err
+	}
+
+	if *current+delta < 0 {
+		return nil, conflictError("Stock for %s cannot go below zero", stockLabel(itemID, skuID))
+	}
+
+	return self.recordStockChange(itemID, skuID, delta, reason, &adminID, nil), nil
+}
+
+func (self *MemoryStorage) GetStockAdjustments(itemID int32) ([]*StockAdjustment, error) {
+	defer self.lock()()
+
+	adjustments := make([]*StockAdjustment, 0)
+	for _, adjustment := range self.data.stockAdjustments {
+		if adjustment.ItemID == itemID {
+			adjustmentClone := *adjustment
+			adjustments = append(adjustments, &adjustmentClone)
+		}
+	}
+
+	return adjustments, nil
+}
+
+// stockOf points at the stock counter of an item, or of one of its SKUs. Items
+// with variants only have stock per SKU.
+func (self *MemoryStorage) stockOf(itemID, skuID int32) (*int32, error) {
+	item, ok := self.data.items[uint32(itemID)]
+	if !ok {
+		return nil, notFoundError("Item %d not found", itemID)
+	}
+
+	if skuID != 0 {
+		sku, ok := self.data.skus[uint32(skuID)]
+		if !ok || sku.ItemID != itemID {
+			return nil, notFoundError("SKU %d of item %d not found", skuID, itemID)
+		}
+
+		return &sku.Stock, nil
+	}
+
+	for _, sku := range self.data.skus {
+		if sku.ItemID == itemID {
+			return nil, variantRequiredError(itemID)
+		}
+	}
+
+	return &item.Stock, nil
+}
+
+func (self *MemoryStorage) availableStock(accountID, itemID, skuID int32) (int32, error) {
+	stock, err := self.stockOf(itemID, skuID)
+	if err != nil {
+		return 0, err
+	}
+
+	now := time.Now().UTC()
+	available := *stock
+	for key, reservation := range self.data.reservations {
+		if key.itemID == itemID && key.skuID == skuID && key.userID != uint32(accountID) && reservation.expiresAt.After(now) {
+			available -= reservation.quantity
+		}
+	}
+
+	return available, nil
+}
+
+func (self *MemoryStorage) reserveStock(accountID, itemID, skuID, quantity int32) error {
+	available, err := self.availableStock(accountID, itemID, skuID)
+	if err != nil {
+		return err
+	}
+
+	if available < quantity {
+		return insufficientStockError(itemID, skuID, quantity, available)
+	}
+
+	now := time.Now().UTC()
+	for key, reservation := range self.data.reservations {
+		if !reservation.expiresAt.After(now) {
+			delete(self.data.reservations, key)
+		}
+	}
+
+	self.data.reservations[reservationKey{uint32(accountID), itemID, skuID}] = &stockReservation{
+		quantity:  quantity,
+		expiresAt: now.Add(stockReservationTTL),
+	}
+
+	return nil
+}
+
+// recordStockChange applies delta to an item or SKU the caller has already
+// checked with stockOf.
+func (self *MemoryStorage) recordStockChange(itemID, skuID, delta int32, reason string, adminID, orderID *int32) *StockAdjustment {
+	stock, _ := self.stockOf(itemID, skuID)
+	*stock += delta
+
+	adjustment := &StockAdjustment{
+		ID:         self.data.nextStockAdjustmentID,
+		ItemID:     itemID,
+		SKUID:      skuID,
+		Delta:      delta,
+		StockAfter: *stock,
+		Reason:     reason,
+		AdminID:    adminID,
+		OrderID:    orderID,
+		CreatedAt:  time.Now().UTC(),
+	}
+	self.data.nextStockAdjustmentID++
+	self.data.stockAdjustments = append(self.data.stockAdjustments, adjustment)
+
+	adjustmentClone := *adjustment
+	return &adjustmentClone
+}
+
+func (self *MemoryStorage) GetOrder(id int32) (*Order, error) {
+	defer self.lock()()
+
+	order, ok := self.data.orders[uint32(id)]
+	if !ok {
+		return nil, notFoundError("Order %d not found", id)
+	}
+
+	return copyOrder(order), nil
+}
+
+func (self *MemoryStorage) DeleteOrder(id int32) error {
+	defer self.lock()()
+
+	if _, ok := self.data.orders[uint32(id)]; !ok {
+		return notFoundError("Order %d not found", id)
+	}
+
+	delete(self.data.orders, uint32(id))
+
+	history := make([]*OrderStatusChange, 0, len(self.data.orderStatusHistory))
+	for _, change := range self.data.orderStatusHistory {
+		if change.OrderID != id {
+			history = append(history, change)
+		}
+	}
+	self.data.orderStatusHistory = history
+
+	return nil
+}
+
+func (self *MemoryStorage) UpdateOrderStatus(orderID int32, status OrderStatus, adminID int32) error {
+	defer self.lock()()
+
+	stored, ok := self.data.orders[uint32(orderID)]
+	if !ok {
+		return notFoundError("Order %d not found", orderID)
+	}
+
+	if err := checkOrderTransition(stored.ID, stored.Status, status); err != nil {
+		return err
+	}
+
+	self.recordOrderStatusChange(orderID, stored.Status, status, &adminID)
+	stored.Status = status
+
+	return nil
+}
+
+func (self *MemoryStorage) recordOrderStatusChange(orderID int32, from, to OrderStatus, adminID *int32) {
+	self.data.orderStatusHistory = append(self.data.orderStatusHistory, &OrderStatusChange{
+		ID:         self.data.nextOrderStatusChangeID,
+		OrderID:    orderID,
+		FromStatus: from,
+		ToStatus:   to,
+		AdminID:    adminID,
+		CreatedAt:  time.Now().UTC(),
+	})
+	self.data.nextOrderStatusChangeID++
+}
+
+func (self *MemoryStorage) GetOrderStatusHistory(orderID int32) ([]*OrderStatusChange, error) {
+	defer self.lock()()
+
+	history := make([]*OrderStatusChange, 0)
+	for _, change := range self.data.orderStatusHistory {
+		if change.OrderID == orderID {
+			changeClone := *change
+			history = append(history, &changeClone)
+		}
+	}
+
+	return history, nil
+}
+
+func (self *MemoryStorage) GetOrders(filter OrderFilter) (*Page[*Order], error) {
+	defer self.lock()()
+
+	orders := make([]*Order, 0, len(self.data.orders))
+	for _, id := range sortedKeys(self.data.orders) {
+		order := self.data.orders[id]
+		if filter.Status != "" && order.Status != filter.Status {
+			continue
+		}
+		if filter.UserID != 0 && order.UserID != uint32(filter.UserID) {
+			continue
+		}
+		if filter.From != nil && order.CreatedAt.Before(*filter.From) {
+			continue
+		}
+		if filter.To != nil && !order.CreatedAt.Before(*filter.To) {
+			continue
+		}
+
+		orders = append(orders, copyOrder(order))
+	}
+
+	return orderListing.paginate(orders, filter.ListOptions)
+}
+
+func (self *MemoryStorage) GetOrdersById(ids []int32) ([]*Order, error) {
+	defer self.lock()()
+
+	orders := make([]*Order, 0)
+	for _, id := range sortedKeys(self.data.orders) {
+		if containsID(ids, int32(id)) {
+			orders = append(orders, copyOrder(self.data.orders[id]))
+		}
+	}
+
+	return orders, nil
+}
+
+func (self *MemoryStorage) SetItemOptions(itemID int32, options []*ItemOption) ([]*SKU, error) {
+	var skus []*SKU
+	err := self.WithTx(func(tx Storage) error {
+		mem := tx.(*MemoryStorage)
+
+		item, ok := mem.data.items[uint32(itemID)]
+		if !ok {
+			return notFoundError("Item %d not found", itemID)
+		}
+
+		existing := mem.itemSKUs(itemID)
+		introducing := len(existing) == 0 && len(options) > 0
+		if introducing && item.Stock > 0 {
+			return conflictError("Item %d still has %d units in stock; set its stock to zero before adding variants", itemID, item.Stock)
+		}
+
+		plan, err := planSKUs(itemID, options, existing)
+		if err != nil {
+			return err
+		}
+
+		for _, sku := range plan.remove {
+			skuID := int32(sku.ID)
+			mem.clearCartLines(func(_, candidate int32) bool { return candidate == skuID })
+			mem.dropStockAdjustments(func(adjustment *StockAdjustment) bool { return adjustment.SKUID == skuID })
+			delete(mem.data.skus, sku.ID)
+		}
+
+		if introducing {
+			mem.clearCartLines(func(candidate, skuID int32) bool { return candidate == itemID && skuID == 0 })
+		}
+
+		for _, sku := range plan.create {
+			if err := mem.checkSKUCodes(sku); err != nil {
+				return err
+			}
+
+			sku.ID = mem.data.nextSKUID
+			mem.data.nextSKUID++
+			mem.data.skus[sku.ID] = copySKU(sku)
+		}
+
+		mem.data.itemOptions[uint32(itemID)] = copyItemOptions(options)
+
+		skus = mem.itemSKUs(itemID)
+		return nil
+	})
+
+	return skus, err
+}
+
+func (self *MemoryStorage) GetItemOptions(itemID int32) ([]*ItemOption, error) {
+	defer self.lock()()
+
+	return copyItemOptions(self.data.itemOptions[uint32(itemID)]), nil
+}
+
+func (self *MemoryStorage) GetSKUs(itemID int32) ([]*SKU, error) {
+	defer self.lock()()
+
+	return self.itemSKUs(itemID), nil
+}
+
+func (self *MemoryStorage) GetSKU(id int32) (*SKU, error) {
+	defer self.lock()()
+
+	sku, ok := self.data.skus[uint32(id)]
+	if !ok {
+		return nil, notFoundError("SKU %d not found", id)
+	}
+
+	return self.withCurrency(copySKU(sku)), nil
+}
+
+func (self *MemoryStorage) UpdateSKU(sku *SKU) error {
+	defer self.lock()()
+
+	stored, ok := self.data.skus[sku.ID]
+	if !ok {
+		return notFoundError("SKU %d not found", sku.ID)
+	}
+
+	if err := self.checkSKUCodes(sku); err != nil {
+		return err
+	}
+
+	stored.Code = sku.Code
+	stored.Barcode = sku.Barcode
+	stored.PriceOverride = nil
+	if sku.PriceOverride != nil {
+		price := *sku.PriceOverride
+		stored.PriceOverride = &price
+	}
+
+	return nil
+}
+
+// itemSKUs returns copies of the item's SKUs in id order.
+func (self *MemoryStorage) itemSKUs(itemID int32) []*SKU {
+	skus := make([]*SKU, 0)
+	for _, sku := range self.data.skus {
+		if sku.ItemID == itemID {
+			skus = append(skus, self.withCurrency(copySKU(sku)))
+		}
+	}
+
+	sortSKUs(skus)
+
+	return skus
+}
+
+// withCurrency keeps a SKU's price override in its item's currency, which
+// the Postgres backend reads from the item row.
+func (self *MemoryStorage) withCurrency(sku *SKU) *SKU {
+	if item, ok := self.data.items[uint32(sku.ItemID)]; ok && sku.PriceOverride != nil {
+		sku.PriceOverride.Currency = item.Price.Currency
+	}
+
+	return sku
+}
+
+// checkSKUCodes enforces what the skus_code_key and skus_barcode_key
+// constraints do in Postgres.
+func (self *MemoryStorage) checkSKUCodes(sku *SKU) error {
+	for id, other := range self.data.skus {
+		if id == sku.ID {
+			continue
+		}
+
+		if other.Code == sku.Code {
+			return conflictError("SKU code \"%s\" is already taken", sku.Code)
+		}
+
+		if sku.Barcode != "" && other.Barcode == sku.Barcode {
+			return conflictError("Barcode \"%s\" is already taken", sku.Barcode)
+		}
+	}
+
+	return nil
+}
+
+func (self *MemoryStorage) dropStockAdjustments(matches func(*StockAdjustment) bool) {
+	adjustments := make([]*StockAdjustment, 0, len(self.data.stockAdjustments))
+	for _, adjustment := range self.data.stockAdjustments {
+		if !matches(adjustment) {
+			adjustments = append(adjustments, adjustment)
+		}
+	}
+	self.data.stockAdjustments = adjustments
+}
+
+func (self *MemoryStorage) CreateItemImage(image *ItemImage) error {
+	defer self.lock()()
+
+	if _, ok := self.data.items[uint32(image.ItemID)]; !ok {
+		return notFoundError("Item %d not found", image.ItemID)
+	}
+
+	images := self.imagesOf(image.ItemID)
+	if len(images) >= maxImagesPerItem {
+		return conflictError("Item %d already has the maximum of %d images", image.ItemID, maxImagesPerItem)
+	}
+
+	image.Position = 0
+	hasPrimary := false
+	for _, other := range images {
+		image.Position = max(image.Position, other.Position+1)
+		hasPrimary = hasPrimary || other.Primary
+	}
+
+	image.Primary = image.Primary || !hasPrimary
+	if image.Primary {
+		for _, other := range images {
+			other.Primary = false
+		}
+	}
+
+	image.ID = self.data.nextItemImageID
+	self.data.nextItemImageID++
+	self.data.itemImages[image.ID] = copyItemImage(image)
+
+	return nil
+}
+
+func (self *MemoryStorage) GetItemImage(id int32) (*ItemImage, error) {
+	defer self.lock()()
+
+	image, ok := self.data.itemImages[uint32(id)]
+	if !ok {
+		return nil, notFoundError("Image %d not found", id)
+	}
+
+	return copyItemImage(image), nil
+}
+
+func (self *MemoryStorage) GetItemImages(itemID int32) ([]*ItemImage, error) {
+	defer self.lock()()
+
+	images := make([]*ItemImage, 0)
+	for _, image := range self.imagesOf(itemID) {
+		images = append(images, copyItemImage(image))
+	}
+
+	return images, nil
+}
+
+func (self *MemoryStorage) GetImagesForItems(itemIDs []int32) (map[int32][]*ItemImage, error) {
+	defer self.lock()()
+
+	byItem := make(map[int32][]*ItemImage)
+	for _, itemID := range itemIDs {
+		for _, image := range self.imagesOf(itemID) {
+			byItem[itemID] = append(byItem[itemID], copyItemImage(image))
+		}
+	}
+
+	return byItem, nil
+}
+
+func (self *MemoryStorage) DeleteItemImage(id int32) error {
+	defer self.lock()()
+
+	image, ok := self.data.itemImages[uint32(id)]
+	if !ok {
+		return notFoundError("Image %d not found", id)
+	}
+
+	delete(self.data.itemImages, image.ID)
+
+	if remaining := self.imagesOf(image.ItemID); image.Primary && len(remaining) > 0 {
+		remaining[0].Primary = true
+	}
+
+	return nil
+}
+
+func (self *MemoryStorage) ReorderItemImages(itemID int32, imageIDs []int32) error {
+	defer self.lock()()
+
+	if err := checkImageOrder(itemID, self.imagesOf(itemID), imageIDs); err != nil {
+		return err
+	}
+
+	for position, id := range imageIDs {
+		self.data.itemImages[uint32(id)].Position = int32(position)
+	}
+
+	return nil
+}
+
+func (self *MemoryStorage) SetPrimaryItemImage(itemID, imageID int32) error {
+	defer self.lock()()
+
+	if image, ok := self.data.itemImages[uint32(imageID)]; !ok || image.ItemID != itemID {
+		return notFoundError("Image %d of item %d not found", imageID, itemID)
+	}
+
+	for _, image := range self.imagesOf(itemID) {
+		image.Primary = image.ID == uint32(imageID)
+	}
+
+	return nil
+}
+
+// imagesOf returns the stored images of an item, in display order.
+func (self *MemoryStorage) imagesOf(itemID int32) []*ItemImage {
+	images := make([]*ItemImage, 0)
+	for _, image := range self.data.itemImages {
+		if image.ItemID == itemID {
+			images = append(images, image)
+		}
+	}
+
+	sort.Slice(images, func(i, j int) bool {
+		if images[i].Position != images[j].Position {
+			return images[i].Position < images[j].Position
+		}
+
+		return images[i].ID < images[j].ID
+	})
+
+	return images
+}
+
+func (self *MemoryStorage) CreateCategory(category *Category) error {
+	defer self.lock()()
+
+	if err := self.checkCategory(category); err != nil {
+		return err
+	}
+
+	category.ID = self.data.nextCategoryID
+	self.data.nextCategoryID++
+	self.data.categories[category.ID] = copyCategory(category)
+
+	return nil
+}
+
+func (self *MemoryStorage) UpdateCategory(category *Category) error {
+	defer self.lock()()
+
+	stored, ok := self.data.categories[category.ID]
+	if !ok {
+		return notFoundError("Category %d not found", category.ID)
+	}
+
+	if err := self.checkCategory(category); err != nil {
+		return err
+	}
+
+	stored.ParentID = category.ParentID
+	stored.Name = category.Name
+	stored.Slug = category.Slug
+
+	return nil
+}
+
+// checkCategory mirrors the slug's unique constraint and the parent checks
+// the Postgres backend makes.
+func (self *MemoryStorage) checkCategory(category *Category) error {
+	for _, other := range self.data.categories {
+		if other.ID != category.ID && other.Slug == category.Slug {
+			return conflictError("Category slug \"%s\" is already taken", category.Slug)
+		}
+	}
+
+	if category.ParentID == nil {
+		return nil
+	}
+
+	for id := uint32(*category.ParentID); id != 0; {
+		parent, ok := self.data.categories[id]
+		if !ok {
+			return validationError("parent_id", "Category %d not found", id)
+		}
+
+		if parent.ID == category.ID {
+			return validationError("parent_id", "Category %d cannot be moved under its own subcategory %d", category.ID, *category.ParentID)
+		}
+
+		id = 0
+		if parent.ParentID != nil {
+			id = uint32(*parent.ParentID)
+		}
+	}
+
+	return nil
+}
+
+func (self *MemoryStorage) GetCategory(id int32) (*Category, error) {
+	defer self.lock()()
+
+	category, ok := self.data.categories[uint32(id)]
+	if !ok {
+		return nil, notFoundError("Category %d not found", id)
+	}
+
+	return copyCategory(category), nil
+}
+
+func (self *MemoryStorage) GetCategoryBySlug(slug string) (*Category, error) {
+	defer self.lock()()
+
+	for _, category := range self.data.categories {
+		if category.Slug == slug {
+			return copyCategory(category), nil
+		}
+	}
+
+	return nil, notFoundError("Category \"%s\" not found", slug)
+}
+
+func (self *MemoryStorage) DeleteCategory(id int32) error {
+	defer self.lock()()
+
+	if _, ok := self.data.categories[uint32(id)]; !ok {
+		return notFoundError("Category %d not found", id)
+	}
+
+	children := 0
+	for _, category := range self.data.categories {
+		if category.ParentID != nil && *category.ParentID == id {
+			children++
+		}
+	}
+
+	if children > 0 {
+		return conflictError("Category %d still has %d subcategories", id, children)
+	}
+
+	delete(self.data.categories, uint32(id))
+
+	for itemID, categoryIDs := range self.data.itemCategories {
+		self.data.itemCategories[itemID] = removeID(categoryIDs, id)
+	}
+
+	return nil
+}
+
+func (self *MemoryStorage) GetCategories() ([]*Category, error) {
+	defer self.lock()()
+
+	categories := make([]*Category, 0, len(self.data.categories))
+	for _, id := range sortedKeys(self.data.categories) {
+		categories = append(categories, copyCategory(self.data.categories[id]))
+	}
+
+	sortCategoriesByName(categories)
+
+	return categories, nil
+}
+
+func (self *MemoryStorage) SetItemCategories(itemID int32, categoryIDs []int32) error {
+	defer self.lock()()
+
+	if _, ok := self.data.items[uint32(itemID)]; !ok {
+		return notFoundError("Item %d not found", itemID)
+	}
+
+	assigned := make([]int32, 0, len(categoryIDs))
+	for _, categoryID := range categoryIDs {
+		if _, ok := self.data.categories[uint32(categoryID)]; !ok {
+			return validationError("category_ids", "Category %d not found", categoryID)
+		}
+
+		if !containsID(assigned, categoryID) {
+			assigned = append(assigned, categoryID)
+		}
+	}
+
+	self.data.itemCategories[uint32(itemID)] = assigned
+
+	return nil
+}
+
+func (self *MemoryStorage) GetItemCategories(itemID int32) ([]*Category, error) {
+	defer self.lock()()
+
+	categories := make([]*Category, 0)
+	for _, categoryID := range self.data.itemCategories[uint32(itemID)] {
+		categories = append(categories, copyCategory(self.data.categories[uint32(categoryID)]))
+	}
+
+	sortCategoriesByName(categories)
+
+	return categories, nil
+}
+
+// categorySubtree returns the id of the category and of every category below
+// it.
+func (self *MemoryStorage) categorySubtree(id int32) []int32 {
+	subtree := []int32{id}
+	for i := 0; i < len(subtree); i++ {
+		for _, childID := range sortedKeys(self.data.categories) {
+			child := self.data.categories[childID]
+			if child.ParentID != nil && *child.ParentID == subtree[i] {
+				subtree = append(subtree, int32(child.ID))
+			}
+		}
+	}
+
+	return subtree
+}
+
+// inCategories reports whether the item is filed under any of the categories.
+func (self *MemoryStorage) inCategories(itemID uint32, categoryIDs []int32) bool {
+	for _, categoryID := range self.data.itemCategories[itemID] {
+		if containsID(categoryIDs, categoryID) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func sortCategoriesByName(categories []*Category) {
+	sort.SliceStable(categories, func(i, j int) bool {
+		if categories[i].Name != categories[j].Name {
+			return categories[i].Name < categories[j].Name
+		}
+
+		return categories[i].ID < categories[j].ID
+	})
+}
+
+func (self *MemoryStorage) Close() {}
+
+func (self *memoryData) clone() *memoryData {
+	clone := *self
+
+	clone.admins = make(map[uint32]*AdminAccount, len(self.admins))
+	for id, account := range self.admins {
+		clone.admins[id] = copyAdminAccount(account)
+	}
+
+	clone.users = make(map[uint32]*UserAccount, len(self.users))
+	for id, account := range self.users {
+		clone.users[id] = copyUserAccount(account)
+	}
+
+	clone.items = make(map[uint32]*Item, len(self.items))
+	for id, item := range self.items {
+		clone.items[id] = copyItem(item)
+	}
+
+	clone.orders = make(map[uint32]*Order, len(self.orders))
+	for id, order := range self.orders {
+		clone.orders[id] = copyOrder(order)
+	}
+
+	clone.carts = make(map[uint32][]*CartItem, len(self.carts))
+	for id, cartItems := range self.carts {
+		clone.carts[id] = copyCartItems(cartItems)
+	}
+
+	clone.categories = make(map[uint32]*Category, len(self.categories))
+	for id, category := range self.categories {
+		clone.categories[id] = copyCategory(category)
+	}
+
+	clone.itemCategories = make(map[uint32][]int32, len(self.itemCategories))
+	for id, categoryIDs := range self.itemCategories {
+		clone.itemCategories[id] = append(make([]int32, 0, len(categoryIDs)), categoryIDs...)
+	}
+
+	clone.skus = make(map[uint32]*SKU, len(self.skus))
+	for id, sku := range self.skus {
+		clone.skus[id] = copySKU(sku)
+	}
+
+	clone.itemOptions = make(map[uint32][]*ItemOption, len(self.itemOptions))
+	for id, options := range self.itemOptions {
+		clone.itemOptions[id] = copyItemOptions(options)
+	}
+
+	clone.itemImages = make(map[uint32]*ItemImage, len(self.itemImages))
+	for id, image := range self.itemImages {
+		clone.itemImages[id] = copyItemImage(image)
+	}
+
+	clone.sessions = make(map[string]*Session, len(self.sessions))
+	for id, session := range self.sessions {
+		clone.sessions[id] = copySession(session)
+	}
+
+	clone.refreshTokens = make(map[string]*refreshToken, len(self.refreshTokens))
+	for hash, token := range self.refreshTokens {
+		tokenClone := *token
+		clone.refreshTokens[hash] = &tokenClone
+	}
+
+	clone.passwordResets = make(map[string]*passwordReset, len(self.passwordResets))
+	for hash, reset := range self.passwordResets {
+		resetClone := *reset
+		clone.passwordResets[hash] = &resetClone
+	}
+
+	clone.loginThrottles = make(map[string]*LoginThrottle, len(self.loginThrottles))
+	for key, throttle := range self.loginThrottles {
+		clone.loginThrottles[key] = copyLoginThrottle(throttle)
+	}
+
+	clone.adminMFA = make(map[uint32]*adminMFA, len(self.adminMFA))
+	for id, mfa := range self.adminMFA {
+		clone.adminMFA[id] = copyAdminMFA(mfa)
+	}
+
+	clone.apiKeys = make(map[uint32]*APIKey, len(self.apiKeys))
+	for id, key := range self.apiKeys {
+		clone.apiKeys[id] = copyAPIKey(key)
+	}
+
+	clone.apiKeyHashes = make(map[string]uint32, len(self.apiKeyHashes))
+	for hash, id := range self.apiKeyHashes {
+		clone.apiKeyHashes[hash] = id
+	}
+
+	clone.reservations = make(map[reservationKey]*stockReservation, len(self.reservations))
+	for key, reservation := range self.reservations {
+		reservationClone := *reservation
+		clone.reservations[key] = &reservationClone
+	}
+
+	clone.stockAdjustments = append(make([]*StockAdjustment, 0, len(self.stockAdjustments)), self.stockAdjustments...)
+	clone.orderStatusHistory = append(make([]*OrderStatusChange, 0, len(self.orderStatusHistory)), self.orderStatusHistory...)
+
+	return &clone
+}
+
+// the copy helpers keep callers from mutating stored records, e.g. the
+// handlers blank out HashedPassword before writing accounts to the client
+
+func copyAdminAccount(account *AdminAccount) *AdminAccount {
+	clone := *account
+	return &clone
+}
+
+func copyAdminMFA(mfa *adminMFA) *adminMFA {
+	clone := *mfa
+	clone.recoveryCodes = make(map[string]bool, len(mfa.recoveryCodes))
+	for hash, used := range mfa.recoveryCodes {
+		clone.recoveryCodes[hash] = used
+	}
+	return &clone
+}
+
+func copyAPIKey(key *APIKey) *APIKey {
+	clone := *key
+	clone.Scopes = append(make([]Permission, 0, len(key.Scopes)), key.Scopes...)
+	return &clone
+}
+
+func copyUserAccount(account *UserAccount) *UserAccount {
+	clone := *account
+	clone.Orders = append(make([]int32, 0, len(account.Orders)), account.Orders...)
+	return &clone
+}
+
+func copyItem(item *Item) *Item {
+	clone := *item
+	return &clone
+}
+
+func copyCategory(category *Category) *Category {
+	clone := *category
+	if category.ParentID != nil {
+		parentID := *category.ParentID
+		clone.ParentID = &parentID
+	}
+	clone.Children = nil
+	return &clone
+}
+
+func copySKU(sku *SKU) *SKU {
+	clone := *sku
+	clone.Options = make(map[string]string, len(sku.Options))
+	for name, value := range sku.Options {
+		clone.Options[name] = value
+	}
+	if sku.PriceOverride != nil {
+		price := *sku.PriceOverride
+		clone.PriceOverride = &price
+	}
+	return &clone
+}
+
+func copyItemOptions(options []*ItemOption) []*ItemOption {
+	clone := make([]*ItemOption, 0, len(options))
+	for _, option := range options {
+		clone = append(clone, &ItemOption{
+			Name:   option.Name,
+			Values: append(make([]string, 0, len(option.Values)), option.Values...),
+		})
+	}
+	return clone
+}
+
+func copyItemImage(image *ItemImage) *ItemImage {
+	clone := *image
+	return &clone
+}
+
+func copySession(session *Session) *Session {
+	clone := *session
+	if session.RevokedAt != nil {
+		revokedAt := *session.RevokedAt
+		clone.RevokedAt = &revokedAt
+	}
+	return &clone
+}
+
+func copyLoginThrottle(throttle *LoginThrottle) *LoginThrottle {
+	clone := *throttle
+	if throttle.LockedUntil != nil {
+		lockedUntil := *throttle.LockedUntil
+		clone.LockedUntil = &lockedUntil
+	}
+	return &clone
+}
+
+func copyOrder(order *Order) *Order {
+	clone := *order
+	clone.Lines = make([]*OrderLine, 0, len(order.Lines))
+	for _, line := range order.Lines {
+		lineClone := *line
+		clone.Lines = append(clone.Lines, &lineClone)
+	}
+	return &clone
+}
+
+func copyCartItems(cartItems []*CartItem) []*CartItem {
+	clone := make([]*CartItem, 0, len(cartItems))
+	for _, cartItem := range cartItems {
+		cartItemClone := *cartItem
+		clone = append(clone, &cartItemClone)
+	}
+	return clone
+}
+
+func sortedKeys[T any](records map[uint32]T) []uint32 {
+	keys := make([]uint32, 0, len(records))
+	for key := range records {
+		keys = append(keys, key)
+	}
+
+	sort.Slice(keys, func(i, j int) bool { return keys[i] < keys[j] })
+
+	return keys
+}
+
+func containsID(ids []int32, id int32) bool {
+	for _, candidate := range ids {
+		if candidate == id {
+			return true
+		}
+	}
+
+	return false
+}
+
+func removeID(ids []int32, id int32) []int32 {
+	kept := make([]int32, 0, len(ids))
+	for _, candidate := range ids {
+		if candidate != id {
+			kept = append(kept, candidate)
+		}
+	}
+
+	return kept
+}
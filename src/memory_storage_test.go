@@ -0,0 +1,76 @@
+package main
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestMemoryStorageWithTxRollsBack(t *testing.T) {
+	storage := NewMemoryStorage()
+
+	account, err := NewUserAccount("bob", "bob-password", "bob@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := storage.CreateUserAccount(account); err != nil {
+		t.Fatal(err)
+	}
+
+	item := NewItem("Shirt", "", NewMoney(1000, "USD"))
+	if err := storage.CreateItem(item); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := storage.SetItemStock(int32(item.ID), 0, 5, "Initial count", 1); err != nil {
+		t.Fatal(err)
+	}
+	if err := storage.AddItemToUserAccount(int32(account.ID), int32(item.ID), 0, 1); err != nil {
+		t.Fatal(err)
+	}
+
+	failed := errors.New("failed")
+	err = storage.WithTx(func(tx Storage) error {
+		line, err := NewOrderLine(item, nil, 1)
+		if err != nil {
+			return err
+		}
+
+		order, err := NewOrder(account.ID, []*OrderLine{line})
+		if err != nil {
+			return err
+		}
+		if err := tx.CreateOrder(order); err != nil {
+			return err
+		}
+		if err := tx.ClearUserItems(int32(account.ID)); err != nil {
+			return err
+		}
+
+		return failed
+	})
+	if err != failed {
+		t.Fatalf("got %v, want the error from the transaction", err)
+	}
+
+	stored, err := storage.GetUserAccount(int32(account.ID))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cartItems, err := storage.GetUserItems(int32(account.ID))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(cartItems) != 1 || len(stored.Orders) != 0 {
+		t.Fatalf("got %d cart items and %d orders after a rollback, want 1 and 0", len(cartItems), len(stored.Orders))
+	}
+
+	storedItem, err := storage.GetItem(int32(item.ID))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if storedItem.Stock != 5 {
+		t.Fatalf("got stock %d after a rollback, want 5", storedItem.Stock)
+	}
+}
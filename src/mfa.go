@@ -0,0 +1,213 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/base32"
+	"encoding/binary"
+	"fmt"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+const (
+	// RFC 6238 defaults, which is what authenticator apps assume
+	totpPeriod = 30
+	totpDigits = 6
+
+	// totpSkew is how many periods either side of now a code is accepted
+	// for, to allow for clock drift.
+	totpSkew = 1
+
+	mfaChallengeTTL   = 5 * time.Minute
+	recoveryCodeCount = 10
+
+	// recoveryCodeBytes gives each recovery code 80 random bits. They are
+	// stored as plain SHA-256 hashes, so they have to be too many to guess
+	// offline from a copy of the table.
+	recoveryCodeBytes = 10
+)
+
+var (
+	errInvalidMFACode    = unauthorizedError("Invalid two-factor code")
+	errMFANotEnabled     = conflictError("Two-factor authentication is not enabled")
+	errMFAAlreadyEnabled = conflictError("Two-factor authentication is already enabled; disable it first")
+	errMFANotEnrolling   = conflictError("Start two-factor enrollment first")
+)
+
+// mfaState is an admin's stored TOTP setup. The secret is in force once
+// confirmed; lastStep is the time step of the last code accepted.
+type mfaState struct {
+	secret    string
+	confirmed bool
+	lastStep  int64
+}
+
+var totpEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// mfaRequired is the ADMIN_MFA_REQUIRED policy: when set, admins without
+// two-factor authentication can only use the enrollment routes.
+func mfaRequired() bool {
+	return os.Getenv("ADMIN_MFA_REQUIRED") == "true"
+}
+
+// MFAChallenge is the answer to a correct password when the admin has
+// two-factor authentication: the token goes to /admin/login/mfa with a code.
+type MFAChallenge struct {
+	MFARequired bool   `json:"mfa_required"`
+	MFAToken    string `json:"mfa_token"`
+	ExpiresIn   int64  `json:"expires_in"`
+}
+
+// MFAEnrollment is a new, unconfirmed TOTP secret for an authenticator app.
+type MFAEnrollment struct {
+	Secret     string `json:"secret"`
+	OTPAuthURI string `json:"otpauth_uri"`
+}
+
+func NewMFAEnrollment(username string) (*MFAEnrollment, error) {
+	buf := make([]byte, 20)
+	if _, err := rand.Read(buf); err != nil {
+		return nil, err
+	}
+
+	secret := totpEncoding.EncodeToString(buf)
+
+	issuer := os.Getenv("MFA_ISSUER")
+	if issuer == "" {
+		issuer = "Go_Ecom"
+	}
+
+	query := url.Values{}
+	query.Set("secret", secret)
+	query.Set("issuer", issuer)
+	query.Set("algorithm", "SHA1")
+	query.Set("digits", fmt.Sprint(totpDigits))
+	query.Set("period", fmt.Sprint(totpPeriod))
+
+	label := url.PathEscape(issuer + ":" + username)
+
+	return &MFAEnrollment{
+		Secret:     secret,
+		OTPAuthURI: "otpauth://totp/" + label + "?" + query.Encode(),
+	}, nil
+}
+
+// totpAt is the code for a time step, per RFC 4226 and RFC 6238.
+func totpAt(key []byte, step int64) string {
+	var counter [8]byte
+	binary.BigEndian.PutUint64(counter[:], uint64(step))
+
+	mac := hmac.New(sha1.New, key)
+	mac.Write(counter[:])
+	sum := mac.Sum(nil)
+
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+
+	modulus := uint32(1)
+	for i := 0; i < totpDigits; i++ {
+		modulus *= 10
+	}
+
+	return fmt.Sprintf("%0*d", totpDigits, value%modulus)
+}
+
+// matchTOTP finds the time step near now that code belongs to. Steps up to
+// lastStep have been used already and are refused, so a code cannot be
+// replayed.
+func matchTOTP(secret, code string, lastStep int64, now time.Time) (int64, bool) {
+	key, err := totpEncoding.DecodeString(secret)
+	if err != nil {
+		return 0, false
+	}
+
+	current := now.Unix() / totpPeriod
+	for step := current - totpSkew; step <= current+totpSkew; step++ {
+		if step <= lastStep {
+			continue
+		}
+
+		if hmac.Equal([]byte(totpAt(key, step)), []byte(code)) {
+			return step, true
+		}
+	}
+
+	return 0, false
+}
+
+func isTOTPCode(code string) bool {
+	if len(code) != totpDigits {
+		return false
+	}
+
+	for _, c := range code {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+
+	return true
+}
+
+// generateRecoveryCodes makes single-use codes for when the authenticator is
+// lost, like "abcd-efgh-ijkl-mnop", returning them for the admin and their
+// hashes for storage.
+func generateRecoveryCodes() ([]string, []string, error) {
+	codes := make([]string, 0, recoveryCodeCount)
+	hashes := make([]string, 0, recoveryCodeCount)
+	for i := 0; i < recoveryCodeCount; i++ {
+		buf := make([]byte, recoveryCodeBytes)
+		if _, err := rand.Read(buf); err != nil {
+			return nil, nil, err
+		}
+
+		raw := strings.ToLower(totpEncoding.EncodeToString(buf))
+
+		groups := make([]string, 0, len(raw)/4)
+		for len(raw) > 0 {
+			n := min(4, len(raw))
+			groups = append(groups, raw[:n])
+			raw = raw[n:]
+		}
+		code := strings.Join(groups, "-")
+
+		codes = append(codes, code)
+		hashes = append(hashes, hashRecoveryCode(code))
+	}
+
+	return codes, hashes, nil
+}
+
+// hashRecoveryCode ignores case, dashes and spaces, so codes can be typed
+// however they were written down.
+func hashRecoveryCode(code string) string {
+	code = strings.ToLower(code)
+	code = strings.NewReplacer("-", "", " ", "").Replace(code)
+	return hashToken(code)
+}
+
+// generateMFAChallenge is what a correct password gets an admin with
+// two-factor authentication: proof of the first step, to be exchanged along
+// with a code for a session.
+func generateMFAChallenge(account *AdminAccount) (string, error) {
+	return signToken(&Claims{
+		Type:      MFAChallengeToken,
+		AccountID: int32(account.ID),
+		Username:  account.Username,
+	}, mfaChallengeTTL)
+}
+
+func parseMFAChallenge(tokenString string) (int32, string, error) {
+	invalid := unauthorizedError("Invalid or expired MFA token; log in again")
+
+	claims, err := parseToken(tokenString, MFAChallengeToken)
+	if err != nil {
+		return 0, "", invalid
+	}
+
+	return claims.AccountID, claims.Username, nil
+}
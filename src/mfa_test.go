@@ -0,0 +1,170 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func totpCode(t *testing.T, secret string, step int64) string {
+	t.Helper()
+
+	key, err := totpEncoding.DecodeString(secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return totpAt(key, step)
+}
+
+func TestMatchTOTPWindow(t *testing.T) {
+	enrollment, err := NewMFAEnrollment("root")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Date(2024, 1, 1, 0, 0, 10, 0, time.UTC)
+	current := now.Unix() / totpPeriod
+
+	tests := []struct {
+		step     int64
+		lastStep int64
+		ok       bool
+	}{
+		{current, 0, true},
+		{current - totpSkew, 0, true},
+		{current + totpSkew, 0, true},
+		{current - totpSkew - 1, 0, false},
+		{current + totpSkew + 1, 0, false},
+		// a step at or before the last one accepted is a replay
+		{current, current, false},
+		{current - 1, current, false},
+		{current + 1, current, true},
+	}
+
+	for _, test := range tests {
+		code := totpCode(t, enrollment.Secret, test.step)
+		step, ok := matchTOTP(enrollment.Secret, code, test.lastStep, now)
+		if ok != test.ok || (ok && step != test.step) {
+			t.Errorf("step %d after %d: got %d, %t, want %t", test.step-current, test.lastStep-current, step-current, ok, test.ok)
+		}
+	}
+}
+
+func TestGenerateRecoveryCodes(t *testing.T) {
+	codes, hashes, err := generateRecoveryCodes()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	seen := make(map[string]bool)
+	for i, code := range codes {
+		// 80 bits is 16 base32 characters, in groups of four
+		if raw := strings.ReplaceAll(code, "-", ""); len(raw) != recoveryCodeBytes*8/5 || len(code) != len(raw)+3 {
+			t.Fatalf("got code %q, want 16 characters in four groups", code)
+		}
+
+		if seen[code] {
+			t.Fatalf("got code %q twice", code)
+		}
+		seen[code] = true
+
+		// codes can be typed back however they were written down
+		if hashRecoveryCode(strings.ToUpper(strings.ReplaceAll(code, "-", " "))) != hashes[i] {
+			t.Fatalf("code %q does not match its hash when retyped", code)
+		}
+	}
+}
+
+// enableMFA turns on two-factor authentication for root, returning the
+// secret, the step of the code used to confirm it and the recovery codes.
+func (self *testServer) enableMFA(token string) (string, int64, []string) {
+	self.t.Helper()
+
+	enrollment := new(MFAEnrollment)
+	self.expect(self.request("POST", "/admin/1/mfa", token, nil, enrollment), http.StatusOK)
+
+	step := time.Now().Unix() / totpPeriod
+
+	var confirmed struct {
+		RecoveryCodes []string `json:"recovery_codes"`
+	}
+	code := totpCode(self.t, enrollment.Secret, step)
+	self.expect(self.request("PUT", "/admin/1/mfa", token, MFACodeRequest{Code: code}, &confirmed), http.StatusOK)
+
+	return enrollment.Secret, step, confirmed.RecoveryCodes
+}
+
+func TestAdminMFALogin(t *testing.T) {
+	server := newTestServer(t)
+	token := server.adminLogin()
+
+	enrollment := new(MFAEnrollment)
+	server.expect(server.request("POST", "/admin/1/mfa", token, nil, enrollment), http.StatusOK)
+	server.expect(server.request("PUT", "/admin/1/mfa", token, MFACodeRequest{Code: "000000"}, nil), http.StatusUnauthorized)
+
+	secret, step, recoveryCodes := server.enableMFA(token)
+	if len(recoveryCodes) != recoveryCodeCount {
+		t.Fatalf("got %d recovery codes, want %d", len(recoveryCodes), recoveryCodeCount)
+	}
+
+	root := LoginRequest{Username: "root", Password: "rootpassword"}
+
+	// the password alone only gets a challenge
+	challenge := new(MFAChallenge)
+	server.expect(server.request("POST", "/admin/login", "", root, challenge), http.StatusOK)
+	if !challenge.MFARequired || challenge.MFAToken == "" {
+		t.Fatalf("got %+v, want an MFA challenge", challenge)
+	}
+
+	// nor is the challenge a session token
+	server.expect(server.request("GET", "/admin/1", challenge.MFAToken, nil, nil), http.StatusUnauthorized)
+
+	wrong := MFALoginRequest{MFAToken: challenge.MFAToken, Code: "000000"}
+	server.expect(server.request("POST", "/admin/login/mfa", "", wrong, nil), http.StatusUnauthorized)
+
+	// the code that confirmed enrollment is spent
+	replay := MFALoginRequest{MFAToken: challenge.MFAToken, Code: totpCode(t, secret, step)}
+	server.expect(server.request("POST", "/admin/login/mfa", "", replay, nil), http.StatusUnauthorized)
+
+	next := MFALoginRequest{MFAToken: challenge.MFAToken, Code: totpCode(t, secret, step+1)}
+	tokens := new(TokenPair)
+	server.expect(server.request("POST", "/admin/login/mfa", "", next, tokens), http.StatusOK)
+	server.expect(server.request("GET", "/admin/1", tokens.AuthToken, nil, nil), http.StatusOK)
+}
+
+func TestAdminMFARecoveryCodeWorksOnce(t *testing.T) {
+	server := newTestServer(t)
+	_, _, recoveryCodes := server.enableMFA(server.adminLogin())
+
+	root := LoginRequest{Username: "root", Password: "rootpassword"}
+
+	challenge := new(MFAChallenge)
+	server.expect(server.request("POST", "/admin/login", "", root, challenge), http.StatusOK)
+
+	recovery := MFALoginRequest{MFAToken: challenge.MFAToken, Code: recoveryCodes[0]}
+	server.expect(server.request("POST", "/admin/login/mfa", "", recovery, nil), http.StatusOK)
+
+	challenge = new(MFAChallenge)
+	server.expect(server.request("POST", "/admin/login", "", root, challenge), http.StatusOK)
+
+	recovery.MFAToken = challenge.MFAToken
+	server.expect(server.request("POST", "/admin/login/mfa", "", recovery, nil), http.StatusUnauthorized)
+
+	// the others are still good
+	recovery.Code = recoveryCodes[1]
+	server.expect(server.request("POST", "/admin/login/mfa", "", recovery, nil), http.StatusOK)
+}
+
+func TestAdminMFARequired(t *testing.T) {
+	server := newTestServer(t)
+	t.Setenv("ADMIN_MFA_REQUIRED", "true")
+
+	token := server.adminLogin()
+	server.expect(server.request("GET", "/admin/1/items", token, nil, nil), http.StatusForbidden)
+
+	// enrolling is still allowed, and afterwards so is everything else
+	server.enableMFA(token)
+	server.expect(server.request("GET", "/admin/1/items", token, nil, nil), http.StatusOK)
+}
@@ -0,0 +1,11 @@
+ALTER TABLE orders ADD COLUMN items INT[];
+
+UPDATE orders
+SET items = (
+  SELECT array_agg(order_lines.item_id ORDER BY order_lines.id)
+  FROM order_lines
+  CROSS JOIN LATERAL generate_series(1, order_lines.quantity)
+  WHERE order_lines.order_id = orders.id
+);
+
+DROP TABLE order_lines;
@@ -0,0 +1,23 @@
+CREATE TABLE order_lines (
+  id SERIAL PRIMARY KEY,
+  order_id INT NOT NULL REFERENCES orders (id) ON DELETE CASCADE,
+  -- no foreign key on item_id: a line outlives the catalog entry it came from
+  item_id INT NOT NULL,
+  name TEXT NOT NULL,
+  unit_price FLOAT NOT NULL,
+  quantity INT NOT NULL CHECK (quantity > 0),
+  line_total FLOAT NOT NULL
+);
+
+CREATE INDEX order_lines_order_id_idx ON order_lines (order_id);
+
+-- Existing orders only recorded item ids, so their lines are snapshotted from
+-- the catalog as it is now. Items that no longer exist cannot be recovered.
+INSERT INTO order_lines (order_id, item_id, name, unit_price, quantity, line_total)
+SELECT orders.id, items.id, items.name, COALESCE(items.price, 0), COUNT(*), COALESCE(items.price, 0) * COUNT(*)
+FROM orders
+CROSS JOIN LATERAL unnest(orders.items) AS ordered (item_id)
+JOIN items ON items.id = ordered.item_id
+GROUP BY orders.id, items.id, items.name, items.price;
+
+ALTER TABLE orders DROP COLUMN items;
@@ -0,0 +1,11 @@
+ALTER TABLE users ADD COLUMN items INT[] DEFAULT '{}';
+
+-- the array cart could only hold one unit of each item
+UPDATE users
+SET items = COALESCE((
+  SELECT array_agg(cart_items.item_id ORDER BY cart_items.added_at)
+  FROM cart_items
+  WHERE cart_items.user_id = users.id
+), '{}');
+
+DROP TABLE cart_items;
@@ -0,0 +1,16 @@
+CREATE TABLE cart_items (
+  user_id INT NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+  item_id INT NOT NULL REFERENCES items (id) ON DELETE CASCADE,
+  quantity INT NOT NULL CHECK (quantity > 0),
+  added_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+  PRIMARY KEY (user_id, item_id)
+);
+
+INSERT INTO cart_items (user_id, item_id, quantity)
+SELECT users.id, items.id, COUNT(*)
+FROM users
+CROSS JOIN LATERAL unnest(users.items) AS cart (item_id)
+JOIN items ON items.id = cart.item_id
+GROUP BY users.id, items.id;
+
+ALTER TABLE users DROP COLUMN items;
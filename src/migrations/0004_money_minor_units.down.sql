@@ -0,0 +1,25 @@
+-- Currencies are dropped on the way down; amounts are read back as hundredths.
+
+ALTER TABLE order_lines ADD COLUMN unit_price_float FLOAT, ADD COLUMN line_total_float FLOAT;
+UPDATE order_lines
+SET unit_price_float = unit_price / 100.0,
+    line_total_float = line_total / 100.0;
+ALTER TABLE order_lines DROP COLUMN unit_price;
+ALTER TABLE order_lines DROP COLUMN line_total;
+ALTER TABLE order_lines DROP COLUMN currency;
+ALTER TABLE order_lines RENAME COLUMN unit_price_float TO unit_price;
+ALTER TABLE order_lines RENAME COLUMN line_total_float TO line_total;
+ALTER TABLE order_lines ALTER COLUMN unit_price SET NOT NULL;
+ALTER TABLE order_lines ALTER COLUMN line_total SET NOT NULL;
+
+ALTER TABLE orders ADD COLUMN total_float FLOAT;
+UPDATE orders SET total_float = total / 100.0;
+ALTER TABLE orders DROP COLUMN total;
+ALTER TABLE orders DROP COLUMN currency;
+ALTER TABLE orders RENAME COLUMN total_float TO total;
+
+ALTER TABLE items ADD COLUMN price_float FLOAT;
+UPDATE items SET price_float = price / 100.0;
+ALTER TABLE items DROP COLUMN price;
+ALTER TABLE items DROP COLUMN currency;
+ALTER TABLE items RENAME COLUMN price_float TO price;
@@ -0,0 +1,37 @@
+-- Prices and totals move from FLOAT to integer minor units with an explicit
+-- ISO 4217 currency. The old values carried no currency, so they are read as
+-- USD dollars and rounded to whole cents; re-tag them afterwards if the store
+-- was priced in something else.
+
+ALTER TABLE items
+  ADD COLUMN price_minor BIGINT,
+  ADD COLUMN currency TEXT NOT NULL DEFAULT 'USD' CHECK (currency ~ '^[A-Z]{3}$');
+UPDATE items SET price_minor = ROUND(COALESCE(price, 0)::NUMERIC * 100);
+ALTER TABLE items DROP COLUMN price;
+ALTER TABLE items RENAME COLUMN price_minor TO price;
+ALTER TABLE items ALTER COLUMN price SET NOT NULL;
+ALTER TABLE items ALTER COLUMN currency DROP DEFAULT;
+
+ALTER TABLE orders
+  ADD COLUMN total_minor BIGINT,
+  ADD COLUMN currency TEXT NOT NULL DEFAULT 'USD' CHECK (currency ~ '^[A-Z]{3}$');
+UPDATE orders SET total_minor = ROUND(COALESCE(total, 0)::NUMERIC * 100);
+ALTER TABLE orders DROP COLUMN total;
+ALTER TABLE orders RENAME COLUMN total_minor TO total;
+ALTER TABLE orders ALTER COLUMN total SET NOT NULL;
+ALTER TABLE orders ALTER COLUMN currency DROP DEFAULT;
+
+ALTER TABLE order_lines
+  ADD COLUMN unit_price_minor BIGINT,
+  ADD COLUMN line_total_minor BIGINT,
+  ADD COLUMN currency TEXT NOT NULL DEFAULT 'USD' CHECK (currency ~ '^[A-Z]{3}$');
+UPDATE order_lines
+SET unit_price_minor = ROUND(unit_price::NUMERIC * 100),
+    line_total_minor = ROUND(unit_price::NUMERIC * 100) * quantity;
+ALTER TABLE order_lines DROP COLUMN unit_price;
+ALTER TABLE order_lines DROP COLUMN line_total;
+ALTER TABLE order_lines RENAME COLUMN unit_price_minor TO unit_price;
+ALTER TABLE order_lines RENAME COLUMN line_total_minor TO line_total;
+ALTER TABLE order_lines ALTER COLUMN unit_price SET NOT NULL;
+ALTER TABLE order_lines ALTER COLUMN line_total SET NOT NULL;
+ALTER TABLE order_lines ALTER COLUMN currency DROP DEFAULT;
@@ -0,0 +1,3 @@
+DROP TABLE stock_reservations;
+DROP TABLE stock_adjustments;
+ALTER TABLE items DROP COLUMN stock;
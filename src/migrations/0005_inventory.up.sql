@@ -0,0 +1,33 @@
+ALTER TABLE items ADD COLUMN stock INT NOT NULL DEFAULT 0 CHECK (stock >= 0);
+
+CREATE TABLE stock_adjustments (
+  id SERIAL PRIMARY KEY,
+  item_id INT NOT NULL REFERENCES items (id) ON DELETE CASCADE,
+  delta INT NOT NULL,
+  stock_after INT NOT NULL,
+  reason TEXT NOT NULL,
+  admin_id INT REFERENCES admins (id) ON DELETE SET NULL,
+  order_id INT REFERENCES orders (id) ON DELETE SET NULL,
+  created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX stock_adjustments_item_id_idx ON stock_adjustments (item_id);
+
+CREATE TABLE stock_reservations (
+  user_id INT NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+  item_id INT NOT NULL REFERENCES items (id) ON DELETE CASCADE,
+  quantity INT NOT NULL CHECK (quantity > 0),
+  expires_at TIMESTAMP NOT NULL,
+  PRIMARY KEY (user_id, item_id)
+);
+
+CREATE INDEX stock_reservations_item_id_idx ON stock_reservations (item_id, expires_at);
+
+-- Items from before stock was tracked could always be sold. Rather than leave
+-- them out of stock, give them a level large enough to keep selling until an
+-- admin sets a real one, and log it like any other change.
+UPDATE items SET stock = 1000000;
+
+INSERT INTO stock_adjustments (item_id, delta, stock_after, reason)
+SELECT id, stock, stock, 'Stock tracking introduced; level set by migration 0005'
+FROM items;
@@ -0,0 +1,4 @@
+DROP TABLE order_status_history;
+ALTER TABLE orders DROP CONSTRAINT orders_status_check;
+ALTER TABLE orders ALTER COLUMN status DROP NOT NULL;
+ALTER TABLE orders ALTER COLUMN status DROP DEFAULT;
@@ -0,0 +1,26 @@
+-- Orders written before statuses were enforced may hold anything; treat those
+-- as still pending so they can move through the state machine.
+UPDATE orders
+SET status = 'pending'
+WHERE status IS NULL
+  OR status NOT IN ('pending', 'paid', 'fulfilled', 'shipped', 'delivered', 'cancelled', 'refunded');
+
+ALTER TABLE orders ALTER COLUMN status SET DEFAULT 'pending';
+ALTER TABLE orders ALTER COLUMN status SET NOT NULL;
+ALTER TABLE orders ADD CONSTRAINT orders_status_check
+  CHECK (status IN ('pending', 'paid', 'fulfilled', 'shipped', 'delivered', 'cancelled', 'refunded'));
+
+CREATE TABLE order_status_history (
+  id SERIAL PRIMARY KEY,
+  order_id INT NOT NULL REFERENCES orders (id) ON DELETE CASCADE,
+  from_status TEXT,
+  to_status TEXT NOT NULL,
+  admin_id INT REFERENCES admins (id) ON DELETE SET NULL,
+  created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX order_status_history_order_id_idx ON order_status_history (order_id);
+
+INSERT INTO order_status_history (order_id, from_status, to_status, created_at)
+SELECT id, NULL, status, created_at
+FROM orders;
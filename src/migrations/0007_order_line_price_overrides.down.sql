@@ -0,0 +1,5 @@
+ALTER TABLE order_lines
+  DROP CONSTRAINT order_lines_override_reason_check,
+  DROP COLUMN override_admin_id,
+  DROP COLUMN override_reason,
+  DROP COLUMN list_price;
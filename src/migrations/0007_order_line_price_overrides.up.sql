@@ -0,0 +1,8 @@
+-- A line charged at something other than the catalog price keeps the list
+-- price it replaced, why, and which admin did it.
+ALTER TABLE order_lines
+  ADD COLUMN list_price BIGINT,
+  ADD COLUMN override_reason TEXT,
+  ADD COLUMN override_admin_id INT REFERENCES admins (id) ON DELETE SET NULL,
+  ADD CONSTRAINT order_lines_override_reason_check
+    CHECK (list_price IS NULL OR (override_reason IS NOT NULL AND override_reason <> ''));
@@ -0,0 +1,7 @@
+DROP INDEX users_created_at_id_idx;
+DROP INDEX orders_status_idx;
+DROP INDEX orders_user_id_idx;
+DROP INDEX orders_total_id_idx;
+DROP INDEX orders_created_at_id_idx;
+DROP INDEX items_created_at_id_idx;
+DROP INDEX items_price_id_idx;
@@ -0,0 +1,9 @@
+-- Keyset pagination orders by (column, id); these cover the sorts and filters
+-- the collection endpoints offer.
+CREATE INDEX items_price_id_idx ON items (price, id);
+CREATE INDEX items_created_at_id_idx ON items (created_at, id);
+CREATE INDEX orders_created_at_id_idx ON orders (created_at, id);
+CREATE INDEX orders_total_id_idx ON orders (total, id);
+CREATE INDEX orders_user_id_idx ON orders (user_id);
+CREATE INDEX orders_status_idx ON orders (status);
+CREATE INDEX users_created_at_id_idx ON users (created_at, id);
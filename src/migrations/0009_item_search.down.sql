@@ -0,0 +1,2 @@
+DROP INDEX items_search_idx;
+ALTER TABLE items DROP COLUMN search;
@@ -0,0 +1,9 @@
+-- Names outrank descriptions: a match in the name is weighted A, one in the
+-- description B, which ts_rank scores accordingly.
+ALTER TABLE items ADD COLUMN search TSVECTOR
+  GENERATED ALWAYS AS (
+    setweight(to_tsvector('english', COALESCE(name, '')), 'A') ||
+    setweight(to_tsvector('english', COALESCE(description, '')), 'B')
+  ) STORED;
+
+CREATE INDEX items_search_idx ON items USING GIN (search);
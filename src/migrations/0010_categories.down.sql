@@ -0,0 +1,2 @@
+DROP TABLE item_categories;
+DROP TABLE categories;
@@ -0,0 +1,21 @@
+-- A category cannot be deleted while it still has subcategories; the parent
+-- reference is RESTRICT so the tree is never left with dangling children.
+CREATE TABLE categories (
+  id SERIAL PRIMARY KEY,
+  parent_id INT REFERENCES categories (id) ON DELETE RESTRICT,
+  name TEXT NOT NULL,
+  slug TEXT NOT NULL,
+  created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+  CONSTRAINT categories_slug_key UNIQUE (slug),
+  CONSTRAINT categories_parent_check CHECK (parent_id <> id)
+);
+
+CREATE INDEX categories_parent_id_idx ON categories (parent_id);
+
+CREATE TABLE item_categories (
+  item_id INT NOT NULL REFERENCES items (id) ON DELETE CASCADE,
+  category_id INT NOT NULL REFERENCES categories (id) ON DELETE CASCADE,
+  PRIMARY KEY (item_id, category_id)
+);
+
+CREATE INDEX item_categories_category_id_idx ON item_categories (category_id);
@@ -0,0 +1,22 @@
+ALTER TABLE order_lines
+  DROP COLUMN options,
+  DROP COLUMN sku_code,
+  DROP COLUMN sku_id;
+
+DELETE FROM stock_adjustments WHERE sku_id IS NOT NULL;
+ALTER TABLE stock_adjustments DROP COLUMN sku_id;
+
+DELETE FROM stock_reservations WHERE sku_id <> 0;
+ALTER TABLE stock_reservations
+  DROP CONSTRAINT stock_reservations_pkey,
+  DROP COLUMN sku_id,
+  ADD PRIMARY KEY (user_id, item_id);
+
+DELETE FROM cart_items WHERE sku_id <> 0;
+ALTER TABLE cart_items
+  DROP CONSTRAINT cart_items_pkey,
+  DROP COLUMN sku_id,
+  ADD PRIMARY KEY (user_id, item_id);
+
+DROP TABLE skus;
+DROP TABLE item_options;
@@ -0,0 +1,48 @@
+-- An item's options are the axes of its variant matrix; each SKU is one
+-- combination of option values and carries its own stock. Items without
+-- options keep selling, and stocking, as a single product.
+CREATE TABLE item_options (
+  item_id INT NOT NULL REFERENCES items (id) ON DELETE CASCADE,
+  position INT NOT NULL,
+  name TEXT NOT NULL,
+  option_values TEXT[] NOT NULL,
+  PRIMARY KEY (item_id, position),
+  CONSTRAINT item_options_name_key UNIQUE (item_id, name)
+);
+
+-- price overrides the item's price, in the item's currency, when set
+CREATE TABLE skus (
+  id SERIAL PRIMARY KEY,
+  item_id INT NOT NULL REFERENCES items (id) ON DELETE CASCADE,
+  code TEXT NOT NULL,
+  options JSONB NOT NULL,
+  price BIGINT CHECK (price >= 0),
+  stock INT NOT NULL DEFAULT 0 CHECK (stock >= 0),
+  barcode TEXT,
+  created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+  CONSTRAINT skus_code_key UNIQUE (code),
+  CONSTRAINT skus_barcode_key UNIQUE (barcode),
+  CONSTRAINT skus_item_options_key UNIQUE (item_id, options)
+);
+
+-- sku_id 0 marks a line or reservation for an item without variants, so it
+-- can stay part of the primary key
+ALTER TABLE cart_items
+  ADD COLUMN sku_id INT NOT NULL DEFAULT 0,
+  DROP CONSTRAINT cart_items_pkey,
+  ADD PRIMARY KEY (user_id, item_id, sku_id);
+
+ALTER TABLE stock_reservations
+  ADD COLUMN sku_id INT NOT NULL DEFAULT 0,
+  DROP CONSTRAINT stock_reservations_pkey,
+  ADD PRIMARY KEY (user_id, item_id, sku_id);
+
+ALTER TABLE stock_adjustments
+  ADD COLUMN sku_id INT REFERENCES skus (id) ON DELETE CASCADE;
+
+-- like item_id, no foreign key: the line keeps the code and options it was
+-- sold with after the SKU is gone
+ALTER TABLE order_lines
+  ADD COLUMN sku_id INT,
+  ADD COLUMN sku_code TEXT,
+  ADD COLUMN options JSONB;
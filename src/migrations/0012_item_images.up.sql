@@ -0,0 +1,20 @@
+-- The files themselves live in the blob store under blob_key and
+-- thumbnail_key; deleting a row does not remove them.
+CREATE TABLE item_images (
+  id SERIAL PRIMARY KEY,
+  item_id INT NOT NULL REFERENCES items (id) ON DELETE CASCADE,
+  position INT NOT NULL,
+  is_primary BOOLEAN NOT NULL DEFAULT false,
+  blob_key TEXT NOT NULL,
+  thumbnail_key TEXT NOT NULL,
+  content_type TEXT NOT NULL,
+  width INT NOT NULL CHECK (width > 0),
+  height INT NOT NULL CHECK (height > 0),
+  size_bytes BIGINT NOT NULL CHECK (size_bytes > 0),
+  created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX item_images_item_id_idx ON item_images (item_id, position);
+
+-- at most one primary image per item
+CREATE UNIQUE INDEX item_images_primary_idx ON item_images (item_id) WHERE is_primary;
@@ -0,0 +1,5 @@
+ALTER TABLE users ADD COLUMN auth_token TEXT;
+ALTER TABLE admins ADD COLUMN auth_token TEXT;
+
+DROP TABLE refresh_tokens;
+DROP TABLE sessions;
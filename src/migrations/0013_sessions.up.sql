@@ -0,0 +1,28 @@
+-- A session belongs to exactly one admin or one user. Access tokens carry the
+-- session id; refresh tokens are stored only as SHA-256 hashes.
+CREATE TABLE sessions (
+  id TEXT PRIMARY KEY,
+  admin_id INT REFERENCES admins (id) ON DELETE CASCADE,
+  user_id INT REFERENCES users (id) ON DELETE CASCADE,
+  created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+  expires_at TIMESTAMP NOT NULL,
+  revoked_at TIMESTAMP,
+  CHECK ((admin_id IS NULL) <> (user_id IS NULL))
+);
+
+CREATE INDEX sessions_admin_id_idx ON sessions (admin_id);
+CREATE INDEX sessions_user_id_idx ON sessions (user_id);
+
+-- used_at is set when the token is swapped for a new one; presenting it
+-- again revokes its session
+CREATE TABLE refresh_tokens (
+  token_hash TEXT PRIMARY KEY,
+  session_id TEXT NOT NULL REFERENCES sessions (id) ON DELETE CASCADE,
+  created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+  used_at TIMESTAMP
+);
+
+CREATE INDEX refresh_tokens_session_id_idx ON refresh_tokens (session_id);
+
+ALTER TABLE admins DROP COLUMN auth_token;
+ALTER TABLE users DROP COLUMN auth_token;
@@ -0,0 +1,7 @@
+-- Every admin was a superuser until now, so existing admins become owners.
+-- New admins are always created with an explicit role.
+ALTER TABLE admins
+  ADD COLUMN role TEXT NOT NULL DEFAULT 'owner'
+  CHECK (role IN ('owner', 'manager', 'catalog', 'support'));
+
+ALTER TABLE admins ALTER COLUMN role DROP DEFAULT;
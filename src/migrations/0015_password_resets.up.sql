@@ -0,0 +1,14 @@
+-- Reset tokens are stored only as SHA-256 hashes. A token is used up when it
+-- resets the password, and so are the account's other outstanding tokens.
+CREATE TABLE password_resets (
+  token_hash TEXT PRIMARY KEY,
+  admin_id INT REFERENCES admins (id) ON DELETE CASCADE,
+  user_id INT REFERENCES users (id) ON DELETE CASCADE,
+  created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+  expires_at TIMESTAMP NOT NULL,
+  used_at TIMESTAMP,
+  CHECK ((admin_id IS NULL) <> (user_id IS NULL))
+);
+
+CREATE INDEX password_resets_admin_id_idx ON password_resets (admin_id);
+CREATE INDEX password_resets_user_id_idx ON password_resets (user_id);
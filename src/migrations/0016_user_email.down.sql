@@ -0,0 +1,6 @@
+DROP INDEX users_email_key;
+
+ALTER TABLE users
+  DROP COLUMN verification_sent_at,
+  DROP COLUMN email_verified_at,
+  DROP COLUMN email;
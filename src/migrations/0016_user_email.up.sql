@@ -0,0 +1,9 @@
+-- Existing users keep a NULL email until they add one; they cannot check out
+-- before it is verified. Emails are stored lower-cased, and the index on
+-- LOWER(email) keeps them unique however they are written.
+ALTER TABLE users
+  ADD COLUMN email TEXT,
+  ADD COLUMN email_verified_at TIMESTAMP,
+  ADD COLUMN verification_sent_at TIMESTAMP;
+
+CREATE UNIQUE INDEX users_email_key ON users (LOWER(email));
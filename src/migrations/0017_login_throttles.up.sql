@@ -0,0 +1,9 @@
+-- Failed logins per account ("user:bob", "admin:root") and per client IP
+-- ("ip:203.0.113.7"). Accounts are keyed by username so unknown usernames are
+-- throttled too.
+CREATE TABLE login_throttles (
+  key TEXT PRIMARY KEY,
+  failures INT NOT NULL,
+  last_failure_at TIMESTAMP NOT NULL,
+  locked_until TIMESTAMP
+);
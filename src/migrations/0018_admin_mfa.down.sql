@@ -0,0 +1,6 @@
+DROP TABLE admin_recovery_codes;
+
+ALTER TABLE admins
+  DROP COLUMN mfa_last_step,
+  DROP COLUMN mfa_confirmed_at,
+  DROP COLUMN mfa_secret;
@@ -0,0 +1,15 @@
+-- mfa_secret is set from the start of enrollment; two-factor authentication is
+-- only in force once mfa_confirmed_at is. mfa_last_step is the TOTP time step
+-- of the last accepted code, which keeps codes from being replayed.
+ALTER TABLE admins
+  ADD COLUMN mfa_secret TEXT,
+  ADD COLUMN mfa_confirmed_at TIMESTAMP,
+  ADD COLUMN mfa_last_step BIGINT NOT NULL DEFAULT 0;
+
+CREATE TABLE admin_recovery_codes (
+  code_hash TEXT PRIMARY KEY,
+  admin_id INT NOT NULL REFERENCES admins (id) ON DELETE CASCADE,
+  used_at TIMESTAMP
+);
+
+CREATE INDEX admin_recovery_codes_admin_id_idx ON admin_recovery_codes (admin_id);
@@ -0,0 +1,16 @@
+-- Only a hash of each key is stored; prefix is its first characters, kept so
+-- admins can tell their keys apart.
+CREATE TABLE api_keys (
+  id SERIAL PRIMARY KEY,
+  admin_id INT NOT NULL REFERENCES admins (id) ON DELETE CASCADE,
+  name TEXT NOT NULL,
+  prefix TEXT NOT NULL,
+  key_hash TEXT NOT NULL UNIQUE,
+  scopes TEXT[] NOT NULL,
+  created_at TIMESTAMP NOT NULL,
+  expires_at TIMESTAMP,
+  last_used_at TIMESTAMP,
+  revoked_at TIMESTAMP
+);
+
+CREATE INDEX api_keys_admin_id_idx ON api_keys (admin_id);
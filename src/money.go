@@ -0,0 +1,130 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+)
+
+// Money is an exact amount in the minor unit of its currency, e.g. cents for
+// USD, so sums never drift the way float64 prices did.
+type Money struct {
+	Amount   int64  `json:"amount"`
+	Currency string `json:"currency"`
+}
+
+var currencyCodePattern = regexp.MustCompile(`^[A-Z]{3}$`)
+
+// currencyExponents lists the ISO 4217 currencies whose minor unit is not
+// hundredths. Anything not listed is assumed to use two decimal places.
+var currencyExponents = map[string]int{
+	"BHD": 3, "CLP": 0, "IQD": 3, "ISK": 0, "JOD": 3, "JPY": 0, "KRW": 0,
+	"KWD": 3, "LYD": 3, "OMR": 3, "PYG": 0, "TND": 3, "UGX": 0, "VND": 0,
+}
+
+// defaultCurrency is the currency assumed when a request omits one.
+func defaultCurrency() string {
+	if currency := os.Getenv("CURRENCY"); currency != "" {
+		return strings.ToUpper(currency)
+	}
+
+	return "USD"
+}
+
+func NewMoney(amount int64, currency string) Money {
+	return Money{Amount: amount, Currency: currency}
+}
+
+// Normalize fills in the default currency when none was given and checks
+// that the code looks like an ISO 4217 code.
+func (self Money) Normalize() (Money, error) {
+	if self.Currency == "" {
+		self.Currency = defaultCurrency()
+	}
+
+	self.Currency = strings.ToUpper(self.Currency)
+	if !currencyCodePattern.MatchString(self.Currency) {
+		return self, validationError("currency", "Invalid currency: \"%s\"", self.Currency)
+	}
+
+	return self, nil
+}
+
+// Add sums two amounts of the same currency. A zero value with no currency
+// adopts the other operand's currency, so it can seed a running total.
+func (self Money) Add(other Money) (Money, error) {
+	if self.Currency == "" {
+		return other, nil
+	}
+
+	if other.Currency == "" {
+		return self, nil
+	}
+
+	if self.Currency != other.Currency {
+		return Money{}, conflictError("Cannot add %s to %s", other.Currency, self.Currency)
+	}
+
+	sum := self.Amount + other.Amount
+	if (other.Amount > 0 && sum < self.Amount) || (other.Amount < 0 && sum > self.Amount) {
+		return Money{}, validationError("quantity", "Total of %s and %s is too large", self, other)
+	}
+
+	return Money{Amount: sum, Currency: self.Currency}, nil
+}
+
+// Mul prices quantity units. A total too large for an int64 of minor units
+// is an error rather than an amount that has wrapped around.
+func (self Money) Mul(quantity int32) (Money, error) {
+	total := self.Amount * int64(quantity)
+	if quantity != 0 && total/int64(quantity) != self.Amount {
+		return Money{}, validationError("quantity", "%d units at %s is too large a total", quantity, self)
+	}
+
+	return Money{Amount: total, Currency: self.Currency}, nil
+}
+
+// String formats the amount in major units, e.g. "19.99 USD".
+func (self Money) String() string {
+	exponent, ok := currencyExponents[self.Currency]
+	if !ok {
+		exponent = 2
+	}
+
+	amount := self.Amount
+	sign := ""
+	if amount < 0 {
+		sign = "-"
+		amount = -amount
+	}
+
+	if exponent == 0 {
+		return fmt.Sprintf("%s%d %s", sign, amount, self.Currency)
+	}
+
+	scale := int64(1)
+	for i := 0; i < exponent; i++ {
+		scale *= 10
+	}
+
+	return fmt.Sprintf("%s%d.%0*d %s", sign, amount/scale, exponent, amount%scale, self.Currency)
+}
+
+// sumMoney totals amounts that must all share one currency. An empty list
+// sums to zero in the default currency.
+func sumMoney(amounts ...Money) (Money, error) {
+	total := Money{}
+	for _, amount := range amounts {
+		var err error
+		if total, err = total.Add(amount); err != nil {
+			return Money{}, err
+		}
+	}
+
+	if total.Currency == "" {
+		total.Currency = defaultCurrency()
+	}
+
+	return total, nil
+}
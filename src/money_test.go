@@ -0,0 +1,30 @@
+package main
+
+import (
+	"math"
+	"testing"
+)
+
+func TestMoneyOverflow(t *testing.T) {
+	price := NewMoney(math.MaxInt64/2+1, "USD")
+
+	if _, err := price.Mul(2); err == nil {
+		t.Error("doubling more than half the largest amount did not fail")
+	}
+	if _, err := NewMoney(-price.Amount, "USD").Mul(3); err == nil {
+		t.Error("tripling a large negative amount did not fail")
+	}
+	if total, err := price.Mul(1); err != nil || total != price {
+		t.Errorf("got %v, %v, want %v", total, err, price)
+	}
+	if total, err := price.Mul(0); err != nil || total.Amount != 0 {
+		t.Errorf("got %v, %v, want zero", total, err)
+	}
+
+	if _, err := price.Add(price); err == nil {
+		t.Error("adding two amounts past the largest did not fail")
+	}
+	if total, err := price.Add(NewMoney(-1, "USD")); err != nil || total.Amount != price.Amount-1 {
+		t.Errorf("got %v, %v, want %d", total, err, price.Amount-1)
+	}
+}
@@ -0,0 +1,479 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	defaultPageLimit = 20
+	maxPageLimit     = 100
+)
+
+// ListOptions selects one page of a collection. A Limit of zero means no
+// limit, which is what internal callers such as the dashboard use; requests
+// coming over HTTP always get a bounded limit from parseListOptions.
+type ListOptions struct {
+	Limit  int
+	Cursor string
+	Sort   string
+	Desc   bool
+}
+
+type ItemFilter struct {
+	ListOptions
+	Name     string
+	MinPrice *int64
+	MaxPrice *int64
+	Currency string
+
+	// CategoryID limits the items to those filed under the category or any
+	// of its subcategories.
+	CategoryID int32
+}
+
+type OrderFilter struct {
+	ListOptions
+	Status OrderStatus
+	UserID int32
+	From   *time.Time
+	To     *time.Time
+}
+
+// Page is one slice of a collection. NextCursor is empty on the last page.
+type Page[T any] struct {
+	Data       []T    `json:"data"`
+	NextCursor string `json:"next_cursor,omitempty"`
+}
+
+// sortKey is a column a collection can be ordered by. Every listing breaks
+// ties on the record id, so the pair is unique and keyset cursors are stable.
+type sortKey[T any] struct {
+	column string
+	kind   sortKind
+	value  func(T) any
+}
+
+type sortKind int
+
+const (
+	sortInt sortKind = iota
+	sortString
+	sortTime
+)
+
+// listing describes how one record type is sorted and paged, so the Postgres
+// and in-memory backends agree on sort keys and cursors.
+type listing[T any] struct {
+	keys map[string]sortKey[T]
+	id   func(T) uint32
+}
+
+var itemListing = &listing[*Item]{
+	keys: map[string]sortKey[*Item]{
+		"id":         {"id", sortInt, func(item *Item) any { return int64(item.ID) }},
+		"name":       {"name", sortString, func(item *Item) any { return item.Name }},
+		"price":      {"price", sortInt, func(item *Item) any { return item.Price.Amount }},
+		"created_at": {"created_at", sortTime, func(item *Item) any { return item.CreatedAt }},
+	},
+	id: func(item *Item) uint32 { return item.ID },
+}
+
+var orderListing = &listing[*Order]{
+	keys: map[string]sortKey[*Order]{
+		"id":         {"id", sortInt, func(order *Order) any { return int64(order.ID) }},
+		"total":      {"total", sortInt, func(order *Order) any { return order.Total.Amount }},
+		"created_at": {"created_at", sortTime, func(order *Order) any { return order.CreatedAt }},
+	},
+	id: func(order *Order) uint32 { return order.ID },
+}
+
+var userListing = &listing[*UserAccount]{
+	keys: map[string]sortKey[*UserAccount]{
+		"id":         {"id", sortInt, func(account *UserAccount) any { return int64(account.ID) }},
+		"username":   {"username", sortString, func(account *UserAccount) any { return account.Username }},
+		"created_at": {"created_at", sortTime, func(account *UserAccount) any { return account.CreatedAt }},
+	},
+	id: func(account *UserAccount) uint32 { return account.ID },
+}
+
+var adminListing = &listing[*AdminAccount]{
+	keys: map[string]sortKey[*AdminAccount]{
+		"id":         {"id", sortInt, func(account *AdminAccount) any { return int64(account.ID) }},
+		"username":   {"username", sortString, func(account *AdminAccount) any { return account.Username }},
+		"created_at": {"created_at", sortTime, func(account *AdminAccount) any { return account.CreatedAt }},
+	},
+	id: func(account *AdminAccount) uint32 { return account.ID },
+}
+
+// pageCursor is the position after the last record of a page. It remembers
+// the sort it was issued for so it cannot be replayed against another one.
+type pageCursor struct {
+	Sort  string `json:"s"`
+	Desc  bool   `json:"d"`
+	Value string `json:"v"`
+	ID    uint32 `json:"id"`
+}
+
+// listPosition is a resolved ListOptions: the sort key to use and, past the
+// first page, the value and id to continue after.
+type listPosition[T any] struct {
+	name    string
+	key     sortKey[T]
+	desc    bool
+	limit   int
+	paged   bool
+	after   any
+	afterID uint32
+}
+
+func (self *listing[T]) resolve(opts ListOptions) (*listPosition[T], error) {
+	name := opts.Sort
+	if name == "" {
+		name = "id"
+	}
+
+	key, ok := self.keys[name]
+	if !ok {
+		return nil, badRequestError("Invalid sort: \"%s\"", opts.Sort)
+	}
+
+	position := &listPosition[T]{name: name, key: key, desc: opts.Desc, limit: opts.Limit}
+	if opts.Cursor == "" {
+		return position, nil
+	}
+
+	raw, err := base64.RawURLEncoding.DecodeString(opts.Cursor)
+	if err != nil {
+		return nil, badRequestError("Invalid cursor")
+	}
+
+	cursor := new(pageCursor)
+	if err := json.Unmarshal(raw, cursor); err != nil {
+		return nil, badRequestError("Invalid cursor")
+	}
+
+	if cursor.Sort != name || cursor.Desc != opts.Desc {
+		return nil, badRequestError("Cursor does not match the requested sort")
+	}
+
+	if position.after, err = parseSortValue(cursor.Value, key.kind); err != nil {
+		return nil, badRequestError("Invalid cursor")
+	}
+
+	position.afterID = cursor.ID
+	position.paged = true
+
+	return position, nil
+}
+
+// page trims a result fetched with one extra row, as fetchLimit asks for, and
+// issues a cursor if that extra row shows there is more to come.
+func (self *listing[T]) page(rows []T, position *listPosition[T]) *Page[T] {
+	if position.limit <= 0 || len(rows) <= position.limit {
+		return &Page[T]{Data: rows}
+	}
+
+	rows = rows[:position.limit]
+	last := rows[len(rows)-1]
+
+	raw, _ := json.Marshal(pageCursor{
+		Sort:  position.name,
+		Desc:  position.desc,
+		Value: formatSortValue(position.key.value(last)),
+		ID:    self.id(last),
+	})
+
+	return &Page[T]{Data: rows, NextCursor: base64.RawURLEncoding.EncodeToString(raw)}
+}
+
+// paginate sorts, positions and limits records held in memory the same way
+// the SQL listing queries do.
+func (self *listing[T]) paginate(records []T, opts ListOptions) (*Page[T], error) {
+	position, err := self.resolve(opts)
+	if err != nil {
+		return nil, err
+	}
+
+	sort.SliceStable(records, func(i, j int) bool {
+		return position.less(records[i], records[j], self.id)
+	})
+
+	rows := make([]T, 0, len(records))
+	for _, record := range records {
+		if position.paged && !position.isAfter(record, self.id) {
+			continue
+		}
+
+		rows = append(rows, record)
+		if position.limit > 0 && len(rows) > position.limit {
+			break
+		}
+	}
+
+	return self.page(rows, position), nil
+}
+
+func (self *listPosition[T]) less(a, b T, id func(T) uint32) bool {
+	cmp := compareSortValues(self.key.value(a), self.key.value(b))
+	if cmp == 0 {
+		cmp = compareSortValues(int64(id(a)), int64(id(b)))
+	}
+
+	if self.desc {
+		return cmp > 0
+	}
+
+	return cmp < 0
+}
+
+func (self *listPosition[T]) isAfter(record T, id func(T) uint32) bool {
+	cmp := compareSortValues(self.key.value(record), self.after)
+	if cmp == 0 {
+		cmp = compareSortValues(int64(id(record)), int64(self.afterID))
+	}
+
+	if self.desc {
+		return cmp < 0
+	}
+
+	return cmp > 0
+}
+
+// fetchLimit is the number of rows to ask the database for: one more than the
+// page, so page can tell whether another page follows.
+func (self *listPosition[T]) fetchLimit() int {
+	if self.limit <= 0 {
+		return 0
+	}
+
+	return self.limit + 1
+}
+
+// apply adds the keyset condition and ORDER BY / LIMIT clauses for the
+// position to a query.
+func (self *listPosition[T]) apply(conditions *sqlConditions) string {
+	direction, comparison := "ASC", ">"
+	if self.desc {
+		direction, comparison = "DESC", "<"
+	}
+
+	if self.paged {
+		conditions.add(fmt.Sprintf("(%s, id) %s (?, ?)", self.key.column, comparison), self.after, int64(self.afterID))
+	}
+
+	clause := fmt.Sprintf("\n    ORDER BY %s %s, id %s", self.key.column, direction, direction)
+	if limit := self.fetchLimit(); limit > 0 {
+		clause += fmt.Sprintf("\n    LIMIT %d", limit)
+	}
+
+	return clause
+}
+
+// sqlConditions collects WHERE clauses written with ? placeholders and
+// numbers them as it goes.
+type sqlConditions struct {
+	clauses []string
+	args    []any
+}
+
+func (self *sqlConditions) add(clause string, args ...any) {
+	for _, arg := range args {
+		self.args = append(self.args, arg)
+		clause = strings.Replace(clause, "?", "$"+strconv.Itoa(len(self.args)), 1)
+	}
+
+	self.clauses = append(self.clauses, clause)
+}
+
+func (self *sqlConditions) where() string {
+	if len(self.clauses) == 0 {
+		return ""
+	}
+
+	return "\n    WHERE " + strings.Join(self.clauses, "\n      AND ")
+}
+
+// escapeLike makes user input match literally inside a LIKE pattern.
+func escapeLike(value string) string {
+	return strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(value)
+}
+
+func formatSortValue(value any) string {
+	switch value := value.(type) {
+	case int64:
+		return strconv.FormatInt(value, 10)
+	case time.Time:
+		return value.UTC().Format(time.RFC3339Nano)
+	case string:
+		return value
+	}
+
+	panic(fmt.Sprintf("unsupported sort value %T", value))
+}
+
+func parseSortValue(raw string, kind sortKind) (any, error) {
+	switch kind {
+	case sortInt:
+		return strconv.ParseInt(raw, 10, 64)
+	case sortTime:
+		return time.Parse(time.RFC3339Nano, raw)
+	}
+
+	return raw, nil
+}
+
+func compareSortValues(a, b any) int {
+	switch a := a.(type) {
+	case int64:
+		b := b.(int64)
+		switch {
+		case a < b:
+			return -1
+		case a > b:
+			return 1
+		}
+		return 0
+	case time.Time:
+		return a.Compare(b.(time.Time))
+	case string:
+		return strings.Compare(a, b.(string))
+	}
+
+	panic(fmt.Sprintf("unsupported sort value %T", a))
+}
+
+// parseListOptions reads limit, cursor, sort and order from the query string.
+func parseListOptions(r *http.Request) (ListOptions, error) {
+	limit, err := parseLimit(r)
+	if err != nil {
+		return ListOptions{}, err
+	}
+
+	query := r.URL.Query()
+	opts := ListOptions{
+		Limit:  limit,
+		Cursor: query.Get("cursor"),
+		Sort:   query.Get("sort"),
+	}
+
+	switch order := query.Get("order"); order {
+	case "", "asc":
+	case "desc":
+		opts.Desc = true
+	default:
+		return opts, badRequestError("Invalid order: \"%s\"", order)
+	}
+
+	return opts, nil
+}
+
+// parseLimit reads the page size, which defaults to defaultPageLimit.
+func parseLimit(r *http.Request) (int, error) {
+	limitStr := r.URL.Query().Get("limit")
+	if limitStr == "" {
+		return defaultPageLimit, nil
+	}
+
+	limit, err := strconv.Atoi(limitStr)
+	if err != nil || limit < 1 || limit > maxPageLimit {
+		return 0, badRequestError("Invalid limit: \"%s\" (must be between 1 and %d)", limitStr, maxPageLimit)
+	}
+
+	return limit, nil
+}
+
+func parseItemFilter(r *http.Request) (ItemFilter, error) {
+	opts, err := parseListOptions(r)
+	if err != nil {
+		return ItemFilter{}, err
+	}
+
+	query := r.URL.Query()
+	filter := ItemFilter{
+		ListOptions: opts,
+		Name:        query.Get("name"),
+		Currency:    strings.ToUpper(query.Get("currency")),
+	}
+
+	if filter.MinPrice, err = parseOptionalInt64(query.Get("min_price"), "min_price"); err != nil {
+		return filter, err
+	}
+
+	if filter.MaxPrice, err = parseOptionalInt64(query.Get("max_price"), "max_price"); err != nil {
+		return filter, err
+	}
+
+	return filter, nil
+}
+
+func parseOrderFilter(r *http.Request) (OrderFilter, error) {
+	opts, err := parseListOptions(r)
+	if err != nil {
+		return OrderFilter{}, err
+	}
+
+	query := r.URL.Query()
+	filter := OrderFilter{
+		ListOptions: opts,
+		Status:      OrderStatus(query.Get("status")),
+	}
+
+	if filter.Status != "" && !filter.Status.IsValid() {
+		return filter, badRequestError("Invalid order status: \"%s\"", filter.Status)
+	}
+
+	if userIDStr := query.Get("user_id"); userIDStr != "" {
+		userID, err := strconv.Atoi(userIDStr)
+		if err != nil {
+			return filter, badRequestError("Invalid user_id: \"%s\"", userIDStr)
+		}
+
+		filter.UserID = int32(userID)
+	}
+
+	if filter.From, err = parseOptionalTime(query.Get("from"), "from"); err != nil {
+		return filter, err
+	}
+
+	if filter.To, err = parseOptionalTime(query.Get("to"), "to"); err != nil {
+		return filter, err
+	}
+
+	return filter, nil
+}
+
+func parseOptionalInt64(raw string, name string) (*int64, error) {
+	if raw == "" {
+		return nil, nil
+	}
+
+	value, err := strconv.ParseInt(raw, 10, 64)
+	if err != nil {
+		return nil, badRequestError("Invalid %s: \"%s\"", name, raw)
+	}
+
+	return &value, nil
+}
+
+// parseOptionalTime accepts either an RFC 3339 timestamp or a bare date.
+func parseOptionalTime(raw string, name string) (*time.Time, error) {
+	if raw == "" {
+		return nil, nil
+	}
+
+	for _, layout := range []string{time.RFC3339, time.DateOnly} {
+		if value, err := time.Parse(layout, raw); err == nil {
+			value = value.UTC()
+			return &value, nil
+		}
+	}
+
+	return nil, badRequestError("Invalid %s: \"%s\"", name, raw)
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/alexedwards/argon2id"
+)
+
+const (
+	minPasswordLength = 8
+
+	// passwordResetTTL is how long a reset token can be used for.
+	passwordResetTTL = time.Hour
+)
+
+func checkPassword(password string) error {
+	if len(password) < minPasswordLength {
+		return validationError("password", "Password must be at least %d characters", minPasswordLength)
+	}
+
+	return nil
+}
+
+// checkPasswordNotUsername is the rule for requests that set a password along
+// with a username.
+func checkPasswordNotUsername(errs FieldErrors, password, username string) {
+	if password != "" && strings.EqualFold(password, username) {
+		errs.add("password", "Password cannot be the username")
+	}
+}
+
+var (
+	dummyHashOnce sync.Once
+	dummyHashed   string
+)
+
+// dummyHash is a hash no password is checked against for real. Logins for
+// unknown usernames verify against it so they take as long as real ones.
+func dummyHash() string {
+	dummyHashOnce.Do(func() {
+		hashed, err := argon2id.CreateHash("dummy password", argon2id.DefaultParams)
+		if err != nil {
+			panic(err)
+		}
+		dummyHashed = hashed
+	})
+
+	return dummyHashed
+}
+
+// PasswordReset is a freshly issued reset token and the account it resets.
+// The token is only ever handed to the mailer; storage keeps its hash. Email
+// is empty for admins and for users who signed up before emails were
+// required, in which case the message is addressed to the username.
+type PasswordReset struct {
+	Token     string
+	Kind      SessionKind
+	AccountID int32
+	Username  string
+	Email     string
+	ExpiresAt time.Time
+}
+
+func NewPasswordReset(kind SessionKind, accountID int32, username, email string) (*PasswordReset, error) {
+	token, err := randomToken()
+	if err != nil {
+		return nil, err
+	}
+
+	return &PasswordReset{
+		Token:     token,
+		Kind:      kind,
+		AccountID: accountID,
+		Username:  username,
+		Email:     email,
+		ExpiresAt: time.Now().UTC().Add(passwordResetTTL),
+	}, nil
+}
+
+func (self *PasswordReset) Message() *Message {
+	to := self.Email
+	if to == "" {
+		to = self.Username
+	}
+
+	return &Message{
+		To:      to,
+		Subject: "Reset your password",
+		Body: fmt.Sprintf(
+			"Someone asked to reset the password of %s account %s.\n\n"+
+				"Reset token: %s\n\n"+
+				"The token works once and expires at %s. If you did not ask for this, ignore this email.\n",
+			self.Kind, self.Username, self.Token, self.ExpiresAt.Format(time.RFC1123),
+		),
+	}
+}
+
+var errInvalidResetToken = unauthorizedError("Invalid or expired reset token")
+
+// rejectUnknownLogin spends as long as a real password check before turning
+// away a username that has no account.
+func rejectUnknownLogin(password string) error {
+	argon2id.ComparePasswordAndHash(password, dummyHash())
+	return errInvalidCredentials
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+// resetToken asks for a password reset and reads the token out of the email
+// sent to address.
+func (self *testServer) resetToken(kind SessionKind, username, address string) string {
+	self.t.Helper()
+
+	path := fmt.Sprintf("/%s/password/forgot", kind)
+	self.expect(self.request("POST", path, "", ForgotPasswordRequest{Username: username}, nil), http.StatusOK)
+
+	message := self.mailer.last(address)
+	if message == nil {
+		self.t.Fatalf("no reset email sent to %s", address)
+	}
+
+	for _, line := range strings.Split(message.Body, "\n") {
+		if token, ok := strings.CutPrefix(line, "Reset token: "); ok {
+			return token
+		}
+	}
+
+	self.t.Fatalf("no reset token in %q", message.Body)
+	return ""
+}
+
+func TestResetPasswordTokenWorksOnce(t *testing.T) {
+	server := newTestServer(t)
+	userID, tokens := server.signup("bob")
+	token := server.resetToken(UserSession, "bob", "bob@example.com")
+
+	res := server.request("POST", "/user/password/reset", "", ResetPasswordRequest{Token: token, Password: "new-password"}, nil)
+	server.expect(res, http.StatusOK)
+
+	// resetting signs the account out everywhere
+	server.expect(server.request("GET", fmt.Sprintf("/user/%d", userID), tokens.AuthToken, nil, nil), http.StatusUnauthorized)
+	server.login("/user/login", LoginRequest{Username: "bob", Password: "new-password"})
+
+	res = server.request("POST", "/user/password/reset", "", ResetPasswordRequest{Token: token, Password: "other-password"}, nil)
+	server.expect(res, http.StatusUnauthorized)
+
+	server.login("/user/login", LoginRequest{Username: "bob", Password: "new-password"})
+}
+
+func TestResetPasswordRejectsBadTokens(t *testing.T) {
+	server := newTestServer(t)
+	server.signup("bob")
+
+	// unknown accounts get the same answer and no email
+	server.expect(server.request("POST", "/user/password/forgot", "", ForgotPasswordRequest{Username: "ghost"}, nil), http.StatusOK)
+	if server.mailer.last("ghost") != nil {
+		t.Fatal("sent a reset email for an unknown account")
+	}
+
+	server.expect(server.request("POST", "/user/password/reset", "", ResetPasswordRequest{Token: "not-a-token", Password: "new-password"}, nil), http.StatusUnauthorized)
+
+	// a user's token does not reset an admin's password
+	token := server.resetToken(UserSession, "bob", "bob@example.com")
+	server.expect(server.request("POST", "/admin/password/reset", "", ResetPasswordRequest{Token: token, Password: "new-password"}, nil), http.StatusUnauthorized)
+
+	server.expect(server.request("POST", "/user/password/reset", "", ResetPasswordRequest{Token: token, Password: "short"}, nil), http.StatusUnprocessableEntity)
+
+	for _, reset := range server.storage.data.passwordResets {
+		reset.expiresAt = time.Now().UTC().Add(-time.Minute)
+	}
+
+	apiErr := new(ApiError)
+	res := server.request("POST", "/user/password/reset", "", ResetPasswordRequest{Token: token, Password: "new-password"}, apiErr)
+	server.expect(res, http.StatusUnauthorized)
+	if apiErr.Error != errInvalidResetToken.Error() {
+		t.Fatalf("got error %q, want %q", apiErr.Error, errInvalidResetToken)
+	}
+
+	server.login("/user/login", LoginRequest{Username: "bob", Password: "bob-password"})
+}
+
+func TestChangePasswordNeedsCurrentPassword(t *testing.T) {
+	server := newTestServer(t)
+	userID, tokens := server.signup("bob")
+	path := fmt.Sprintf("/user/%d/password", userID)
+
+	res := server.request("PUT", path, tokens.AuthToken, ChangePasswordRequest{CurrentPassword: "wrong-password", NewPassword: "new-password"}, nil)
+	server.expect(res, http.StatusUnprocessableEntity)
+
+	res = server.request("PUT", path, tokens.AuthToken, ChangePasswordRequest{CurrentPassword: "bob-password", NewPassword: "new-password"}, nil)
+	server.expect(res, http.StatusOK)
+
+	server.login("/user/login", LoginRequest{Username: "bob", Password: "new-password"})
+}
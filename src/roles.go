@@ -0,0 +1,117 @@
+package main
+
+import (
+	"net/http"
+)
+
+// Role is what an admin is allowed to do, as a named set of permissions.
+type Role string
+
+const (
+	RoleOwner   Role = "owner"
+	RoleManager Role = "manager"
+	RoleCatalog Role = "catalog"
+	RoleSupport Role = "support"
+)
+
+type Permission string
+
+const (
+	PermDashboardRead Permission = "dashboard:read"
+	PermAdminsManage  Permission = "admins:manage"
+	PermUsersRead     Permission = "users:read"
+	PermUsersWrite    Permission = "users:write"
+	PermCatalogRead   Permission = "catalog:read"
+	PermCatalogWrite  Permission = "catalog:write"
+	PermOrdersRead    Permission = "orders:read"
+	PermOrdersWrite   Permission = "orders:write"
+)
+
+// rolePermissions lists what each role grants. Only owners can manage other
+// admins, so there must always be at least one of them.
+var rolePermissions = map[Role][]Permission{
+	RoleOwner: {
+		PermDashboardRead, PermAdminsManage,
+		PermUsersRead, PermUsersWrite,
+		PermCatalogRead, PermCatalogWrite,
+		PermOrdersRead, PermOrdersWrite,
+	},
+	RoleManager: {
+		PermDashboardRead,
+		PermUsersRead, PermUsersWrite,
+		PermCatalogRead, PermCatalogWrite,
+		PermOrdersRead, PermOrdersWrite,
+	},
+	RoleCatalog: {
+		PermCatalogRead, PermCatalogWrite,
+	},
+	RoleSupport: {
+		PermUsersRead,
+		PermCatalogRead,
+		PermOrdersRead,
+	},
+}
+
+func checkRole(role Role) error {
+	if _, ok := rolePermissions[role]; !ok {
+		return validationError("role", "Unknown role: \"%s\" (must be owner, manager, catalog or support)", role)
+	}
+
+	return nil
+}
+
+func (self Role) Permissions() []Permission {
+	return rolePermissions[self]
+}
+
+func (self Role) grants(permission Permission) bool {
+	for _, granted := range rolePermissions[self] {
+		if granted == permission {
+			return true
+		}
+	}
+
+	return false
+}
+
+// adminAccess is what an admin route requires: the read permission for GET
+// requests and the write permission for everything else. Routes with no
+// permissions, like an admin's own account, are open to every admin.
+type adminAccess struct {
+	read  Permission
+	write Permission
+
+	// withoutMFA routes stay open to admins without two-factor
+	// authentication when ADMIN_MFA_REQUIRED is set, so they can enroll.
+	withoutMFA bool
+
+	// sessionOnly routes refuse API keys, so a leaked key cannot change the
+	// admin's password or two-factor setup, or mint more keys.
+	sessionOnly bool
+}
+
+func requires(read, write Permission) adminAccess {
+	return adminAccess{read: read, write: write}
+}
+
+func (self adminAccess) allowingNoMFA() adminAccess {
+	self.withoutMFA = true
+	return self
+}
+
+func (self adminAccess) requiringSession() adminAccess {
+	self.sessionOnly = true
+	return self
+}
+
+func (self adminAccess) permission(method string) Permission {
+	if method == http.MethodGet {
+		return self.read
+	}
+
+	return self.write
+}
+
+func lastOwnerError(id int32) error {
+	return conflictError("Admin %d is the last owner; make another admin an owner first", id)
+}
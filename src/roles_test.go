@@ -0,0 +1,101 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"testing"
+)
+
+// createAdmin adds an admin with the given role and logs them in.
+func (self *testServer) createAdmin(ownerToken, username string, role Role) (int32, string) {
+	self.t.Helper()
+
+	account := new(AdminAccount)
+	res := self.request("POST", "/admin/1/admins", ownerToken, CreateAdminAccountRequest{
+		Username: username,
+		Password: username + "-password",
+		Role:     role,
+	}, account)
+	self.expect(res, http.StatusOK)
+
+	tokens := self.login("/admin/login", LoginRequest{Username: username, Password: username + "-password"})
+
+	return int32(account.ID), tokens.AuthToken
+}
+
+func TestAdminRolePermissions(t *testing.T) {
+	server := newTestServer(t)
+	ownerToken := server.adminLogin()
+	itemID := server.createItem(ownerToken, "Shirt", 1000, 5)
+
+	catalogID, catalogToken := server.createAdmin(ownerToken, "carol", RoleCatalog)
+	supportID, supportToken := server.createAdmin(ownerToken, "sam", RoleSupport)
+
+	item := CreateItemRequest{Name: "Hat", Price: Money{Amount: 2000}}
+
+	checks := []struct {
+		name   string
+		id     int32
+		token  string
+		method string
+		path   string
+		body   any
+		want   int
+	}{
+		{"catalog edits items", catalogID, catalogToken, "POST", "/items", item, http.StatusOK},
+		{"catalog reads stock", catalogID, catalogToken, "GET", fmt.Sprintf("/items/%d/stock", itemID), nil, http.StatusOK},
+		{"catalog reads users", catalogID, catalogToken, "GET", "/users", nil, http.StatusForbidden},
+		{"catalog reads orders", catalogID, catalogToken, "GET", "/orders", nil, http.StatusForbidden},
+		{"catalog opens the dashboard", catalogID, catalogToken, "GET", "/dash", nil, http.StatusForbidden},
+		{"catalog manages admins", catalogID, catalogToken, "GET", "/admins", nil, http.StatusForbidden},
+		{"catalog reads its own account", catalogID, catalogToken, "GET", "", nil, http.StatusOK},
+		{"support reads users", supportID, supportToken, "GET", "/users", nil, http.StatusOK},
+		{"support reads items", supportID, supportToken, "GET", "/items", nil, http.StatusOK},
+		{"support edits items", supportID, supportToken, "POST", "/items", item, http.StatusForbidden},
+		{"support sets stock", supportID, supportToken, "PUT", fmt.Sprintf("/items/%d/stock", itemID), SetStockRequest{Stock: 0, Reason: "Lost"}, http.StatusForbidden},
+		{"support creates admins", supportID, supportToken, "POST", "/admins", CreateAdminAccountRequest{Username: "eve", Password: "eve-password", Role: RoleOwner}, http.StatusForbidden},
+		{"a token for another admin", supportID, catalogToken, "GET", "/users", nil, http.StatusUnauthorized},
+	}
+
+	for _, check := range checks {
+		path := fmt.Sprintf("/admin/%d%s", check.id, check.path)
+		if res := server.request(check.method, path, check.token, check.body, nil); res.StatusCode != check.want {
+			t.Errorf("%s: got %d, want %d", check.name, res.StatusCode, check.want)
+		}
+	}
+}
+
+func TestAdminRoleChangeInvalidatesTokens(t *testing.T) {
+	server := newTestServer(t)
+	ownerToken := server.adminLogin()
+	catalogID, catalogToken := server.createAdmin(ownerToken, "carol", RoleCatalog)
+
+	res := server.request("PUT", "/admin/1/admins", ownerToken, SetAdminRoleRequest{ID: catalogID, Role: RoleSupport}, nil)
+	server.expect(res, http.StatusOK)
+
+	// the old token still claims the catalog role
+	server.expect(server.request("GET", fmt.Sprintf("/admin/%d/items", catalogID), catalogToken, nil, nil), http.StatusUnauthorized)
+}
+
+func TestAdminRoleValidation(t *testing.T) {
+	server := newTestServer(t)
+	ownerToken := server.adminLogin()
+
+	res := server.request("POST", "/admin/1/admins", ownerToken, CreateAdminAccountRequest{Username: "eve", Password: "eve-password", Role: "superuser"}, nil)
+	server.expect(res, http.StatusUnprocessableEntity)
+
+	managerID, _ := server.createAdmin(ownerToken, "max", RoleManager)
+
+	res = server.request("PUT", "/admin/1/admins", ownerToken, SetAdminRoleRequest{ID: managerID, Role: "superuser"}, nil)
+	server.expect(res, http.StatusUnprocessableEntity)
+
+	// root is the only owner, so it cannot step down until there is another
+	res = server.request("PUT", "/admin/1/admins", ownerToken, SetAdminRoleRequest{ID: 1, Role: RoleManager}, nil)
+	server.expect(res, http.StatusConflict)
+
+	res = server.request("PUT", "/admin/1/admins", ownerToken, SetAdminRoleRequest{ID: managerID, Role: RoleOwner}, nil)
+	server.expect(res, http.StatusOK)
+
+	res = server.request("PUT", "/admin/1/admins", ownerToken, SetAdminRoleRequest{ID: 1, Role: RoleManager}, nil)
+	server.expect(res, http.StatusOK)
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"sort"
+	"strings"
+	"unicode"
+)
+
+const (
+	highlightStart = "<mark>"
+	highlightStop  = "</mark>"
+)
+
+// ItemSearchResult is an item matched by SearchItems. NameHighlight and
+// Snippet are the item's own text, unescaped, with the matched words wrapped
+// in <mark>.
+type ItemSearchResult struct {
+	Item          *Item   `json:"item"`
+	Rank          float64 `json:"rank"`
+	NameHighlight string  `json:"name_highlight"`
+	Snippet       string  `json:"snippet"`
+}
+
+// searchTerms splits a free-text query into lower-case words, dropping
+// punctuation, so nothing the user types can reach to_tsquery as syntax.
+func searchTerms(query string) ([]string, error) {
+	terms := searchWords(query)
+
+	if len(terms) == 0 {
+		return nil, badRequestError("Search query must contain at least one word")
+	}
+
+	return terms, nil
+}
+
+// prefixTSQuery turns search terms into a tsquery that requires every term,
+// each matched as a prefix so "cott shi" finds "cotton shirt".
+func prefixTSQuery(terms []string) string {
+	parts := make([]string, 0, len(terms))
+	for _, term := range terms {
+		parts = append(parts, term+":*")
+	}
+
+	return strings.Join(parts, " & ")
+}
+
+// matchItem is the in-memory stand-in for the tsvector search: every term
+// must prefix a word of the name or description, and name hits weigh more.
+// It does no stemming, so it is only an approximation of the Postgres path.
+func matchItem(item *Item, terms []string) (*ItemSearchResult, bool) {
+	nameWords := searchWords(item.Name)
+	descriptionWords := searchWords(item.Description)
+
+	rank := 0.0
+	for _, term := range terms {
+		nameHits := countPrefixHits(nameWords, term)
+		descriptionHits := countPrefixHits(descriptionWords, term)
+		if nameHits+descriptionHits == 0 {
+			return nil, false
+		}
+
+		rank += float64(nameHits) + 0.4*float64(descriptionHits)
+	}
+
+	return &ItemSearchResult{
+		Item:          item,
+		Rank:          rank,
+		NameHighlight: highlightTerms(item.Name, terms),
+		Snippet:       highlightTerms(item.Description, terms),
+	}, true
+}
+
+// sortSearchResults orders results by rank, best first, then by item id.
+func sortSearchResults(results []*ItemSearchResult) {
+	sort.SliceStable(results, func(i, j int) bool {
+		if results[i].Rank != results[j].Rank {
+			return results[i].Rank > results[j].Rank
+		}
+
+		return results[i].Item.ID < results[j].Item.ID
+	})
+}
+
+func searchWords(text string) []string {
+	return strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+}
+
+func countPrefixHits(words []string, term string) int {
+	hits := 0
+	for _, word := range words {
+		if strings.HasPrefix(word, term) {
+			hits++
+		}
+	}
+
+	return hits
+}
+
+// highlightTerms marks every word that starts with one of the terms, the way
+// ts_headline does.
+func highlightTerms(text string, terms []string) string {
+	var builder strings.Builder
+
+	runes := []rune(text)
+	for start := 0; start < len(runes); {
+		if !unicode.IsLetter(runes[start]) && !unicode.IsDigit(runes[start]) {
+			builder.WriteRune(runes[start])
+			start++
+			continue
+		}
+
+		end := start
+		for end < len(runes) && (unicode.IsLetter(runes[end]) || unicode.IsDigit(runes[end])) {
+			end++
+		}
+
+		word := string(runes[start:end])
+		if matchesAnyTerm(word, terms) {
+			builder.WriteString(highlightStart + word + highlightStop)
+		} else {
+			builder.WriteString(word)
+		}
+
+		start = end
+	}
+
+	return builder.String()
+}
+
+func matchesAnyTerm(word string, terms []string) bool {
+	word = strings.ToLower(word)
+	for _, term := range terms {
+		if strings.HasPrefix(word, term) {
+			return true
+		}
+	}
+
+	return false
+}
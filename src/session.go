@@ -0,0 +1,120 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"time"
+)
+
+const (
+	// accessTokenTTL is kept short because an access token is only checked
+	// against its session, not re-issued, until it expires.
+	accessTokenTTL = 15 * time.Minute
+
+	// refreshTokenTTL is how long a session lasts without being refreshed.
+	refreshTokenTTL = 30 * 24 * time.Hour
+)
+
+type SessionKind string
+
+const (
+	AdminSession SessionKind = "admin"
+	UserSession  SessionKind = "user"
+)
+
+// Session is one login of an account. Every refresh token issued for it,
+// each replacing the last, belongs to the same family; revoking the session
+// revokes them all along with its access tokens.
+type Session struct {
+	ID        string
+	Kind      SessionKind
+	AccountID int32
+	CreatedAt time.Time
+	ExpiresAt time.Time
+	RevokedAt *time.Time
+}
+
+func NewSession(kind SessionKind, accountID int32) (*Session, error) {
+	id, err := randomToken()
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now().UTC()
+	return &Session{
+		ID:        id,
+		Kind:      kind,
+		AccountID: accountID,
+		CreatedAt: now,
+		ExpiresAt: now.Add(refreshTokenTTL),
+	}, nil
+}
+
+// Active reports whether the session still authorises requests.
+func (self *Session) Active() bool {
+	return self.RevokedAt == nil && time.Now().UTC().Before(self.ExpiresAt)
+}
+
+// TokenPair is what a login or refresh hands the client.
+type TokenPair struct {
+	AuthToken    string `json:"auth_token"`
+	RefreshToken string `json:"refresh_token"`
+	ExpiresIn    int64  `json:"expires_in"`
+}
+
+// issueTokens mints an access token bound to the session and a new refresh
+// token, returning the pair and the refresh token's hash for storage. Only
+// the hash is ever stored. Admin tokens carry the admin's role; role is empty
+// for users.
+func issueTokens(session *Session, username string, role Role) (*TokenPair, string, error) {
+	accessToken, err := generateToken(session.Kind, session.AccountID, username, session.ID, role)
+	if err != nil {
+		return nil, "", err
+	}
+
+	refreshToken, err := randomToken()
+	if err != nil {
+		return nil, "", err
+	}
+
+	return &TokenPair{
+		AuthToken:    accessToken,
+		RefreshToken: refreshToken,
+		ExpiresIn:    int64(accessTokenTTL / time.Second),
+	}, hashToken(refreshToken), nil
+}
+
+func generateToken(kind SessionKind, id int32, username, sessionID string, role Role) (string, error) {
+	return signToken(&Claims{
+		Type:        accessTokenType(kind),
+		AccountID:   id,
+		Username:    username,
+		SessionID:   sessionID,
+		Role:        role,
+		Permissions: role.Permissions(),
+	}, accessTokenTTL)
+}
+
+// randomToken returns 128 random bits, hex-encoded.
+func randomToken() (string, error) {
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(buf), nil
+}
+
+// hashToken is how refresh tokens are stored and looked up. They are random
+// and long, so a fast hash is enough; unlike passwords they cannot be
+// guessed.
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+var (
+	errInvalidRefreshToken = unauthorizedError("Invalid or expired refresh token")
+	errRefreshTokenReused  = unauthorizedError("Refresh token was already used; the session has been revoked")
+)
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestRefreshRotatesToken(t *testing.T) {
+	server := newTestServer(t)
+	userID, tokens := server.signup("bob")
+
+	rotated := new(TokenPair)
+	res := server.request("POST", "/user/refresh", "", RefreshRequest{RefreshToken: tokens.RefreshToken}, rotated)
+	server.expect(res, http.StatusOK)
+
+	if rotated.RefreshToken == tokens.RefreshToken || rotated.AuthToken == "" {
+		t.Fatalf("refresh did not hand out new tokens: %+v", rotated)
+	}
+
+	server.expect(server.request("GET", fmt.Sprintf("/user/%d", userID), rotated.AuthToken, nil, nil), http.StatusOK)
+
+	// a user's refresh token is no good for an admin session
+	server.expect(server.request("POST", "/admin/refresh", "", RefreshRequest{RefreshToken: rotated.RefreshToken}, nil), http.StatusUnauthorized)
+	server.expect(server.request("POST", "/user/refresh", "", RefreshRequest{RefreshToken: "not-a-token"}, nil), http.StatusUnauthorized)
+}
+
+func TestRefreshTokenReuseRevokesSession(t *testing.T) {
+	server := newTestServer(t)
+	userID, tokens := server.signup("bob")
+
+	rotated := new(TokenPair)
+	server.expect(server.request("POST", "/user/refresh", "", RefreshRequest{RefreshToken: tokens.RefreshToken}, rotated), http.StatusOK)
+
+	// presenting the old token again means it leaked; the whole session goes
+	apiErr := new(ApiError)
+	res := server.request("POST", "/user/refresh", "", RefreshRequest{RefreshToken: tokens.RefreshToken}, apiErr)
+	server.expect(res, http.StatusUnauthorized)
+	if apiErr.Error != errRefreshTokenReused.Error() {
+		t.Fatalf("got error %q, want %q", apiErr.Error, errRefreshTokenReused)
+	}
+
+	server.expect(server.request("POST", "/user/refresh", "", RefreshRequest{RefreshToken: rotated.RefreshToken}, nil), http.StatusUnauthorized)
+	server.expect(server.request("GET", fmt.Sprintf("/user/%d", userID), rotated.AuthToken, nil, nil), http.StatusUnauthorized)
+
+	// other sessions of the same user are left alone
+	other := server.login("/user/login", LoginRequest{Username: "bob", Password: "bob-password"})
+	server.expect(server.request("POST", "/user/refresh", "", RefreshRequest{RefreshToken: other.RefreshToken}, nil), http.StatusOK)
+}
+
+func TestLogoutRevokesSession(t *testing.T) {
+	server := newTestServer(t)
+	userID, tokens := server.signup("bob")
+
+	server.expect(server.request("POST", "/user/logout", "", RefreshRequest{RefreshToken: tokens.RefreshToken}, nil), http.StatusOK)
+
+	server.expect(server.request("GET", fmt.Sprintf("/user/%d", userID), tokens.AuthToken, nil, nil), http.StatusUnauthorized)
+	server.expect(server.request("POST", "/user/refresh", "", RefreshRequest{RefreshToken: tokens.RefreshToken}, nil), http.StatusUnauthorized)
+}
+
+func TestRefreshExpiredSession(t *testing.T) {
+	t.Setenv("JWT_SECRET", "test-secret")
+
+	storage := NewMemoryStorage()
+
+	account, err := NewUserAccount("bob", "bob-password", "bob@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := storage.CreateUserAccount(account); err != nil {
+		t.Fatal(err)
+	}
+
+	tokens, err := storage.LoginUserAccount("bob", "bob-password")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, session := range storage.data.sessions {
+		session.ExpiresAt = time.Now().UTC().Add(-time.Minute)
+	}
+
+	if _, err := storage.RefreshSession(UserSession, tokens.RefreshToken); err != errInvalidRefreshToken {
+		t.Fatalf("got %v, want %v", err, errInvalidRefreshToken)
+	}
+}
@@ -2,12 +2,15 @@ package main
 
 import (
 	"database/sql"
+	"encoding/json"
 	"fmt"
+	"log"
 	"os"
+	"sort"
+	"strings"
 	"time"
 
 	"github.com/alexedwards/argon2id"
-	"github.com/golang-jwt/jwt/v4"
 	_ "github.com/joho/godotenv/autoload"
 	"github.com/lib/pq"
 )
@@ -15,45 +18,145 @@ import (
 type Storage interface {
 	// AdminAccount
 	CreateAdminAccount(*AdminAccount) error
-	LoginAdminAccount(string, string) (string, error)
+	LoginAdminAccount(string, string) (*AdminAccount, error)
 	UpdateAdminAccount(*AdminAccount) error
 	GetAdminAccount(int32) (*AdminAccount, error)
 	DeleteAdminAccount(int32) error
-	GetAdminAccounts() ([]*AdminAccount, error)
+	SetAdminRole(int32, Role) error
+	GetAdminAccounts(ListOptions) (*Page[*AdminAccount], error)
 
 	// UserAccount
 	CreateUserAccount(*UserAccount) error
-	LoginUserAccount(string, string) (string, error)
+	LoginUserAccount(string, string) (*TokenPair, error)
 	UpdateUserAccount(*UserAccount) error
 	GetUserAccount(int32) (*UserAccount, error)
+	LockUserAccount(int32) (*UserAccount, error)
 	DeleteUserAccount(int32) error
-	AddItemToUserAccount(int32, int32) error
-	RemoveItemFromUserAccount(int32, int32) error
+	AddItemToUserAccount(int32, int32, int32, int32) error
+	SetUserItemQuantity(int32, int32, int32, int32) error
+	RemoveItemFromUserAccount(int32, int32, int32) error
+	GetUserItems(int32) ([]*CartItem, error)
 	ClearUserItems(int32) error
-	GetUserAccounts() ([]*UserAccount, error)
+	GetUserAccounts(ListOptions) (*Page[*UserAccount], error)
+	ClaimVerificationEmail(int32) (*UserAccount, error)
+	VerifyUserEmail(int32, string) error
+
+	// Session
+	OpenSession(SessionKind, int32) (*TokenPair, error)
+	RefreshSession(SessionKind, string) (*TokenPair, error)
+	RevokeSession(SessionKind, string) error
+	GetSession(string) (*Session, error)
+
+	// Password
+	ChangePassword(SessionKind, int32, string, string) error
+	CreatePasswordReset(SessionKind, string) (*PasswordReset, error)
+	ResetPassword(SessionKind, string, string) error
+
+	// MFA
+	BeginMFAEnrollment(int32, string) error
+	ConfirmMFAEnrollment(int32, string, []string) error
+	VerifyMFA(int32, string) error
+	DisableMFA(int32) error
+
+	// APIKey
+	CreateAPIKey(*APIKey, string) error
+	GetAPIKeys(int32) ([]*APIKey, error)
+	RevokeAPIKey(int32, int32) error
+	FindAPIKey(string) (*APIKey, error)
+	RecordAPIKeyUse(int32) error
+
+	// LoginThrottle
+	GetLoginThrottle(string) (*LoginThrottle, error)
+	RecordLoginFailure(string) (*LoginThrottle, error)
+	ClearLoginThrottle(string) error
 
 	// Item
 	CreateItem(*Item) error
 	UpdateItem(*Item) error
 	GetItem(int32) (*Item, error)
 	DeleteItem(int32) error
-	GetItems() ([]*Item, error)
-	GetItemsById([]int32) ([]*Item, float64, error)
+	GetItems(ItemFilter) (*Page[*Item], error)
+	GetItemsById([]*CartItem) ([]*CartLine, Money, error)
+	SearchItems(string, int) ([]*ItemSearchResult, error)
+
+	// Variant
+	SetItemOptions(int32, []*ItemOption) ([]*SKU, error)
+	GetItemOptions(int32) ([]*ItemOption, error)
+	GetSKUs(int32) ([]*SKU, error)
+	GetSKU(int32) (*SKU, error)
+	UpdateSKU(*SKU) error
+
+	// Image
+	CreateItemImage(*ItemImage) error
+	GetItemImage(int32) (*ItemImage, error)
+	GetItemImages(int32) ([]*ItemImage, error)
+	GetImagesForItems([]int32) (map[int32][]*ItemImage, error)
+	DeleteItemImage(int32) error
+	ReorderItemImages(int32, []int32) error
+	SetPrimaryItemImage(int32, int32) error
+
+	// Category
+	CreateCategory(*Category) error
+	UpdateCategory(*Category) error
+	GetCategory(int32) (*Category, error)
+	GetCategoryBySlug(string) (*Category, error)
+	DeleteCategory(int32) error
+	GetCategories() ([]*Category, error)
+	SetItemCategories(int32, []int32) error
+	GetItemCategories(int32) ([]*Category, error)
+
+	// Inventory
+	SetItemStock(int32, int32, int32, string, int32) (*StockAdjustment, error)
+	AdjustItemStock(int32, int32, int32, string, int32) (*StockAdjustment, error)
+	GetStockAdjustments(int32) ([]*StockAdjustment, error)
 
 	// Order
 	CreateOrder(*Order) error
-	UpdateOrder(*Order) error
+	UpdateOrderStatus(int32, OrderStatus, int32) error
+	GetOrderStatusHistory(int32) ([]*OrderStatusChange, error)
 	GetOrder(int32) (*Order, error)
 	DeleteOrder(int32) error
-	GetOrders() ([]*Order, error)
+	GetOrders(OrderFilter) (*Page[*Order], error)
 	GetOrdersById([]int32) ([]*Order, error)
 
+	// WithTx runs fn as a single unit of work. Every call made through the
+	// Storage passed to fn commits together, or not at all if fn returns an
+	// error. Nested calls join the enclosing transaction.
+	WithTx(func(Storage) error) error
+
 	Init() error
 	Close()
 }
 
+// NewStorage returns the Storage backend selected by STORAGE_BACKEND. It
+// defaults to Postgres; "memory" keeps everything in process.
+func NewStorage() (Storage, error) {
+	switch backend := os.Getenv("STORAGE_BACKEND"); backend {
+	case "", "postgres":
+		return NewPostgresStorage()
+	case "memory":
+		return NewMemoryStorage(), nil
+	default:
+		return nil, fmt.Errorf("Unknown storage backend: \"%s\"", backend)
+	}
+}
+
+// dbtx is the query surface shared by *sql.DB and *sql.Tx, so the same
+// PostgresStorage methods can run inside or outside a transaction.
+type dbtx interface {
+	Exec(string, ...any) (sql.Result, error)
+	Query(string, ...any) (*sql.Rows, error)
+	QueryRow(string, ...any) *sql.Row
+}
+
+// stockReservationTTL is how long items in a cart hold back stock from other
+// shoppers before the reservation lapses.
+const stockReservationTTL = 15 * time.Minute
+
 type PostgresStorage struct {
-	db *sql.DB
+	pool *sql.DB
+	db   dbtx
+	inTx bool
 }
 
 func NewPostgresStorage() (*PostgresStorage, error) {
@@ -71,114 +174,76 @@ func NewPostgresStorage() (*PostgresStorage, error) {
 		return nil, err
 	}
 
-	return &PostgresStorage{db: db}, nil
+	return &PostgresStorage{pool: db, db: db}, nil
 }
 
-func (self *PostgresStorage) Init() error {
-	if err := self.createAdminAccountTable(); err != nil {
-		return err
+func (self *PostgresStorage) WithTx(fn func(Storage) error) error {
+	if self.inTx {
+		return fn(self)
 	}
 
-	if err := self.createUserAccountTable(); err != nil {
+	tx, err := self.pool.Begin()
+	if err != nil {
 		return err
 	}
+	defer tx.Rollback()
 
-	if err := self.createItemTable(); err != nil {
+	if err := fn(&PostgresStorage{pool: self.pool, db: tx, inTx: true}); err != nil {
 		return err
 	}
 
-	if err := self.createOrderTable(); err != nil {
+	return tx.Commit()
+}
+
+func (self *PostgresStorage) Init() error {
+	migrator, err := self.Migrator()
+	if err != nil {
 		return err
 	}
 
-	return nil
-}
-
-func (self *PostgresStorage) createAdminAccountTable() error {
-	_, err := self.db.Exec(`
-      CREATE TABLE IF NOT EXISTS admins (
-        id SERIAL PRIMARY KEY,
-        username TEXT NOT NULL,
-        hashed_password TEXT NOT NULL,
-        auth_token TEXT,
-        created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
-      )
-    `)
+	applied, err := migrator.Up()
 	if err != nil {
 		return err
 	}
 
+	for _, migration := range applied {
+		log.Printf("Applied migration %d (%s)\n", migration.Version, migration.Name)
+	}
+
+	return self.seedRootAdminAccount()
+}
+
+func (self *PostgresStorage) Migrator() (*Migrator, error) {
+	return NewMigrator(self.pool)
+}
+
+func (self *PostgresStorage) seedRootAdminAccount() error {
 	rootUser := os.Getenv("ROOT_USER")
 	rootPass := os.Getenv("ROOT_PASS")
 	if rootUser == "" || rootPass == "" {
 		return fmt.Errorf("ROOT_USER and ROOT_PASS must be set")
 	}
 
-	rootAccount, err := NewAdminAccount(rootUser, rootPass)
+	rootAccount, err := NewAdminAccount(rootUser, rootPass, RoleOwner)
 	if err != nil {
 		return err
 	}
 
 	_, err = self.db.Exec(`
-      INSERT INTO admins (id, username, hashed_password)
-      VALUES (1 ,$1, $2)
+      INSERT INTO admins (id, username, hashed_password, role)
+      VALUES (1 ,$1, $2, $3)
       ON CONFLICT DO NOTHING
-    `, rootAccount.Username, rootAccount.HashedPassword)
-	return err
-}
-
-func (self *PostgresStorage) createUserAccountTable() error {
-	_, err := self.db.Exec(`
-      CREATE TABLE IF NOT EXISTS users (
-        id SERIAL PRIMARY KEY,
-        username TEXT NOT NULL,
-        hashed_password TEXT NOT NULL,
-        auth_token TEXT,
-        items INT[],
-        orders INT[],
-        created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
-      )
-    `)
-
-	return err
-}
-
-func (self *PostgresStorage) createItemTable() error {
-	_, err := self.db.Exec(`
-    CREATE TABLE IF NOT EXISTS items (
-      id SERIAL PRIMARY KEY,
-      name TEXT NOT NULL,
-      description TEXT,
-      price FLOAT,
-      created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
-    )
-  `)
-
-	return err
-}
-
-func (self *PostgresStorage) createOrderTable() error {
-	_, err := self.db.Exec(`
-    CREATE TABLE IF NOT EXISTS orders (
-      id SERIAL PRIMARY KEY,
-      user_id INT,
-      items INT[],
-      total FLOAT,
-      status TEXT,
-      created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
-    )
-  `)
-
+    `, rootAccount.Username, rootAccount.HashedPassword, rootAccount.Role)
 	return err
 }
 
 func (self *PostgresStorage) CreateAdminAccount(account *AdminAccount) error {
 	var id int
 	err := self.db.QueryRow(`
-    INSERT INTO admins (username, hashed_password, created_at)
-    VALUES ($1, $2, $3)
+    INSERT INTO admins (username, hashed_password, role, created_at)
+    VALUES ($1, $2, $3, $4)
     RETURNING id
-  `, account.Username, account.HashedPassword, account.CreatedAt).Scan(&id)
+  `, account.Username, account.HashedPassword, account.Role, account.CreatedAt).Scan(&id)
 	if err != nil {
 		return err
 	}
@@ -191,10 +256,13 @@ func (self *PostgresStorage) CreateAdminAccount(account *AdminAccount) error {
 func (self *PostgresStorage) CreateUserAccount(account *UserAccount) error {
 	var id int
 	err := self.db.QueryRow(`
-    INSERT INTO users (username, hashed_password, items, orders, created_at)
+    INSERT INTO users (username, hashed_password, email, orders, created_at)
     VALUES ($1, $2, $3, $4, $5)
     RETURNING id
-  `, account.Username, account.HashedPassword, pq.Array(account.Items), pq.Array(account.Orders), account.CreatedAt).Scan(&id)
+  `, account.Username, account.HashedPassword, account.Email, pq.Array(account.Orders), account.CreatedAt).Scan(&id)
+	if isUniqueViolation(err, "users_email_key") {
+		return emailTakenError(account.Email)
+	}
 	if err != nil {
 		return err
 	}
@@ -215,511 +283,2620 @@ func (self *PostgresStorage) UpdateAdminAccount(account *AdminAccount) error {
 	}
 
 	if count, _ := res.RowsAffected(); count == 0 {
-		return fmt.Errorf("Account %d not found", account.ID)
+		return notFoundError("Account %d not found", account.ID)
 	}
 
 	return nil
 }
 
-func generateToken(id uint32, username string, secret string) (string, error) {
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
-		"id":       id,
-		"username": username,
-		"exp":      time.Now().Add(time.Hour * 24).Unix(),
-	})
-
-	return token.SignedString([]byte(secret))
-}
-
-func (self *PostgresStorage) LoginAdminAccount(username, password string) (string, error) {
+// LoginAdminAccount checks the admin's password. Whether that is enough for a
+// session depends on two-factor authentication, so opening one is left to the
+// caller.
+func (self *PostgresStorage) LoginAdminAccount(username, password string) (*AdminAccount, error) {
 	rows, err := self.db.Query(`
-    SELECT * FROM admins WHERE username = $1
+    SELECT id, username, hashed_password, role, mfa_confirmed_at IS NOT NULL, created_at FROM admins WHERE username = $1
   `, username)
 	if err != nil {
-		return "", err
+		return nil, err
 	}
 	defer rows.Close()
 
 	for rows.Next() {
 		account, err := scanAdminAccount(rows)
 		if err != nil {
-			return "", err
+			return nil, err
 		}
 
 		if match, err := argon2id.ComparePasswordAndHash(password, account.HashedPassword); err != nil {
-			return "", err
+			return nil, err
 		} else if !match {
-			return "", fmt.Errorf("Invalid password")
+			return nil, errInvalidCredentials
 		} else {
 			// do NOTHING
 		}
 
-		// update auth token in db then return it
-		secret := os.Getenv("JWT_SECRET")
-		token, err := generateToken(account.ID, account.Username, secret)
-		if err != nil {
-			return "", err
-		}
-
-		_, err = self.db.Exec(`
-      UPDATE admins
-      SET auth_token = $1
-      WHERE id = $2 
-    `, token, account.ID)
-		if err != nil {
-			return "", err
-		}
-
-		return token, nil
+		return account, nil
 	}
 
-	return "", fmt.Errorf("Account %s not found", username)
+	return nil, rejectUnknownLogin(password)
 }
 
-func (self *PostgresStorage) LoginUserAccount(username, password string) (string, error) {
+func (self *PostgresStorage) LoginUserAccount(username, password string) (*TokenPair, error) {
 	rows, err := self.db.Query(`
-    SELECT * FROM users WHERE username = $1
+    SELECT id, username, hashed_password, COALESCE(email, ''), email_verified_at, verification_sent_at, orders, created_at FROM users WHERE username = $1
   `, username)
 	if err != nil {
-		return "", err
+		return nil, err
 	}
 	defer rows.Close()
 
 	for rows.Next() {
 		account, err := scanUserAccount(rows)
 		if err != nil {
-			return "", err
+			return nil, err
 		}
 
 		if match, err := argon2id.ComparePasswordAndHash(password, account.HashedPassword); err != nil {
-			return "", err
+			return nil, err
 		} else if !match {
-			return "", fmt.Errorf("Invalid password")
+			return nil, errInvalidCredentials
 		} else {
 			// do nothing
 		}
 
-		// update auth token in db then return it
-		secret := os.Getenv("JWT_SECRET")
-		token, err := generateToken(account.ID, account.Username, secret)
-		if err != nil {
-			return "", err
-		}
-
-		_, err = self.db.Exec(`
-      UPDATE users
-      SET auth_token = $1
-      WHERE id = $2 
-    `, token, account.ID)
-		if err != nil {
-			return "", err
-		}
-
-		return token, nil
+		return self.openSession(UserSession, int32(account.ID), account.Username, "")
 	}
 
-	return "", fmt.Errorf("Account %s not found", username)
+	return nil, rejectUnknownLogin(password)
 }
 
-func (self *PostgresStorage) UpdateUserAccount(account *UserAccount) error {
-	res, err := self.db.Exec(`
-    UPDATE users
-    SET username = $1
-    WHERE id = $2
-  `, account.Username, account.ID)
+// OpenSession starts a session for an account that has fully authenticated.
+func (self *PostgresStorage) OpenSession(kind SessionKind, accountID int32) (*TokenPair, error) {
+	username, role, err := self.accountIdentity(kind, accountID)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	if count, _ := res.RowsAffected(); count == 0 {
-		return fmt.Errorf("Account %d not found", account.ID)
+	return self.openSession(kind, accountID, username, role)
+}
+
+// accountIdentity is what an access token says about the account: its
+// username and, for admins, its role.
+func (self *PostgresStorage) accountIdentity(kind SessionKind, accountID int32) (string, Role, error) {
+	var username string
+	var role Role
+
+	var err error
+	if kind == AdminSession {
+		err = self.db.QueryRow(`SELECT username, role FROM admins WHERE id = $1`, accountID).Scan(&username, &role)
+	} else {
+		err = self.db.QueryRow(`SELECT username FROM users WHERE id = $1`, accountID).Scan(&username)
+	}
+	if err == sql.ErrNoRows {
+		return "", "", notFoundError("Account %d not found", accountID)
 	}
 
-	return nil
+	return username, role, err
 }
 
-func (self *PostgresStorage) GetAdminAccount(id int32) (*AdminAccount, error) {
-	rows, err := self.db.Query(`
-    SELECT * FROM admins WHERE id = $1
-  `, id)
+// openSession starts a session for an account that has just authenticated
+// and clears out the account's expired ones.
+func (self *PostgresStorage) openSession(kind SessionKind, accountID int32, username string, role Role) (*TokenPair, error) {
+	session, err := NewSession(kind, accountID)
 	if err != nil {
 		return nil, err
 	}
-	defer rows.Close()
 
-	for rows.Next() {
-		return scanAdminAccount(rows)
+	tokens, refreshHash, err := issueTokens(session, username, role)
+	if err != nil {
+		return nil, err
 	}
 
-	return nil, fmt.Errorf("Account %d not found", id)
-}
+	adminID, userID := accountColumns(session.Kind, session.AccountID)
+	err = self.WithTx(func(tx Storage) error {
+		pg := tx.(*PostgresStorage)
+		if _, err := pg.db.Exec(`
+      DELETE FROM sessions
+      WHERE (admin_id = $1 OR user_id = $2) AND expires_at <= $3
+    `, adminID, userID, session.CreatedAt); err != nil {
+			return err
+		}
 
-func (self *PostgresStorage) GetUserAccount(id int32) (*UserAccount, error) {
-	rows, err := self.db.Query(`
-    SELECT * FROM users WHERE id = $1
-  `, id)
+		if _, err := pg.db.Exec(`
+      INSERT INTO sessions (id, admin_id, user_id, created_at, expires_at)
+      VALUES ($1, $2, $3, $4, $5)
+    `, session.ID, adminID, userID, session.CreatedAt, session.ExpiresAt); err != nil {
+			return err
+		}
+
+		_, err := pg.db.Exec(`
+      INSERT INTO refresh_tokens (token_hash, session_id, created_at)
+      VALUES ($1, $2, $3)
+    `, refreshHash, session.ID, session.CreatedAt)
+
+		return err
+	})
 	if err != nil {
 		return nil, err
 	}
-	defer rows.Close()
-
-	for rows.Next() {
-		return scanUserAccount(rows)
-	}
 
-	return nil, fmt.Errorf("Account %d not found", id)
+	return tokens, nil
 }
 
-func (self *PostgresStorage) DeleteAdminAccount(id int32) error {
-	res, err := self.db.Exec(`
-    DELETE FROM admins WHERE id = $1
-  `, id)
-	if err != nil {
-		return err
+// accountColumns splits an account into the admin_id and user_id columns,
+// exactly one of which is set, of the tables that belong to either kind of
+// account.
+func accountColumns(kind SessionKind, accountID int32) (adminID, userID *int32) {
+	if kind == AdminSession {
+		return &accountID, nil
 	}
 
-	if count, _ := res.RowsAffected(); count == 0 {
-		return fmt.Errorf("Account %d not found", id)
+	return nil, &accountID
+}
+
+// accountTable is the table holding accounts of the kind.
+func accountTable(kind SessionKind) string {
+	if kind == AdminSession {
+		return "admins"
 	}
 
-	return nil
+	return "users"
 }
 
-func (self *PostgresStorage) DeleteUserAccount(id int32) error {
-	res, err := self.db.Exec(`
-    DELETE FROM users WHERE id = $1
-  `, id)
-	if err != nil {
+// RefreshSession swaps a refresh token for a new pair. Presenting a token
+// that was already swapped means it leaked, so the whole session is revoked.
+func (self *PostgresStorage) RefreshSession(kind SessionKind, refreshToken string) (*TokenPair, error) {
+	var tokens *TokenPair
+	reused := false
+	err := self.WithTx(func(tx Storage) error {
+		pg := tx.(*PostgresStorage)
+
+		var sessionID string
+		var usedAt sql.NullTime
+		err := pg.db.QueryRow(`
+      SELECT session_id, used_at FROM refresh_tokens
+      WHERE token_hash = $1
+      FOR UPDATE
+    `, hashToken(refreshToken)).Scan(&sessionID, &usedAt)
+		if err == sql.ErrNoRows {
+			return errInvalidRefreshToken
+		}
+		if err != nil {
+			return err
+		}
+
+		session, err := pg.querySession(`
+      SELECT id, admin_id, user_id, created_at, expires_at, revoked_at
+      FROM sessions
+      WHERE id = $1
+      FOR UPDATE
+    `, sessionID)
+		if err != nil {
+			return err
+		}
+
+		if session.Kind != kind {
+			return errInvalidRefreshToken
+		}
+
+		if usedAt.Valid {
+			reused = true
+			return pg.revokeSession(session.ID)
+		}
+
+		if !session.Active() {
+			return errInvalidRefreshToken
+		}
+
+		username, role, err := pg.accountIdentity(session.Kind, session.AccountID)
+		if err != nil {
+			return err
+		}
+
+		var refreshHash string
+		tokens, refreshHash, err = issueTokens(session, username, role)
+		if err != nil {
+			return err
+		}
+
+		now := time.Now().UTC()
+		if _, err := pg.db.Exec(`
+      UPDATE refresh_tokens SET used_at = $1 WHERE token_hash = $2
+    `, now, hashToken(refreshToken)); err != nil {
+			return err
+		}
+
+		if _, err := pg.db.Exec(`
+      INSERT INTO refresh_tokens (token_hash, session_id, created_at)
+      VALUES ($1, $2, $3)
+    `, refreshHash, session.ID, now); err != nil {
+			return err
+		}
+
+		_, err = pg.db.Exec(`
+      UPDATE sessions SET expires_at = $1 WHERE id = $2
+    `, now.Add(refreshTokenTTL), session.ID)
+
 		return err
+	})
+	if err != nil {
+		return nil, err
 	}
 
-	if count, _ := res.RowsAffected(); count == 0 {
-		return fmt.Errorf("Account %d not found", id)
+	if reused {
+		return nil, errRefreshTokenReused
 	}
 
-	return nil
+	return tokens, nil
 }
 
-func (self *PostgresStorage) AddItemToUserAccount(accountID, itemID int32) error {
-	rows, err := self.db.Query(`
-    SELECT * FROM items WHERE id = $1
-  `, itemID)
-	if err != nil {
-		return fmt.Errorf("Item %d not found", itemID)
+// RevokeSession ends the session the refresh token belongs to, which is how
+// a client logs out.
+func (self *PostgresStorage) RevokeSession(kind SessionKind, refreshToken string) error {
+	session, err := self.querySession(`
+    SELECT s.id, s.admin_id, s.user_id, s.created_at, s.expires_at, s.revoked_at
+    FROM sessions s
+    JOIN refresh_tokens t ON t.session_id = s.id
+    WHERE t.token_hash = $1
+  `, hashToken(refreshToken))
+	if err != nil || session.Kind != kind {
+		return errInvalidRefreshToken
 	}
-	defer rows.Close()
 
-	if !rows.Next() {
-		return fmt.Errorf("Item %d not found", itemID)
-	}
+	return self.revokeSession(session.ID)
+}
 
-	res2, err := self.db.Exec(`
-    UPDATE users 
-    SET items = CASE
-      WHEN $1 = ANY(items) THEN items
-      ELSE array_append(items, $1)
-    END
-    WHERE id = $2
-  `, itemID, accountID)
+func (self *PostgresStorage) revokeSession(id string) error {
+	_, err := self.db.Exec(`
+    UPDATE sessions SET revoked_at = $1 WHERE id = $2 AND revoked_at IS NULL
+  `, time.Now().UTC(), id)
+
+	return err
+}
+
+func (self *PostgresStorage) GetSession(id string) (*Session, error) {
+	return self.querySession(`
+    SELECT id, admin_id, user_id, created_at, expires_at, revoked_at
+    FROM sessions
+    WHERE id = $1
+  `, id)
+}
+
+func (self *PostgresStorage) querySession(query string, args ...any) (*Session, error) {
+	session := new(Session)
+
+	var adminID, userID sql.NullInt32
+	err := self.db.QueryRow(query, args...).Scan(&session.ID, &adminID, &userID, &session.CreatedAt, &session.ExpiresAt, &session.RevokedAt)
+	if err == sql.ErrNoRows {
+		return nil, notFoundError("Session not found")
+	}
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	if count, _ := res2.RowsAffected(); count == 0 {
-		return fmt.Errorf("Account %d not found", accountID)
+	if adminID.Valid {
+		session.Kind, session.AccountID = AdminSession, adminID.Int32
+	} else {
+		session.Kind, session.AccountID = UserSession, userID.Int32
 	}
 
-	return nil
+	return session, nil
 }
 
-func (self *PostgresStorage) RemoveItemFromUserAccount(accountID, itemID int32) error {
-	rows, err := self.db.Query(`
-    SELECT * FROM items WHERE id = $1
-  `, itemID)
-	if err != nil {
-		return fmt.Errorf("Item %d not found", itemID)
-	}
-	defer rows.Close()
+// revokeAccountSessions revokes every session of the account.
+func (self *PostgresStorage) revokeAccountSessions(kind SessionKind, accountID int32) error {
+	adminID, userID := accountColumns(kind, accountID)
+	_, err := self.db.Exec(`
+    UPDATE sessions SET revoked_at = $1
+    WHERE (admin_id = $2 OR user_id = $3) AND revoked_at IS NULL
+  `, time.Now().UTC(), adminID, userID)
+
+	return err
+}
 
-	if !rows.Next() {
-		return fmt.Errorf("Item %d not found", itemID)
+func (self *PostgresStorage) ChangePassword(kind SessionKind, id int32, current, next string) error {
+	if err := checkPassword(next); err != nil {
+		return err
 	}
 
-	res, err := self.db.Exec(`
-    UPDATE users 
-    SET items = array_remove(items, $1)
-    WHERE id = $2
-  `, itemID, accountID)
+	var hashedPassword string
+	err := self.db.QueryRow(`
+    SELECT hashed_password FROM `+accountTable(kind)+` WHERE id = $1
+  `, id).Scan(&hashedPassword)
+	if err == sql.ErrNoRows {
+		return notFoundError("Account %d not found", id)
+	}
 	if err != nil {
 		return err
 	}
 
-	if count, _ := res.RowsAffected(); count == 0 {
-		return fmt.Errorf("Item %d in account %d not found", itemID, accountID)
+	if match, err := argon2id.ComparePasswordAndHash(current, hashedPassword); err != nil {
+		return err
+	} else if !match {
+		return validationError("current_password", "Current password is incorrect")
 	}
 
-	return nil
-}
+	hashedPassword, err = argon2id.CreateHash(next, argon2id.DefaultParams)
+	if err != nil {
+		return err
+	}
 
-func (self *PostgresStorage) ClearUserItems(accountID int32) error {
-	_, err := self.db.Exec(`
-    UPDATE users
-    SET items = '{}'
-    WHERE id = $1
-  `, accountID)
+	_, err = self.db.Exec(`
+    UPDATE `+accountTable(kind)+` SET hashed_password = $1 WHERE id = $2
+  `, hashedPassword, id)
 
 	return err
 }
 
-func (self *PostgresStorage) GetAdminAccounts() ([]*AdminAccount, error) {
-	rows, err := self.db.Query(`
-    SELECT * FROM admins
-  `)
+// CreatePasswordReset issues a reset token for the account with the
+// username. It returns nil, and no error, when there is no such account so
+// that callers cannot tell which usernames exist.
+func (self *PostgresStorage) CreatePasswordReset(kind SessionKind, username string) (*PasswordReset, error) {
+	// admins have no email address
+	query := `SELECT id, '' FROM admins WHERE username = $1`
+	if kind == UserSession {
+		query = `SELECT id, COALESCE(email, '') FROM users WHERE username = $1`
+	}
+
+	var id int32
+	var email string
+	err := self.db.QueryRow(query, username).Scan(&id, &email)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
 	if err != nil {
 		return nil, err
 	}
-	defer rows.Close()
 
-	accounts := make([]*AdminAccount, 0)
-	for rows.Next() {
-		account, err := scanAdminAccount(rows)
-		if err != nil {
-			return nil, err
-		}
+	reset, err := NewPasswordReset(kind, id, username, email)
+	if err != nil {
+		return nil, err
+	}
 
-		accounts = append(accounts, account)
+	adminID, userID := accountColumns(kind, id)
+	if _, err := self.db.Exec(`
+    INSERT INTO password_resets (token_hash, admin_id, user_id, expires_at)
+    VALUES ($1, $2, $3, $4)
+  `, hashToken(reset.Token), adminID, userID, reset.ExpiresAt); err != nil {
+		return nil, err
 	}
 
-	return accounts, nil
+	return reset, nil
 }
 
-func (self *PostgresStorage) GetUserAccounts() ([]*UserAccount, error) {
-	rows, err := self.db.Query(`
-    SELECT * FROM users
-  `)
+// ResetPassword sets a new password with a reset token. The token, and every
+// other outstanding token of the account, is used up, and all of the
+// account's sessions are revoked.
+func (self *PostgresStorage) ResetPassword(kind SessionKind, token, password string) error {
+	if err := checkPassword(password); err != nil {
+		return err
+	}
+
+	hashedPassword, err := argon2id.CreateHash(password, argon2id.DefaultParams)
 	if err != nil {
-		return nil, err
+		return err
 	}
-	defer rows.Close()
 
-	accounts := make([]*UserAccount, 0)
-	for rows.Next() {
-		account, err := scanUserAccount(rows)
+	return self.WithTx(func(tx Storage) error {
+		pg := tx.(*PostgresStorage)
+
+		var adminID, userID sql.NullInt32
+		var expiresAt time.Time
+		var usedAt sql.NullTime
+		err := pg.db.QueryRow(`
+      SELECT admin_id, user_id, expires_at, used_at FROM password_resets
+      WHERE token_hash = $1
+      FOR UPDATE
+    `, hashToken(token)).Scan(&adminID, &userID, &expiresAt, &usedAt)
+		if err == sql.ErrNoRows {
+			return errInvalidResetToken
+		}
 		if err != nil {
-			return nil, err
+			return err
 		}
 
-		accounts = append(accounts, account)
-	}
+		now := time.Now().UTC()
+		if usedAt.Valid || !now.Before(expiresAt) {
+			return errInvalidResetToken
+		}
 
-	return accounts, nil
-}
+		var id int32
+		if kind == AdminSession && adminID.Valid {
+			id = adminID.Int32
+		} else if kind == UserSession && userID.Valid {
+			id = userID.Int32
+		} else {
+			return errInvalidResetToken
+		}
 
-func scanAdminAccount(row *sql.Rows) (*AdminAccount, error) {
-	account := new(AdminAccount)
-	throwaway := new(string)
+		if _, err := pg.db.Exec(`
+      UPDATE password_resets SET used_at = $1
+      WHERE (admin_id = $2 OR user_id = $3) AND used_at IS NULL
+    `, now, adminID, userID); err != nil {
+			return err
+		}
 
-	err := row.Scan(
-		&account.ID,
-		&account.Username,
-		&account.HashedPassword,
-		&throwaway,
-		&account.CreatedAt,
-	)
+		if _, err := pg.db.Exec(`
+      UPDATE `+accountTable(kind)+` SET hashed_password = $1 WHERE id = $2
+    `, hashedPassword, id); err != nil {
+			return err
+		}
 
-	return account, err
+		return pg.revokeAccountSessions(kind, id)
+	})
 }
 
-func scanUserAccount(row *sql.Rows) (*UserAccount, error) {
-	account := new(UserAccount)
-	throwaway := new(string)
+func (self *PostgresStorage) GetLoginThrottle(key string) (*LoginThrottle, error) {
+	return self.queryLoginThrottle(`
+    SELECT key, failures, last_failure_at, locked_until FROM login_throttles WHERE key = $1
+  `, key)
+}
 
-	err := row.Scan(
-		&account.ID,
-		&account.Username,
-		&account.HashedPassword,
-		&throwaway,
-		pq.Array(&account.Items),
-		pq.Array(&account.Orders),
+func (self *PostgresStorage) RecordLoginFailure(key string) (*LoginThrottle, error) {
+	var throttle *LoginThrottle
+	err := self.WithTx(func(tx Storage) error {
+		pg := tx.(*PostgresStorage)
+
+		var err error
+		throttle, err = pg.queryLoginThrottle(`
+      SELECT key, failures, last_failure_at, locked_until FROM login_throttles WHERE key = $1 FOR UPDATE
+    `, key)
+		if err != nil {
+			return err
+		}
+
+		throttle.recordFailure(time.Now().UTC())
+
+		_, err = pg.db.Exec(`
+      INSERT INTO login_throttles (key, failures, last_failure_at, locked_until)
+      VALUES ($1, $2, $3, $4)
+      ON CONFLICT (key) DO UPDATE
+      SET failures = EXCLUDED.failures,
+          last_failure_at = EXCLUDED.last_failure_at,
+          locked_until = EXCLUDED.locked_until
+    `, throttle.Key, throttle.Failures, throttle.LastFailureAt, throttle.LockedUntil)
+
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return throttle, nil
+}
+
+func (self *PostgresStorage) ClearLoginThrottle(key string) error {
+	_, err := self.db.Exec(`
+    DELETE FROM login_throttles WHERE key = $1
+  `, key)
+
+	return err
+}
+
+// queryLoginThrottle returns a throttle with no failures for a key that has
+// none recorded.
+func (self *PostgresStorage) queryLoginThrottle(query string, key string) (*LoginThrottle, error) {
+	throttle := &LoginThrottle{Key: key}
+	err := self.db.QueryRow(query, key).Scan(&throttle.Key, &throttle.Failures, &throttle.LastFailureAt, &throttle.LockedUntil)
+	if err == sql.ErrNoRows {
+		return throttle, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return throttle, nil
+}
+
+func (self *PostgresStorage) BeginMFAEnrollment(adminID int32, secret string) error {
+	return self.WithTx(func(tx Storage) error {
+		pg := tx.(*PostgresStorage)
+
+		state, err := pg.lockAdminMFA(adminID)
+		if err != nil {
+			return err
+		}
+
+		if state.confirmed {
+			return errMFAAlreadyEnabled
+		}
+
+		_, err = pg.db.Exec(`
+      UPDATE admins SET mfa_secret = $1, mfa_last_step = 0 WHERE id = $2
+    `, secret, adminID)
+
+		return err
+	})
+}
+
+// ConfirmMFAEnrollment puts the pending secret in force once the admin proves
+// their authenticator has it, and replaces their recovery codes.
+func (self *PostgresStorage) ConfirmMFAEnrollment(adminID int32, code string, recoveryHashes []string) error {
+	return self.WithTx(func(tx Storage) error {
+		pg := tx.(*PostgresStorage)
+
+		state, err := pg.lockAdminMFA(adminID)
+		if err != nil {
+			return err
+		}
+
+		if state.confirmed {
+			return errMFAAlreadyEnabled
+		}
+
+		if state.secret == "" {
+			return errMFANotEnrolling
+		}
+
+		now := time.Now().UTC()
+		step, ok := matchTOTP(state.secret, code, state.lastStep, now)
+		if !ok {
+			return errInvalidMFACode
+		}
+
+		if _, err := pg.db.Exec(`
+      UPDATE admins SET mfa_confirmed_at = $1, mfa_last_step = $2 WHERE id = $3
+    `, now, step, adminID); err != nil {
+			return err
+		}
+
+		if _, err := pg.db.Exec(`
+      DELETE FROM admin_recovery_codes WHERE admin_id = $1
+    `, adminID); err != nil {
+			return err
+		}
+
+		for _, hash := range recoveryHashes {
+			if _, err := pg.db.Exec(`
+        INSERT INTO admin_recovery_codes (code_hash, admin_id) VALUES ($1, $2)
+      `, hash, adminID); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+}
+
+// VerifyMFA accepts a current TOTP code that has not been used yet, or one
+// of the admin's unused recovery codes, which it uses up.
+func (self *PostgresStorage) VerifyMFA(adminID int32, code string) error {
+	return self.WithTx(func(tx Storage) error {
+		pg := tx.(*PostgresStorage)
+
+		state, err := pg.lockAdminMFA(adminID)
+		if err != nil {
+			return err
+		}
+
+		if !state.confirmed {
+			return errMFANotEnabled
+		}
+
+		now := time.Now().UTC()
+		if isTOTPCode(code) {
+			step, ok := matchTOTP(state.secret, code, state.lastStep, now)
+			if !ok {
+				return errInvalidMFACode
+			}
+
+			_, err := pg.db.Exec(`
+        UPDATE admins SET mfa_last_step = $1 WHERE id = $2
+      `, step, adminID)
+
+			return err
+		}
+
+		res, err := pg.db.Exec(`
+      UPDATE admin_recovery_codes SET used_at = $1
+      WHERE code_hash = $2 AND admin_id = $3 AND used_at IS NULL
+    `, now, hashRecoveryCode(code), adminID)
+		if err != nil {
+			return err
+		}
+
+		if count, _ := res.RowsAffected(); count == 0 {
+			return errInvalidMFACode
+		}
+
+		return nil
+	})
+}
+
+func (self *PostgresStorage) DisableMFA(adminID int32) error {
+	return self.WithTx(func(tx Storage) error {
+		pg := tx.(*PostgresStorage)
+
+		res, err := pg.db.Exec(`
+      UPDATE admins
+      SET mfa_secret = NULL, mfa_confirmed_at = NULL, mfa_last_step = 0
+      WHERE id = $1
+    `, adminID)
+		if err != nil {
+			return err
+		}
+
+		if count, _ := res.RowsAffected(); count == 0 {
+			return notFoundError("Account %d not found", adminID)
+		}
+
+		_, err = pg.db.Exec(`
+      DELETE FROM admin_recovery_codes WHERE admin_id = $1
+    `, adminID)
+
+		return err
+	})
+}
+
+func (self *PostgresStorage) lockAdminMFA(adminID int32) (*mfaState, error) {
+	state := new(mfaState)
+
+	var secret sql.NullString
+	var confirmedAt sql.NullTime
+	err := self.db.QueryRow(`
+    SELECT mfa_secret, mfa_confirmed_at, mfa_last_step FROM admins WHERE id = $1 FOR UPDATE
+  `, adminID).Scan(&secret, &confirmedAt, &state.lastStep)
+	if err == sql.ErrNoRows {
+		return nil, notFoundError("Account %d not found", adminID)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	state.secret, state.confirmed = secret.String, confirmedAt.Valid
+
+	return state, nil
+}
+
+func (self *PostgresStorage) CreateAPIKey(key *APIKey, keyHash string) error {
+	return self.db.QueryRow(`
+    INSERT INTO api_keys (admin_id, name, prefix, key_hash, scopes, created_at, expires_at)
+    VALUES ($1, $2, $3, $4, $5, $6, $7)
+    RETURNING id
+  `, key.AdminID, key.Name, key.Prefix, keyHash, pq.Array(permissionStrings(key.Scopes)), key.CreatedAt, key.ExpiresAt).Scan(&key.ID)
+}
+
+func (self *PostgresStorage) GetAPIKeys(adminID int32) ([]*APIKey, error) {
+	rows, err := self.db.Query(`
+    SELECT `+apiKeyColumns+`
+    FROM api_keys
+    WHERE admin_id = $1
+    ORDER BY id
+  `, adminID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	keys := []*APIKey{}
+	for rows.Next() {
+		key, err := scanAPIKey(rows)
+		if err != nil {
+			return nil, err
+		}
+
+		keys = append(keys, key)
+	}
+
+	return keys, rows.Err()
+}
+
+func (self *PostgresStorage) RevokeAPIKey(adminID, keyID int32) error {
+	res, err := self.db.Exec(`
+    UPDATE api_keys SET revoked_at = COALESCE(revoked_at, $1)
+    WHERE id = $2 AND admin_id = $3
+  `, time.Now().UTC(), keyID, adminID)
+	if err != nil {
+		return err
+	}
+
+	if count, _ := res.RowsAffected(); count == 0 {
+		return notFoundError("API key %d not found", keyID)
+	}
+
+	return nil
+}
+
+// FindAPIKey finds the active key with the hash.
+func (self *PostgresStorage) FindAPIKey(keyHash string) (*APIKey, error) {
+	rows, err := self.db.Query(`
+    SELECT `+apiKeyColumns+`
+    FROM api_keys
+    WHERE key_hash = $1
+  `, keyHash)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		key, err := scanAPIKey(rows)
+		if err != nil {
+			return nil, err
+		}
+
+		if !key.Active(time.Now().UTC()) {
+			return nil, errInvalidAPIKey
+		}
+
+		return key, nil
+	}
+
+	return nil, errInvalidAPIKey
+}
+
+// RecordAPIKeyUse notes that the key was just used. Call it once a request
+// made with the key has passed every check.
+func (self *PostgresStorage) RecordAPIKeyUse(keyID int32) error {
+	_, err := self.db.Exec(`
+    UPDATE api_keys SET last_used_at = $1
+    WHERE id = $2
+  `, time.Now().UTC(), keyID)
+	return err
+}
+
+const apiKeyColumns = `id, admin_id, name, prefix, scopes, created_at, expires_at, last_used_at, revoked_at`
+
+func scanAPIKey(row *sql.Rows) (*APIKey, error) {
+	key := new(APIKey)
+
+	var scopes []string
+	if err := row.Scan(&key.ID, &key.AdminID, &key.Name, &key.Prefix, pq.Array(&scopes), &key.CreatedAt, &key.ExpiresAt, &key.LastUsedAt, &key.RevokedAt); err != nil {
+		return nil, err
+	}
+
+	for _, scope := range scopes {
+		key.Scopes = append(key.Scopes, Permission(scope))
+	}
+
+	return key, nil
+}
+
+func permissionStrings(permissions []Permission) []string {
+	strs := make([]string, 0, len(permissions))
+	for _, permission := range permissions {
+		strs = append(strs, string(permission))
+	}
+
+	return strs
+}
+
+// UpdateUserAccount keeps the username or email when the account's field is
+// blank. A changed email is unverified again and can be sent a verification
+// email right away.
+func (self *PostgresStorage) UpdateUserAccount(account *UserAccount) error {
+	res, err := self.db.Exec(`
+    UPDATE users
+    SET username = CASE WHEN $1 = '' THEN username ELSE $1 END,
+        email_verified_at = CASE WHEN $2 = '' OR $2 = email THEN email_verified_at END,
+        verification_sent_at = CASE WHEN $2 = '' OR $2 = email THEN verification_sent_at END,
+        email = CASE WHEN $2 = '' THEN email ELSE $2 END
+    WHERE id = $3
+  `, account.Username, account.Email, account.ID)
+	if isUniqueViolation(err, "users_email_key") {
+		return emailTakenError(account.Email)
+	}
+	if err != nil {
+		return err
+	}
+
+	if count, _ := res.RowsAffected(); count == 0 {
+		return notFoundError("Account %d not found", account.ID)
+	}
+
+	return nil
+}
+
+// ClaimVerificationEmail records that a verification email is about to be
+// sent to the account, refusing if one went out too recently or the email is
+// already verified.
+func (self *PostgresStorage) ClaimVerificationEmail(id int32) (*UserAccount, error) {
+	var account *UserAccount
+	err := self.WithTx(func(tx Storage) error {
+		pg := tx.(*PostgresStorage)
+
+		var err error
+		if account, err = pg.LockUserAccount(id); err != nil {
+			return err
+		}
+
+		now := time.Now().UTC()
+		if err := checkVerificationClaim(account, now); err != nil {
+			return err
+		}
+
+		_, err = pg.db.Exec(`
+      UPDATE users SET verification_sent_at = $1 WHERE id = $2
+    `, now, id)
+		account.VerificationSentAt = &now
+
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return account, nil
+}
+
+// VerifyUserEmail marks the email verified if it is still the account's
+// email. Verifying twice is not an error.
+func (self *PostgresStorage) VerifyUserEmail(id int32, email string) error {
+	res, err := self.db.Exec(`
+    UPDATE users
+    SET email_verified_at = COALESCE(email_verified_at, $1)
+    WHERE id = $2 AND email = $3
+  `, time.Now().UTC(), id, email)
+	if err != nil {
+		return err
+	}
+
+	if count, _ := res.RowsAffected(); count == 0 {
+		return unauthorizedError("Verification link is no longer valid")
+	}
+
+	return nil
+}
+
+func (self *PostgresStorage) GetAdminAccount(id int32) (*AdminAccount, error) {
+	rows, err := self.db.Query(`
+    SELECT id, username, hashed_password, role, mfa_confirmed_at IS NOT NULL, created_at FROM admins WHERE id = $1
+  `, id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		return scanAdminAccount(rows)
+	}
+
+	return nil, notFoundError("Account %d not found", id)
+}
+
+func (self *PostgresStorage) GetUserAccount(id int32) (*UserAccount, error) {
+	rows, err := self.db.Query(`
+    SELECT id, username, hashed_password, COALESCE(email, ''), email_verified_at, verification_sent_at, orders, created_at FROM users WHERE id = $1
+  `, id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		return scanUserAccount(rows)
+	}
+
+	return nil, notFoundError("Account %d not found", id)
+}
+
+// LockUserAccount reads the account with a row lock, which is held until the
+// enclosing transaction ends. Outside of WithTx it behaves like GetUserAccount.
+func (self *PostgresStorage) LockUserAccount(id int32) (*UserAccount, error) {
+	rows, err := self.db.Query(`
+    SELECT id, username, hashed_password, COALESCE(email, ''), email_verified_at, verification_sent_at, orders, created_at FROM users WHERE id = $1 FOR UPDATE
+  `, id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		return scanUserAccount(rows)
+	}
+
+	return nil, notFoundError("Account %d not found", id)
+}
+
+func (self *PostgresStorage) DeleteAdminAccount(id int32) error {
+	return self.WithTx(func(tx Storage) error {
+		pg := tx.(*PostgresStorage)
+		if err := pg.guardLastOwner(id); err != nil {
+			return err
+		}
+
+		res, err := pg.db.Exec(`
+      DELETE FROM admins WHERE id = $1
+    `, id)
+		if err != nil {
+			return err
+		}
+
+		if count, _ := res.RowsAffected(); count == 0 {
+			return notFoundError("Account %d not found", id)
+		}
+
+		return nil
+	})
+}
+
+func (self *PostgresStorage) SetAdminRole(id int32, role Role) error {
+	if err := checkRole(role); err != nil {
+		return err
+	}
+
+	return self.WithTx(func(tx Storage) error {
+		pg := tx.(*PostgresStorage)
+		if role != RoleOwner {
+			if err := pg.guardLastOwner(id); err != nil {
+				return err
+			}
+		}
+
+		res, err := pg.db.Exec(`
+      UPDATE admins SET role = $1 WHERE id = $2
+    `, role, id)
+		if err != nil {
+			return err
+		}
+
+		if count, _ := res.RowsAffected(); count == 0 {
+			return notFoundError("Account %d not found", id)
+		}
+
+		return nil
+	})
+}
+
+// guardLastOwner refuses to let the admin stop being an owner when no other
+// owner is left. The owners stay locked until the transaction ends, so two
+// owners cannot demote each other at the same time.
+func (self *PostgresStorage) guardLastOwner(id int32) error {
+	rows, err := self.db.Query(`
+    SELECT id FROM admins WHERE role = $1 FOR UPDATE
+  `, RoleOwner)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	owners := make([]int32, 0)
+	for rows.Next() {
+		var ownerID int32
+		if err := rows.Scan(&ownerID); err != nil {
+			return err
+		}
+		owners = append(owners, ownerID)
+	}
+
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	if len(owners) == 1 && owners[0] == id {
+		return lastOwnerError(id)
+	}
+
+	return nil
+}
+
+func (self *PostgresStorage) DeleteUserAccount(id int32) error {
+	res, err := self.db.Exec(`
+    DELETE FROM users WHERE id = $1
+  `, id)
+	if err != nil {
+		return err
+	}
+
+	if count, _ := res.RowsAffected(); count == 0 {
+		return notFoundError("Account %d not found", id)
+	}
+
+	return nil
+}
+
+// AddItemToUserAccount adds quantity units of an item to the cart, on top of
+// any already there, and extends the stock reservation to cover them.
+func (self *PostgresStorage) AddItemToUserAccount(accountID, itemID, skuID, quantity int32) error {
+	return self.WithTx(func(tx Storage) error {
+		pg := tx.(*PostgresStorage)
+		if err := pg.checkCartTarget(accountID, itemID, skuID); err != nil {
+			return err
+		}
+
+		var current int32
+		err := pg.db.QueryRow(`
+      SELECT quantity FROM cart_items
+      WHERE user_id = $1 AND item_id = $2 AND sku_id = $3
+    `, accountID, itemID, skuID).Scan(&current)
+		if err != nil && err != sql.ErrNoRows {
+			return err
+		}
+
+		return pg.setCartQuantity(accountID, itemID, skuID, current+quantity)
+	})
+}
+
+// SetUserItemQuantity replaces the quantity of an item in the cart. A
+// quantity of zero removes the line.
+func (self *PostgresStorage) SetUserItemQuantity(accountID, itemID, skuID, quantity int32) error {
+	if quantity == 0 {
+		return self.RemoveItemFromUserAccount(accountID, itemID, skuID)
+	}
+
+	return self.WithTx(func(tx Storage) error {
+		pg := tx.(*PostgresStorage)
+		if err := pg.checkCartTarget(accountID, itemID, skuID); err != nil {
+			return err
+		}
+
+		return pg.setCartQuantity(accountID, itemID, skuID, quantity)
+	})
+}
+
+func (self *PostgresStorage) setCartQuantity(accountID, itemID, skuID, quantity int32) error {
+	if err := self.reserveStock(accountID, itemID, skuID, quantity); err != nil {
+		return err
+	}
+
+	_, err := self.db.Exec(`
+    INSERT INTO cart_items (user_id, item_id, sku_id, quantity)
+    VALUES ($1, $2, $3, $4)
+    ON CONFLICT (user_id, item_id, sku_id)
+    DO UPDATE SET quantity = EXCLUDED.quantity
+  `, accountID, itemID, skuID, quantity)
+
+	return err
+}
+
+// checkCartTarget makes sure the account and item exist. Whether the item
+// needs a SKU, and whether the SKU belongs to it, is checked when its stock is
+// reserved.
+func (self *PostgresStorage) checkCartTarget(accountID, itemID, skuID int32) error {
+	var itemExists, accountExists bool
+	err := self.db.QueryRow(`
+    SELECT
+      EXISTS (SELECT 1 FROM items WHERE id = $1),
+      EXISTS (SELECT 1 FROM users WHERE id = $2)
+  `, itemID, accountID).Scan(&itemExists, &accountExists)
+	if err != nil {
+		return err
+	}
+
+	if !itemExists {
+		return validationError("item_id", "Item %d not found", itemID)
+	}
+
+	if !accountExists {
+		return notFoundError("Account %d not found", accountID)
+	}
+
+	return nil
+}
+
+func (self *PostgresStorage) RemoveItemFromUserAccount(accountID, itemID, skuID int32) error {
+	return self.WithTx(func(tx Storage) error {
+		pg := tx.(*PostgresStorage)
+		res, err := pg.db.Exec(`
+      DELETE FROM cart_items
+      WHERE user_id = $1 AND item_id = $2 AND sku_id = $3
+    `, accountID, itemID, skuID)
+		if err != nil {
+			return err
+		}
+
+		if count, _ := res.RowsAffected(); count == 0 {
+			return notFoundError("Cart line for %s in account %d not found", stockLabel(itemID, skuID), accountID)
+		}
+
+		_, err = pg.db.Exec(`
+      DELETE FROM stock_reservations
+      WHERE user_id = $1 AND item_id = $2 AND sku_id = $3
+    `, accountID, itemID, skuID)
+
+		return err
+	})
+}
+
+func (self *PostgresStorage) GetUserItems(accountID int32) ([]*CartItem, error) {
+	rows, err := self.db.Query(`
+    SELECT item_id, sku_id, quantity FROM cart_items
+    WHERE user_id = $1
+    ORDER BY added_at, item_id, sku_id
+  `, accountID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	cartItems := make([]*CartItem, 0)
+	for rows.Next() {
+		cartItem := new(CartItem)
+		if err := rows.Scan(&cartItem.ItemID, &cartItem.SKUID, &cartItem.Quantity); err != nil {
+			return nil, err
+		}
+
+		cartItems = append(cartItems, cartItem)
+	}
+
+	return cartItems, rows.Err()
+}
+
+func (self *PostgresStorage) ClearUserItems(accountID int32) error {
+	return self.WithTx(func(tx Storage) error {
+		pg := tx.(*PostgresStorage)
+		if _, err := pg.db.Exec(`
+      DELETE FROM cart_items WHERE user_id = $1
+    `, accountID); err != nil {
+			return err
+		}
+
+		_, err := pg.db.Exec(`
+      DELETE FROM stock_reservations WHERE user_id = $1
+    `, accountID)
+
+		return err
+	})
+}
+
+func (self *PostgresStorage) GetAdminAccounts(opts ListOptions) (*Page[*AdminAccount], error) {
+	position, err := adminListing.resolve(opts)
+	if err != nil {
+		return nil, err
+	}
+
+	conditions := new(sqlConditions)
+	tail := position.apply(conditions)
+
+	rows, err := self.db.Query(`
+    SELECT id, username, hashed_password, role, mfa_confirmed_at IS NOT NULL, created_at FROM admins`+conditions.where()+tail, conditions.args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	accounts := make([]*AdminAccount, 0)
+	for rows.Next() {
+		account, err := scanAdminAccount(rows)
+		if err != nil {
+			return nil, err
+		}
+
+		accounts = append(accounts, account)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return adminListing.page(accounts, position), nil
+}
+
+func (self *PostgresStorage) GetUserAccounts(opts ListOptions) (*Page[*UserAccount], error) {
+	position, err := userListing.resolve(opts)
+	if err != nil {
+		return nil, err
+	}
+
+	conditions := new(sqlConditions)
+	tail := position.apply(conditions)
+
+	rows, err := self.db.Query(`
+    SELECT id, username, hashed_password, COALESCE(email, ''), email_verified_at, verification_sent_at, orders, created_at FROM users`+conditions.where()+tail, conditions.args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	accounts := make([]*UserAccount, 0)
+	for rows.Next() {
+		account, err := scanUserAccount(rows)
+		if err != nil {
+			return nil, err
+		}
+
+		accounts = append(accounts, account)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return userListing.page(accounts, position), nil
+}
+
+func scanAdminAccount(row *sql.Rows) (*AdminAccount, error) {
+	account := new(AdminAccount)
+
+	err := row.Scan(
+		&account.ID,
+		&account.Username,
+		&account.HashedPassword,
+		&account.Role,
+		&account.MFAEnabled,
+		&account.CreatedAt,
+	)
+
+	return account, err
+}
+
+func scanUserAccount(row *sql.Rows) (*UserAccount, error) {
+	account := new(UserAccount)
+
+	err := row.Scan(
+		&account.ID,
+		&account.Username,
+		&account.HashedPassword,
+		&account.Email,
+		&account.EmailVerifiedAt,
+		&account.VerificationSentAt,
+		pq.Array(&account.Orders),
 		&account.CreatedAt,
 	)
 
-	return account, err
+	return account, err
+}
+
+func (self *PostgresStorage) CreateItem(item *Item) error {
+	var id int
+	err := self.db.QueryRow(`
+    INSERT INTO items (name, description, price, currency, stock, created_at)
+    VALUES ($1, $2, $3, $4, $5, $6)
+    RETURNING id
+  `, item.Name, item.Description, item.Price.Amount, item.Price.Currency, item.Stock, item.CreatedAt).Scan(&id)
+	if err != nil {
+		return err
+	}
+
+	item.ID = uint32(id)
+
+	return nil
+}
+
+func (self *PostgresStorage) GetItem(id int32) (*Item, error) {
+	rows, err := self.db.Query(`
+    SELECT id, name, description, price, currency, stock, created_at
+    FROM items
+    WHERE id = $1
+  `, id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		return scanItem(rows)
+	}
+
+	return nil, notFoundError("Item %d not found", id)
+}
+
+func (self *PostgresStorage) DeleteItem(id int32) error {
+	res, err := self.db.Exec(`
+    DELETE FROM items WHERE id = $1
+  `, id)
+	if err != nil {
+		return err
+	}
+
+	if count, _ := res.RowsAffected(); count == 0 {
+		return notFoundError("Item %d not found", id)
+	}
+
+	return nil
+}
+
+func (self *PostgresStorage) UpdateItem(item *Item) error {
+	res, err := self.db.Exec(`
+    UPDATE items 
+    SET name = $1, description = $2, price = $3, currency = $4
+    WHERE id = $5
+  `, item.Name, item.Description, item.Price.Amount, item.Price.Currency, item.ID)
+	if err != nil {
+		return err
+	}
+
+	if count, _ := res.RowsAffected(); count == 0 {
+		return notFoundError("Item %d not found", item.ID)
+	}
+	return nil
+}
+
+func (self *PostgresStorage) GetItems(filter ItemFilter) (*Page[*Item], error) {
+	position, err := itemListing.resolve(filter.ListOptions)
+	if err != nil {
+		return nil, err
+	}
+
+	conditions := new(sqlConditions)
+	if filter.Name != "" {
+		conditions.add("name ILIKE ?", "%"+escapeLike(filter.Name)+"%")
+	}
+	if filter.MinPrice != nil {
+		conditions.add("price >= ?", *filter.MinPrice)
+	}
+	if filter.MaxPrice != nil {
+		conditions.add("price <= ?", *filter.MaxPrice)
+	}
+	if filter.Currency != "" {
+		conditions.add("currency = ?", filter.Currency)
+	}
+	if filter.CategoryID != 0 {
+		conditions.add(`id IN (
+      WITH RECURSIVE subtree AS (
+        SELECT id FROM categories WHERE id = ?
+        UNION ALL
+        SELECT c.id FROM categories c JOIN subtree s ON c.parent_id = s.id
+      )
+      SELECT item_id FROM item_categories WHERE category_id IN (SELECT id FROM subtree)
+    )`, filter.CategoryID)
+	}
+	tail := position.apply(conditions)
+
+	rows, err := self.db.Query(`
+    SELECT id, name, description, price, currency, stock, created_at
+    FROM items`+conditions.where()+tail, conditions.args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	items := make([]*Item, 0)
+	for rows.Next() {
+		item, err := scanItem(rows)
+		if err != nil {
+			return nil, err
+		}
+
+		items = append(items, item)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return itemListing.page(items, position), nil
+}
+
+// SearchItems runs a full-text search over item names and descriptions,
+// best matches first. Every word of the query must match, as a prefix.
+func (self *PostgresStorage) SearchItems(query string, limit int) ([]*ItemSearchResult, error) {
+	terms, err := searchTerms(query)
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := self.db.Query(`
+    SELECT
+      id, name, description, price, currency, stock, created_at,
+      ts_rank(search, query) AS rank,
+      ts_headline('english', name, query, 'StartSel=<mark>, StopSel=</mark>, HighlightAll=true'),
+      ts_headline('english', description, query, 'StartSel=<mark>, StopSel=</mark>, MaxFragments=2, MinWords=5, MaxWords=20')
+    FROM items, to_tsquery('english', $1) AS query
+    WHERE search @@ query
+    ORDER BY rank DESC, id
+    LIMIT $2
+  `, prefixTSQuery(terms), limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	results := make([]*ItemSearchResult, 0)
+	for rows.Next() {
+		item := new(Item)
+		result := &ItemSearchResult{Item: item}
+
+		err := rows.Scan(
+			&item.ID,
+			&item.Name,
+			&item.Description,
+			&item.Price.Amount,
+			&item.Price.Currency,
+			&item.Stock,
+			&item.CreatedAt,
+			&result.Rank,
+			&result.NameHighlight,
+			&result.Snippet,
+		)
+		if err != nil {
+			return nil, err
+		}
+
+		results = append(results, result)
+	}
+
+	return results, rows.Err()
+}
+
+// GetItemsById resolves cart items against the catalog, in cart order, and
+// totals them by quantity. Items that no longer exist are skipped.
+func (self *PostgresStorage) GetItemsById(cartItems []*CartItem) ([]*CartLine, Money, error) {
+	ids := make([]int32, 0, len(cartItems))
+	skuIDs := make([]int32, 0)
+	for _, cartItem := range cartItems {
+		ids = append(ids, cartItem.ItemID)
+		if cartItem.SKUID != 0 {
+			skuIDs = append(skuIDs, cartItem.SKUID)
+		}
+	}
+
+	rows, err := self.db.Query(`
+    SELECT id, name, description, price, currency, stock, created_at
+    FROM items
+    WHERE id = ANY($1)
+  `, pq.Array(ids))
+	if err != nil {
+		return nil, Money{}, err
+	}
+
+	items := make(map[int32]*Item)
+	for rows.Next() {
+		item, err := scanItem(rows)
+		if err != nil {
+			rows.Close()
+			return nil, Money{}, err
+		}
+
+		items[int32(item.ID)] = item
+	}
+	rows.Close()
+
+	if err := rows.Err(); err != nil {
+		return nil, Money{}, err
+	}
+
+	skus := make(map[int32]*SKU)
+	if len(skuIDs) > 0 {
+		found, err := self.querySKUs(`
+      SELECT s.id, s.item_id, s.code, s.options, s.price, i.currency, s.stock, COALESCE(s.barcode, ''), s.created_at
+      FROM skus s
+      JOIN items i ON i.id = s.item_id
+      WHERE s.id = ANY($1)
+    `, pq.Array(skuIDs))
+		if err != nil {
+			return nil, Money{}, err
+		}
+
+		for _, sku := range found {
+			skus[int32(sku.ID)] = sku
+		}
+	}
+
+	return buildCartLines(cartItems, items, skus)
+}
+
+// linesByItemID returns the lines sorted by item and then SKU id, the order
+// in which stock rows are locked.
+func linesByItemID(lines []*OrderLine) []*OrderLine {
+	sorted := append(make([]*OrderLine, 0, len(lines)), lines...)
+	sort.Slice(sorted, func(i, j int) bool {
+		if sorted[i].ItemID != sorted[j].ItemID {
+			return sorted[i].ItemID < sorted[j].ItemID
+		}
+
+		return sorted[i].SKUID < sorted[j].SKUID
+	})
+
+	return sorted
+}
+
+func insufficientStockError(itemID, skuID, requested, available int32) error {
+	return conflictError("Insufficient stock for %s: %d requested, %d available", stockLabel(itemID, skuID), requested, max(available, 0))
+}
+
+// stockLabel names what stock is held against: an item, or one of its SKUs.
+func stockLabel(itemID, skuID int32) string {
+	if skuID == 0 {
+		return fmt.Sprintf("item %d", itemID)
+	}
+
+	return fmt.Sprintf("SKU %d of item %d", skuID, itemID)
+}
+
+// buildCartLines pairs cart items with their catalog entries, preserving cart
+// order. A cart item whose item or SKU is gone is a conflict naming every
+// such entry, rather than a line quietly left out. Every line must share a
+// currency.
+func buildCartLines(cartItems []*CartItem, items map[int32]*Item, skus map[int32]*SKU) ([]*CartLine, Money, error) {
+	subtotals := make([]Money, 0, len(cartItems))
+
+	var missing []string
+	lines := make([]*CartLine, 0, len(cartItems))
+	for _, cartItem := range cartItems {
+		item, ok := items[cartItem.ItemID]
+		if !ok {
+			missing = append(missing, stockLabel(cartItem.ItemID, cartItem.SKUID))
+			continue
+		}
+
+		var sku *SKU
+		if cartItem.SKUID != 0 {
+			if sku, ok = skus[cartItem.SKUID]; !ok || sku.ItemID != cartItem.ItemID {
+				missing = append(missing, stockLabel(cartItem.ItemID, cartItem.SKUID))
+				continue
+			}
+		}
+
+		line, err := NewCartLine(item, sku, cartItem.Quantity)
+		if err != nil {
+			return nil, Money{}, err
+		}
+
+		lines = append(lines, line)
+		subtotals = append(subtotals, line.Subtotal)
+	}
+
+	if len(missing) > 0 {
+		return nil, Money{}, conflictError("No longer in the catalog: %s", strings.Join(missing, ", "))
+	}
+
+	total, err := sumMoney(subtotals...)
+	if err != nil {
+		return nil, Money{}, err
+	}
+
+	return lines, total, nil
+}
+
+func scanItem(row *sql.Rows) (*Item, error) {
+	item := new(Item)
+
+	err := row.Scan(
+		&item.ID,
+		&item.Name,
+		&item.Description,
+		&item.Price.Amount,
+		&item.Price.Currency,
+		&item.Stock,
+		&item.CreatedAt,
+	)
+
+	return item, err
+}
+
+func (self *PostgresStorage) SetItemOptions(itemID int32, options []*ItemOption) ([]*SKU, error) {
+	var skus []*SKU
+	err := self.WithTx(func(tx Storage) error {
+		pg := tx.(*PostgresStorage)
+
+		var stock int32
+		err := pg.db.QueryRow(`
+      SELECT stock FROM items WHERE id = $1 FOR UPDATE
+    `, itemID).Scan(&stock)
+		if err == sql.ErrNoRows {
+			return notFoundError("Item %d not found", itemID)
+		}
+		if err != nil {
+			return err
+		}
+
+		existing, err := pg.GetSKUs(itemID)
+		if err != nil {
+			return err
+		}
+
+		introducing := len(existing) == 0 && len(options) > 0
+		if introducing && stock > 0 {
+			return conflictError("Item %d still has %d units in stock; set its stock to zero before adding variants", itemID, stock)
+		}
+
+		plan, err := planSKUs(itemID, options, existing)
+		if err != nil {
+			return err
+		}
+
+		for _, sku := range plan.remove {
+			if err := pg.clearCartLines(`
+        WHERE sku_id = $1
+      `, sku.ID); err != nil {
+				return err
+			}
+
+			if _, err := pg.db.Exec(`
+        DELETE FROM skus WHERE id = $1
+      `, sku.ID); err != nil {
+				return err
+			}
+		}
+
+		// Carts and reservations of the plain item cannot be fulfilled once
+		// it only sells by SKU.
+		if introducing {
+			if err := pg.clearCartLines(`
+        WHERE item_id = $1 AND sku_id = 0
+      `, itemID); err != nil {
+				return err
+			}
+		}
+
+		for _, sku := range plan.create {
+			if err := pg.insertSKU(sku); err != nil {
+				return err
+			}
+		}
+
+		if _, err := pg.db.Exec(`
+      DELETE FROM item_options WHERE item_id = $1
+    `, itemID); err != nil {
+			return err
+		}
+
+		for position, option := range options {
+			if _, err := pg.db.Exec(`
+        INSERT INTO item_options (item_id, position, name, option_values)
+        VALUES ($1, $2, $3, $4)
+      `, itemID, position, option.Name, pq.Array(option.Values)); err != nil {
+				return err
+			}
+		}
+
+		skus, err = pg.GetSKUs(itemID)
+		return err
+	})
+
+	return skus, err
+}
+
+// clearCartLines removes the cart lines and stock reservations matching the
+// condition, which may refer to item_id and sku_id.
+func (self *PostgresStorage) clearCartLines(condition string, args ...any) error {
+	for _, table := range []string{"cart_items", "stock_reservations"} {
+		if _, err := self.db.Exec("DELETE FROM "+table+condition, args...); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (self *PostgresStorage) insertSKU(sku *SKU) error {
+	options, err := json.Marshal(sku.Options)
+	if err != nil {
+		return err
+	}
+
+	var id int
+	err = self.db.QueryRow(`
+    INSERT INTO skus (item_id, code, options, created_at)
+    VALUES ($1, $2, $3, $4)
+    RETURNING id
+  `, sku.ItemID, sku.Code, options, sku.CreatedAt).Scan(&id)
+	if isUniqueViolation(err, "skus_code_key") {
+		return conflictError("SKU code \"%s\" is already taken", sku.Code)
+	}
+	if err != nil {
+		return err
+	}
+
+	sku.ID = uint32(id)
+
+	return nil
+}
+
+func (self *PostgresStorage) GetItemOptions(itemID int32) ([]*ItemOption, error) {
+	rows, err := self.db.Query(`
+    SELECT name, option_values
+    FROM item_options
+    WHERE item_id = $1
+    ORDER BY position
+  `, itemID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	options := make([]*ItemOption, 0)
+	for rows.Next() {
+		option := new(ItemOption)
+		if err := rows.Scan(&option.Name, pq.Array(&option.Values)); err != nil {
+			return nil, err
+		}
+
+		options = append(options, option)
+	}
+
+	return options, rows.Err()
+}
+
+func (self *PostgresStorage) GetSKUs(itemID int32) ([]*SKU, error) {
+	return self.querySKUs(`
+    SELECT s.id, s.item_id, s.code, s.options, s.price, i.currency, s.stock, COALESCE(s.barcode, ''), s.created_at
+    FROM skus s
+    JOIN items i ON i.id = s.item_id
+    WHERE s.item_id = $1
+    ORDER BY s.id
+  `, itemID)
+}
+
+func (self *PostgresStorage) GetSKU(id int32) (*SKU, error) {
+	skus, err := self.querySKUs(`
+    SELECT s.id, s.item_id, s.code, s.options, s.price, i.currency, s.stock, COALESCE(s.barcode, ''), s.created_at
+    FROM skus s
+    JOIN items i ON i.id = s.item_id
+    WHERE s.id = $1
+  `, id)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(skus) == 0 {
+		return nil, notFoundError("SKU %d not found", id)
+	}
+
+	return skus[0], nil
+}
+
+// UpdateSKU saves the SKU's code, price override and barcode. Its stock only
+// changes through SetItemStock and AdjustItemStock.
+func (self *PostgresStorage) UpdateSKU(sku *SKU) error {
+	var price *int64
+	if sku.PriceOverride != nil {
+		price = &sku.PriceOverride.Amount
+	}
+
+	var barcode *string
+	if sku.Barcode != "" {
+		barcode = &sku.Barcode
+	}
+
+	res, err := self.db.Exec(`
+    UPDATE skus
+    SET code = $1, price = $2, barcode = $3
+    WHERE id = $4
+  `, sku.Code, price, barcode, sku.ID)
+	if isUniqueViolation(err, "skus_code_key") {
+		return conflictError("SKU code \"%s\" is already taken", sku.Code)
+	}
+	if isUniqueViolation(err, "skus_barcode_key") {
+		return conflictError("Barcode \"%s\" is already taken", sku.Barcode)
+	}
+	if err != nil {
+		return err
+	}
+
+	if count, _ := res.RowsAffected(); count == 0 {
+		return notFoundError("SKU %d not found", sku.ID)
+	}
+
+	return nil
+}
+
+func (self *PostgresStorage) querySKUs(query string, args ...any) ([]*SKU, error) {
+	rows, err := self.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	skus := make([]*SKU, 0)
+	for rows.Next() {
+		sku := new(SKU)
+
+		var options []byte
+		var price sql.NullInt64
+		var currency string
+		err := rows.Scan(&sku.ID, &sku.ItemID, &sku.Code, &options, &price, &currency, &sku.Stock, &sku.Barcode, &sku.CreatedAt)
+		if err != nil {
+			return nil, err
+		}
+
+		if err := json.Unmarshal(options, &sku.Options); err != nil {
+			return nil, err
+		}
+
+		if price.Valid {
+			sku.PriceOverride = &Money{Amount: price.Int64, Currency: currency}
+		}
+
+		skus = append(skus, sku)
+	}
+
+	return skus, rows.Err()
+}
+
+// CreateItemImage appends the image to the end of the item's images. It
+// becomes the primary image when asked to or when it is the item's first.
+func (self *PostgresStorage) CreateItemImage(image *ItemImage) error {
+	return self.WithTx(func(tx Storage) error {
+		pg := tx.(*PostgresStorage)
+
+		// the item's row lock serialises uploads, so positions do not collide
+		err := pg.db.QueryRow(`
+      SELECT id FROM items WHERE id = $1 FOR UPDATE
+    `, image.ItemID).Scan(new(int32))
+		if err == sql.ErrNoRows {
+			return notFoundError("Item %d not found", image.ItemID)
+		}
+		if err != nil {
+			return err
+		}
+
+		var count, nextPosition int32
+		var hasPrimary bool
+		err = pg.db.QueryRow(`
+      SELECT COUNT(*), COALESCE(MAX(position) + 1, 0), COALESCE(BOOL_OR(is_primary), false)
+      FROM item_images
+      WHERE item_id = $1
+    `, image.ItemID).Scan(&count, &nextPosition, &hasPrimary)
+		if err != nil {
+			return err
+		}
+
+		if count >= maxImagesPerItem {
+			return conflictError("Item %d already has the maximum of %d images", image.ItemID, maxImagesPerItem)
+		}
+
+		image.Position = nextPosition
+		image.Primary = image.Primary || !hasPrimary
+
+		if image.Primary && hasPrimary {
+			if _, err := pg.db.Exec(`
+        UPDATE item_images SET is_primary = false WHERE item_id = $1
+      `, image.ItemID); err != nil {
+				return err
+			}
+		}
+
+		var id int
+		err = pg.db.QueryRow(`
+      INSERT INTO item_images (item_id, position, is_primary, blob_key, thumbnail_key, content_type, width, height, size_bytes, created_at)
+      VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)
+      RETURNING id
+    `, image.ItemID, image.Position, image.Primary, image.Key, image.ThumbnailKey, image.ContentType, image.Width, image.Height, image.Size, image.CreatedAt).Scan(&id)
+		if err != nil {
+			return err
+		}
+
+		image.ID = uint32(id)
+
+		return nil
+	})
+}
+
+func (self *PostgresStorage) GetItemImage(id int32) (*ItemImage, error) {
+	images, err := self.queryItemImages(`
+    SELECT id, item_id, position, is_primary, blob_key, thumbnail_key, content_type, width, height, size_bytes, created_at
+    FROM item_images
+    WHERE id = $1
+  `, id)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(images) == 0 {
+		return nil, notFoundError("Image %d not found", id)
+	}
+
+	return images[0], nil
+}
+
+func (self *PostgresStorage) GetItemImages(itemID int32) ([]*ItemImage, error) {
+	return self.queryItemImages(`
+    SELECT id, item_id, position, is_primary, blob_key, thumbnail_key, content_type, width, height, size_bytes, created_at
+    FROM item_images
+    WHERE item_id = $1
+    ORDER BY position, id
+  `, itemID)
+}
+
+// GetImagesForItems loads the images of several items at once, for listings.
+func (self *PostgresStorage) GetImagesForItems(itemIDs []int32) (map[int32][]*ItemImage, error) {
+	images, err := self.queryItemImages(`
+    SELECT id, item_id, position, is_primary, blob_key, thumbnail_key, content_type, width, height, size_bytes, created_at
+    FROM item_images
+    WHERE item_id = ANY($1)
+    ORDER BY item_id, position, id
+  `, pq.Array(itemIDs))
+	if err != nil {
+		return nil, err
+	}
+
+	byItem := make(map[int32][]*ItemImage)
+	for _, image := range images {
+		byItem[image.ItemID] = append(byItem[image.ItemID], image)
+	}
+
+	return byItem, nil
+}
+
+// DeleteItemImage removes the image record; its blobs are the caller's to
+// delete. If it was the primary image, the first remaining one takes over.
+func (self *PostgresStorage) DeleteItemImage(id int32) error {
+	return self.WithTx(func(tx Storage) error {
+		pg := tx.(*PostgresStorage)
+
+		var itemID int32
+		var wasPrimary bool
+		err := pg.db.QueryRow(`
+      DELETE FROM item_images WHERE id = $1
+      RETURNING item_id, is_primary
+    `, id).Scan(&itemID, &wasPrimary)
+		if err == sql.ErrNoRows {
+			return notFoundError("Image %d not found", id)
+		}
+		if err != nil {
+			return err
+		}
+
+		if !wasPrimary {
+			return nil
+		}
+
+		_, err = pg.db.Exec(`
+      UPDATE item_images
+      SET is_primary = true
+      WHERE id = (
+        SELECT id FROM item_images
+        WHERE item_id = $1
+        ORDER BY position, id
+        LIMIT 1
+      )
+    `, itemID)
+
+		return err
+	})
+}
+
+// ReorderItemImages puts the item's images in the order given, which must
+// list every one of them exactly once.
+func (self *PostgresStorage) ReorderItemImages(itemID int32, imageIDs []int32) error {
+	return self.WithTx(func(tx Storage) error {
+		pg := tx.(*PostgresStorage)
+
+		images, err := pg.queryItemImages(`
+      SELECT id, item_id, position, is_primary, blob_key, thumbnail_key, content_type, width, height, size_bytes, created_at
+      FROM item_images
+      WHERE item_id = $1
+      FOR UPDATE
+    `, itemID)
+		if err != nil {
+			return err
+		}
+
+		if err := checkImageOrder(itemID, images, imageIDs); err != nil {
+			return err
+		}
+
+		for position, id := range imageIDs {
+			if _, err := pg.db.Exec(`
+        UPDATE item_images SET position = $1 WHERE id = $2
+      `, position, id); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+}
+
+func (self *PostgresStorage) SetPrimaryItemImage(itemID, imageID int32) error {
+	return self.WithTx(func(tx Storage) error {
+		pg := tx.(*PostgresStorage)
+
+		var exists bool
+		err := pg.db.QueryRow(`
+      SELECT EXISTS (SELECT 1 FROM item_images WHERE id = $1 AND item_id = $2)
+    `, imageID, itemID).Scan(&exists)
+		if err != nil {
+			return err
+		}
+
+		if !exists {
+			return notFoundError("Image %d of item %d not found", imageID, itemID)
+		}
+
+		// two statements, since the one-primary index is checked row by row
+		if _, err := pg.db.Exec(`
+      UPDATE item_images SET is_primary = false WHERE item_id = $1 AND is_primary
+    `, itemID); err != nil {
+			return err
+		}
+
+		_, err = pg.db.Exec(`
+      UPDATE item_images SET is_primary = true WHERE id = $1
+    `, imageID)
+
+		return err
+	})
+}
+
+func (self *PostgresStorage) queryItemImages(query string, args ...any) ([]*ItemImage, error) {
+	rows, err := self.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	images := make([]*ItemImage, 0)
+	for rows.Next() {
+		image := new(ItemImage)
+		err := rows.Scan(
+			&image.ID,
+			&image.ItemID,
+			&image.Position,
+			&image.Primary,
+			&image.Key,
+			&image.ThumbnailKey,
+			&image.ContentType,
+			&image.Width,
+			&image.Height,
+			&image.Size,
+			&image.CreatedAt,
+		)
+		if err != nil {
+			return nil, err
+		}
+
+		image.resolveURLs()
+		images = append(images, image)
+	}
+
+	return images, rows.Err()
+}
+
+func (self *PostgresStorage) CreateCategory(category *Category) error {
+	return self.WithTx(func(tx Storage) error {
+		pg := tx.(*PostgresStorage)
+		if err := pg.checkCategoryParent(category); err != nil {
+			return err
+		}
+
+		var id int
+		err := pg.db.QueryRow(`
+      INSERT INTO categories (parent_id, name, slug, created_at)
+      VALUES ($1, $2, $3, $4)
+      RETURNING id
+    `, category.ParentID, category.Name, category.Slug, category.CreatedAt).Scan(&id)
+		if isUniqueViolation(err, "categories_slug_key") {
+			return conflictError("Category slug \"%s\" is already taken", category.Slug)
+		}
+		if err != nil {
+			return err
+		}
+
+		category.ID = uint32(id)
+
+		return nil
+	})
+}
+
+func (self *PostgresStorage) UpdateCategory(category *Category) error {
+	return self.WithTx(func(tx Storage) error {
+		pg := tx.(*PostgresStorage)
+		if err := pg.checkCategoryParent(category); err != nil {
+			return err
+		}
+
+		res, err := pg.db.Exec(`
+      UPDATE categories
+      SET parent_id = $1, name = $2, slug = $3
+      WHERE id = $4
+    `, category.ParentID, category.Name, category.Slug, category.ID)
+		if isUniqueViolation(err, "categories_slug_key") {
+			return conflictError("Category slug \"%s\" is already taken", category.Slug)
+		}
+		if err != nil {
+			return err
+		}
+
+		if count, _ := res.RowsAffected(); count == 0 {
+			return notFoundError("Category %d not found", category.ID)
+		}
+
+		return nil
+	})
+}
+
+// checkCategoryParent makes sure the parent exists and is not the category
+// itself or one of its descendants. The table lock serialises tree edits so
+// two concurrent moves cannot close a loop between them.
+func (self *PostgresStorage) checkCategoryParent(category *Category) error {
+	if _, err := self.db.Exec(`
+    LOCK TABLE categories IN SHARE ROW EXCLUSIVE MODE
+  `); err != nil {
+		return err
+	}
+
+	if category.ParentID == nil {
+		return nil
+	}
+
+	var found, cycle bool
+	err := self.db.QueryRow(`
+    WITH RECURSIVE ancestors AS (
+      SELECT id, parent_id FROM categories WHERE id = $1
+      UNION ALL
+      SELECT c.id, c.parent_id
+      FROM categories c
+      JOIN ancestors a ON c.id = a.parent_id
+    )
+    SELECT COUNT(*) > 0, COALESCE(BOOL_OR(id = $2), false)
+    FROM ancestors
+  `, *category.ParentID, category.ID).Scan(&found, &cycle)
+	if err != nil {
+		return err
+	}
+
+	if !found {
+		return validationError("parent_id", "Category %d not found", *category.ParentID)
+	}
+
+	if cycle {
+		return validationError("parent_id", "Category %d cannot be moved under its own subcategory %d", category.ID, *category.ParentID)
+	}
+
+	return nil
+}
+
+func (self *PostgresStorage) GetCategory(id int32) (*Category, error) {
+	categories, err := self.queryCategories(`
+    SELECT id, parent_id, name, slug, created_at
+    FROM categories
+    WHERE id = $1
+  `, id)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(categories) == 0 {
+		return nil, notFoundError("Category %d not found", id)
+	}
+
+	return categories[0], nil
+}
+
+func (self *PostgresStorage) GetCategoryBySlug(slug string) (*Category, error) {
+	categories, err := self.queryCategories(`
+    SELECT id, parent_id, name, slug, created_at
+    FROM categories
+    WHERE slug = $1
+  `, slug)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(categories) == 0 {
+		return nil, notFoundError("Category \"%s\" not found", slug)
+	}
+
+	return categories[0], nil
 }
 
-func (self *PostgresStorage) CreateItem(item *Item) error {
-	var id int
-	err := self.db.QueryRow(`
-    INSERT INTO items (name, description, price, created_at)
-    VALUES ($1, $2, $3, $4)
-    RETURNING id
-  `, item.Name, item.Description, item.Price, item.CreatedAt).Scan(&id)
-	if err != nil {
-		return err
-	}
+// DeleteCategory refuses to delete a category that still has subcategories;
+// move or delete those first. Item assignments to it are dropped.
+func (self *PostgresStorage) DeleteCategory(id int32) error {
+	return self.WithTx(func(tx Storage) error {
+		pg := tx.(*PostgresStorage)
+
+		var children int
+		if err := pg.db.QueryRow(`
+      SELECT COUNT(*) FROM categories WHERE parent_id = $1
+    `, id).Scan(&children); err != nil {
+			return err
+		}
 
-	item.ID = uint32(id)
+		if children > 0 {
+			return conflictError("Category %d still has %d subcategories", id, children)
+		}
 
-	return nil
+		res, err := pg.db.Exec(`
+      DELETE FROM categories WHERE id = $1
+    `, id)
+		if err != nil {
+			return err
+		}
+
+		if count, _ := res.RowsAffected(); count == 0 {
+			return notFoundError("Category %d not found", id)
+		}
+
+		return nil
+	})
 }
 
-func (self *PostgresStorage) GetItem(id int32) (*Item, error) {
-	rows, err := self.db.Query(`
-    SELECT * FROM items WHERE id = $1
-  `, id)
+func (self *PostgresStorage) GetCategories() ([]*Category, error) {
+	return self.queryCategories(`
+    SELECT id, parent_id, name, slug, created_at
+    FROM categories
+    ORDER BY name, id
+  `)
+}
+
+// SetItemCategories replaces the categories an item is filed under.
+func (self *PostgresStorage) SetItemCategories(itemID int32, categoryIDs []int32) error {
+	return self.WithTx(func(tx Storage) error {
+		pg := tx.(*PostgresStorage)
+
+		if _, err := pg.GetItem(itemID); err != nil {
+			return err
+		}
+
+		var known []int32
+		if err := pg.db.QueryRow(`
+      SELECT COALESCE(array_agg(id), '{}') FROM categories WHERE id = ANY($1)
+    `, pq.Array(categoryIDs)).Scan(pq.Array(&known)); err != nil {
+			return err
+		}
+
+		for _, categoryID := range categoryIDs {
+			if !containsID(known, categoryID) {
+				return validationError("category_ids", "Category %d not found", categoryID)
+			}
+		}
+
+		if _, err := pg.db.Exec(`
+      DELETE FROM item_categories WHERE item_id = $1
+    `, itemID); err != nil {
+			return err
+		}
+
+		_, err := pg.db.Exec(`
+      INSERT INTO item_categories (item_id, category_id)
+      SELECT $1, category_id FROM unnest($2::INT[]) AS category_id
+      ON CONFLICT DO NOTHING
+    `, itemID, pq.Array(categoryIDs))
+
+		return err
+	})
+}
+
+func (self *PostgresStorage) GetItemCategories(itemID int32) ([]*Category, error) {
+	return self.queryCategories(`
+    SELECT c.id, c.parent_id, c.name, c.slug, c.created_at
+    FROM categories c
+    JOIN item_categories ic ON ic.category_id = c.id
+    WHERE ic.item_id = $1
+    ORDER BY c.name, c.id
+  `, itemID)
+}
+
+func (self *PostgresStorage) queryCategories(query string, args ...any) ([]*Category, error) {
+	rows, err := self.db.Query(query, args...)
 	if err != nil {
 		return nil, err
 	}
 	defer rows.Close()
 
+	categories := make([]*Category, 0)
 	for rows.Next() {
-		return scanItem(rows)
+		category := new(Category)
+		if err := rows.Scan(&category.ID, &category.ParentID, &category.Name, &category.Slug, &category.CreatedAt); err != nil {
+			return nil, err
+		}
+
+		categories = append(categories, category)
 	}
 
-	return nil, fmt.Errorf("Item %d not found", id)
+	return categories, rows.Err()
 }
 
-func (self *PostgresStorage) DeleteItem(id int32) error {
-	res, err := self.db.Exec(`
-    DELETE FROM items WHERE id = $1
-  `, id)
-	if err != nil {
-		return err
-	}
+// isUniqueViolation reports whether err is Postgres rejecting a duplicate
+// under the named unique constraint.
+func isUniqueViolation(err error, constraint string) bool {
+	pqErr, ok := err.(*pq.Error)
+	return ok && pqErr.Code == "23505" && pqErr.Constraint == constraint
+}
 
-	if count, _ := res.RowsAffected(); count == 0 {
-		return fmt.Errorf("Item %d not found", id)
-	}
+func (self *PostgresStorage) SetItemStock(itemID, skuID, stock int32, reason string, adminID int32) (*StockAdjustment, error) {
+	var adjustment *StockAdjustment
+	err := self.WithTx(func(tx Storage) error {
+		pg := tx.(*PostgresStorage)
+		current, err := pg.lockItemStock(itemID, skuID)
+		if err != nil {
+			return err
+		}
 
-	_, err2 := self.db.Exec(`
-    UPDATE users 
-    SET items = array_remove(items, $1) 
-  `, id)
+		if stock < 0 {
+			return validationError("stock", "Stock for %s cannot go below zero", stockLabel(itemID, skuID))
+		}
+
+		adjustment, err = pg.recordStockChange(itemID, skuID, stock-current, reason, &adminID, nil)
+		return err
+	})
 
-	return err2
+	return adjustment, err
 }
 
-func (self *PostgresStorage) UpdateItem(item *Item) error {
-	res, err := self.db.Exec(`
-    UPDATE items 
-    SET name = $1, description = $2, price = $3 
-    WHERE id = $4
-  `, item.Name, item.Description, item.Price, item.ID)
-	if err != nil {
+func (self *PostgresStorage) AdjustItemStock(itemID, skuID, delta int32, reason string, adminID int32) (*StockAdjustment, error) {
+	var adjustment *StockAdjustment
+	err := self.WithTx(func(tx Storage) error {
+		pg := tx.(*PostgresStorage)
+		current, err := pg.lockItemStock(itemID, skuID)
+		if err != nil {
+			return err
+		}
+
+		if current+delta < 0 {
+			return conflictError("Stock for %s cannot go below zero", stockLabel(itemID, skuID))
+		}
+
+		adjustment, err = pg.recordStockChange(itemID, skuID, delta, reason, &adminID, nil)
 		return err
-	}
+	})
 
-	if count, _ := res.RowsAffected(); count == 0 {
-		return fmt.Errorf("Item %d not found", item.ID)
-	}
-	return nil
+	return adjustment, err
 }
 
-func (self *PostgresStorage) GetItems() ([]*Item, error) {
+func (self *PostgresStorage) GetStockAdjustments(itemID int32) ([]*StockAdjustment, error) {
 	rows, err := self.db.Query(`
-    SELECT * FROM items
-  `)
+    SELECT id, item_id, COALESCE(sku_id, 0), delta, stock_after, reason, admin_id, order_id, created_at
+    FROM stock_adjustments
+    WHERE item_id = $1
+    ORDER BY id
+  `, itemID)
 	if err != nil {
 		return nil, err
 	}
 	defer rows.Close()
 
-	items := make([]*Item, 0)
+	adjustments := make([]*StockAdjustment, 0)
 	for rows.Next() {
-		item, err := scanItem(rows)
+		adjustment := new(StockAdjustment)
+		err := rows.Scan(
+			&adjustment.ID,
+			&adjustment.ItemID,
+			&adjustment.SKUID,
+			&adjustment.Delta,
+			&adjustment.StockAfter,
+			&adjustment.Reason,
+			&adjustment.AdminID,
+			&adjustment.OrderID,
+			&adjustment.CreatedAt,
+		)
 		if err != nil {
 			return nil, err
 		}
 
-		items = append(items, item)
+		adjustments = append(adjustments, adjustment)
 	}
 
-	return items, nil
+	return adjustments, rows.Err()
 }
 
-func (self *PostgresStorage) GetItemsById(ids []int32) ([]*Item, float64, error) {
-	rows, err := self.db.Query(`
-    SELECT * FROM items WHERE id = ANY($1)
-  `, pq.Array(ids))
+// lockItemStock reads the stock of an item, or of one of its SKUs, and holds
+// a row lock on it until the enclosing transaction ends. Items with variants
+// only have stock per SKU.
+func (self *PostgresStorage) lockItemStock(itemID, skuID int32) (int32, error) {
+	if skuID != 0 {
+		var stock int32
+		err := self.db.QueryRow(`
+      SELECT stock FROM skus WHERE id = $1 AND item_id = $2 FOR UPDATE
+    `, skuID, itemID).Scan(&stock)
+		if err == sql.ErrNoRows {
+			return 0, notFoundError("SKU %d of item %d not found", skuID, itemID)
+		}
+
+		return stock, err
+	}
+
+	var stock int32
+	var hasVariants bool
+	err := self.db.QueryRow(`
+    SELECT stock, EXISTS (SELECT 1 FROM skus WHERE item_id = $1)
+    FROM items
+    WHERE id = $1
+    FOR UPDATE
+  `, itemID).Scan(&stock, &hasVariants)
+	if err == sql.ErrNoRows {
+		return 0, notFoundError("Item %d not found", itemID)
+	}
 	if err != nil {
-		return nil, 0, err
+		return 0, err
 	}
-	defer rows.Close()
 
-	var total float64
+	if hasVariants {
+		return 0, variantRequiredError(itemID)
+	}
 
-	items := make([]*Item, 0)
-	for rows.Next() {
-		item, err := scanItem(rows)
-		if err != nil {
-			return nil, 0, err
-		}
+	return stock, nil
+}
 
-		items = append(items, item)
-		total += item.Price
+// availableStock is the item's stock less the units held by other accounts'
+// unexpired reservations. It locks the item row like lockItemStock.
+func (self *PostgresStorage) availableStock(accountID, itemID, skuID int32) (int32, error) {
+	stock, err := self.lockItemStock(itemID, skuID)
+	if err != nil {
+		return 0, err
+	}
+
+	var reserved int32
+	err = self.db.QueryRow(`
+    SELECT COALESCE(SUM(quantity), 0) FROM stock_reservations
+    WHERE item_id = $1 AND sku_id = $2 AND user_id <> $3 AND expires_at > $4
+  `, itemID, skuID, accountID, time.Now().UTC()).Scan(&reserved)
+	if err != nil {
+		return 0, err
 	}
 
-	return items, total, nil
+	return stock - reserved, nil
 }
 
-func scanItem(row *sql.Rows) (*Item, error) {
-	item := new(Item)
+// reserveStock holds quantity units of the item for the account's cart until
+// stockReservationTTL passes, replacing any earlier reservation.
+func (self *PostgresStorage) reserveStock(accountID, itemID, skuID, quantity int32) error {
+	available, err := self.availableStock(accountID, itemID, skuID)
+	if err != nil {
+		return err
+	}
 
-	err := row.Scan(
-		&item.ID,
-		&item.Name,
-		&item.Description,
-		&item.Price,
-		&item.CreatedAt,
-	)
+	if available < quantity {
+		return insufficientStockError(itemID, skuID, quantity, available)
+	}
 
-	return item, err
+	now := time.Now().UTC()
+	if _, err := self.db.Exec(`
+    DELETE FROM stock_reservations WHERE expires_at <= $1
+  `, now); err != nil {
+		return err
+	}
+
+	_, err = self.db.Exec(`
+    INSERT INTO stock_reservations (user_id, item_id, sku_id, quantity, expires_at)
+    VALUES ($1, $2, $3, $4, $5)
+    ON CONFLICT (user_id, item_id, sku_id)
+    DO UPDATE SET quantity = EXCLUDED.quantity, expires_at = EXCLUDED.expires_at
+  `, accountID, itemID, skuID, quantity, now.Add(stockReservationTTL))
+
+	return err
+}
+
+// recordStockChange applies delta to the stock of the item or SKU and logs
+// it. The caller must already hold the row lock from lockItemStock.
+func (self *PostgresStorage) recordStockChange(itemID, skuID, delta int32, reason string, adminID, orderID *int32) (*StockAdjustment, error) {
+	adjustment := &StockAdjustment{
+		ItemID:    itemID,
+		SKUID:     skuID,
+		Delta:     delta,
+		Reason:    reason,
+		AdminID:   adminID,
+		OrderID:   orderID,
+		CreatedAt: time.Now().UTC(),
+	}
+
+	var err error
+	if skuID != 0 {
+		err = self.db.QueryRow(`
+      UPDATE skus
+      SET stock = stock + $1
+      WHERE id = $2
+      RETURNING stock
+    `, delta, skuID).Scan(&adjustment.StockAfter)
+	} else {
+		err = self.db.QueryRow(`
+      UPDATE items
+      SET stock = stock + $1
+      WHERE id = $2
+      RETURNING stock
+    `, delta, itemID).Scan(&adjustment.StockAfter)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var sku *int32
+	if skuID != 0 {
+		sku = &skuID
+	}
+
+	var id int
+	err = self.db.QueryRow(`
+    INSERT INTO stock_adjustments (item_id, sku_id, delta, stock_after, reason, admin_id, order_id, created_at)
+    VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
+    RETURNING id
+  `, itemID, sku, delta, adjustment.StockAfter, reason, adminID, orderID, adjustment.CreatedAt).Scan(&id)
+	if err != nil {
+		return nil, err
+	}
+
+	adjustment.ID = uint32(id)
+
+	return adjustment, nil
 }
 
 func (self *PostgresStorage) CreateOrder(order *Order) error {
+	return self.WithTx(func(tx Storage) error {
+		return tx.(*PostgresStorage).createOrder(order)
+	})
+}
+
+func (self *PostgresStorage) createOrder(order *Order) error {
 	var id int
 	err := self.db.QueryRow(`
-    INSERT INTO orders (user_id, items, total, status, created_at)
+    INSERT INTO orders (user_id, total, currency, status, created_at)
     VALUES ($1, $2, $3, $4, $5)
     RETURNING id
-  `, order.UserID, pq.Array(order.Items), order.Total, order.Status, order.CreatedAt).Scan(&id)
+  `, order.UserID, order.Total.Amount, order.Total.Currency, order.Status, order.CreatedAt).Scan(&id)
 	if err != nil {
 		return err
 	}
 
 	order.ID = uint32(id)
 
+	for _, line := range order.Lines {
+		var listPrice *int64
+		var overrideReason *string
+		if line.ListPrice != nil {
+			listPrice = &line.ListPrice.Amount
+			overrideReason = &line.OverrideReason
+		}
+
+		var skuID *int32
+		var skuCode *string
+		var options []byte
+		if line.SKUID != 0 {
+			skuID = &line.SKUID
+			skuCode = &line.SKUCode
+			if options, err = json.Marshal(line.Options); err != nil {
+				return err
+			}
+		}
+
+		_, err = self.db.Exec(`
+      INSERT INTO order_lines (order_id, item_id, name, unit_price, quantity, line_total, currency, list_price, override_reason, override_admin_id, sku_id, sku_code, options)
+      VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13)
+    `, order.ID, line.ItemID, line.Name, line.UnitPrice.Amount, line.Quantity, line.LineTotal.Amount, line.UnitPrice.Currency, listPrice, overrideReason, line.OverriddenBy, skuID, skuCode, options)
+		if err != nil {
+			return err
+		}
+	}
+
+	if err := self.sellStock(order); err != nil {
+		return err
+	}
+
+	if err := self.recordOrderStatusChange(int32(order.ID), "", order.Status, nil); err != nil {
+		return err
+	}
+
 	err = self.db.QueryRow(`
     UPDATE users
     SET orders = array_append(orders, $1)
     WHERE id = $2 
     RETURNING id 
   `, order.ID, order.UserID).Scan(&id)
-	if err != nil {
-		return err
+	if err == sql.ErrNoRows {
+		return validationError("account_id", "User %d not found", order.UserID)
 	}
 
-	if id == 0 {
-		return fmt.Errorf("User %d not found", order.UserID)
+	return err
+}
+
+// sellStock takes the ordered quantities out of stock and drops the buyer's
+// reservations for them. Stock rows are locked in item and SKU id order so
+// that concurrent orders sharing items cannot deadlock.
+func (self *PostgresStorage) sellStock(order *Order) error {
+	orderID := int32(order.ID)
+	for _, line := range linesByItemID(order.Lines) {
+		available, err := self.availableStock(int32(order.UserID), line.ItemID, line.SKUID)
+		if err != nil {
+			return err
+		}
+
+		if available < line.Quantity {
+			return insufficientStockError(line.ItemID, line.SKUID, line.Quantity, available)
+		}
+
+		if _, err := self.recordStockChange(line.ItemID, line.SKUID, -line.Quantity, fmt.Sprintf("Order %d", order.ID), nil, &orderID); err != nil {
+			return err
+		}
+
+		if _, err := self.db.Exec(`
+      DELETE FROM stock_reservations
+      WHERE user_id = $1 AND item_id = $2 AND sku_id = $3
+    `, order.UserID, line.ItemID, line.SKUID); err != nil {
+			return err
+		}
 	}
 
 	return nil
 }
 
 func (self *PostgresStorage) GetOrder(id int32) (*Order, error) {
-	rows, err := self.db.Query(`
-    SELECT * FROM orders WHERE id = $1
+	orders, err := self.queryOrders(`
+    SELECT id, user_id, total, currency, status, created_at
+    FROM orders
+    WHERE id = $1
   `, id)
 	if err != nil {
 		return nil, err
 	}
-	defer rows.Close()
 
-	for rows.Next() {
-		return scanOrder(rows)
+	if len(orders) == 0 {
+		return nil, notFoundError("Order %d not found", id)
 	}
 
-	return nil, fmt.Errorf("Order %d not found", id)
+	return orders[0], nil
 }
 
 func (self *PostgresStorage) DeleteOrder(id int32) error {
@@ -731,80 +2908,225 @@ func (self *PostgresStorage) DeleteOrder(id int32) error {
 	}
 
 	if count, _ := res.RowsAffected(); count == 0 {
-		return fmt.Errorf("Order %d not found", id)
+		return notFoundError("Order %d not found", id)
 	}
 
 	return nil
 }
 
-func (self *PostgresStorage) UpdateOrder(order *Order) error {
-	res, err := self.db.Exec(`
-    UPDATE orders 
-    SET status = $1
-    WHERE id = $2
-  `, order.Status, order.ID)
-	if err != nil {
-		return err
-	}
+// UpdateOrderStatus moves an order to a new status if the transition table
+// allows it, and records the change against the acting admin.
+func (self *PostgresStorage) UpdateOrderStatus(orderID int32, status OrderStatus, adminID int32) error {
+	return self.WithTx(func(tx Storage) error {
+		pg := tx.(*PostgresStorage)
+
+		var current OrderStatus
+		err := pg.db.QueryRow(`
+      SELECT status FROM orders WHERE id = $1 FOR UPDATE
+    `, orderID).Scan(&current)
+		if err == sql.ErrNoRows {
+			return notFoundError("Order %d not found", orderID)
+		}
+		if err != nil {
+			return err
+		}
 
-	if count, _ := res.RowsAffected(); count == 0 {
-		return fmt.Errorf("Order %d not found", order.ID)
+		if err := checkOrderTransition(uint32(orderID), current, status); err != nil {
+			return err
+		}
+
+		if _, err := pg.db.Exec(`
+      UPDATE orders
+      SET status = $1
+      WHERE id = $2
+    `, status, orderID); err != nil {
+			return err
+		}
+
+		return pg.recordOrderStatusChange(orderID, current, status, &adminID)
+	})
+}
+
+func (self *PostgresStorage) recordOrderStatusChange(orderID int32, from, to OrderStatus, adminID *int32) error {
+	var fromStatus *OrderStatus
+	if from != "" {
+		fromStatus = &from
 	}
-	return nil
+
+	_, err := self.db.Exec(`
+    INSERT INTO order_status_history (order_id, from_status, to_status, admin_id, created_at)
+    VALUES ($1, $2, $3, $4, $5)
+  `, orderID, fromStatus, to, adminID, time.Now().UTC())
+
+	return err
 }
 
-func (self *PostgresStorage) GetOrders() ([]*Order, error) {
+func (self *PostgresStorage) GetOrderStatusHistory(orderID int32) ([]*OrderStatusChange, error) {
 	rows, err := self.db.Query(`
-    SELECT * FROM orders
-  `)
+    SELECT id, order_id, COALESCE(from_status, ''), to_status, admin_id, created_at
+    FROM order_status_history
+    WHERE order_id = $1
+    ORDER BY id
+  `, orderID)
 	if err != nil {
 		return nil, err
 	}
 	defer rows.Close()
 
-	orders := make([]*Order, 0)
+	history := make([]*OrderStatusChange, 0)
 	for rows.Next() {
-		order, err := scanOrder(rows)
+		change := new(OrderStatusChange)
+		err := rows.Scan(
+			&change.ID,
+			&change.OrderID,
+			&change.FromStatus,
+			&change.ToStatus,
+			&change.AdminID,
+			&change.CreatedAt,
+		)
 		if err != nil {
 			return nil, err
 		}
 
-		orders = append(orders, order)
+		history = append(history, change)
 	}
 
-	return orders, nil
+	return history, rows.Err()
+}
+
+func (self *PostgresStorage) GetOrders(filter OrderFilter) (*Page[*Order], error) {
+	position, err := orderListing.resolve(filter.ListOptions)
+	if err != nil {
+		return nil, err
+	}
+
+	conditions := new(sqlConditions)
+	if filter.Status != "" {
+		conditions.add("status = ?", filter.Status)
+	}
+	if filter.UserID != 0 {
+		conditions.add("user_id = ?", filter.UserID)
+	}
+	if filter.From != nil {
+		conditions.add("created_at >= ?", *filter.From)
+	}
+	if filter.To != nil {
+		conditions.add("created_at < ?", *filter.To)
+	}
+	tail := position.apply(conditions)
+
+	orders, err := self.queryOrders(`
+    SELECT id, user_id, total, currency, status, created_at
+    FROM orders`+conditions.where()+tail, conditions.args...)
+	if err != nil {
+		return nil, err
+	}
+
+	return orderListing.page(orders, position), nil
 }
 
 func (self *PostgresStorage) GetOrdersById(ids []int32) ([]*Order, error) {
-	rows, err := self.db.Query(`
-    SELECT * FROM orders WHERE id = ANY($1)
+	return self.queryOrders(`
+    SELECT id, user_id, total, currency, status, created_at
+    FROM orders
+    WHERE id = ANY($1)
   `, pq.Array(ids))
+}
+
+// queryOrders scans every order the query returns and then attaches their
+// lines. The order rows are closed first so this also works inside WithTx,
+// where only one statement can be in flight at a time.
+func (self *PostgresStorage) queryOrders(query string, args ...any) ([]*Order, error) {
+	rows, err := self.db.Query(query, args...)
 	if err != nil {
 		return nil, err
 	}
-	defer rows.Close()
 
 	orders := make([]*Order, 0)
 	for rows.Next() {
 		order, err := scanOrder(rows)
 		if err != nil {
+			rows.Close()
 			return nil, err
 		}
 
 		orders = append(orders, order)
 	}
+	rows.Close()
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	if err := self.loadOrderLines(orders); err != nil {
+		return nil, err
+	}
 
 	return orders, nil
 }
 
+func (self *PostgresStorage) loadOrderLines(orders []*Order) error {
+	if len(orders) == 0 {
+		return nil
+	}
+
+	byID := make(map[uint32]*Order, len(orders))
+	ids := make([]int32, 0, len(orders))
+	for _, order := range orders {
+		order.Lines = make([]*OrderLine, 0)
+		byID[order.ID] = order
+		ids = append(ids, int32(order.ID))
+	}
+
+	rows, err := self.db.Query(`
+    SELECT order_id, item_id, name, unit_price, quantity, line_total, currency, list_price, override_reason, override_admin_id, COALESCE(sku_id, 0), COALESCE(sku_code, ''), options
+    FROM order_lines
+    WHERE order_id = ANY($1)
+    ORDER BY id
+  `, pq.Array(ids))
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var orderID uint32
+		line := new(OrderLine)
+		var listPrice sql.NullInt64
+		var overrideReason sql.NullString
+		var options []byte
+		if err := rows.Scan(&orderID, &line.ItemID, &line.Name, &line.UnitPrice.Amount, &line.Quantity, &line.LineTotal.Amount, &line.UnitPrice.Currency, &listPrice, &overrideReason, &line.OverriddenBy, &line.SKUID, &line.SKUCode, &options); err != nil {
+			return err
+		}
+
+		if options != nil {
+			if err := json.Unmarshal(options, &line.Options); err != nil {
+				return err
+			}
+		}
+		line.LineTotal.Currency = line.UnitPrice.Currency
+
+		if listPrice.Valid {
+			line.ListPrice = &Money{Amount: listPrice.Int64, Currency: line.UnitPrice.Currency}
+			line.OverrideReason = overrideReason.String
+		}
+
+		if order, ok := byID[orderID]; ok {
+			order.Lines = append(order.Lines, line)
+		}
+	}
+
+	return rows.Err()
+}
+
 func scanOrder(row *sql.Rows) (*Order, error) {
 	order := new(Order)
 
 	err := row.Scan(
 		&order.ID,
 		&order.UserID,
-		pq.Array(&order.Items),
-		&order.Total,
+		&order.Total.Amount,
+		&order.Total.Currency,
 		&order.Status,
 		&order.CreatedAt,
 	)
@@ -813,5 +3135,5 @@ func scanOrder(row *sql.Rows) (*Order, error) {
 }
 
 func (self *PostgresStorage) Close() {
-	self.db.Close()
+	self.pool.Close()
 }
@@ -2,6 +2,8 @@ package main
 
 import (
 	"net/http"
+	"regexp"
+	"strings"
 	"time"
 
 	"github.com/alexedwards/argon2id"
@@ -10,80 +12,243 @@ import (
 
 type apiFunc func(http.ResponseWriter, *http.Request) error
 
+// ApiError is the body of every error response.
 type ApiError struct {
-	Error string `json:"error"`
+	Error     string            `json:"error"`
+	Code      ErrorCode         `json:"code"`
+	Fields    map[string]string `json:"fields,omitempty"`
+	RequestID string            `json:"request_id,omitempty"`
 }
 
 type APIServer struct {
 	portAddress string
 	storage     Storage
+	blobs       BlobStore
+	mailer      Mailer
 }
 
 type CreateAccountRequest struct {
-	Username string `json:"user"`
-  Password string `json:"password"`
+	Username string `json:"user" validate:"required,min=3,max=64,pattern=username"`
+	Password string `json:"password" validate:"required,min=8,max=256"`
+	Email    string `json:"email" validate:"required,max=254"`
+}
+
+func (self *CreateAccountRequest) checkFields(errs FieldErrors) {
+	checkPasswordNotUsername(errs, self.Password, self.Username)
+}
+
+type CreateAdminAccountRequest struct {
+	Username string `json:"user" validate:"required,min=3,max=64,pattern=username"`
+	Password string `json:"password" validate:"required,min=8,max=256"`
+	Role     Role   `json:"role" validate:"required"`
+}
+
+func (self *CreateAdminAccountRequest) checkFields(errs FieldErrors) {
+	checkPasswordNotUsername(errs, self.Password, self.Username)
+}
+
+type SetAdminRoleRequest struct {
+	ID   int32 `json:"id" validate:"required"`
+	Role Role  `json:"role" validate:"required"`
 }
 
 type LoginRequest struct {
-	Username string `json:"user"`
-	Password string `json:"password"`
+	Username string `json:"user" validate:"required,max=64"`
+	Password string `json:"password" validate:"required,max=256"`
+}
+
+type CreateAPIKeyRequest struct {
+	Name      string       `json:"name" validate:"required,max=100"`
+	Scopes    []Permission `json:"scopes" validate:"required"`
+	ExpiresAt *time.Time   `json:"expires_at"`
+}
+
+type MFALoginRequest struct {
+	MFAToken string `json:"mfa_token" validate:"required,max=2048"`
+	Code     string `json:"code" validate:"required,max=32"`
+}
+
+type MFACodeRequest struct {
+	Code string `json:"code" validate:"required,max=32"`
+}
+
+type RefreshRequest struct {
+	RefreshToken string `json:"refresh_token" validate:"required,max=256"`
+}
+
+type ChangePasswordRequest struct {
+	CurrentPassword string `json:"current_password" validate:"required,max=256"`
+	NewPassword     string `json:"new_password" validate:"required,min=8,max=256"`
+}
+
+func (self *ChangePasswordRequest) checkFields(errs FieldErrors) {
+	if self.NewPassword != "" && self.NewPassword == self.CurrentPassword {
+		errs.add("new_password", "New password must differ from the current one")
+	}
+}
+
+type ForgotPasswordRequest struct {
+	Username string `json:"user" validate:"required,max=64"`
+}
+
+type ResetPasswordRequest struct {
+	Token    string `json:"token" validate:"required,max=256"`
+	Password string `json:"password" validate:"required,min=8,max=256"`
+}
+
+type UnlockAccountRequest struct {
+	ID int32 `json:"id" validate:"required"`
 }
 
 type DeleteAccountRequest struct {
-	ID int32 `json:"id"`
+	ID int32 `json:"id" validate:"required"`
 }
 
 type AddItemRequest struct {
-	ItemID int32 `json:"item_id"`
+	ItemID   int32 `json:"item_id"`
+	SKUID    int32 `json:"sku_id"`
+	Quantity int32 `json:"quantity" validate:"min=0,max=999"`
+}
+
+type SetItemQuantityRequest struct {
+	ItemID   int32 `json:"item_id"`
+	SKUID    int32 `json:"sku_id"`
+	Quantity int32 `json:"quantity" validate:"min=0,max=999"`
 }
 
 type RemoveItemRequest struct {
 	ItemID int32 `json:"item_id"`
+	SKUID  int32 `json:"sku_id"`
 }
 
 type UpdateAccountRequest struct {
-	Username string `json:"user"`
+	Username string `json:"user" validate:"required,min=3,max=64,pattern=username"`
+}
+
+// UpdateUserAccountRequest leaves blank fields as they are. A new email has to
+// be verified again.
+type UpdateUserAccountRequest struct {
+	Username string `json:"user" validate:"min=3,max=64,pattern=username"`
+	Email    string `json:"email" validate:"max=254"`
 }
 
 type CreateItemRequest struct {
-	Name        string  `json:"name"`
-	Description string  `json:"desc"`
-	Price       float64 `json:"price"`
+	Name        string `json:"name" validate:"required,max=200"`
+	Description string `json:"desc" validate:"max=5000"`
+	Price       Money  `json:"price" validate:"min=0"`
 }
 
 type DeleteItemRequest struct {
-	ID int32 `json:"id"`
+	ID int32 `json:"id" validate:"required"`
 }
 
 type UpdateItemRequest struct {
-	Name        string  `json:"name"`
-	Description string  `json:"desc"`
-	Price       float64 `json:"price"`
+	Name        string `json:"name" validate:"required,max=200"`
+	Description string `json:"desc" validate:"max=5000"`
+	Price       Money  `json:"price" validate:"min=0"`
+}
+
+type SetItemOptionsRequest struct {
+	Options []*ItemOption `json:"options"`
+}
+
+type ReorderImagesRequest struct {
+	ImageIDs []int32 `json:"image_ids" validate:"required"`
+}
+
+type UpdateImageRequest struct {
+	Primary bool `json:"primary"`
+}
+
+type DeleteImageRequest struct {
+	ID int32 `json:"id" validate:"required"`
+}
+
+type UpdateSKURequest struct {
+	Code          string `json:"code" validate:"required,max=64"`
+	Barcode       string `json:"barcode" validate:"max=64"`
+	PriceOverride *Money `json:"price_override" validate:"min=0"`
+}
+
+type SetStockRequest struct {
+	Stock  int32  `json:"stock" validate:"min=0"`
+	Reason string `json:"reason" validate:"required,max=500"`
+}
+
+type AdjustStockRequest struct {
+	Delta  int32  `json:"delta"`
+	Reason string `json:"reason" validate:"required,max=500"`
 }
 
+// CreateOrderRequest is an admin-placed order. Prices come from the catalog;
+// the only way to charge something else is a PriceOverride, which is recorded
+// on the order line along with the admin who made it.
 type CreateOrderRequest struct {
-	AccountID int32   `json:"account_id"`
-	Items     []int32 `json:"items"`
-	Total     float64 `json:"total"`
+	AccountID      int32            `json:"account_id" validate:"required"`
+	Items          []int32          `json:"items"`
+	SKUs           []int32          `json:"skus"`
+	PriceOverrides []*PriceOverride `json:"price_overrides"`
+}
+
+func (self *CreateOrderRequest) checkFields(errs FieldErrors) {
+	if len(self.Items)+len(self.SKUs) == 0 {
+		errs.add("items", "Order must contain at least one item")
+	}
+}
+
+type PriceOverride struct {
+	ItemID    int32  `json:"item_id"`
+	SKUID     int32  `json:"sku_id"`
+	UnitPrice Money  `json:"unit_price" validate:"min=0"`
+	Reason    string `json:"reason" validate:"required,max=500"`
 }
 
 type DeleteOrderRequest struct {
-	ID int32 `json:"id"`
+	ID int32 `json:"id" validate:"required"`
 }
 
 type UpdateOrderRequest struct {
-	Status string `json:"status"`
+	Status OrderStatus `json:"status" validate:"required"`
+}
+
+type CreateCategoryRequest struct {
+	Name     string `json:"name" validate:"required,max=100"`
+	Slug     string `json:"slug" validate:"max=100,pattern=slug"`
+	ParentID *int32 `json:"parent_id"`
+}
+
+type UpdateCategoryRequest struct {
+	Name     string `json:"name" validate:"required,max=100"`
+	Slug     string `json:"slug" validate:"max=100,pattern=slug"`
+	ParentID *int32 `json:"parent_id"`
+}
+
+type DeleteCategoryRequest struct {
+	ID int32 `json:"id" validate:"required"`
+}
+
+type SetItemCategoriesRequest struct {
+	CategoryIDs []int32 `json:"category_ids"`
 }
 
 type Item struct {
 	ID          uint32    `json:"id"`
 	Name        string    `json:"name"`
 	Description string    `json:"desc"`
-	Price       float64   `json:"price"`
+	Price       Money     `json:"price"`
+	Stock       int32     `json:"stock"`
 	CreatedAt   time.Time `json:"created_at"`
+
+	// Options and SKUs make up the variant matrix. They are only filled in
+	// where a single item is returned.
+	Options []*ItemOption `json:"options,omitempty"`
+	SKUs    []*SKU        `json:"skus,omitempty"`
+
+	// Images is filled in wherever items are returned to clients.
+	Images []*ItemImage `json:"images,omitempty"`
 }
 
-func NewItem(name, description string, price float64) *Item {
+func NewItem(name, description string, price Money) *Item {
 	return &Item{
 		Name:        name,
 		Description: description,
@@ -92,14 +257,34 @@ func NewItem(name, description string, price float64) *Item {
 	}
 }
 
+// StockAdjustment records one change to an item's stock level. AdminID is
+// set for manual changes and OrderID for sales.
+type StockAdjustment struct {
+	ID         uint32    `json:"id"`
+	ItemID     int32     `json:"item_id"`
+	SKUID      int32     `json:"sku_id,omitempty"`
+	Delta      int32     `json:"delta"`
+	StockAfter int32     `json:"stock_after"`
+	Reason     string    `json:"reason"`
+	AdminID    *int32    `json:"admin_id,omitempty"`
+	OrderID    *int32    `json:"order_id,omitempty"`
+	CreatedAt  time.Time `json:"created_at"`
+}
+
 type AdminAccount struct {
 	ID             uint32    `json:"id"`
 	Username       string    `json:"username"`
 	HashedPassword string    `json:"hashed_password"`
+	Role           Role      `json:"role"`
+	MFAEnabled     bool      `json:"mfa_enabled"`
 	CreatedAt      time.Time `json:"created_at"`
 }
 
-func NewAdminAccount(username string, password string) (*AdminAccount, error) {
+func NewAdminAccount(username string, password string, role Role) (*AdminAccount, error) {
+	if err := checkRole(role); err != nil {
+		return nil, err
+	}
+
 	hashedPassword, err := argon2id.CreateHash(password, argon2id.DefaultParams)
 	if err != nil {
 		return nil, err
@@ -108,20 +293,30 @@ func NewAdminAccount(username string, password string) (*AdminAccount, error) {
 	return &AdminAccount{
 		Username:       username,
 		HashedPassword: hashedPassword,
+		Role:           role,
 		CreatedAt:      time.Now().UTC(),
 	}, nil
 }
 
+// UserAccount.Email is empty only for accounts created before emails were
+// required. An account can check out once EmailVerifiedAt is set.
 type UserAccount struct {
-	ID             uint32    `json:"id"`
-	Username       string    `json:"username"`
-	HashedPassword string    `json:"hashed_password"`
-	Items          []int32   `json:"items"`
-	Orders         []int32   `json:"orders"`
-	CreatedAt      time.Time `json:"created_at"`
+	ID                 uint32     `json:"id"`
+	Username           string     `json:"username"`
+	HashedPassword     string     `json:"hashed_password"`
+	Email              string     `json:"email"`
+	EmailVerifiedAt    *time.Time `json:"email_verified_at"`
+	VerificationSentAt *time.Time `json:"-"`
+	Orders             []int32    `json:"orders"`
+	CreatedAt          time.Time  `json:"created_at"`
 }
 
-func NewUserAccount(username string, password string) (*UserAccount, error) {
+func NewUserAccount(username string, password string, email string) (*UserAccount, error) {
+	email, err := normalizeEmail(email)
+	if err != nil {
+		return nil, err
+	}
+
 	hashedPassword, err := argon2id.CreateHash(password, argon2id.DefaultParams)
 	if err != nil {
 		return nil, err
@@ -130,27 +325,324 @@ func NewUserAccount(username string, password string) (*UserAccount, error) {
 	return &UserAccount{
 		Username:       username,
 		HashedPassword: hashedPassword,
-		Items:          make([]int32, 0),
+		Email:          email,
 		Orders:         make([]int32, 0),
 		CreatedAt:      time.Now().UTC(),
 	}, nil
 }
 
+// CartItem is one line of a user's cart as stored: which item, which SKU
+// for items with variants (zero otherwise), and how many.
+type CartItem struct {
+	ItemID   int32 `json:"item_id"`
+	SKUID    int32 `json:"sku_id,omitempty"`
+	Quantity int32 `json:"quantity"`
+}
+
+// CartLine is a CartItem resolved against the catalog for display and
+// checkout.
+type CartLine struct {
+	Item     *Item `json:"item"`
+	SKU      *SKU  `json:"sku,omitempty"`
+	Quantity int32 `json:"quantity"`
+	Subtotal Money `json:"subtotal"`
+}
+
+// NewCartLine prices the line at the SKU's price when there is one.
+func NewCartLine(item *Item, sku *SKU, quantity int32) (*CartLine, error) {
+	price := item.Price
+	if sku != nil {
+		price = sku.Price(item)
+	}
+
+	subtotal, err := price.Mul(quantity)
+	if err != nil {
+		return nil, err
+	}
+
+	return &CartLine{
+		Item:     item,
+		SKU:      sku,
+		Quantity: quantity,
+		Subtotal: subtotal,
+	}, nil
+}
+
+type Cart struct {
+	Lines []*CartLine `json:"lines"`
+	Total Money       `json:"total"`
+}
+
+// OrderLine is a snapshot of an item taken when the order is placed, so an
+// order keeps its meaning after the catalog entry is updated or deleted.
+type OrderLine struct {
+	ItemID    int32  `json:"item_id"`
+	Name      string `json:"name"`
+	UnitPrice Money  `json:"unit_price"`
+	Quantity  int32  `json:"quantity"`
+	LineTotal Money  `json:"line_total"`
+
+	// SKUID, SKUCode and Options are only set for items sold by variant.
+	SKUID   int32             `json:"sku_id,omitempty"`
+	SKUCode string            `json:"sku,omitempty"`
+	Options map[string]string `json:"options,omitempty"`
+
+	// ListPrice, OverrideReason and OverriddenBy are only set when an admin
+	// charged something other than the catalog price.
+	ListPrice      *Money `json:"list_price,omitempty"`
+	OverrideReason string `json:"override_reason,omitempty"`
+	OverriddenBy   *int32 `json:"overridden_by,omitempty"`
+}
+
+func NewOrderLine(item *Item, sku *SKU, quantity int32) (*OrderLine, error) {
+	line := &OrderLine{
+		ItemID:    int32(item.ID),
+		Name:      item.Name,
+		UnitPrice: item.Price,
+		Quantity:  quantity,
+	}
+
+	if sku != nil {
+		line.SKUID = int32(sku.ID)
+		line.SKUCode = sku.Code
+		line.Options = sku.Options
+		line.UnitPrice = sku.Price(item)
+	}
+
+	lineTotal, err := line.UnitPrice.Mul(quantity)
+	if err != nil {
+		return nil, err
+	}
+	line.LineTotal = lineTotal
+
+	return line, nil
+}
+
+// Override replaces the catalog price of the line, keeping the list price
+// alongside the reason and the admin responsible.
+func (self *OrderLine) Override(price Money, reason string, adminID int32) error {
+	if strings.TrimSpace(reason) == "" {
+		return validationError("price_overrides", "Price override for item %d needs a reason", self.ItemID)
+	}
+
+	price, err := price.Normalize()
+	if err != nil {
+		return err
+	}
+
+	if price.Amount < 0 {
+		return validationError("price_overrides", "Price override for item %d cannot be negative", self.ItemID)
+	}
+
+	if price.Currency != self.UnitPrice.Currency {
+		return validationError("price_overrides", "Price override for item %d must be in %s", self.ItemID, self.UnitPrice.Currency)
+	}
+
+	lineTotal, err := price.Mul(self.Quantity)
+	if err != nil {
+		return validationError("price_overrides", "Price override for item %d is too large for %d units", self.ItemID, self.Quantity)
+	}
+
+	listPrice := self.UnitPrice
+	self.ListPrice = &listPrice
+	self.UnitPrice = price
+	self.LineTotal = lineTotal
+	self.OverrideReason = reason
+	self.OverriddenBy = &adminID
+
+	return nil
+}
+
 type Order struct {
-	ID        uint32    `json:"id"`
-	UserID    uint32    `json:"user_id"`
-	Items     []int32   `json:"items"`
-	Total     float64   `json:"total"`
-	Status    string    `json:"status"`
-	CreatedAt time.Time `json:"created_at"`
+	ID        uint32       `json:"id"`
+	UserID    uint32       `json:"user_id"`
+	Lines     []*OrderLine `json:"lines"`
+	Total     Money        `json:"total"`
+	Status    OrderStatus  `json:"status"`
+	CreatedAt time.Time    `json:"created_at"`
+
+	// History is only filled in where it is asked for, e.g. the admin view of
+	// a single order.
+	History []*OrderStatusChange `json:"history,omitempty"`
 }
 
-func NewOrder(userID uint32, items []int32, total float64) *Order {
+// NewOrder totals the lines, which must all be priced in the same currency.
+func NewOrder(userID uint32, lines []*OrderLine) (*Order, error) {
+	if len(lines) == 0 {
+		return nil, conflictError("An order needs at least one line")
+	}
+
+	lineTotals := make([]Money, 0, len(lines))
+	for _, line := range lines {
+		lineTotals = append(lineTotals, line.LineTotal)
+	}
+
+	total, err := sumMoney(lineTotals...)
+	if err != nil {
+		return nil, err
+	}
+
 	return &Order{
 		UserID:    userID,
-		Items:     items,
+		Lines:     lines,
 		Total:     total,
-		Status:    "pending",
+		Status:    OrderStatusPending,
 		CreatedAt: time.Now().UTC(),
+	}, nil
+}
+
+type OrderStatus string
+
+const (
+	OrderStatusPending   OrderStatus = "pending"
+	OrderStatusPaid      OrderStatus = "paid"
+	OrderStatusFulfilled OrderStatus = "fulfilled"
+	OrderStatusShipped   OrderStatus = "shipped"
+	OrderStatusDelivered OrderStatus = "delivered"
+	OrderStatusCancelled OrderStatus = "cancelled"
+	OrderStatusRefunded  OrderStatus = "refunded"
+)
+
+// orderStatusTransitions lists, for each status, the statuses an order may
+// move to next. Cancelled and refunded orders are final.
+var orderStatusTransitions = map[OrderStatus][]OrderStatus{
+	OrderStatusPending:   {OrderStatusPaid, OrderStatusCancelled},
+	OrderStatusPaid:      {OrderStatusFulfilled, OrderStatusCancelled, OrderStatusRefunded},
+	OrderStatusFulfilled: {OrderStatusShipped, OrderStatusCancelled, OrderStatusRefunded},
+	OrderStatusShipped:   {OrderStatusDelivered, OrderStatusRefunded},
+	OrderStatusDelivered: {OrderStatusRefunded},
+	OrderStatusCancelled: {},
+	OrderStatusRefunded:  {},
+}
+
+func (self OrderStatus) IsValid() bool {
+	_, ok := orderStatusTransitions[self]
+	return ok
+}
+
+func (self OrderStatus) CanTransitionTo(next OrderStatus) bool {
+	for _, allowed := range orderStatusTransitions[self] {
+		if allowed == next {
+			return true
+		}
+	}
+
+	return false
+}
+
+// checkOrderTransition is the rule both storage backends enforce before
+// writing a new status.
+func checkOrderTransition(orderID uint32, from, to OrderStatus) error {
+	if !to.IsValid() {
+		return validationError("status", "Invalid order status: \"%s\"", to)
+	}
+
+	if !from.CanTransitionTo(to) {
+		return conflictError("Order %d cannot move from %s to %s", orderID, from, to)
+	}
+
+	return nil
+}
+
+// OrderStatusChange is one entry in an order's status history. FromStatus is
+// empty for the entry recording the order's creation, and AdminID is nil for
+// changes no admin made.
+type OrderStatusChange struct {
+	ID         uint32      `json:"id"`
+	OrderID    int32       `json:"order_id"`
+	FromStatus OrderStatus `json:"from_status,omitempty"`
+	ToStatus   OrderStatus `json:"to_status"`
+	AdminID    *int32      `json:"admin_id,omitempty"`
+	CreatedAt  time.Time   `json:"created_at"`
+}
+
+// Category is a node in the catalog taxonomy. A nil ParentID makes it a top
+// level department.
+type Category struct {
+	ID        uint32    `json:"id"`
+	ParentID  *int32    `json:"parent_id"`
+	Name      string    `json:"name"`
+	Slug      string    `json:"slug"`
+	CreatedAt time.Time `json:"created_at"`
+
+	// Children is only filled in when categories are returned as a tree.
+	Children []*Category `json:"children,omitempty"`
+}
+
+var categorySlugPattern = regexp.MustCompile(`^[a-z0-9]+(-[a-z0-9]+)*$`)
+
+// NewCategory derives the slug from the name when none is given.
+func NewCategory(name, slug string, parentID *int32) (*Category, error) {
+	category := &Category{
+		ParentID:  parentID,
+		CreatedAt: time.Now().UTC(),
+	}
+
+	if err := category.Set(name, slug, parentID); err != nil {
+		return nil, err
 	}
+
+	return category, nil
+}
+
+// Set validates and applies new details to the category. Whether the new
+// parent would create a cycle is checked by storage, which can see the rest
+// of the tree.
+func (self *Category) Set(name, slug string, parentID *int32) error {
+	name = strings.TrimSpace(name)
+	if name == "" {
+		return validationError("name", "Category name is required")
+	}
+
+	if slug == "" {
+		slug = slugify(name)
+	}
+
+	if !categorySlugPattern.MatchString(slug) {
+		return validationError("slug", "Invalid category slug: \"%s\"", slug)
+	}
+
+	if parentID != nil && self.ID != 0 && *parentID == int32(self.ID) {
+		return validationError("parent_id", "Category %d cannot be its own parent", self.ID)
+	}
+
+	self.Name = name
+	self.Slug = slug
+	self.ParentID = parentID
+
+	return nil
+}
+
+// slugify lower-cases a name and joins its words with hyphens, e.g.
+// "Men's Shoes" becomes "men-s-shoes".
+func slugify(name string) string {
+	words := strings.FieldsFunc(strings.ToLower(name), func(r rune) bool {
+		return (r < 'a' || r > 'z') && (r < '0' || r > '9')
+	})
+
+	return strings.Join(words, "-")
+}
+
+// buildCategoryTree nests a flat list of categories under their parents,
+// keeping the list order among siblings, and returns the roots.
+func buildCategoryTree(categories []*Category) []*Category {
+	byID := make(map[uint32]*Category, len(categories))
+	for _, category := range categories {
+		category.Children = make([]*Category, 0)
+		byID[category.ID] = category
+	}
+
+	roots := make([]*Category, 0)
+	for _, category := range categories {
+		if category.ParentID != nil {
+			if parent, ok := byID[uint32(*category.ParentID)]; ok {
+				parent.Children = append(parent.Children, category)
+				continue
+			}
+		}
+
+		roots = append(roots, category)
+	}
+
+	return roots
 }
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestOrderStatusTransitions(t *testing.T) {
+	allowed := map[OrderStatus][]OrderStatus{
+		OrderStatusPending:   {OrderStatusPaid, OrderStatusCancelled},
+		OrderStatusPaid:      {OrderStatusFulfilled, OrderStatusCancelled, OrderStatusRefunded},
+		OrderStatusFulfilled: {OrderStatusShipped, OrderStatusCancelled, OrderStatusRefunded},
+		OrderStatusShipped:   {OrderStatusDelivered, OrderStatusRefunded},
+		OrderStatusDelivered: {OrderStatusRefunded},
+	}
+
+	statuses := []OrderStatus{
+		OrderStatusPending, OrderStatusPaid, OrderStatusFulfilled, OrderStatusShipped,
+		OrderStatusDelivered, OrderStatusCancelled, OrderStatusRefunded,
+	}
+
+	for _, from := range statuses {
+		for _, to := range statuses {
+			want := false
+			for _, next := range allowed[from] {
+				want = want || next == to
+			}
+
+			if got := from.CanTransitionTo(to); got != want {
+				t.Errorf("%s to %s: got %t, want %t", from, to, got, want)
+			}
+
+			err := checkOrderTransition(1, from, to)
+			if want && err != nil {
+				t.Errorf("%s to %s: unexpected error %s", from, to, err)
+			}
+
+			var statusErr *StatusError
+			if !want && (!errors.As(err, &statusErr) || statusErr.Code != CodeConflict) {
+				t.Errorf("%s to %s: got %v, want a conflict", from, to, err)
+			}
+		}
+	}
+}
+
+func TestCheckOrderTransitionUnknownStatus(t *testing.T) {
+	var statusErr *StatusError
+	err := checkOrderTransition(1, OrderStatusPending, "lost")
+	if !errors.As(err, &statusErr) || statusErr.Code != CodeValidationFailed || statusErr.Fields["status"] == "" {
+		t.Fatalf("got %v, want a validation error on status", err)
+	}
+
+	if OrderStatus("lost").IsValid() {
+		t.Fatal("unknown status reported as valid")
+	}
+}
+
+func TestNewOrderNeedsLines(t *testing.T) {
+	_, err := NewOrder(1, nil)
+
+	var statusErr *StatusError
+	if !errors.As(err, &statusErr) || statusErr.Code != CodeConflict {
+		t.Fatalf("got %v, want a conflict", err)
+	}
+}
@@ -0,0 +1,419 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// maxBodyBytes caps JSON request bodies. Image uploads have their own limit.
+const maxBodyBytes = 1 << 20
+
+// decodeJSON reads a request body of at most maxBodyBytes into v, a pointer
+// to a request struct, and validates it. Anything wrong with the body is a
+// StatusError: 413 when it is too big, 400 when it is not the JSON we expect
+// and 422 listing every field that fails validation.
+func decodeJSON(w http.ResponseWriter, r *http.Request, v any) error {
+	r.Body = http.MaxBytesReader(w, r.Body, maxBodyBytes)
+
+	jsonDecoderHandle := json.NewDecoder(r.Body)
+	jsonDecoderHandle.DisallowUnknownFields()
+	if err := jsonDecoderHandle.Decode(v); err != nil {
+		return decodeError(err)
+	}
+
+	if err := jsonDecoderHandle.Decode(&json.RawMessage{}); err != io.EOF {
+		if err != nil {
+			return decodeError(err)
+		}
+
+		return badRequestError("Request body must be a single JSON value")
+	}
+
+	return validateRequest(v)
+}
+
+func decodeError(err error) error {
+	var tooLarge *http.MaxBytesError
+	var syntaxErr *json.SyntaxError
+	var typeErr *json.UnmarshalTypeError
+	var timeErr *time.ParseError
+
+	switch {
+	case errors.As(err, &tooLarge):
+		return payloadTooLargeError("Request body must be at most %d KB", maxBodyBytes>>10)
+	case errors.Is(err, io.EOF):
+		return badRequestError("Request body is empty")
+	case errors.Is(err, io.ErrUnexpectedEOF):
+		return badRequestError("Request body is not valid JSON")
+	case errors.As(err, &syntaxErr):
+		return badRequestError("Request body is not valid JSON: %s", syntaxErr)
+	case errors.As(err, &typeErr):
+		return badRequestError("Invalid value for \"%s\": expected %s", typeErr.Field, typeErr.Type)
+	case errors.As(err, &timeErr):
+		return badRequestError("Invalid time: \"%s\"", timeErr.Value)
+	case strings.HasPrefix(err.Error(), "json: unknown field "):
+		return badRequestError("Unknown field %s", strings.TrimPrefix(err.Error(), "json: unknown field "))
+	}
+
+	var statusErr *StatusError
+	if errors.As(err, &statusErr) {
+		return err
+	}
+
+	return badRequestError("Invalid request body: %s", err)
+}
+
+// FieldErrors maps request fields, by their JSON names, to what is wrong with
+// them. Only the first problem with each field is kept.
+type FieldErrors map[string]string
+
+func (self FieldErrors) add(field, format string, args ...any) {
+	if _, ok := self[field]; !ok {
+		self[field] = fmt.Sprintf(format, args...)
+	}
+}
+
+// err is the 422 for the fields, or nil when there are none.
+func (self FieldErrors) err() error {
+	if len(self) == 0 {
+		return nil
+	}
+
+	message := fmt.Sprintf("%d fields are invalid", len(self))
+	if len(self) == 1 {
+		for _, fieldMessage := range self {
+			message = fieldMessage
+		}
+	}
+
+	return &StatusError{
+		Status:  http.StatusUnprocessableEntity,
+		Code:    CodeValidationFailed,
+		Message: message,
+		Fields:  self,
+	}
+}
+
+// fieldChecker is implemented by requests with rules that span fields. It is
+// run on the request after its tags have been checked, and should leave alone
+// fields that already have an error.
+type fieldChecker interface {
+	checkFields(errs FieldErrors)
+}
+
+// validationPattern is a named pattern for the pattern rule, with a
+// description of what it allows for the error message.
+type validationPattern struct {
+	pattern *regexp.Regexp
+	allows  string
+}
+
+var validationPatterns = map[string]validationPattern{
+	"username": {regexp.MustCompile(`^[A-Za-z0-9._@-]+$`), "letters, digits, '.', '_', '@' and '-'"},
+	"slug":     {categorySlugPattern, "lower-case words joined by '-'"},
+}
+
+// validateRequest checks a decoded request against the validate tags on its
+// fields, and then its checkFields if it has one. Structs inside the request,
+// directly or in slices, are checked too, with fields named like
+// "price_overrides[0].reason".
+//
+// A tag is a list of rules separated by commas:
+//
+//	required   not zero, blank, nil or empty
+//	min=N      at least N: characters for strings, entries for slices, the
+//	           amount for Money and the value for numbers
+//	max=N      at most N, measured the same way
+//	pattern=P  matches the named pattern in validationPatterns
+//
+// Rules other than required are skipped for blank strings, nil pointers and
+// empty slices, so optional fields are only checked when they are given.
+// Numbers are always checked.
+func validateRequest(v any) error {
+	rules, err := rulesFor(reflect.TypeOf(v))
+	if err != nil {
+		return err
+	}
+
+	errs := FieldErrors{}
+
+	validateStruct(reflect.ValueOf(v), rules, "", errs)
+
+	if checker, ok := v.(fieldChecker); ok {
+		checker.checkFields(errs)
+	}
+
+	return errs.err()
+}
+
+var (
+	moneyType = reflect.TypeOf(Money{})
+	timeType  = reflect.TypeOf(time.Time{})
+)
+
+// fieldRules is what validateStruct checks on one field of a struct, parsed
+// from its validate tag.
+type fieldRules struct {
+	index    int
+	name     string
+	required bool
+	rules    []validationRule
+	// nested holds the rules of the struct the field holds, directly or in
+	// a slice, if it holds one.
+	nested []*fieldRules
+}
+
+// validationRule is one min, max or pattern rule from a validate tag.
+type validationRule struct {
+	kind    string
+	limit   int64
+	pattern validationPattern
+}
+
+// parsedRules caches the rules of each struct type rulesFor has seen, so a
+// tag is parsed once rather than on every request.
+var parsedRules sync.Map
+
+// rulesFor returns the rules for a struct type, or a pointer to one, parsing
+// them the first time the type is seen. A malformed tag is an error naming
+// the field, rather than a panic in the middle of a request.
+func rulesFor(structType reflect.Type) ([]*fieldRules, error) {
+	for structType.Kind() == reflect.Pointer {
+		structType = structType.Elem()
+	}
+
+	if cached, ok := parsedRules.Load(structType); ok {
+		return cached.([]*fieldRules), nil
+	}
+
+	if structType.Kind() != reflect.Struct {
+		return nil, nil
+	}
+
+	rules := make([]*fieldRules, 0, structType.NumField())
+	for i := 0; i < structType.NumField(); i++ {
+		field := structType.Field(i)
+		if !field.IsExported() {
+			continue
+		}
+
+		name, _, _ := strings.Cut(field.Tag.Get("json"), ",")
+		if name == "-" {
+			continue
+		}
+		if name == "" {
+			name = field.Name
+		}
+
+		parsed, err := parseTag(field, name)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid validate tag on %s.%s: %w", structType.Name(), field.Name, err)
+		}
+
+		if elemType := nestedType(field.Type); elemType != nil {
+			if parsed.nested, err = rulesFor(elemType); err != nil {
+				return nil, err
+			}
+		}
+
+		rules = append(rules, parsed)
+	}
+
+	parsedRules.Store(structType, rules)
+	return rules, nil
+}
+
+func parseTag(field reflect.StructField, name string) (*fieldRules, error) {
+	rules := &fieldRules{index: field.Index[0], name: name}
+
+	tag := field.Tag.Get("validate")
+	if tag == "" {
+		return rules, nil
+	}
+
+	for _, rule := range strings.Split(tag, ",") {
+		kind, arg, _ := strings.Cut(rule, "=")
+
+		switch kind {
+		case "required":
+			rules.required = true
+		case "min", "max":
+			limit, err := strconv.ParseInt(arg, 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("%s needs a number, got \"%s\"", kind, arg)
+			}
+
+			if !measurable(field.Type) {
+				return nil, fmt.Errorf("%s cannot measure %s", kind, field.Type)
+			}
+
+			rules.rules = append(rules.rules, validationRule{kind: kind, limit: limit})
+		case "pattern":
+			pattern, ok := validationPatterns[arg]
+			if !ok {
+				return nil, fmt.Errorf("unknown pattern \"%s\"", arg)
+			}
+
+			if field.Type.Kind() != reflect.String {
+				return nil, fmt.Errorf("pattern cannot match %s", field.Type)
+			}
+
+			rules.rules = append(rules.rules, validationRule{kind: kind, pattern: pattern})
+		default:
+			return nil, fmt.Errorf("unknown rule \"%s\"", kind)
+		}
+	}
+
+	return rules, nil
+}
+
+// nestedType is the struct a field of this type holds, directly or in a
+// slice, or nil if it holds none that validateStruct descends into.
+func nestedType(fieldType reflect.Type) reflect.Type {
+	if fieldType.Kind() == reflect.Slice {
+		fieldType = fieldType.Elem()
+	}
+	if fieldType.Kind() == reflect.Pointer {
+		fieldType = fieldType.Elem()
+	}
+
+	if fieldType.Kind() != reflect.Struct || fieldType == moneyType || fieldType == timeType {
+		return nil
+	}
+
+	return fieldType
+}
+
+func validateStruct(value reflect.Value, rules []*fieldRules, prefix string, errs FieldErrors) {
+	for value.Kind() == reflect.Pointer {
+		if value.IsNil() {
+			return
+		}
+		value = value.Elem()
+	}
+
+	if value.Kind() != reflect.Struct {
+		return
+	}
+
+	for _, field := range rules {
+		name := prefix + field.name
+		fieldValue := value.Field(field.index)
+
+		checkRules(fieldValue, name, field, errs)
+
+		if field.nested != nil {
+			validateNested(fieldValue, name, field.nested, errs)
+		}
+	}
+}
+
+// validateNested descends into the structs a field holds.
+func validateNested(value reflect.Value, name string, rules []*fieldRules, errs FieldErrors) {
+	if value.Kind() != reflect.Slice {
+		validateStruct(value, rules, name+".", errs)
+		return
+	}
+
+	for i := 0; i < value.Len(); i++ {
+		validateStruct(value.Index(i), rules, fmt.Sprintf("%s[%d].", name, i), errs)
+	}
+}
+
+func checkRules(value reflect.Value, name string, field *fieldRules, errs FieldErrors) {
+	if isBlank(value) {
+		if field.required {
+			errs.add(name, "Field \"%s\" is required", name)
+			return
+		}
+
+		switch value.Kind() {
+		case reflect.String, reflect.Slice, reflect.Map, reflect.Pointer:
+			return
+		}
+	}
+
+	for _, rule := range field.rules {
+		switch rule.kind {
+		case "min", "max":
+			size, unit := measure(value)
+			if rule.limit == 1 {
+				unit = strings.NewReplacer("characters", "character", "entries", "entry").Replace(unit)
+			}
+
+			if rule.kind == "min" && size < rule.limit {
+				errs.add(name, "Field \"%s\" must be at least %d%s", name, rule.limit, unit)
+				return
+			}
+			if rule.kind == "max" && size > rule.limit {
+				errs.add(name, "Field \"%s\" must be at most %d%s", name, rule.limit, unit)
+				return
+			}
+		case "pattern":
+			if !rule.pattern.pattern.MatchString(value.String()) {
+				errs.add(name, "Field \"%s\" may only contain %s", name, rule.pattern.allows)
+				return
+			}
+		}
+	}
+}
+
+func isBlank(value reflect.Value) bool {
+	switch value.Kind() {
+	case reflect.String:
+		return strings.TrimSpace(value.String()) == ""
+	case reflect.Slice, reflect.Map:
+		return value.Len() == 0
+	case reflect.Pointer:
+		return value.IsNil()
+	}
+
+	return value.IsZero()
+}
+
+// measure is what min and max compare against, and the unit to name in
+// their errors. The value is one measurable accepts.
+func measure(value reflect.Value) (int64, string) {
+	if value.Kind() == reflect.Pointer {
+		value = value.Elem()
+	}
+
+	switch value.Kind() {
+	case reflect.String:
+		return int64(utf8.RuneCountInString(value.String())), " characters"
+	case reflect.Slice, reflect.Map:
+		return int64(value.Len()), " entries"
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return value.Int(), ""
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return int64(value.Uint()), ""
+	}
+
+	return value.Interface().(Money).Amount, ""
+}
+
+// measurable reports whether measure can size a field of this type.
+func measurable(fieldType reflect.Type) bool {
+	if fieldType.Kind() == reflect.Pointer {
+		fieldType = fieldType.Elem()
+	}
+
+	switch fieldType.Kind() {
+	case reflect.String, reflect.Slice, reflect.Map,
+		reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return true
+	}
+
+	return fieldType == moneyType
+}
@@ -0,0 +1,221 @@
+package main
+
+import (
+	"errors"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"net/http"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestValidateRequest(t *testing.T) {
+	tests := []struct {
+		name    string
+		request any
+		fields  []string
+	}{
+		{"valid", &CreateAccountRequest{Username: "bob", Password: "long enough", Email: "bob@example.com"}, nil},
+		{"blank", &CreateAccountRequest{Username: " ", Password: "", Email: ""}, []string{"user", "password", "email"}},
+		{"short", &CreateAccountRequest{Username: "bo", Password: "short", Email: "bob@example.com"}, []string{"user", "password"}},
+		{"pattern", &CreateAccountRequest{Username: "bob smith", Password: "long enough", Email: "bob@example.com"}, []string{"user"}},
+		{"password is username", &CreateAccountRequest{Username: "bobsmith", Password: "bobsmith", Email: "bob@example.com"}, []string{"password"}},
+		{"negative price", &CreateItemRequest{Name: "Shirt", Price: Money{Amount: -1}}, []string{"price"}},
+		{"nested", &CreateOrderRequest{
+			AccountID:      1,
+			Items:          []int32{1},
+			PriceOverrides: []*PriceOverride{{ItemID: 1, UnitPrice: Money{Amount: 1}}},
+		}, []string{"price_overrides[0].reason"}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := validateRequest(test.request)
+			if test.fields == nil {
+				if err != nil {
+					t.Fatalf("unexpected error %s", err)
+				}
+				return
+			}
+
+			var statusErr *StatusError
+			if !errors.As(err, &statusErr) || statusErr.Status != http.StatusUnprocessableEntity {
+				t.Fatalf("got %v, want a 422", err)
+			}
+
+			got := make([]string, 0, len(statusErr.Fields))
+			for field := range statusErr.Fields {
+				got = append(got, field)
+			}
+
+			sort.Strings(got)
+			sort.Strings(test.fields)
+			if !reflect.DeepEqual(got, test.fields) {
+				t.Fatalf("got fields %v, want %v", statusErr.Fields, test.fields)
+			}
+		})
+	}
+}
+
+func TestValidationResponses(t *testing.T) {
+	server := newTestServer(t)
+
+	apiErr := new(ApiError)
+	res := server.request("POST", "/user/signup", "", CreateAccountRequest{Username: "bo", Password: "short"}, apiErr)
+	server.expect(res, http.StatusUnprocessableEntity)
+
+	if apiErr.Code != CodeValidationFailed || apiErr.Error != "3 fields are invalid" || apiErr.RequestID == "" {
+		t.Fatalf("got %+v", apiErr)
+	}
+
+	want := map[string]string{
+		"user":     `Field "user" must be at least 3 characters`,
+		"password": `Field "password" must be at least 8 characters`,
+		"email":    `Field "email" is required`,
+	}
+	if !reflect.DeepEqual(apiErr.Fields, want) {
+		t.Fatalf("got fields %v, want %v", apiErr.Fields, want)
+	}
+
+	// a single bad field is named in the message itself
+	apiErr = new(ApiError)
+	res = server.request("POST", "/user/signup", "", CreateAccountRequest{Username: "bob", Password: "short", Email: "bob@example.com"}, apiErr)
+	server.expect(res, http.StatusUnprocessableEntity)
+	if apiErr.Error != want["password"] || len(apiErr.Fields) != 1 {
+		t.Fatalf("got %+v", apiErr)
+	}
+}
+
+func TestMalformedRequestBodies(t *testing.T) {
+	server := newTestServer(t)
+
+	tests := []struct {
+		name string
+		body string
+		want int
+	}{
+		{"empty", "", http.StatusBadRequest},
+		{"not json", "user=bob", http.StatusBadRequest},
+		{"wrong type", `{"user": 1, "password": "x"}`, http.StatusBadRequest},
+		{"unknown field", `{"user": "bob", "password": "x", "admin": true}`, http.StatusBadRequest},
+		{"trailing value", `{"user": "bob", "password": "x"} {}`, http.StatusBadRequest},
+		{"too large", `{"user": "` + strings.Repeat("x", maxBodyBytes) + `"}`, http.StatusRequestEntityTooLarge},
+	}
+
+	for _, test := range tests {
+		apiErr := new(ApiError)
+		res := server.request("POST", "/user/login", "", test.body, apiErr)
+		if res.StatusCode != test.want || apiErr.Error == "" {
+			t.Errorf("%s: got %d %+v, want %d", test.name, res.StatusCode, apiErr, test.want)
+		}
+	}
+}
+
+// requestTypes holds every request type declared in types.go, so their tags
+// can be checked without a request to each endpoint.
+var requestTypes = map[string]any{
+	"CreateAccountRequest":      CreateAccountRequest{},
+	"CreateAdminAccountRequest": CreateAdminAccountRequest{},
+	"SetAdminRoleRequest":       SetAdminRoleRequest{},
+	"LoginRequest":              LoginRequest{},
+	"CreateAPIKeyRequest":       CreateAPIKeyRequest{},
+	"MFALoginRequest":           MFALoginRequest{},
+	"MFACodeRequest":            MFACodeRequest{},
+	"RefreshRequest":            RefreshRequest{},
+	"ChangePasswordRequest":     ChangePasswordRequest{},
+	"ForgotPasswordRequest":     ForgotPasswordRequest{},
+	"ResetPasswordRequest":      ResetPasswordRequest{},
+	"UnlockAccountRequest":      UnlockAccountRequest{},
+	"DeleteAccountRequest":      DeleteAccountRequest{},
+	"AddItemRequest":            AddItemRequest{},
+	"SetItemQuantityRequest":    SetItemQuantityRequest{},
+	"RemoveItemRequest":         RemoveItemRequest{},
+	"UpdateAccountRequest":      UpdateAccountRequest{},
+	"UpdateUserAccountRequest":  UpdateUserAccountRequest{},
+	"CreateItemRequest":         CreateItemRequest{},
+	"DeleteItemRequest":         DeleteItemRequest{},
+	"UpdateItemRequest":         UpdateItemRequest{},
+	"SetItemOptionsRequest":     SetItemOptionsRequest{},
+	"ReorderImagesRequest":      ReorderImagesRequest{},
+	"UpdateImageRequest":        UpdateImageRequest{},
+	"DeleteImageRequest":        DeleteImageRequest{},
+	"UpdateSKURequest":          UpdateSKURequest{},
+	"SetStockRequest":           SetStockRequest{},
+	"AdjustStockRequest":        AdjustStockRequest{},
+	"CreateOrderRequest":        CreateOrderRequest{},
+	"DeleteOrderRequest":        DeleteOrderRequest{},
+	"UpdateOrderRequest":        UpdateOrderRequest{},
+	"CreateCategoryRequest":     CreateCategoryRequest{},
+	"UpdateCategoryRequest":     UpdateCategoryRequest{},
+	"DeleteCategoryRequest":     DeleteCategoryRequest{},
+	"SetItemCategoriesRequest":  SetItemCategoriesRequest{},
+}
+
+func TestRequestTagsParse(t *testing.T) {
+	file, err := parser.ParseFile(token.NewFileSet(), "types.go", nil, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	declared := 0
+	for _, decl := range file.Decls {
+		genDecl, ok := decl.(*ast.GenDecl)
+		if !ok || genDecl.Tok != token.TYPE {
+			continue
+		}
+
+		for _, spec := range genDecl.Specs {
+			name := spec.(*ast.TypeSpec).Name.Name
+			if !strings.HasSuffix(name, "Request") {
+				continue
+			}
+			declared++
+
+			request, ok := requestTypes[name]
+			if !ok {
+				t.Errorf("%s is not in requestTypes", name)
+				continue
+			}
+
+			if _, err := rulesFor(reflect.TypeOf(request)); err != nil {
+				t.Errorf("%s: %s", name, err)
+			}
+		}
+	}
+
+	if declared != len(requestTypes) {
+		t.Errorf("types.go declares %d request types, requestTypes has %d", declared, len(requestTypes))
+	}
+}
+
+func TestMalformedTagIsAnError(t *testing.T) {
+	tags := []any{
+		&struct {
+			Name string `validate:"min=x"`
+		}{},
+		&struct {
+			Name string `validate:"pattern=nothing"`
+		}{},
+		&struct {
+			Name string `validate:"shorter"`
+		}{},
+		&struct {
+			At time.Time `validate:"max=1"`
+		}{},
+		&struct {
+			Lines []*struct {
+				Count int32 `validate:"pattern=slug"`
+			}
+		}{},
+	}
+
+	for _, request := range tags {
+		if err := validateRequest(request); err == nil {
+			t.Errorf("%T: got no error", request)
+		}
+	}
+}
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// maxSKUsPerItem bounds the variant matrix, which grows as the product of the
+// number of values of every option.
+const maxSKUsPerItem = 250
+
+// ItemOption is one axis of an item's variants, e.g. size with the values S,
+// M and L.
+type ItemOption struct {
+	Name   string   `json:"name"`
+	Values []string `json:"values"`
+}
+
+// SKU is one purchasable combination of an item's option values. Stock is
+// tracked per SKU; PriceOverride, when set, replaces the item's price and is
+// always in the item's currency.
+type SKU struct {
+	ID            uint32            `json:"id"`
+	ItemID        int32             `json:"item_id"`
+	Code          string            `json:"code"`
+	Options       map[string]string `json:"options"`
+	PriceOverride *Money            `json:"price_override"`
+	Stock         int32             `json:"stock"`
+	Barcode       string            `json:"barcode,omitempty"`
+	CreatedAt     time.Time         `json:"created_at"`
+}
+
+// Price is what one unit of the SKU sells for.
+func (self *SKU) Price(item *Item) Money {
+	if self.PriceOverride != nil {
+		return *self.PriceOverride
+	}
+
+	return item.Price
+}
+
+// checkItemOptions trims the option names and values and rejects blanks,
+// duplicates and matrices larger than maxSKUsPerItem.
+func checkItemOptions(options []*ItemOption) error {
+	names := make(map[string]bool, len(options))
+	combinations := 1
+	for _, option := range options {
+		option.Name = strings.TrimSpace(option.Name)
+		if option.Name == "" {
+			return validationError("options", "Option name is required")
+		}
+
+		if names[option.Name] {
+			return validationError("options", "Option \"%s\" is listed more than once", option.Name)
+		}
+		names[option.Name] = true
+
+		if len(option.Values) == 0 {
+			return validationError("options", "Option \"%s\" needs at least one value", option.Name)
+		}
+
+		values := make(map[string]bool, len(option.Values))
+		for i, value := range option.Values {
+			value = strings.TrimSpace(value)
+			if value == "" {
+				return validationError("options", "Option \"%s\" has a blank value", option.Name)
+			}
+
+			if values[value] {
+				return validationError("options", "Option \"%s\" lists \"%s\" more than once", option.Name, value)
+			}
+			values[value] = true
+			option.Values[i] = value
+		}
+
+		combinations *= len(option.Values)
+		if combinations > maxSKUsPerItem {
+			return validationError("options", "Options would make more than %d SKUs", maxSKUsPerItem)
+		}
+	}
+
+	return nil
+}
+
+// skuMatrix lists every combination of option values, varying the last
+// option fastest. No options means no SKUs.
+func skuMatrix(options []*ItemOption) []map[string]string {
+	if len(options) == 0 {
+		return nil
+	}
+
+	matrix := []map[string]string{{}}
+	for _, option := range options {
+		next := make([]map[string]string, 0, len(matrix)*len(option.Values))
+		for _, combination := range matrix {
+			for _, value := range option.Values {
+				extended := make(map[string]string, len(combination)+1)
+				for name, chosen := range combination {
+					extended[name] = chosen
+				}
+				extended[option.Name] = value
+
+				next = append(next, extended)
+			}
+		}
+
+		matrix = next
+	}
+
+	return matrix
+}
+
+// defaultSKUCode builds a readable code from the item id and the option
+// values in option order, e.g. "12-M-RED".
+func defaultSKUCode(itemID int32, options []*ItemOption, combination map[string]string) string {
+	parts := []string{fmt.Sprint(itemID)}
+	for _, option := range options {
+		parts = append(parts, strings.ToUpper(slugify(combination[option.Name])))
+	}
+
+	return strings.Join(parts, "-")
+}
+
+func sameOptions(a, b map[string]string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+
+	for name, value := range a {
+		if chosen, ok := b[name]; !ok || chosen != value {
+			return false
+		}
+	}
+
+	return true
+}
+
+// skuPlan is how SetItemOptions reconciles an item's existing SKUs with a new
+// set of options: SKUs whose combination survives are kept as they are, with
+// their stock, price and barcode, the rest are removed and missing
+// combinations are created.
+type skuPlan struct {
+	remove []*SKU
+	create []*SKU
+}
+
+func planSKUs(itemID int32, options []*ItemOption, existing []*SKU) (*skuPlan, error) {
+	plan := new(skuPlan)
+	matrix := skuMatrix(options)
+
+	for _, sku := range existing {
+		kept := false
+		for _, combination := range matrix {
+			if sameOptions(sku.Options, combination) {
+				kept = true
+				break
+			}
+		}
+
+		if kept {
+			continue
+		}
+
+		if sku.Stock > 0 {
+			return nil, conflictError("SKU %s still has %d units in stock; set its stock to zero before removing it", sku.Code, sku.Stock)
+		}
+
+		plan.remove = append(plan.remove, sku)
+	}
+
+	now := time.Now().UTC()
+	for _, combination := range matrix {
+		found := false
+		for _, sku := range existing {
+			if sameOptions(sku.Options, combination) {
+				found = true
+				break
+			}
+		}
+
+		if !found {
+			plan.create = append(plan.create, &SKU{
+				ItemID:    itemID,
+				Code:      defaultSKUCode(itemID, options, combination),
+				Options:   combination,
+				CreatedAt: now,
+			})
+		}
+	}
+
+	return plan, nil
+}
+
+// cartKey identifies a cart line: an item, and the SKU when it has variants.
+type cartKey struct {
+	itemID int32
+	skuID  int32
+}
+
+func sortSKUs(skus []*SKU) {
+	sort.Slice(skus, func(i, j int) bool { return skus[i].ID < skus[j].ID })
+}
+
+func variantRequiredError(itemID int32) error {
+	return validationError("sku_id", "Item %d has variants; choose one of its SKUs", itemID)
+}
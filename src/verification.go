@@ -0,0 +1,111 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/mail"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+const (
+	// emailVerificationTTL is how long a verification link works for.
+	emailVerificationTTL = 24 * time.Hour
+
+	// verificationResendInterval is how often a user can have another
+	// verification email sent.
+	verificationResendInterval = time.Minute
+)
+
+// normalizeEmail checks that email is a bare address and lower-cases it, which
+// is how addresses are stored and compared.
+func normalizeEmail(email string) (string, error) {
+	email = strings.TrimSpace(email)
+	if email == "" {
+		return "", validationError("email", "Email is required")
+	}
+
+	address, err := mail.ParseAddress(email)
+	if err != nil || address.Address != email {
+		return "", validationError("email", "Invalid email address: \"%s\"", email)
+	}
+
+	return strings.ToLower(email), nil
+}
+
+// generateVerificationToken signs the user's id and email. The link stops
+// working when it expires or when the user's email changes.
+func generateVerificationToken(account *UserAccount) (string, error) {
+	return signToken(&Claims{
+		Type:      VerifyEmailToken,
+		AccountID: int32(account.ID),
+		Email:     account.Email,
+	}, emailVerificationTTL)
+}
+
+func parseVerificationToken(tokenString string) (int32, string, error) {
+	invalid := unauthorizedError("Invalid or expired verification link")
+
+	claims, err := parseToken(tokenString, VerifyEmailToken)
+	if err != nil {
+		return 0, "", invalid
+	}
+
+	return claims.AccountID, claims.Email, nil
+}
+
+// verificationLink points at the verify endpoint on PUBLIC_URL, or on the
+// host the request came in on when that is not set.
+func verificationLink(r *http.Request, token string) string {
+	base := os.Getenv("PUBLIC_URL")
+	if base == "" {
+		scheme := "http"
+		if r.TLS != nil {
+			scheme = "https"
+		}
+		base = scheme + "://" + r.Host
+	}
+
+	return strings.TrimSuffix(base, "/") + "/user/verify?token=" + url.QueryEscape(token)
+}
+
+func verificationMessage(account *UserAccount, link string) *Message {
+	return &Message{
+		To:      account.Email,
+		Subject: "Verify your email address",
+		Body: fmt.Sprintf(
+			"Hi %s,\n\nConfirm your email address by opening this link:\n\n%s\n\n"+
+				"The link expires in 24 hours. You need a verified address to check out.\n",
+			account.Username, link,
+		),
+	}
+}
+
+func resendTooSoonError(sentAt time.Time) error {
+	wait := time.Until(sentAt.Add(verificationResendInterval)).Round(time.Second)
+	return tooManyRequestsError(wait, "A verification email was sent recently; try again in %d seconds", int(wait/time.Second))
+}
+
+func emailTakenError(email string) error {
+	return conflictError("Email %s is already registered", email)
+}
+
+// checkVerificationClaim is whether a verification email can be sent to the
+// account now.
+func checkVerificationClaim(account *UserAccount, now time.Time) error {
+	if account.Email == "" {
+		return conflictError("Account %d has no email address; add one first", account.ID)
+	}
+
+	if account.EmailVerifiedAt != nil {
+		return conflictError("Email %s is already verified", account.Email)
+	}
+
+	if account.VerificationSentAt != nil && now.Before(account.VerificationSentAt.Add(verificationResendInterval)) {
+		return resendTooSoonError(*account.VerificationSentAt)
+	}
+
+	return nil
+}
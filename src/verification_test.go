@@ -0,0 +1,60 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"testing"
+)
+
+func TestCheckoutRequiresVerifiedEmail(t *testing.T) {
+	server := newTestServer(t)
+	adminToken := server.adminLogin()
+	itemID := server.createItem(adminToken, "Shirt", 1000, 5)
+
+	account := new(UserAccount)
+	res := server.request("POST", "/user/signup", "", CreateAccountRequest{Username: "bob", Password: "bob-password", Email: "Bob@Example.com"}, account)
+	server.expect(res, http.StatusOK)
+	if account.Email != "bob@example.com" || account.EmailVerifiedAt != nil {
+		t.Fatalf("got email %q verified at %v, want an unverified bob@example.com", account.Email, account.EmailVerifiedAt)
+	}
+
+	tokens := server.login("/user/login", LoginRequest{Username: "bob", Password: "bob-password"})
+	server.expect(server.request("POST", fmt.Sprintf("/user/%d/cart", account.ID), tokens.AuthToken, AddItemRequest{ItemID: itemID}, nil), http.StatusOK)
+
+	checkoutPath := fmt.Sprintf("/user/%d/checkout", account.ID)
+	apiErr := new(ApiError)
+	server.expect(server.request("POST", checkoutPath, tokens.AuthToken, nil, apiErr), http.StatusForbidden)
+	if apiErr.Code != CodeForbidden {
+		t.Fatalf("got code %q, want %q", apiErr.Code, CodeForbidden)
+	}
+
+	// asking again straight away is refused; the first link still works
+	server.expect(server.request("POST", fmt.Sprintf("/user/%d/verify", account.ID), tokens.AuthToken, nil, nil), http.StatusTooManyRequests)
+
+	server.verifyEmail("bob@example.com")
+	server.expect(server.request("POST", checkoutPath, tokens.AuthToken, nil, nil), http.StatusOK)
+}
+
+func TestSignupRejectsBadEmails(t *testing.T) {
+	server := newTestServer(t)
+	server.signup("bob")
+
+	emails := []struct {
+		email string
+		want  int
+	}{
+		{"", http.StatusUnprocessableEntity},
+		{"not-an-email", http.StatusUnprocessableEntity},
+		{"Bob <bob@example.com>", http.StatusUnprocessableEntity},
+		{"BOB@example.com", http.StatusConflict},
+	}
+
+	for i, test := range emails {
+		request := CreateAccountRequest{Username: fmt.Sprintf("amy%d", i), Password: "amy-password", Email: test.email}
+		if res := server.request("POST", "/user/signup", "", request, nil); res.StatusCode != test.want {
+			t.Errorf("signing up with email %q: got %d, want %d", test.email, res.StatusCode, test.want)
+		}
+	}
+
+	server.expect(server.request("GET", "/user/verify?token=not-a-token", "", nil, nil), http.StatusUnauthorized)
+}